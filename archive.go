@@ -2,61 +2,655 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
 )
 
-// ArchiveMedia reads the files send through all of the in channels and
-// sends them to the configured backends.
-//
-// TODO Implement storage adapters.
-func ArchiveMedia(watcher *MediaWatcher, archive, bucket string) <-chan error {
-	errs := make(chan error)
+// Archive is a named archive that media files are stored in.
+type Archive struct {
+	Name         string
+	Backends     []Backend
+	Cache        Cache
+	Filter       *Filter
+	StorageClass string
 
-	go func() {
+	// Files smaller than BundleThreshold are packed into bundles of about
+	// BundleSize bytes. Bundling is disabled if BundleThreshold is zero.
+	BundleThreshold int64
+	BundleSize      int64
+
+	// Previews configures the thumbnails and previews of images.
+	Previews PreviewConfig
+
+	// Duplicates configures how near-duplicate images are handled.
+	Duplicates DuplicatesConfig
+
+	keys     *template.Template
+	classes  map[string]string
+	images   imageIndex
+	roots    []RootConfig
+	dirs     dirIndex
+	contents contentIndex
+}
+
+// KeyData contains the fields available to an archive's key template.
+type KeyData struct {
+
+	// Archive is the name of the archive.
+	Archive string
 
-		sess, err := session.NewSession()
+	// Path is the file's slash separated path relative to its root.
+	Path string
+
+	// Dir is the directory portion of Path, or "." for files in the root.
+	Dir string
+
+	// Name is the file's base name, e.g. IMG_0001.JPG.
+	Name string
+
+	// Ext is the file's extension including the dot, e.g. .JPG.
+	Ext string
+
+	// ModTime is the file's modification time.
+	ModTime time.Time
+}
+
+// NewArchive returns the Archive defined by cfg, connecting to its backends.
+// The state of archived files is tracked in cache. Uploads are limited by the
+// global throttle, which may be nil, and the backends' own bandwidth limits.
+func NewArchive(cfg ArchiveConfig, cache Cache, global *Throttle) (*Archive, error) {
+	a, err := newArchive(cfg, cache)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, bc := range cfg.Backends {
+		backend, err := NewBackend(bc)
 		if err != nil {
-			errs <- err
-			return
+			return nil, err
 		}
 
-		svc := s3.New(sess)
+		var own *Throttle
+		if !bc.Bandwidth.Empty() {
+			if own, err = NewThrottle(backend.Name(), bc.Bandwidth); err != nil {
+				return nil, err
+			}
+		}
+		a.Backends = append(a.Backends, throttle(backend, global, own))
+	}
 
-		for path := range watcher.Media() {
+	return a, nil
+}
+
+// NewOfflineArchive returns the Archive defined by cfg without connecting to
+// its backends, e.g. for dry runs and reports. The backends only have names,
+// and fail to read or write.
+func NewOfflineArchive(cfg ArchiveConfig, cache Cache) (*Archive, error) {
+	a, err := newArchive(cfg, cache)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, bc := range cfg.Backends {
+		a.Backends = append(a.Backends, offlineBackend(bc.Name()))
+	}
+
+	return a, nil
+}
+
+func newArchive(cfg ArchiveConfig, cache Cache) (*Archive, error) {
+	keys, err := template.New(cfg.Name).Option("missingkey=error").Parse(cfg.KeyTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key template [archive=%s]: %s", cfg.Name, err)
+	}
+
+	// Fields that KeyData doesn't have only fail when the template is
+	// executed, so it's tried on a sample file first.
+	sample := KeyData{Archive: cfg.Name, Path: "2019/IMG_0001.JPG", Dir: "2019", Name: "IMG_0001.JPG", Ext: ".JPG", ModTime: time.Now()}
+	if err := keys.Execute(ioutil.Discard, sample); err != nil {
+		return nil, fmt.Errorf("invalid key template [archive=%s]: %s", cfg.Name, err)
+	}
+
+	filter, err := NewFilter(cfg.Include, cfg.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter [archive=%s]: %s", cfg.Name, err)
+	}
+
+	a := &Archive{
+		Name:            cfg.Name,
+		Cache:           cache,
+		Filter:          filter,
+		StorageClass:    cfg.StorageClass,
+		BundleThreshold: cfg.BundleThreshold,
+		BundleSize:      cfg.BundleSize,
+		Previews:        cfg.Previews,
+		Duplicates:      cfg.Duplicates,
+		keys:            keys,
+		classes:         make(map[string]string),
+		roots:           cfg.Roots,
+	}
+	for _, bc := range cfg.Backends {
+		if bc.StorageClass != "" {
+			a.classes[bc.Name()] = bc.StorageClass
+		}
+	}
+
+	return a, nil
+}
+
+// Key renders the key that the file at relpath is stored under.
+func (a *Archive) Key(relpath string, info os.FileInfo) (string, error) {
+	data := KeyData{
+		Archive: a.Name,
+		Path:    relpath,
+		Dir:     path.Dir(relpath),
+		Name:    path.Base(relpath),
+		Ext:     path.Ext(relpath),
+		ModTime: info.ModTime(),
+	}
+
+	var b bytes.Buffer
+	if err := a.keys.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// StorageClassOf returns the storage class that files are archived with on
+// backend, which is the backend's own class if it overrides the archive's.
+// Previews and catalog objects have their own classes.
+func (a *Archive) StorageClassOf(backend Backend) string {
+	if class, ok := a.classes[backend.Name()]; ok {
+		return class
+	}
+	return a.StorageClass
+}
+
+// Prefix returns the directory that all of the archive's keys are stored
+// under, derived from the literal text at the start of the key template and
+// the archive name. Since listing an empty prefix would list other archives'
+// objects too, it fails if the template doesn't start with a directory, e.g.
+// if it starts with a file field.
+func (a *Archive) Prefix() (string, error) {
+	var b bytes.Buffer
+	for _, node := range a.keys.Tree.Root.Nodes {
+		if text, ok := node.(*parse.TextNode); ok {
+			b.Write(text.Text)
+		} else if node.String() == "{{.Archive}}" {
+			b.WriteString(a.Name)
+		} else {
+			break
+		}
+	}
+
+	prefix := b.String()
+	prefix = prefix[:strings.LastIndex(prefix, "/")+1]
+	if strings.Trim(prefix, "/") == "" {
+		return "", fmt.Errorf("key template must start with a directory, e.g. {{.Archive}}/, to list the archive's objects [archive=%s]", a.Name)
+	}
+	return prefix, nil
+}
+
+// cacheFlushSize and cacheFlushInterval control how archived files are
+// batched into a single cache transaction.
+const (
+	cacheFlushSize     = 100
+	cacheFlushInterval = 5 * time.Second
+)
+
+// Pending returns the backends that don't have a current copy of the file
+// described by item and info.
+func (a *Archive) Pending(item CacheItem, info os.FileInfo) []Backend {
+
+	// Duplicates aren't uploaded while the archive skips them, unless the
+	// image that they duplicate no longer has a current copy.
+	if item.DuplicateOf != "" {
+		if a.Duplicates.SkipUploads && !item.Modified(info) && a.hasCurrentCopy(item.DuplicateOf) {
+			return nil
+		}
+	} else if item.Filename != "" && len(item.Copies) == 0 && !item.Modified(info) {
+		// Files archived before copies were tracked were uploaded to every
+		// backend that was configured at the time.
+		return nil
+	}
+
+	var pending []Backend
+	for _, backend := range a.Backends {
+		if c, ok := item.Copy(backend.Name()); !ok || !c.Current(info) {
+			pending = append(pending, backend)
+		}
+	}
+	return pending
+}
+
+// Actions that archiving a file can entail, see Archive.Plan.
+const (
+	ActionUpload = "upload"
+	ActionBundle = "bundle"
+	ActionSkip   = "skip"
+)
+
+// Action describes what archiving a file entails, and why.
+type Action struct {
+	Action   string   `json:"action"`
+	Archive  string   `json:"archive"`
+	Path     string   `json:"path"`
+	Key      string   `json:"key"`
+	Size     int64    `json:"size"`
+	Backends []string `json:"backends,omitempty"`
+	Reason   string   `json:"reason"`
+
+	// backends are the backends that the file is uploaded to.
+	backends []Backend
+}
+
+// Plan decides what archiving the file at path entails, given its cached
+// state in item. Nothing is uploaded or written to the cache, and the file
+// isn't read, so companions that only share a content identifier with their
+// group are planned under the template's key.
+func (a *Archive) Plan(path, relpath string, info os.FileInfo, item CacheItem) (Action, error) {
+	group, err := a.Group(path, relpath, "")
+	if err != nil {
+		return Action{}, err
+	}
+	key, err := a.GroupKey(group, path, relpath, info)
+	if err != nil {
+		return Action{}, err
+	}
 
-			// TODO check the cache
+	action := Action{
+		Action:   ActionUpload,
+		Archive:  a.Name,
+		Path:     path,
+		Key:      key,
+		Size:     info.Size(),
+		backends: a.Pending(item, info),
+	}
+	for _, b := range action.backends {
+		action.Backends = append(action.Backends, b.Name())
+	}
 
-			dat, err := ioutil.ReadFile(path)
+	switch {
+	case len(action.backends) == 0 && item.DuplicateOf != "":
+		action.Action, action.Reason = ActionSkip, "duplicate of "+item.DuplicateOf
+	case len(action.backends) == 0:
+		action.Action, action.Reason = ActionSkip, "unchanged"
+	case item.Filename == "":
+		action.Reason = "new"
+	case item.Modified(info):
+		action.Reason = "modified"
+	case item.DuplicateOf != "":
+		action.Reason = "original of duplicate not archived"
+	default:
+		action.Reason = copyReason(item, action.backends)
+	}
+
+	if action.Action == ActionUpload && a.BundleThreshold > 0 && info.Size() < a.BundleThreshold {
+		action.Action = ActionBundle
+	}
+
+	return action, nil
+}
+
+// copyReason explains why an unchanged file is uploaded to the backends.
+func copyReason(item CacheItem, backends []Backend) string {
+	var reasons []string
+	seen := make(map[string]bool)
+	for _, b := range backends {
+		reason := "missing copy"
+		if c, ok := item.Copy(b.Name()); ok && c.Error != "" {
+			reason = "failed copy"
+		} else if ok {
+			reason = "stale copy"
+		}
+		if !seen[reason] {
+			seen[reason] = true
+			reasons = append(reasons, reason)
+		}
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// PlanMedia sends the Action planned for each file sent through the watcher's
+// media channel to actions. It is the dry run of ArchiveMedia, and the
+// returned channel is closed once the media channel is.
+func PlanMedia(watcher *MediaWatcher, archive *Archive, actions chan<- Action) <-chan error {
+	errs := make(chan error)
+
+	go func() {
+		defer close(errs)
+		for path := range watcher.Media() {
+			info, err := os.Stat(path)
 			if err != nil {
 				errs <- err
 				continue
 			}
 
-			params := &s3.PutObjectInput{
-				Bucket:       aws.String(bucket),
-				Key:          aws.String(fmt.Sprintf("%s/%s", archive, watcher.RelativePath(path))),
-				Body:         bytes.NewReader(dat),
-				StorageClass: aws.String(s3.TransitionStorageClassStandardIa),
+			relpath := watcher.RelativePath(path)
+			item, err := archive.Cache.Get(relpath)
+			if err != nil && err != ErrNotCached {
+				errs <- err
+				continue
 			}
 
-			_, err = svc.PutObject(params)
+			action, err := archive.Plan(path, relpath, info, item)
 			if err != nil {
 				errs <- err
 				continue
 			}
+			actions <- action
+		}
+	}()
+
+	return errs
+}
+
+// MediaSource sends the paths of the files to archive through its media
+// channel, and names them by their path relative to the archive, like
+// MediaWatcher does for the files under the roots.
+type MediaSource interface {
+	Media() <-chan string
+	RelativePath(path string) string
+}
+
+// MediaAnnotator is implemented by the MediaSources that know more about
+// their files than the files themselves, such as cloud exports. Annotate adds
+// what is known about the file at relpath to the metadata read from it,
+// before the file is cached.
+type MediaAnnotator interface {
+	Annotate(relpath string, m *Media)
+}
+
+// ArchiveMedia reads the files send through all of the in channels and
+// sends them to the configured backends. Files are uploaded concurrently by
+// the passed number of workers, and their status is recorded in progress.
+// Each file is only uploaded to the backends that don't have a current copy,
+// so a backend that failed is retried without uploading to the others again.
+// Small files are handed to a bundler if the archive enables bundling. Once
+// the media channel is closed or ctx is done, the workers finish the files in
+// progress, open bundles are uploaded, the cache is written and the returned
+// channel is closed.
+func ArchiveMedia(ctx context.Context, watcher MediaSource, archive *Archive, progress *Progress, workers int) <-chan error {
+	errs := make(chan error)
+	archived := make(chan CacheItem)
+
+	cached := (<-chan CacheItem)(archived)
+	if annotator, ok := watcher.(MediaAnnotator); ok {
+		annotated := make(chan CacheItem)
+		go func() {
+			defer close(annotated)
+			for item := range archived {
+				if item.Media != nil {
+					annotator.Annotate(item.Filename, item.Media)
+				}
+				annotated <- item
+			}
+		}()
+		cached = annotated
+	}
 
-			// TODO write to cache
+	written := make(chan struct{})
+	go func() {
+		cacheWriter(archive.Cache, cached, errs)
+		close(written)
+	}()
+
+	var bundles chan bundleFile
+	bundled := make(chan struct{})
+	if archive.BundleThreshold > 0 {
+		bundles = make(chan bundleFile)
+		go func() {
+			bundler(archive, progress, bundles, archived, errs)
+			close(bundled)
+		}()
+	} else {
+		close(bundled)
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func(id int) {
+			archiveWorker(ctx, id, watcher, archive, progress, bundles, archived, errs)
+			wg.Done()
+		}(progress.NextWorker())
+	}
 
-			// TODO Figure out a logging strategy.
-			log.Printf("file uploaded [filepath=%s]", path)
+	go func() {
+		wg.Wait()
+		if bundles != nil {
+			close(bundles)
 		}
+		<-bundled
+		close(archived)
+		<-written
+		close(errs)
 	}()
 
 	return errs
 }
+
+// archiveWorker uploads the files sent through the watcher's media channel
+// until it is closed or ctx is done, and sends the archived files to the
+// archived channel.
+func archiveWorker(ctx context.Context, id int, watcher MediaSource, archive *Archive, progress *Progress, bundles chan<- bundleFile, archived chan<- CacheItem, errs chan<- error) {
+	for {
+		var path string
+		select {
+		case <-ctx.Done():
+			return
+		case p, ok := <-watcher.Media():
+			if !ok {
+				return
+			}
+			path = p
+		}
+		progress.Start(id, path)
+
+		info, err := os.Stat(path)
+		if err != nil {
+			progress.Fail(id, path)
+			errs <- err
+			continue
+		}
+
+		relpath := watcher.RelativePath(path)
+		item, err := archive.Cache.Get(relpath)
+		if err != nil && err != ErrNotCached {
+			progress.Fail(id, path)
+			errs <- err
+			continue
+		}
+
+		action, err := archive.Plan(path, relpath, info, item)
+		if err != nil {
+			progress.Fail(id, path)
+			errs <- err
+			continue
+		}
+
+		// New and modified images that are no better than an archived
+		// image are cached as its duplicates instead of being uploaded.
+		if action.Action != ActionSkip && archive.Duplicates.SkipUploads && CanPreview(relpath) && (item.Filename == "" || item.Modified(info)) {
+			dup, err := archive.checkDuplicate(path, relpath, info, item)
+			if err != nil {
+				progress.Fail(id, path)
+				errs <- err
+				continue
+			}
+			if dup.DuplicateOf != "" {
+				log.Printf("duplicate not uploaded [archive=%s] [filename=%s] [duplicate-of=%s]", archive.Name, relpath, dup.DuplicateOf)
+				if err := archive.indexImage(dup); err != nil {
+					errs <- err
+				}
+				archived <- dup
+				progress.Skip(id, path)
+				continue
+			}
+		}
+
+		switch action.Action {
+		case ActionSkip:
+			progress.Skip(id, path)
+			continue
+
+		// The bundler records the file's status once the bundle it was
+		// packed into is uploaded.
+		case ActionBundle:
+			bundles <- bundleFile{path: path, relpath: relpath, item: item, backends: action.backends}
+			progress.Idle(id)
+			continue
+		}
+
+		// The item is cached even if some backends failed so that the
+		// copies that succeeded aren't uploaded again.
+		item, failed := archiveFile(archive, action.backends, item, path, relpath)
+		if item.Filename != "" {
+			if err := archive.indexImage(item); err != nil {
+				errs <- err
+			}
+			archived <- item
+		}
+		if len(failed) > 0 {
+			progress.Fail(id, path)
+			for _, err := range failed {
+				errs <- err
+			}
+			continue
+		}
+
+		progress.Done(id, path)
+	}
+}
+
+// archiveFile uploads a single file to the passed backends, and returns item
+// updated with the status of each copy. A backend that fails doesn't prevent
+// the file from being uploaded to the others. The returned item is empty if
+// the file couldn't be read.
+func archiveFile(archive *Archive, backends []Backend, item CacheItem, path, relpath string) (CacheItem, []error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return CacheItem{}, []error{err}
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return CacheItem{}, []error{err}
+	}
+
+	var pic *Picture
+	item.Media, pic = analyzeMedia(f, info.Size(), relpath)
+
+	group, err := archive.Group(path, relpath, item.Media.ContentID)
+	if err != nil {
+		return CacheItem{}, []error{err}
+	}
+	key, err := archive.GroupKey(group, path, relpath, info)
+	if err != nil {
+		return CacheItem{}, []error{err}
+	}
+
+	item.Filename = relpath
+	item.Size = info.Size()
+	item.ModTime = info.ModTime()
+	item.Key = key
+	item.DuplicateOf = ""
+	item.Group = group.Name()
+	item.Companions = group.Companions(relpath)
+
+	opts := PutOptions{
+		ModTime: info.ModTime(),
+		Metadata: map[string]string{
+			"mtime": info.ModTime().UTC().Format(time.RFC3339Nano),
+		},
+	}
+
+	var failed []error
+	var uploaded []Backend
+	for _, backend := range backends {
+		c := Copy{
+			Backend: backend.Name(),
+			Key:     key,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+
+		opts.StorageClass = archive.StorageClassOf(backend)
+		_, err := f.Seek(0, io.SeekStart)
+		if err == nil {
+			err = backend.Put(key, f, info.Size(), opts)
+		}
+		if err != nil {
+			c.Error = err.Error()
+			item.SetCopy(c)
+			failed = append(failed, fmt.Errorf("%s [backend=%s] [key=%s]", err, backend.Name(), key))
+			continue
+		}
+
+		c.ArchivedAt = time.Now()
+		item.SetCopy(c)
+		item.ArchivedAt = c.ArchivedAt
+		uploaded = append(uploaded, backend)
+
+		// TODO Figure out a logging strategy.
+		log.Printf("file uploaded [archive=%s] [backend=%s] [filepath=%s] [key=%s]", archive.Name, backend.Name(), path, key)
+	}
+
+	item.Previews = archive.uploadPreviews(uploaded, pic, relpath)
+	return item, failed
+}
+
+// cacheWriter writes archived files to the cache, batching them into a single
+// transaction per cacheFlushSize items or cacheFlushInterval. If a batch
+// can't be written, its items are written one by one so that a single bad
+// item doesn't lose the others.
+func cacheWriter(cache Cache, archived <-chan CacheItem, errs chan<- error) {
+	ticker := time.NewTicker(cacheFlushInterval)
+	defer ticker.Stop()
+
+	var batch []CacheItem
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := cache.SetMany(batch); err != nil {
+			log.Printf("cannot cache batch, caching files one by one [files=%d]: %s", len(batch), err)
+			for _, item := range batch {
+				if err := cache.Set(item); err != nil {
+					errs <- fmt.Errorf("cannot cache file [file=%s]: %s", item.Filename, err)
+				}
+			}
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case item, ok := <-archived:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, item)
+			if len(batch) >= cacheFlushSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
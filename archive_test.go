@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testArchive returns the archive configured by cfg with its cache in a
+// temporary directory, archiving to the passed backends.
+func testArchive(t *testing.T, cfg ArchiveConfig, backends ...Backend) *Archive {
+	dir, err := ioutil.TempDir("", "media-archive-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	db, err := OpenSQLiteDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	cache, err := db.Cache(cfg.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.KeyTemplate == "" {
+		cfg.KeyTemplate = DefaultKeyTemplate
+	}
+	a, err := newArchive(cfg, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Backends = backends
+	return a
+}
+
+func TestArchivePrefix(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{DefaultKeyTemplate, "photos/"},
+		{"{{.Archive}}/{{.ModTime.Year}}/{{.Name}}", "photos/"},
+		{"backup/{{.Archive}}/{{.Path}}", "backup/photos/"},
+		{"backup/media/{{.Path}}", "backup/media/"},
+		{"backup/{{.Archive}}-{{.Path}}", "backup/"},
+		{"{{.ModTime.Year}}/{{.Name}}", ""},
+		{"{{.Path}}", ""},
+		{"media-{{.Path}}", ""},
+		{"/{{.Path}}", ""},
+	}
+	for _, tt := range tests {
+		a, err := newArchive(ArchiveConfig{Name: "photos", KeyTemplate: tt.template}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := a.Prefix()
+		if (err != nil) != (tt.want == "") || got != tt.want {
+			t.Errorf("Prefix() of %q = %q, %v, want %q", tt.template, got, err, tt.want)
+		}
+	}
+}
+
+func TestNewArchiveKeyTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		valid    bool
+	}{
+		{DefaultKeyTemplate, true},
+		{`{{.Archive}}/{{.ModTime.Format "2006/01"}}/{{.Name}}`, true},
+		{"{{.Archive}}/{{.Taken.Year}}/{{.Name}}", false},
+		{"{{.Archive}}/{{.Nmae}}", false},
+		{"{{.Archive}}/{{.Name}", false},
+	}
+	for _, tt := range tests {
+		_, err := newArchive(ArchiveConfig{Name: "photos", KeyTemplate: tt.template}, nil)
+		if (err == nil) != tt.valid {
+			t.Errorf("newArchive with %q: %v, want valid %t", tt.template, err, tt.valid)
+		}
+	}
+}
+
+// batchFailingCache fails to write batches, and items named bad.
+type batchFailingCache struct {
+	Cache
+}
+
+func (c batchFailingCache) SetMany(items []CacheItem) error {
+	return errors.New("batch failed")
+}
+
+func (c batchFailingCache) Set(item CacheItem) error {
+	if item.Filename == "bad" {
+		return errors.New("item failed")
+	}
+	return c.Cache.Set(item)
+}
+
+func TestCacheWriterFallback(t *testing.T) {
+	a := testArchive(t, ArchiveConfig{Name: "photos"})
+	archived := make(chan CacheItem, 3)
+	errs := make(chan error, 3)
+	for _, filename := range []string{"a", "bad", "b"} {
+		archived <- CacheItem{Filename: filename}
+	}
+	close(archived)
+	cacheWriter(batchFailingCache{a.Cache}, archived, errs)
+	close(errs)
+
+	var n int
+	for err := range errs {
+		n++
+		if !strings.Contains(err.Error(), "[file=bad]") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	if n != 1 {
+		t.Errorf("got %d errors, want 1", n)
+	}
+	for _, filename := range []string{"a", "b"} {
+		if _, err := a.Cache.Get(filename); err != nil {
+			t.Errorf("%s not cached: %s", filename, err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+)
+
+// DefaultAzureBlockSize is the default size of the blocks that an
+// AzureBackend stages per request.
+const DefaultAzureBlockSize = 8 << 20
+
+// azureUploadConcurrency is the number of blocks of a single file that are
+// staged in parallel. Each one buffers a block in memory.
+const azureUploadConcurrency = 2
+
+// azureAccessTiers maps S3 storage classes, which archives are configured
+// with, to their closest Azure access tiers.
+var azureAccessTiers = map[string]blob.AccessTier{
+	"STANDARD":            blob.AccessTierHot,
+	"REDUCED_REDUNDANCY":  blob.AccessTierHot,
+	"INTELLIGENT_TIERING": blob.AccessTierHot,
+	"STANDARD_IA":         blob.AccessTierCool,
+	"ONEZONE_IA":          blob.AccessTierCool,
+	"GLACIER_IR":          blob.AccessTierCold,
+	"GLACIER":             blob.AccessTierArchive,
+	"DEEP_ARCHIVE":        blob.AccessTierArchive,
+	"HOT":                 blob.AccessTierHot,
+	"COOL":                blob.AccessTierCool,
+	"COLD":                blob.AccessTierCold,
+	"ARCHIVE":             blob.AccessTierArchive,
+}
+
+// AzureBackend archives files to an Azure Blob Storage container as block
+// blobs. Files are staged in blocks and committed once all blocks are
+// uploaded, so a partial upload never replaces an existing blob.
+type AzureBackend struct {
+	name      string
+	container string
+	blockSize int64
+	client    *azblob.Client
+}
+
+// NewAzureBackend returns an AzureBackend configured by cfg. The container's
+// properties are read at startup to validate the credentials.
+func NewAzureBackend(cfg BackendConfig) (*AzureBackend, error) {
+	url := azureURL(cfg)
+
+	var client *azblob.Client
+	if cfg.AccountKeyFile != "" {
+		key, err := ioutil.ReadFile(cfg.AccountKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cred, err := azblob.NewSharedKeyCredential(cfg.Account, strings.TrimSpace(string(key)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid account key [file=%s]: %s", cfg.AccountKeyFile, err)
+		}
+		if client, err = azblob.NewClientWithSharedKeyCredential(url, cred, nil); err != nil {
+			return nil, err
+		}
+	} else {
+		// Environment variables, workload and managed identities, and the
+		// Azure CLI's login, see azidentity.DefaultAzureCredential.
+		cred, err := azidentity.NewDefaultAzureCredential(nil)
+		if err != nil {
+			return nil, err
+		}
+		if client, err = azblob.NewClient(url, cred, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	b := &AzureBackend{
+		name:      cfg.Name(),
+		container: cfg.Container,
+		blockSize: cfg.ChunkSize,
+		client:    client,
+	}
+
+	container := client.ServiceClient().NewContainerClient(b.container)
+	if _, err := container.GetProperties(context.Background(), nil); err != nil {
+		return nil, fmt.Errorf("cannot read container [backend=%s]: %s", b.Name(), err)
+	}
+
+	return b, nil
+}
+
+// Name implements Backend.
+func (b *AzureBackend) Name() string {
+	return b.name
+}
+
+// azureURL returns the URL of the blob service, which is the endpoint if it
+// is set.
+func azureURL(cfg BackendConfig) string {
+	if cfg.Endpoint != "" {
+		return cfg.Endpoint
+	}
+	return fmt.Sprintf("https://%s.blob.core.windows.net/", cfg.Account)
+}
+
+// Put implements Backend.
+func (b *AzureBackend) Put(key string, r io.ReadSeeker, size int64, opts PutOptions) error {
+	// Blobs without a tier get the account's default access tier.
+	var tier *blob.AccessTier
+	if opts.StorageClass != "" {
+		t, ok := azureAccessTiers[strings.ToUpper(opts.StorageClass)]
+		if !ok {
+			return fmt.Errorf("invalid access tier [storage-class=%s]", opts.StorageClass)
+		}
+		tier = &t
+	}
+
+	metadata := make(map[string]*string, len(opts.Metadata))
+	for k, v := range opts.Metadata {
+		v := v
+		metadata[k] = &v
+	}
+
+	_, err := b.client.UploadStream(context.Background(), b.container, key, &sizedReader{r, size}, &azblob.UploadStreamOptions{
+		BlockSize:   b.blockSize,
+		Concurrency: azureUploadConcurrency,
+		Metadata:    metadata,
+		AccessTier:  tier,
+	})
+	return err
+}
+
+// Get implements Backend. Blobs in the archive tier must be rehydrated before
+// they can be read.
+func (b *AzureBackend) Get(key string, offset, length int64) (io.ReadCloser, error) {
+	count := length
+	if count < 0 {
+		count = 0 // to the end of the blob
+	}
+
+	res, err := b.client.DownloadStream(context.Background(), b.container, key, &azblob.DownloadStreamOptions{
+		Range: blob.HTTPRange{Offset: offset, Count: count},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// List implements Backend.
+func (b *AzureBackend) List(prefix string, fn func(Object) error) error {
+	pager := b.client.NewListBlobsFlatPager(b.container, &azblob.ListBlobsFlatOptions{
+		Prefix:  &prefix,
+		Include: azblob.ListBlobsInclude{Metadata: true},
+	})
+	for pager.More() {
+		page, err := pager.NextPage(context.Background())
+		if err != nil {
+			return err
+		}
+
+		for _, item := range page.Segment.BlobItems {
+			o := Object{Key: *item.Name}
+			if p := item.Properties; p != nil {
+				if p.ContentLength != nil {
+					o.Size = *p.ContentLength
+				}
+				if p.LastModified != nil {
+					o.ModTime = *p.LastModified
+				}
+				if p.ETag != nil {
+					o.ETag = strings.Trim(string(*p.ETag), `"`)
+				}
+				o.MD5 = hex.EncodeToString(p.ContentMD5)
+			}
+			if item.Metadata != nil {
+				o.Metadata = make(map[string]string, len(item.Metadata))
+				for k, v := range item.Metadata {
+					if v != nil {
+						o.Metadata[strings.ToLower(k)] = *v
+					}
+				}
+			}
+			if err := fn(o); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Delete implements Backend.
+func (b *AzureBackend) Delete(key string) error {
+	_, err := b.client.DeleteBlob(context.Background(), b.container, key, nil)
+	return err
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// azuriteAccount and azuriteKey are the well-known credentials of Azurite's
+// development storage account.
+const (
+	azuriteAccount = "devstoreaccount1"
+	azuriteKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+// TestAzureRoundTrip runs against the Blob Storage emulator at
+// MEDIA_ARCHIVE_TEST_AZURE_ENDPOINT, e.g. Azurite's
+// http://127.0.0.1:10000/devstoreaccount1/. The container must exist.
+// MEDIA_ARCHIVE_TEST_AZURE_ACCOUNT and MEDIA_ARCHIVE_TEST_AZURE_KEY_FILE
+// default to Azurite's development account.
+func TestAzureRoundTrip(t *testing.T) {
+	endpoint := testEnv(t, "MEDIA_ARCHIVE_TEST_AZURE_ENDPOINT")
+	container := testEnv(t, "MEDIA_ARCHIVE_TEST_AZURE_CONTAINER")
+
+	account := os.Getenv("MEDIA_ARCHIVE_TEST_AZURE_ACCOUNT")
+	keyFile := os.Getenv("MEDIA_ARCHIVE_TEST_AZURE_KEY_FILE")
+	if account == "" {
+		account = azuriteAccount
+	}
+	if keyFile == "" {
+		dir, err := ioutil.TempDir("", "media-archive-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		keyFile = filepath.Join(dir, "key")
+		if err := ioutil.WriteFile(keyFile, []byte(azuriteKey), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := NewAzureBackend(BackendConfig{
+		Type:           BackendAzure,
+		Endpoint:       endpoint,
+		Account:        account,
+		AccountKeyFile: keyFile,
+		Container:      container,
+		ChunkSize:      DefaultAzureBlockSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackendRoundTrip(t, b)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Backend types that can be set in BackendConfig.Type.
+const (
+	BackendS3     = "s3"
+	BackendSFTP   = "sftp"
+	BackendWebDAV = "webdav"
+	BackendGCS    = "gcs"
+	BackendAzure  = "azure"
+)
+
+// Backend is a storage backend that media files are archived to.
+type Backend interface {
+
+	// Name returns a human readable identifier of the backend, used in log
+	// messages, e.g. s3://my-bucket.
+	Name() string
+
+	// Put stores size bytes read from r under key.
+	Put(key string, r io.ReadSeeker, size int64, opts PutOptions) error
+
+	// Get reads length bytes of the object stored under key starting at
+	// offset. A negative length reads to the end of the object.
+	Get(key string, offset, length int64) (io.ReadCloser, error)
+
+	// List calls fn for each object whose key starts with prefix. Listing
+	// stops at the first error returned by fn.
+	List(prefix string, fn func(Object) error) error
+
+	// Delete removes the object stored under key.
+	Delete(key string) error
+}
+
+// Object describes a stored object, as returned by Backend.List.
+type Object struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+
+	// ETag is the backend's opaque version identifier, if it has one.
+	ETag string
+
+	// MD5 is the hex encoded MD5 sum of the content, if the backend lists it.
+	MD5 string
+
+	// Metadata is the metadata stored with the object by Backend.Put, if the
+	// backend lists it. Keys are lowercase.
+	Metadata map[string]string
+}
+
+// PutOptions are per-object settings passed to Backend.Put.
+type PutOptions struct {
+	StorageClass string
+
+	// ModTime is the local file's modification time, which backends preserve
+	// where they can.
+	ModTime time.Time
+
+	// Metadata is stored with the object by backends that support it.
+	Metadata map[string]string
+}
+
+// Name returns the name of the backend configured by b without connecting to
+// it, which matches Backend.Name.
+func (b BackendConfig) Name() string {
+	switch b.Type {
+	case BackendS3:
+		if b.Endpoint != "" {
+			return fmt.Sprintf("s3://%s (%s)", b.Bucket, b.Endpoint)
+		}
+		return "s3://" + b.Bucket
+	case BackendSFTP:
+		addr := b.Host
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "22")
+		}
+		return fmt.Sprintf("sftp://%s@%s/%s", b.User, addr, strings.TrimLeft(b.Path, "/"))
+	case BackendWebDAV:
+		return strings.TrimRight(b.URL, "/")
+	case BackendGCS:
+		if b.Endpoint != "" {
+			return fmt.Sprintf("gs://%s (%s)", b.Bucket, b.Endpoint)
+		}
+		return "gs://" + b.Bucket
+	case BackendAzure:
+		return strings.TrimSuffix(azureURL(b), "/") + "/" + b.Container
+	default:
+		return b.Type
+	}
+}
+
+// httpRange formats a Range header value for Backend.Get's arguments. It
+// returns an empty string if the whole object is requested.
+func httpRange(offset, length int64) string {
+	switch {
+	case length < 0 && offset == 0:
+		return ""
+	case length < 0:
+		return fmt.Sprintf("bytes=%d-", offset)
+	default:
+		return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	}
+}
+
+// readCloser combines a reader with the Close method of another value, e.g.
+// to limit the bytes read from a file.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// sizedReader reads exactly size bytes from r. It fails with
+// io.ErrUnexpectedEOF if r ends early, so that an upload is aborted rather
+// than committed with a truncated body.
+type sizedReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (s *sizedReader) Read(p []byte) (int, error) {
+	if s.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > s.left {
+		p = p[:s.left]
+	}
+	n, err := s.r.Read(p)
+	s.left -= int64(n)
+	if err == io.EOF && s.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// errOffline is returned by the backends of an offline archive.
+var errOffline = errors.New("backend is offline")
+
+// offlineBackend stands in for a backend that isn't connected to, see
+// NewOfflineArchive.
+type offlineBackend string
+
+// Name implements Backend.
+func (b offlineBackend) Name() string {
+	return string(b)
+}
+
+// Put implements Backend.
+func (b offlineBackend) Put(key string, r io.ReadSeeker, size int64, opts PutOptions) error {
+	return errOffline
+}
+
+// Get implements Backend.
+func (b offlineBackend) Get(key string, offset, length int64) (io.ReadCloser, error) {
+	return nil, errOffline
+}
+
+// List implements Backend.
+func (b offlineBackend) List(prefix string, fn func(Object) error) error {
+	return errOffline
+}
+
+// Delete implements Backend.
+func (b offlineBackend) Delete(key string) error {
+	return errOffline
+}
+
+// NewBackend returns the Backend configured by cfg.
+func NewBackend(cfg BackendConfig) (Backend, error) {
+	switch cfg.Type {
+	case BackendS3:
+		return NewS3Backend(cfg)
+	case BackendSFTP:
+		return NewSFTPBackend(cfg)
+	case BackendWebDAV:
+		return NewWebDAVBackend(cfg)
+	case BackendGCS:
+		return NewGCSBackend(cfg)
+	case BackendAzure:
+		return NewAzureBackend(cfg)
+	default:
+		return nil, fmt.Errorf("invalid backend type [backend=%s]", cfg.Type)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memBackend is a Backend that stores objects in memory, along with the
+// storage class that each one was put with.
+type memBackend struct {
+	name    string
+	mu      sync.Mutex
+	objects map[string][]byte
+	classes map[string]string
+}
+
+func newMemBackend(name string) *memBackend {
+	return &memBackend{name: name, objects: make(map[string][]byte), classes: make(map[string]string)}
+}
+
+func (b *memBackend) Name() string { return b.name }
+
+func (b *memBackend) Put(key string, r io.ReadSeeker, size int64, opts PutOptions) error {
+	data, err := ioutil.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return io.ErrUnexpectedEOF
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[key] = data
+	b.classes[key] = opts.StorageClass
+	return nil
+}
+
+func (b *memBackend) Get(key string, offset, length int64) (io.ReadCloser, error) {
+	b.mu.Lock()
+	data, ok := b.objects[key]
+	b.mu.Unlock()
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (b *memBackend) List(prefix string, fn func(Object) error) error {
+	b.mu.Lock()
+	var objects []Object
+	for key, data := range b.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, Object{Key: key, Size: int64(len(data))})
+		}
+	}
+	b.mu.Unlock()
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	for _, o := range objects {
+		if err := fn(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memBackend) Delete(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.objects[key]; !ok {
+		return os.ErrNotExist
+	}
+	delete(b.objects, key)
+	delete(b.classes, key)
+	return nil
+}
+
+// testEnv returns the environment variable, and skips the test if it isn't
+// set, e.g. because the backend's emulator isn't running.
+func testEnv(t *testing.T, name string) string {
+	v := os.Getenv(name)
+	if v == "" {
+		t.Skipf("%s isn't set", name)
+	}
+	return v
+}
+
+// testBackendRoundTrip stores an object under a random prefix, reads it back
+// whole, by range and by listing the prefix, then deletes it.
+func testBackendRoundTrip(t *testing.T, b Backend) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		t.Fatal(err)
+	}
+	prefix := "media-archive-test/" + hex.EncodeToString(suffix) + "/"
+	key := prefix + "2019/07/IMG_0001.JPG"
+	data := []byte("0123456789")
+
+	opts := PutOptions{ModTime: time.Date(2019, 7, 14, 10, 0, 0, 0, time.UTC)}
+	if err := b.Put(key, bytes.NewReader(data), int64(len(data)), opts); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+
+	for _, tt := range []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, -1, "0123456789"},
+		{2, 3, "234"},
+		{7, -1, "789"},
+	} {
+		r, err := b.Get(key, tt.offset, tt.length)
+		if err != nil {
+			t.Fatalf("Get(%d, %d): %s", tt.offset, tt.length, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("Get(%d, %d): %s", tt.offset, tt.length, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("Get(%d, %d) = %q, want %q", tt.offset, tt.length, got, tt.want)
+		}
+	}
+
+	var objects []Object
+	err := b.List(prefix, func(o Object) error {
+		objects = append(objects, o)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("List: %s", err)
+	}
+	if len(objects) != 1 || objects[0].Key != key || objects[0].Size != int64(len(data)) {
+		t.Errorf("List(%q) = %+v, want %s of %d bytes", prefix, objects, key, len(data))
+	}
+
+	if err := b.Delete(key); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	objects = nil
+	err = b.List(prefix, func(o Object) error {
+		objects = append(objects, o)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("List: %s", err)
+	}
+	if len(objects) != 0 {
+		t.Errorf("List(%q) after Delete = %+v, want none", prefix, objects)
+	}
+}
+
+func TestMemBackendRoundTrip(t *testing.T) {
+	testBackendRoundTrip(t, newMemBackend("mem"))
+}
+
+func TestSizedReader(t *testing.T) {
+	for _, tt := range []struct {
+		data string
+		size int64
+		want string
+		err  error
+	}{
+		{"0123456789", 10, "0123456789", nil},
+		{"0123456789", 4, "0123", nil},
+		{"0123", 10, "0123", io.ErrUnexpectedEOF},
+	} {
+		got, err := ioutil.ReadAll(&sizedReader{strings.NewReader(tt.data), tt.size})
+		if string(got) != tt.want || err != tt.err {
+			t.Errorf("sizedReader(%q, %d) = %q, %v, want %q, %v", tt.data, tt.size, got, err, tt.want, tt.err)
+		}
+	}
+}
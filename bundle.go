@@ -0,0 +1,323 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultBundleSize is the size at which a bundle is closed and uploaded when
+// an archive doesn't set one.
+const DefaultBundleSize = 64 << 20
+
+// bundleIdle is how long an open bundle waits for more files before it is
+// uploaded anyway.
+const bundleIdle = 30 * time.Second
+
+// bundleFile is a small file handed to the bundler by an archive worker.
+type bundleFile struct {
+	path     string
+	relpath  string
+	item     CacheItem
+	backends []Backend
+}
+
+// bundle is a tar file in the temp directory that small files are appended
+// to until it is uploaded. All files in a bundle are pending on the same
+// backends.
+type bundle struct {
+	backends []Backend
+	file     *os.File
+	tw       *tar.Writer
+	size     countingWriter
+	members  []bundleMember
+}
+
+// bundleMember is a file that was written to a bundle.
+type bundleMember struct {
+	bundleFile
+	key    string
+	offset int64
+	size   int64
+	mtime  time.Time
+	media  *Media
+	group  FileGroup
+}
+
+// countingWriter counts the bytes written to the underlying writer, which is
+// used to find the offsets of the bundle members' content.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingReader counts the bytes read from the underlying reader, which is
+// used to find the offsets of the members of a bundle while extracting it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// bundler packs the files sent through in into bundles and uploads each one
+// once it reaches the archive's bundle size, or has been idle for a while.
+// The members' copies reference the bundle and their offset within it, and
+// are sent to archived. Open bundles are uploaded when in is closed.
+func bundler(archive *Archive, progress *Progress, in <-chan bundleFile, archived chan<- CacheItem, errs chan<- error) {
+	id := progress.NextWorker()
+	open := make(map[string]*bundle)
+
+	flush := func(group string) {
+		b := open[group]
+		if err := b.upload(archive, id, progress, archived, errs); err != nil {
+			for _, m := range b.members {
+				progress.Fail(id, m.path)
+			}
+			errs <- err
+		}
+		delete(open, group)
+	}
+
+	for {
+		select {
+		case f, ok := <-in:
+			if !ok {
+				for group := range open {
+					flush(group)
+				}
+				return
+			}
+
+			group := backendGroup(f.backends)
+			b := open[group]
+			if b == nil {
+				var err error
+				if b, err = newBundle(f.backends); err != nil {
+					progress.Fail(id, f.path)
+					errs <- err
+					continue
+				}
+				open[group] = b
+			}
+
+			if err := b.add(archive, f); err != nil {
+				progress.Fail(id, f.path)
+				errs <- err
+				continue
+			}
+			if b.size.n >= archive.BundleSize {
+				flush(group)
+			}
+
+		case <-time.After(bundleIdle):
+			for group := range open {
+				flush(group)
+			}
+		}
+	}
+}
+
+// backendGroup returns a key identifying a set of backends.
+func backendGroup(backends []Backend) string {
+	names := make([]string, len(backends))
+	for i, b := range backends {
+		names[i] = b.Name()
+	}
+	sort.Strings(names)
+	return strings.Join(names, "\n")
+}
+
+func newBundle(backends []Backend) (*bundle, error) {
+	f, err := ioutil.TempFile("", "media-archive-bundle-")
+	if err != nil {
+		return nil, err
+	}
+
+	b := &bundle{backends: backends, file: f}
+	b.size.w = f
+	b.tw = tar.NewWriter(&b.size)
+	return b, nil
+}
+
+// add appends a file to the bundle. The file is read into memory first so
+// that a file that changes while it is read can't corrupt the bundle.
+func (b *bundle) add(archive *Archive, f bundleFile) error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(file, info.Size()))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != info.Size() {
+		return fmt.Errorf("file truncated while reading [filepath=%s]", f.path)
+	}
+
+	// The watcher reports a file for every write, so skip versions that
+	// are already in the bundle.
+	for _, m := range b.members {
+		if m.relpath == f.relpath && m.size == info.Size() && m.mtime.Equal(info.ModTime()) {
+			return nil
+		}
+	}
+
+	// The decoded image is dropped, since a bundle can hold many of them.
+	media, _ := analyzeMedia(bytes.NewReader(data), int64(len(data)), f.relpath)
+
+	group, err := archive.Group(f.path, f.relpath, media.ContentID)
+	if err != nil {
+		return err
+	}
+	key, err := archive.GroupKey(group, f.path, f.relpath, info)
+	if err != nil {
+		return err
+	}
+
+	hdr := &tar.Header{
+		Name:     key,
+		Mode:     int64(info.Mode().Perm()),
+		Size:     int64(len(data)),
+		ModTime:  info.ModTime(),
+		Typeflag: tar.TypeReg,
+	}
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	// The header has been written in full, so the content starts here.
+	offset := b.size.n
+	if _, err := b.tw.Write(data); err != nil {
+		return err
+	}
+
+	b.members = append(b.members, bundleMember{
+		bundleFile: f,
+		key:        key,
+		offset:     offset,
+		size:       int64(len(data)),
+		mtime:      info.ModTime(),
+		media:      media,
+		group:      group,
+	})
+	return nil
+}
+
+// upload closes the bundle, uploads it to its backends and records the copies
+// of its members. The temp file is removed.
+func (b *bundle) upload(archive *Archive, id int, progress *Progress, archived chan<- CacheItem, errs chan<- error) error {
+	defer os.Remove(b.file.Name())
+	defer b.file.Close()
+
+	if err := b.tw.Close(); err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	now := time.Now()
+	key := path.Join(archive.Name, "bundles", fmt.Sprintf("%s-%s.tar", now.UTC().Format("20060102T150405Z"), hex.EncodeToString(suffix)))
+
+	progress.Start(id, key)
+	opts := PutOptions{
+		ModTime: now,
+		Metadata: map[string]string{
+			"files": strconv.Itoa(len(b.members)),
+		},
+	}
+
+	failed := make(map[string]string)
+	var uploaded []Backend
+	for _, backend := range b.backends {
+		opts.StorageClass = archive.StorageClassOf(backend)
+		_, err := b.file.Seek(0, io.SeekStart)
+		if err == nil {
+			err = backend.Put(key, b.file, b.size.n, opts)
+		}
+		if err != nil {
+			failed[backend.Name()] = err.Error()
+			errs <- fmt.Errorf("%s [backend=%s] [bundle=%s]", err, backend.Name(), key)
+			continue
+		}
+
+		// TODO Figure out a logging strategy.
+		log.Printf("bundle uploaded [archive=%s] [backend=%s] [bundle=%s] [files=%d]", archive.Name, backend.Name(), key, len(b.members))
+		uploaded = append(uploaded, backend)
+	}
+
+	for _, m := range b.members {
+		item := m.item
+		item.Filename = m.relpath
+		item.Size = m.size
+		item.ModTime = m.mtime
+		item.Key = m.key
+		item.Media = m.media
+		item.DuplicateOf = ""
+		item.Group = m.group.Name()
+		item.Companions = m.group.Companions(m.relpath)
+		if archive.Previews.Enabled && m.media.Hash != "" {
+			if pic, err := DecodePicture(io.NewSectionReader(b.file, m.offset, m.size), m.size, m.media); err == nil {
+				item.Previews = archive.uploadPreviews(uploaded, pic, m.relpath)
+			}
+		}
+
+		for _, backend := range b.backends {
+			c := Copy{
+				Backend: backend.Name(),
+				Key:     m.key,
+				Bundle:  key,
+				Offset:  m.offset,
+				Size:    m.size,
+				ModTime: m.mtime,
+				Error:   failed[backend.Name()],
+			}
+			if c.Error == "" {
+				c.ArchivedAt = now
+				item.ArchivedAt = now
+			}
+			item.SetCopy(c)
+		}
+		if err := archive.indexImage(item); err != nil {
+			errs <- err
+		}
+		archived <- item
+
+		if len(failed) > 0 {
+			progress.Fail(id, m.path)
+		} else {
+			progress.Done(id, m.path)
+		}
+	}
+
+	return nil
+}
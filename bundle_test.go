@@ -0,0 +1,190 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testFile writes data to the file under root, dated modTime.
+func testFile(t *testing.T, root, relpath, data string, modTime time.Time) bundleFile {
+	p := filepath.Join(root, filepath.FromSlash(relpath))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(p, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	return bundleFile{path: p, relpath: relpath}
+}
+
+// uploadTestBundle uploads a bundle of the files written by add to the
+// archive's backends, and caches the items of its members in order.
+func uploadTestBundle(t *testing.T, a *Archive, add func(b *bundle)) []CacheItem {
+	b, err := newBundle(a.Backends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	add(b)
+
+	archived := make(chan CacheItem, len(b.members))
+	errs := make(chan error, 2*len(b.members))
+	if err := b.upload(a, 0, NewProgress(), archived, errs); err != nil {
+		t.Fatal(err)
+	}
+	close(archived)
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	var items []CacheItem
+	for item := range archived {
+		if err := a.Cache.Set(item); err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func TestBundleRestore(t *testing.T) {
+	root := t.TempDir()
+	mem := newMemBackend("mem")
+	a := testArchive(t, ArchiveConfig{Name: "docs", Roots: []RootConfig{{Path: root}}}, mem)
+
+	modTime := time.Date(2019, 7, 14, 10, 0, 0, 0, time.UTC)
+	want := map[string]string{
+		"notes/a.txt":     "first file",
+		"notes/b.txt":     "modified",
+		"notes/sub/c.txt": "",
+		"notes/d.txt":     "bundled on its own",
+	}
+	add := func(b *bundle, f bundleFile) {
+		f.backends = a.Backends
+		if err := b.add(a, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first bundle holds two versions of b.txt, since it was modified
+	// after it was added, and only the second one is cached.
+	items := uploadTestBundle(t, a, func(b *bundle) {
+		add(b, testFile(t, root, "notes/a.txt", want["notes/a.txt"], modTime))
+		add(b, testFile(t, root, "notes/b.txt", "second file, before it was modified", modTime))
+		add(b, testFile(t, root, "notes/b.txt", want["notes/b.txt"], modTime.Add(time.Hour)))
+		add(b, testFile(t, root, "notes/sub/c.txt", want["notes/sub/c.txt"], modTime))
+	})
+	if len(items) != 4 {
+		t.Fatalf("bundled %d files, want 4", len(items))
+	}
+	items = append(items, uploadTestBundle(t, a, func(b *bundle) {
+		add(b, testFile(t, root, "notes/d.txt", want["notes/d.txt"], modTime))
+	})...)
+
+	// Each member's offset points at its content in the bundle object.
+	versions := map[string]string{"notes/b.txt": "second file, before it was modified"}
+	for _, item := range items {
+		c, ok := item.Copy("mem")
+		if !ok || c.Error != "" || c.Bundle == "" {
+			t.Fatalf("%s: copy %+v, want a bundled copy", item.Filename, c)
+		}
+		data := mem.objects[c.Bundle]
+		if c.Offset+c.Size > int64(len(data)) {
+			t.Fatalf("%s: member at %d+%d beyond the bundle's %d bytes", item.Filename, c.Offset, c.Size, len(data))
+		}
+		content := want[item.Filename]
+		if v, ok := versions[item.Filename]; ok {
+			content = v
+			delete(versions, item.Filename)
+		}
+		if got := string(data[c.Offset : c.Offset+c.Size]); got != content {
+			t.Errorf("%s: bundle content at %d = %q, want %q", item.Filename, c.Offset, got, content)
+		}
+	}
+
+	plan, err := restorePlan(a, func(string) bool { return true }, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := groupBundles(plan)
+	sort.Slice(groups, func(i, j int) bool { return len(groups[i]) > len(groups[j]) })
+	if len(groups) != 2 || len(groups[0]) != 3 || len(groups[1]) != 1 {
+		t.Fatalf("grouped %d files into %d groups, want groups of 3 and 1", len(plan), len(groups))
+	}
+
+	// The members of the first bundle are extracted from the streamed
+	// bundle, and d.txt is read with a ranged request.
+	to := t.TempDir()
+	for _, group := range groups {
+		n, errs := restoreGroup(a, group, to)
+		for _, err := range errs {
+			t.Error(err)
+		}
+		if n != len(group) {
+			t.Errorf("restored %d of %d files", n, len(group))
+		}
+	}
+
+	for relpath, content := range want {
+		p := filepath.Join(to, filepath.FromSlash(relpath))
+		got, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != content {
+			t.Errorf("%s restored as %q, want %q", relpath, got, content)
+		}
+		wantTime := modTime
+		if relpath == "notes/b.txt" {
+			wantTime = modTime.Add(time.Hour)
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(wantTime) {
+			t.Errorf("%s restored with modification time %s, want %s", relpath, info.ModTime(), wantTime)
+		}
+	}
+}
+
+func TestRestoreGroupMissingMember(t *testing.T) {
+	root := t.TempDir()
+	mem := newMemBackend("mem")
+	a := testArchive(t, ArchiveConfig{Name: "docs", Roots: []RootConfig{{Path: root}}}, mem)
+
+	modTime := time.Date(2019, 7, 14, 10, 0, 0, 0, time.UTC)
+	items := uploadTestBundle(t, a, func(b *bundle) {
+		for _, relpath := range []string{"a.txt", "b.txt"} {
+			f := testFile(t, root, relpath, "content of "+relpath, modTime)
+			f.backends = a.Backends
+			if err := b.add(a, f); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	// A member whose offset doesn't match the bundle isn't restored.
+	var group []restoreFile
+	for _, item := range items {
+		f, _ := restoreSource(item, a.Backends)
+		group = append(group, f)
+	}
+	group[1].copy.Offset++
+
+	to := t.TempDir()
+	n, errs := restoreGroup(a, group, to)
+	if n != 1 || len(errs) != 1 {
+		t.Errorf("restored %d files with errors %v, want 1 file and 1 error", n, errs)
+	}
+	if _, err := os.Stat(filepath.Join(to, "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("b.txt restored from the wrong offset: %v", err)
+	}
+}
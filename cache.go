@@ -2,105 +2,873 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// ErrNotCached is returned by Cache.Get when there is no item for the key.
+var ErrNotCached = errors.New("item not cached")
+
+// CacheDir returns the directory that the cache database is stored in. It is
+// set with --cache-dir, and otherwise defaults to the platform's user cache
+// directory, e.g. $XDG_CACHE_HOME/media-archive on Linux.
+func CacheDir() (string, error) {
+	if dir := viper.GetString("cache-dir"); dir != "" {
+		return dir, nil
+	}
+
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot determine the cache directory, set --cache-dir: %s", err)
+	}
+
+	// Keep the reverse-DNS name on macOS so existing caches are found.
+	name := "media-archive"
+	if runtime.GOOS == "darwin" {
+		name = "com.chrispliakas.media-archive"
+	}
+
+	return filepath.Join(base, name), nil
+}
+
+// CacheItem is the cached state of an archived file.
 type CacheItem struct {
-	Filename string
+
+	// Filename is the file's path relative to the archive's roots.
+	Filename string `json:"filename"`
+
+	// Size and ModTime are the file's size and modification time when it was
+	// archived, and are used to detect changes.
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+
+	// Key is the key that the file is stored under.
+	Key string `json:"key"`
+
+	// ArchivedAt is when the file was last archived to any backend.
+	ArchivedAt time.Time `json:"archived_at"`
+
+	// Copies is the status of the file on each backend it was archived to.
+	Copies []Copy `json:"copies"`
+
+	// Media is the file's metadata, which is only set when the file was
+	// read. Items without it leave the cached metadata as it is.
+	Media *Media `json:"-"`
+
+	// Previews are the thumbnail and preview uploaded with the file, which
+	// are only set when they were made. Items without them leave the cached
+	// previews as they are, see SQLiteCache.Previews.
+	Previews []Preview `json:"-"`
+
+	// DuplicateOf is the file that this image is a duplicate of, if it
+	// wasn't uploaded because the archive skips duplicates.
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+
+	// Group is the primary file of the group that the file belongs to, e.g.
+	// the raw file for its JPEG and XMP sidecar, see FileGroup. Items
+	// without it leave the cached group as it is, since a file may have
+	// been archived before its companions.
+	Group string `json:"group,omitempty"`
+
+	// Companions are the other files in the group, whose cached group is
+	// set to Group as well when the item is written.
+	Companions []string `json:"-"`
+}
+
+// Copy is the status of a file on a single backend.
+type Copy struct {
+
+	// Backend is the backend's name, see Backend.Name.
+	Backend string `json:"backend"`
+
+	// Key is the key that the file is stored under on the backend. For
+	// bundled files it is the name of the member in the bundle.
+	Key string `json:"key"`
+
+	// Bundle is the key of the bundle object that the file was packed into,
+	// and Offset is where the file's content starts within it. Bundle is
+	// empty if the file is stored as an object of its own.
+	Bundle string `json:"bundle,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+
+	// Size and ModTime are the file's size and modification time when it was
+	// uploaded to the backend.
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+
+	// ArchivedAt is when the file was last uploaded to the backend.
+	ArchivedAt time.Time `json:"archived_at"`
+
+	// Error is the error of the last upload attempt, which is empty if the
+	// upload succeeded.
+	Error string `json:"error,omitempty"`
+}
+
+// Current reports whether the copy was uploaded successfully and matches the
+// file described by info.
+func (c Copy) Current(info os.FileInfo) bool {
+	return c.Error == "" && c.Size == info.Size() && c.ModTime.Equal(info.ModTime())
 }
 
 func (i CacheItem) String() string {
 	return i.Filename
 }
 
+// Modified reports whether the file described by info has changed since the
+// item was cached.
+func (i CacheItem) Modified(info os.FileInfo) bool {
+	return i.Size != info.Size() || !i.ModTime.Equal(info.ModTime())
+}
+
+// Copy returns the file's copy on the named backend.
+func (i CacheItem) Copy(backend string) (Copy, bool) {
+	for _, c := range i.Copies {
+		if c.Backend == backend {
+			return c, true
+		}
+	}
+	return Copy{}, false
+}
+
+// SetCopy adds or replaces the copy on c's backend.
+func (i *CacheItem) SetCopy(c Copy) {
+	for n := range i.Copies {
+		if i.Copies[n].Backend == c.Backend {
+			i.Copies[n] = c
+			return
+		}
+	}
+	i.Copies = append(i.Copies, c)
+}
+
+// Cache stores the state of the files in an archive.
 type Cache interface {
 
-	// Set adds an item to the cache.
+	// Set adds an item to the cache, replacing an existing item.
 	Set(CacheItem) error
 
-	// Get returns a cache item by unique key.
+	// SetMany adds multiple items to the cache in a single transaction.
+	SetMany([]CacheItem) error
+
+	// Get returns a cache item by unique key, or ErrNotCached.
 	Get(string) (CacheItem, error)
 
 	// Purge removes an item from the cache.
 	Purge(string) error
+
+	// Walk calls fn for each item in the cache in filename order, stopping at
+	// the first error.
+	Walk(fn func(CacheItem) error) error
+
+	// Images calls fn for each image with a perceptual hash in filename
+	// order, stopping at the first error.
+	Images(fn func(CachedImage) error) error
+
+	// ContentMatches returns the files whose metadata has the content
+	// identifier, see Media.ContentID.
+	ContentMatches(id string) ([]string, error)
+
+	// Fingerprints calls fn for each file with its fingerprint, stopping at
+	// the first error.
+	Fingerprints(fn func(filename string, fp Fingerprint) error) error
 }
 
-type SQLiteCache struct {
-	db      *sql.DB
-	archive string
+// migrations are applied in order to bring the schema up to date. The index
+// of the last applied migration plus one is stored in PRAGMA user_version, so
+// new migrations must only ever be appended.
+var migrations = []string{
+	`
+	CREATE TABLE archives (
+		id   INTEGER PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE
+	);
+
+	CREATE TABLE files (
+		archive_id  INTEGER NOT NULL REFERENCES archives(id),
+		filename    TEXT NOT NULL,
+		size        INTEGER NOT NULL DEFAULT 0,
+		mod_time    INTEGER NOT NULL DEFAULT 0,
+		key         TEXT NOT NULL DEFAULT '',
+		archived_at INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (archive_id, filename)
+	);
+	`,
+	`
+	CREATE TABLE backends (
+		id   INTEGER PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE
+	);
+
+	CREATE TABLE copies (
+		archive_id  INTEGER NOT NULL,
+		filename    TEXT NOT NULL,
+		backend_id  INTEGER NOT NULL REFERENCES backends(id),
+		key         TEXT NOT NULL DEFAULT '',
+		size        INTEGER NOT NULL DEFAULT 0,
+		mod_time    INTEGER NOT NULL DEFAULT 0,
+		archived_at INTEGER NOT NULL DEFAULT 0,
+		error       TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (archive_id, filename, backend_id),
+		FOREIGN KEY (archive_id, filename) REFERENCES files(archive_id, filename)
+	);
+	`,
+	`
+	ALTER TABLE copies ADD COLUMN bundle TEXT NOT NULL DEFAULT '';
+	ALTER TABLE copies ADD COLUMN bundle_offset INTEGER NOT NULL DEFAULT 0;
+
+	CREATE INDEX copies_bundle ON copies (bundle) WHERE bundle != '';
+	`,
+	`
+	CREATE TABLE media (
+		id          INTEGER PRIMARY KEY,
+		archive_id  INTEGER NOT NULL,
+		filename    TEXT NOT NULL,
+		class       TEXT NOT NULL DEFAULT '',
+		taken_at    TEXT NOT NULL DEFAULT '',
+		camera      TEXT NOT NULL DEFAULT '' COLLATE NOCASE,
+		model       TEXT NOT NULL DEFAULT '' COLLATE NOCASE,
+		latitude    REAL,
+		longitude   REAL,
+		UNIQUE (archive_id, filename),
+		FOREIGN KEY (archive_id, filename) REFERENCES files(archive_id, filename)
+	);
+
+	CREATE INDEX media_class ON media (class);
+	CREATE INDEX media_taken ON media (taken_at);
+	CREATE INDEX media_camera ON media (camera);
+	CREATE INDEX media_model ON media (model);
+	CREATE INDEX media_location ON media (latitude, longitude);
+
+	-- The docid of a row is the id of its media row.
+	CREATE VIRTUAL TABLE media_text USING fts4(name, dir, tags, tokenize=unicode61);
+	`,
+	`
+	CREATE TABLE previews (
+		archive_id  INTEGER NOT NULL,
+		filename    TEXT NOT NULL,
+		kind        TEXT NOT NULL,
+		key         TEXT NOT NULL,
+		width       INTEGER NOT NULL DEFAULT 0,
+		height      INTEGER NOT NULL DEFAULT 0,
+		size        INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (archive_id, filename, kind),
+		FOREIGN KEY (archive_id, filename) REFERENCES files(archive_id, filename)
+	);
+	`,
+	`
+	ALTER TABLE media ADD COLUMN hash TEXT NOT NULL DEFAULT '';
+	ALTER TABLE media ADD COLUMN width INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE media ADD COLUMN height INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE files ADD COLUMN duplicate_of TEXT NOT NULL DEFAULT '';
+
+	CREATE INDEX media_hash ON media (archive_id) WHERE hash != '';
+	`,
+	`
+	ALTER TABLE media ADD COLUMN content_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE files ADD COLUMN file_group TEXT NOT NULL DEFAULT '';
+
+	CREATE INDEX media_content_id ON media (archive_id, content_id) WHERE content_id != '';
+	CREATE INDEX files_group ON files (archive_id, file_group) WHERE file_group != '';
+	`,
 }
 
-func NewSQLiteCache(archive string) (Cache, error) {
-	basedir := fmt.Sprintf("/Users/%s/Library/Caches/com.chrispliakas.media-archive", os.Getenv("USER"))
-	cachefile := fmt.Sprintf("%s/cache.db", basedir)
+// SQLiteDB is the SQLite database that backs the caches of all archives.
+// Statements are prepared once and reused for the lifetime of the database.
+type SQLiteDB struct {
+	db *sql.DB
 
-	// Ensure the cache directory is available.
-	stat, err := os.Stat(basedir)
-	if os.IsNotExist(err) {
-		if err := os.Mkdir(basedir, 0755); err != nil {
-			return nil, err
-		}
-	} else if err != nil {
+	selectArchive *sql.Stmt
+	insertArchive *sql.Stmt
+	selectFile    *sql.Stmt
+	upsertFile    *sql.Stmt
+	deleteFile    *sql.Stmt
+	selectBackend *sql.Stmt
+	insertBackend *sql.Stmt
+	selectCopies  *sql.Stmt
+	upsertCopy    *sql.Stmt
+	deleteCopies  *sql.Stmt
+	selectMedia   *sql.Stmt
+	insertMedia   *sql.Stmt
+	updateMedia   *sql.Stmt
+	deleteMedia   *sql.Stmt
+	deleteText    *sql.Stmt
+	insertText    *sql.Stmt
+	selectPreview *sql.Stmt
+	insertPreview *sql.Stmt
+	deletePreview *sql.Stmt
+	selectContent *sql.Stmt
+	updateGroup   *sql.Stmt
+
+	// readOnly is set if the database may not be written to.
+	readOnly bool
+}
+
+// OpenSQLiteDB opens the cache database in dir, creating the directory and
+// the schema if they don't exist.
+func OpenSQLiteDB(dir string) (*SQLiteDB, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	// Writers take the lock when the transaction begins so that concurrent
+	// transactions wait for the busy timeout instead of failing to upgrade.
+	dsn := filepath.Join(dir, "cache.db") + "?_busy_timeout=5000&_txlock=immediate"
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// WAL mode lets readers, e.g. the status command, query the database
+	// while the daemon is writing to it. The setting is persistent.
+	if _, err := db.Exec("PRAGMA journal_mode=WAL"); err != nil {
+		db.Close()
 		return nil, err
-	} else if !stat.IsDir() {
+	}
+
+	if err := migrate(db); err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	// Open the database.
-	db, err := sql.Open("sqlite3", cachefile)
+	return prepare(db, false)
+}
+
+// OpenSQLiteDBReadOnly opens the cache database in dir without modifying it,
+// e.g. for dry runs. If the database doesn't exist, an empty in-memory one is
+// used instead so that no file is cached.
+func OpenSQLiteDBReadOnly(dir string) (*SQLiteDB, error) {
+	file, err := filepath.Abs(filepath.Join(dir, "cache.db"))
 	if err != nil {
 		return nil, err
 	}
 
-	sql := `
-		CREATE TABLE IF NOT EXISTS %s (
-    		filename VARCHAR(255) PRIMARY KEY
-		);
-	`
-	_, err = db.Exec(fmt.Sprintf(sql, "`"+archive+"`"))
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		db, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			return nil, err
+		}
+
+		// Every connection would open a database of its own.
+		db.SetMaxOpenConns(1)
+		if err := migrate(db); err != nil {
+			db.Close()
+			return nil, err
+		}
+		return prepare(db, true)
+	}
+
+	dsn := url.URL{Scheme: "file", Path: filepath.ToSlash(file), RawQuery: "mode=ro&_busy_timeout=5000"}
+	db, err := sql.Open("sqlite3", dsn.String())
 	if err != nil {
 		return nil, err
 	}
 
-	return &SQLiteCache{db: db, archive: archive}, nil
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if version != len(migrations) {
+		db.Close()
+		return nil, fmt.Errorf("cache schema is out of date, run media-archive once to update it [version=%d]", version)
+	}
+
+	return prepare(db, true)
+}
+
+// prepare prepares the statements used by the caches.
+func prepare(db *sql.DB, readOnly bool) (*SQLiteDB, error) {
+	var err error
+	d := &SQLiteDB{db: db, readOnly: readOnly}
+	stmts := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&d.selectArchive, "SELECT id FROM archives WHERE name = ?"},
+		{&d.insertArchive, "INSERT INTO archives (name) VALUES (?)"},
+		{&d.selectFile, "SELECT filename, size, mod_time, key, archived_at, duplicate_of, file_group FROM files WHERE archive_id = ? AND filename = ?"},
+		{&d.upsertFile, "INSERT OR REPLACE INTO files (archive_id, filename, size, mod_time, key, archived_at, duplicate_of, file_group) VALUES (?, ?, ?, ?, ?, ?, ?, COALESCE(NULLIF(?, ''), (SELECT file_group FROM files WHERE archive_id = ? AND filename = ?), ''))"},
+		{&d.deleteFile, "DELETE FROM files WHERE archive_id = ? AND filename = ?"},
+		{&d.selectBackend, "SELECT id FROM backends WHERE name = ?"},
+		{&d.insertBackend, "INSERT INTO backends (name) VALUES (?)"},
+		{&d.selectCopies, "SELECT b.name, c.key, c.bundle, c.bundle_offset, c.size, c.mod_time, c.archived_at, c.error FROM copies c JOIN backends b ON b.id = c.backend_id WHERE c.archive_id = ? AND c.filename = ? ORDER BY b.name"},
+		{&d.upsertCopy, "INSERT OR REPLACE INTO copies (archive_id, filename, backend_id, key, bundle, bundle_offset, size, mod_time, archived_at, error) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"},
+		{&d.deleteCopies, "DELETE FROM copies WHERE archive_id = ? AND filename = ?"},
+		{&d.selectMedia, "SELECT id FROM media WHERE archive_id = ? AND filename = ?"},
+		{&d.insertMedia, "INSERT INTO media (archive_id, filename, class, taken_at, camera, model, latitude, longitude, hash, width, height, content_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"},
+		{&d.updateMedia, "UPDATE media SET class = ?, taken_at = ?, camera = ?, model = ?, latitude = ?, longitude = ?, hash = ?, width = ?, height = ?, content_id = ? WHERE id = ?"},
+		{&d.deleteMedia, "DELETE FROM media WHERE id = ?"},
+		{&d.deleteText, "DELETE FROM media_text WHERE docid = ?"},
+		{&d.insertText, "INSERT INTO media_text (docid, name, dir, tags) VALUES (?, ?, ?, ?)"},
+		{&d.selectPreview, "SELECT kind, key, width, height, size FROM previews WHERE archive_id = ? AND filename = ? ORDER BY kind DESC"},
+		{&d.insertPreview, "INSERT INTO previews (archive_id, filename, kind, key, width, height, size) VALUES (?, ?, ?, ?, ?, ?, ?)"},
+		{&d.deletePreview, "DELETE FROM previews WHERE archive_id = ? AND filename = ?"},
+		{&d.selectContent, "SELECT filename FROM media WHERE archive_id = ? AND content_id = ? ORDER BY filename"},
+		{&d.updateGroup, "UPDATE files SET file_group = ? WHERE archive_id = ? AND filename = ? AND file_group != ?"},
+	}
+	for _, s := range stmts {
+		if *s.stmt, err = db.Prepare(s.query); err != nil {
+			d.Close()
+			return nil, fmt.Errorf("%s [query=%s]", err, s.query)
+		}
+	}
+
+	return d, nil
+}
+
+// migrate applies the migrations that haven't been applied yet.
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%s [migration=%d]", err, version)
+		}
+
+		// PRAGMA doesn't support placeholders.
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes the prepared statements and the database.
+func (d *SQLiteDB) Close() error {
+	for _, stmt := range []*sql.Stmt{
+		d.selectArchive, d.insertArchive, d.selectFile, d.upsertFile, d.deleteFile,
+		d.selectBackend, d.insertBackend, d.selectCopies, d.upsertCopy, d.deleteCopies,
+		d.selectMedia, d.insertMedia, d.updateMedia, d.deleteMedia, d.deleteText, d.insertText,
+		d.selectPreview, d.insertPreview, d.deletePreview, d.selectContent, d.updateGroup,
+	} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return d.db.Close()
+}
+
+// Cache returns the cache for the named archive, registering the archive if
+// it is new and the database isn't read-only.
+func (d *SQLiteDB) Cache(archive string) (*SQLiteCache, error) {
+	var id int64
+	err := d.selectArchive.QueryRow(archive).Scan(&id)
+	if err == sql.ErrNoRows && d.readOnly {
+		// Archive IDs start at 1, so an unregistered archive has no files.
+		return &SQLiteCache{d: d}, nil
+	}
+	if err == sql.ErrNoRows {
+		res, err := d.insertArchive.Exec(archive)
+		if err != nil {
+			return nil, err
+		}
+		if id, err = res.LastInsertId(); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &SQLiteCache{d: d, archiveID: id}, nil
+}
+
+// backendID returns the ID of the named backend, registering the backend in
+// tx if it is new. Registering it outside of tx would wait for tx's lock.
+func (d *SQLiteDB) backendID(tx *sql.Tx, name string) (int64, error) {
+	var id int64
+	err := tx.Stmt(d.selectBackend).QueryRow(name).Scan(&id)
+	if err == sql.ErrNoRows {
+		res, err := tx.Stmt(d.insertBackend).Exec(name)
+		if err != nil {
+			return 0, err
+		}
+		if id, err = res.LastInsertId(); err != nil {
+			return 0, err
+		}
+	} else if err != nil {
+		return 0, err
+	}
+
+	return id, nil
 }
 
-func (c *SQLiteCache) Set(item CacheItem) (err error) {
-	stmt, err := c.db.Prepare(fmt.Sprintf("INSERT INTO `%s`(filename) values(?)", c.archive))
+// SQLiteCache is the Cache of a single archive stored in a SQLiteDB.
+type SQLiteCache struct {
+	d         *SQLiteDB
+	archiveID int64
+}
+
+// Set implements Cache.
+func (c *SQLiteCache) Set(item CacheItem) error {
+	return c.SetMany([]CacheItem{item})
+}
+
+// SetMany implements Cache.
+func (c *SQLiteCache) SetMany(items []CacheItem) error {
+	tx, err := c.d.db.Begin()
 	if err != nil {
-		return
+		return err
 	}
 
-	_, err = stmt.Exec(item.Filename)
-	return
+	for _, item := range items {
+		if err := c.set(tx, item); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// set writes the item, its copies and its metadata. Copies on backends that
+// aren't in the item are left as they are.
+func (c *SQLiteCache) set(tx *sql.Tx, item CacheItem) error {
+	_, err := tx.Stmt(c.d.upsertFile).Exec(c.archiveID, item.Filename, item.Size, unixNano(item.ModTime), item.Key, unixNano(item.ArchivedAt), item.DuplicateOf, item.Group, c.archiveID, item.Filename)
+	if err != nil {
+		return err
+	}
+
+	// Companions that aren't cached yet record the group when they are.
+	for _, filename := range item.Companions {
+		if _, err := tx.Stmt(c.d.updateGroup).Exec(item.Group, c.archiveID, filename, item.Group); err != nil {
+			return err
+		}
+	}
+
+	for _, cp := range item.Copies {
+		id, err := c.d.backendID(tx, cp.Backend)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Stmt(c.d.upsertCopy).Exec(c.archiveID, item.Filename, id, cp.Key, cp.Bundle, cp.Offset, cp.Size, unixNano(cp.ModTime), unixNano(cp.ArchivedAt), cp.Error)
+		if err != nil {
+			return err
+		}
+	}
+
+	if item.Media != nil {
+		if err := c.setMedia(tx, item.Filename, item.Media); err != nil {
+			return err
+		}
+	}
+
+	if item.Previews != nil {
+		if _, err := tx.Stmt(c.d.deletePreview).Exec(c.archiveID, item.Filename); err != nil {
+			return err
+		}
+		for _, p := range item.Previews {
+			if _, err := tx.Stmt(c.d.insertPreview).Exec(c.archiveID, item.Filename, p.Kind, p.Key, p.Width, p.Height, p.Size); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setMedia writes the file's metadata and its full text index entry.
+func (c *SQLiteCache) setMedia(tx *sql.Tx, filename string, m *Media) error {
+	var taken string
+	if !m.Taken.IsZero() {
+		taken = m.Taken.Format(takenLayout)
+	}
+	var lat, lon interface{}
+	if m.Location != nil {
+		lat, lon = m.Location.Latitude, m.Location.Longitude
+	}
+
+	var id int64
+	err := tx.Stmt(c.d.selectMedia).QueryRow(c.archiveID, filename).Scan(&id)
+	if err == sql.ErrNoRows {
+		res, err := tx.Stmt(c.d.insertMedia).Exec(c.archiveID, filename, m.Class, taken, m.Camera(), m.Model, lat, lon, m.Hash, m.Width, m.Height, m.ContentID)
+		if err != nil {
+			return err
+		}
+		if id, err = res.LastInsertId(); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else if _, err := tx.Stmt(c.d.updateMedia).Exec(m.Class, taken, m.Camera(), m.Model, lat, lon, m.Hash, m.Width, m.Height, m.ContentID, id); err != nil {
+		return err
+	}
+
+	// FTS tables can't be upserted.
+	if _, err := tx.Stmt(c.d.deleteText).Exec(id); err != nil {
+		return err
+	}
+	tags := append([]string{m.Class, m.Make, m.Model, strings.TrimPrefix(path.Ext(filename), ".")}, m.Tags...)
+	if m.Description != "" {
+		tags = append(tags, m.Description)
+	}
+	_, err = tx.Stmt(c.d.insertText).Exec(id, path.Base(filename), path.Dir(filename), strings.Join(tags, " "))
+	return err
 }
 
+// Get implements Cache.
 func (c *SQLiteCache) Get(filename string) (item CacheItem, err error) {
-	sql := fmt.Sprintf("SELECT filename FROM `%s` WHERE filename = ?", c.archive)
-	rows, err := c.db.Query(sql, filename)
+	var modTime, archivedAt int64
+	err = c.d.selectFile.QueryRow(c.archiveID, filename).Scan(&item.Filename, &item.Size, &modTime, &item.Key, &archivedAt, &item.DuplicateOf, &item.Group)
+	if err == sql.ErrNoRows {
+		return item, ErrNotCached
+	}
+
 	if err != nil {
 		return
 	}
+
+	item.ModTime = fromUnixNano(modTime)
+	item.ArchivedAt = fromUnixNano(archivedAt)
+	item.Copies, err = c.copies(filename)
+	return
+}
+
+// copies returns the file's copies ordered by backend name.
+func (c *SQLiteCache) copies(filename string) ([]Copy, error) {
+	rows, err := c.d.selectCopies.Query(c.archiveID, filename)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
+	var copies []Copy
 	for rows.Next() {
-		item = CacheItem{}
-		err = rows.Scan(&item.Filename)
-		return
+		var cp Copy
+		var modTime, archivedAt int64
+		if err := rows.Scan(&cp.Backend, &cp.Key, &cp.Bundle, &cp.Offset, &cp.Size, &modTime, &archivedAt, &cp.Error); err != nil {
+			return nil, err
+		}
+		cp.ModTime = fromUnixNano(modTime)
+		cp.ArchivedAt = fromUnixNano(archivedAt)
+		copies = append(copies, cp)
 	}
 
-	return
+	return copies, rows.Err()
 }
 
-func (c *SQLiteCache) Purge(filename string) (err error) {
-	stmt, err := c.db.Prepare(fmt.Sprintf("DELETE FROM `%s` WHERE filename = ?", c.archive))
+// Previews returns the file's thumbnail and preview, if they were uploaded.
+func (c *SQLiteCache) Previews(filename string) ([]Preview, error) {
+	rows, err := c.d.selectPreview.Query(c.archiveID, filename)
 	if err != nil {
-		return
+		return nil, err
+	}
+	defer rows.Close()
+
+	var previews []Preview
+	for rows.Next() {
+		var p Preview
+		if err := rows.Scan(&p.Kind, &p.Key, &p.Width, &p.Height, &p.Size); err != nil {
+			return nil, err
+		}
+		previews = append(previews, p)
 	}
+	return previews, rows.Err()
+}
 
-	_, err = stmt.Exec(filename)
-	return
+// Purge implements Cache.
+func (c *SQLiteCache) Purge(filename string) error {
+	tx, err := c.d.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(c.d.deleteCopies).Exec(c.archiveID, filename); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Stmt(c.d.deletePreview).Exec(c.archiveID, filename); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	var id int64
+	err = tx.Stmt(c.d.selectMedia).QueryRow(c.archiveID, filename).Scan(&id)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return err
+	}
+	if err == nil {
+		if _, err := tx.Stmt(c.d.deleteText).Exec(id); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Stmt(c.d.deleteMedia).Exec(id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if _, err := tx.Stmt(c.d.deleteFile).Exec(c.archiveID, filename); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Walk implements Cache. The items are read with a single query that joins
+// their copies, so fn must not call back into the cache.
+func (c *SQLiteCache) Walk(fn func(CacheItem) error) error {
+	rows, err := c.d.db.Query(`
+		SELECT f.filename, f.size, f.mod_time, f.key, f.archived_at, f.duplicate_of, f.file_group,
+			IFNULL(b.name, ''), IFNULL(c.key, ''), IFNULL(c.bundle, ''), IFNULL(c.bundle_offset, 0), IFNULL(c.size, 0), IFNULL(c.mod_time, 0), IFNULL(c.archived_at, 0), IFNULL(c.error, '')
+		FROM files f
+		LEFT JOIN copies c ON c.archive_id = f.archive_id AND c.filename = f.filename
+		LEFT JOIN backends b ON b.id = c.backend_id
+		WHERE f.archive_id = ?
+		ORDER BY f.filename, b.name`, c.archiveID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var item CacheItem
+	for rows.Next() {
+		var next CacheItem
+		var cp Copy
+		var modTime, archivedAt, copyModTime, copyArchivedAt int64
+		err := rows.Scan(&next.Filename, &next.Size, &modTime, &next.Key, &archivedAt, &next.DuplicateOf, &next.Group,
+			&cp.Backend, &cp.Key, &cp.Bundle, &cp.Offset, &cp.Size, &copyModTime, &copyArchivedAt, &cp.Error)
+		if err != nil {
+			return err
+		}
+
+		if next.Filename != item.Filename {
+			if item.Filename != "" {
+				if err := fn(item); err != nil {
+					return err
+				}
+			}
+			item = next
+			item.ModTime = fromUnixNano(modTime)
+			item.ArchivedAt = fromUnixNano(archivedAt)
+		}
+
+		if cp.Backend != "" {
+			cp.ModTime = fromUnixNano(copyModTime)
+			cp.ArchivedAt = fromUnixNano(copyArchivedAt)
+			item.Copies = append(item.Copies, cp)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if item.Filename != "" {
+		return fn(item)
+	}
+	return nil
+}
+
+// Images implements Cache.
+func (c *SQLiteCache) Images(fn func(CachedImage) error) error {
+	rows, err := c.d.db.Query(`
+		SELECT f.filename, m.hash, m.class, m.width, m.height, f.size, m.taken_at, f.duplicate_of, f.file_group,
+			f.archived_at != 0 AND (
+				EXISTS (SELECT 1 FROM copies c WHERE c.archive_id = f.archive_id AND c.filename = f.filename AND c.error = '') OR
+				NOT EXISTS (SELECT 1 FROM copies c WHERE c.archive_id = f.archive_id AND c.filename = f.filename))
+		FROM media m
+		JOIN files f ON f.archive_id = m.archive_id AND f.filename = m.filename
+		WHERE m.archive_id = ? AND m.hash != ''
+		ORDER BY f.filename`, c.archiveID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var img CachedImage
+		if err := rows.Scan(&img.Filename, &img.Hash, &img.Class, &img.Width, &img.Height, &img.Size, &img.Taken, &img.DuplicateOf, &img.Group, &img.uploaded); err != nil {
+			return err
+		}
+		if img.hash, err = parseHash(img.Hash); err != nil {
+			return fmt.Errorf("invalid perceptual hash [filename=%s] [hash=%s]", img.Filename, img.Hash)
+		}
+		if err := fn(img); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ContentMatches implements Cache.
+func (c *SQLiteCache) ContentMatches(id string) ([]string, error) {
+	rows, err := c.d.selectContent.Query(c.archiveID, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var filenames []string
+	for rows.Next() {
+		var filename string
+		if err := rows.Scan(&filename); err != nil {
+			return nil, err
+		}
+		filenames = append(filenames, filename)
+	}
+	return filenames, rows.Err()
+}
+
+// Fingerprints implements Cache.
+func (c *SQLiteCache) Fingerprints(fn func(string, Fingerprint) error) error {
+	rows, err := c.d.db.Query(`
+		SELECT f.filename, f.size, f.mod_time, IFNULL(m.taken_at, '')
+		FROM files f
+		LEFT JOIN media m ON m.archive_id = f.archive_id AND m.filename = f.filename
+		WHERE f.archive_id = ?`, c.archiveID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var filename, taken string
+		var size, modTime int64
+		if err := rows.Scan(&filename, &size, &modTime, &taken); err != nil {
+			return err
+		}
+		if err := fn(filename, newFingerprint(path.Base(filename), size, taken, fromUnixNano(modTime))); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// unixNano converts t to nanoseconds since the epoch, mapping the zero time
+// to zero.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNano is the inverse of unixNano.
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
 }
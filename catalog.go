@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultCatalogLease is how long a machine holds the catalog lock when an
+// archive doesn't configure it.
+const DefaultCatalogLease = 10 * time.Minute
+
+// DefaultCatalogKeep is the number of snapshots that are kept when an archive
+// doesn't configure it.
+const DefaultCatalogKeep = 10
+
+// catalogFormat is the version of the snapshot format, which is written in
+// each snapshot's header.
+const catalogFormat = 1
+
+// Catalog shares the state of an archive's cache between machines that
+// archive to the same backend. Snapshots of the cache are uploaded to the
+// archive's first backend under <archive>/catalog/ as gzipped JSON lines, and
+// the latest snapshot is merged into the local cache. A lock object with a
+// lease keeps two machines from writing snapshots at the same time.
+type Catalog struct {
+	archive  *Archive
+	backend  Backend
+	interval time.Duration
+	lease    time.Duration
+	keep     int
+
+	// host names the snapshots, and holder identifies this process in the
+	// lock.
+	host   string
+	holder string
+
+	// merged is the key of the last snapshot that was merged or written,
+	// and sum is the checksum of the last snapshot that was written.
+	merged string
+	sum    [sha256.Size]byte
+}
+
+// catalogHeader is the first line of a snapshot.
+type catalogHeader struct {
+	Format  int       `json:"format"`
+	Archive string    `json:"archive"`
+	Holder  string    `json:"holder"`
+	Created time.Time `json:"created"`
+}
+
+// catalogLock is the content of the lock object.
+type catalogLock struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// NewCatalog returns the Catalog of the archive configured by cfg.
+func NewCatalog(archive *Archive, cfg CatalogConfig) *Catalog {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	// Catalogs are small and a final snapshot is written on shutdown, so
+	// they aren't held up by a paused throttle.
+	backend := archive.Backends[0]
+	if t, ok := backend.(*throttledBackend); ok {
+		backend = t.Backend
+	}
+
+	return &Catalog{
+		archive:  archive,
+		backend:  backend,
+		interval: cfg.interval,
+		lease:    cfg.lease,
+		keep:     cfg.keep,
+		host:     host,
+		holder:   fmt.Sprintf("%s:%d", host, os.Getpid()),
+	}
+}
+
+func (c *Catalog) prefix() string {
+	return c.archive.Name + "/catalog/"
+}
+
+func (c *Catalog) lockKey() string {
+	return c.prefix() + "lock.json"
+}
+
+// Run snapshots the catalog at the configured interval until ctx is done.
+func (c *Catalog) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Snapshot(); err != nil {
+				log.Println("ERROR", err)
+			}
+		}
+	}
+}
+
+// snapshots returns the keys of the snapshots from oldest to newest. Snapshot
+// keys start with a UTC timestamp, so they sort by age.
+func (c *Catalog) snapshots() ([]string, error) {
+	var keys []string
+	err := c.backend.List(c.prefix(), func(o Object) error {
+		if strings.HasSuffix(o.Key, ".jsonl.gz") {
+			keys = append(keys, o.Key)
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+// latest returns the key of the newest snapshot, or an empty string if there
+// are none.
+func (c *Catalog) latest() (string, error) {
+	keys, err := c.snapshots()
+	if err != nil || len(keys) == 0 {
+		return "", err
+	}
+	return keys[len(keys)-1], nil
+}
+
+// prune deletes all but the newest keep snapshots. Failures are logged, as
+// the snapshots are deleted again after the next one is written.
+func (c *Catalog) prune() {
+	keys, err := c.snapshots()
+	if err != nil {
+		log.Println("ERROR", fmt.Errorf("cannot list catalog [archive=%s] [backend=%s]: %s", c.archive.Name, c.backend.Name(), err))
+		return
+	}
+	if c.keep <= 0 || len(keys) <= c.keep {
+		return
+	}
+
+	for _, key := range keys[:len(keys)-c.keep] {
+		if err := c.backend.Delete(key); err != nil {
+			log.Println("ERROR", fmt.Errorf("cannot delete catalog [archive=%s] [backend=%s] [key=%s]: %s", c.archive.Name, c.backend.Name(), key, err))
+			continue
+		}
+		log.Printf("catalog deleted [archive=%s] [backend=%s] [key=%s]", c.archive.Name, c.backend.Name(), key)
+	}
+}
+
+// Merge merges the newest snapshot into the local cache unless it was already
+// merged, and returns the number of files that were updated.
+func (c *Catalog) Merge() (int, error) {
+	key, err := c.latest()
+	if err != nil {
+		return 0, fmt.Errorf("cannot list catalog [archive=%s] [backend=%s]: %s", c.archive.Name, c.backend.Name(), err)
+	}
+	if key == "" || key == c.merged {
+		return 0, nil
+	}
+
+	r, err := c.backend.Get(key, 0, -1)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read catalog [archive=%s] [backend=%s] [key=%s]: %s", c.archive.Name, c.backend.Name(), key, err)
+	}
+	defer r.Close()
+
+	n, err := c.merge(r)
+	if err != nil {
+		return n, fmt.Errorf("cannot merge catalog [archive=%s] [key=%s]: %s", c.archive.Name, key, err)
+	}
+	c.merged = key
+
+	log.Printf("catalog merged [archive=%s] [key=%s] [files=%d]", c.archive.Name, key, n)
+	return n, nil
+}
+
+// merge merges the items of a snapshot. The checksum of the items is
+// recorded, so that a snapshot of an unchanged cache isn't uploaded again.
+func (c *Catalog) merge(r io.Reader) (int, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	br := bufio.NewReader(gz)
+
+	var header catalogHeader
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal(line, &header); err != nil {
+		return 0, err
+	}
+	if header.Format != catalogFormat {
+		return 0, fmt.Errorf("unsupported catalog format [format=%d]", header.Format)
+	}
+	h := sha256.New()
+	dec := json.NewDecoder(io.TeeReader(br, h))
+
+	merged := 0
+	var items []CacheItem
+	for {
+		var remote CacheItem
+		if err := dec.Decode(&remote); err == io.EOF {
+			break
+		} else if err != nil {
+			return merged, err
+		}
+
+		local, err := c.archive.Cache.Get(remote.Filename)
+		if err != nil && err != ErrNotCached {
+			return merged, err
+		}
+
+		item, changed := mergeItem(local, remote)
+		if !changed {
+			continue
+		}
+		if items = append(items, item); len(items) >= cacheFlushSize {
+			if err := c.archive.Cache.SetMany(items); err != nil {
+				return merged, err
+			}
+			merged += len(items)
+			items = items[:0]
+		}
+	}
+
+	if len(items) > 0 {
+		if err := c.archive.Cache.SetMany(items); err != nil {
+			return merged, err
+		}
+		merged += len(items)
+	}
+
+	copy(c.sum[:], h.Sum(nil))
+	return merged, nil
+}
+
+// mergeItem merges a file's state from another machine into the local state.
+// The file's version is taken from whichever archived it last, and each copy
+// from whichever uploaded it last, preferring successful uploads. Only the
+// copies taken from remote are returned, so that the cache leaves the others
+// as they are. Items whose filename isn't a valid relative path are left out.
+func mergeItem(local, remote CacheItem) (CacheItem, bool) {
+	if err := checkFilename(remote.Filename); err != nil {
+		log.Println("WARNING catalog item not merged:", err)
+		return local, false
+	}
+
+	item := local
+	item.Copies = nil
+	changed := false
+	if local.Filename == "" || remote.ArchivedAt.After(local.ArchivedAt) {
+		item.Filename = remote.Filename
+		item.Size = remote.Size
+		item.ModTime = remote.ModTime
+		item.Key = remote.Key
+		item.ArchivedAt = remote.ArchivedAt
+		item.DuplicateOf = remote.DuplicateOf
+		item.Group = remote.Group
+		changed = true
+	}
+
+	// Groups are recorded on files that were archived before their
+	// companions without archiving them again.
+	if item.Group == "" && remote.Group != "" {
+		item.Group = remote.Group
+		changed = true
+	}
+
+	for _, rc := range remote.Copies {
+		lc, ok := local.Copy(rc.Backend)
+		newer := rc.ArchivedAt.After(lc.ArchivedAt) && (rc.Error == "" || lc.Error != "")
+		if !ok || (rc.Error == "" && lc.Error != "") || newer {
+			item.SetCopy(rc)
+			changed = true
+		}
+	}
+
+	return item, changed
+}
+
+// Snapshot merges the newest snapshot, then uploads a snapshot of the local
+// cache if it has changed since the last one. It does nothing if another
+// machine holds the lock.
+func (c *Catalog) Snapshot() error {
+	ok, err := c.lock()
+	if err != nil {
+		return fmt.Errorf("cannot lock catalog [archive=%s] [backend=%s]: %s", c.archive.Name, c.backend.Name(), err)
+	}
+	if !ok {
+		log.Printf("catalog locked by another machine, skipping snapshot [archive=%s]", c.archive.Name)
+		return nil
+	}
+	defer c.unlock()
+
+	if _, err := c.Merge(); err != nil {
+		return err
+	}
+
+	// The snapshot is gzipped to a temporary file as it is written, so the
+	// cache is never held in memory.
+	f, err := ioutil.TempFile("", "media-archive-catalog-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	zw := gzip.NewWriter(f)
+	sum, err := c.write(zw)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write catalog [archive=%s]: %s", c.archive.Name, err)
+	}
+
+	// The header's timestamp changes every time, so compare the items.
+	if sum == c.sum {
+		return nil
+	}
+
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	key := path.Join(c.prefix(), fmt.Sprintf("%s-%s.jsonl.gz", now.UTC().Format("20060102T150405Z"), c.host))
+
+	opts := PutOptions{StorageClass: catalogStorageClass(c.archive.StorageClassOf(c.backend)), ModTime: now}
+	if err := c.backend.Put(key, f, size, opts); err != nil {
+		return fmt.Errorf("cannot upload catalog [archive=%s] [backend=%s] [key=%s]: %s", c.archive.Name, c.backend.Name(), key, err)
+	}
+	c.merged = key
+	c.sum = sum
+
+	log.Printf("catalog uploaded [archive=%s] [backend=%s] [key=%s] [bytes=%d]", c.archive.Name, c.backend.Name(), key, size)
+	c.prune()
+	return nil
+}
+
+// write writes the header and the cache items as JSON lines, and returns the
+// checksum of the items.
+func (c *Catalog) write(w io.Writer) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	bw := bufio.NewWriter(w)
+
+	header := catalogHeader{
+		Format:  catalogFormat,
+		Archive: c.archive.Name,
+		Holder:  c.holder,
+		Created: time.Now().UTC(),
+	}
+	if err := json.NewEncoder(bw).Encode(header); err != nil {
+		return sum, err
+	}
+
+	h := sha256.New()
+	enc := json.NewEncoder(io.MultiWriter(bw, h))
+	if err := c.archive.Cache.Walk(func(item CacheItem) error {
+		return enc.Encode(item)
+	}); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, bw.Flush()
+}
+
+// lock takes the lease on the catalog, unless another machine holds a lease
+// that hasn't expired. Backends don't support conditional writes, so the lock
+// is read back after it is written to detect a concurrent writer.
+func (c *Catalog) lock() (bool, error) {
+	current, err := c.readLock()
+	if err != nil {
+		return false, err
+	}
+	if current.Holder != "" && current.Holder != c.holder && time.Now().Before(current.Expires) {
+		return false, nil
+	}
+
+	if err := c.writeLock(catalogLock{Holder: c.holder, Expires: time.Now().Add(c.lease)}); err != nil {
+		return false, err
+	}
+
+	current, err = c.readLock()
+	if err != nil {
+		return false, err
+	}
+	return current.Holder == c.holder, nil
+}
+
+// unlock releases the lease by writing an expired lock.
+func (c *Catalog) unlock() {
+	if err := c.writeLock(catalogLock{Holder: c.holder}); err != nil {
+		log.Println("ERROR", fmt.Errorf("cannot unlock catalog [archive=%s]: %s", c.archive.Name, err))
+	}
+}
+
+// readLock returns the current lock, which is empty if there is none.
+func (c *Catalog) readLock() (catalogLock, error) {
+	var lock catalogLock
+	exists := false
+	err := c.backend.List(c.lockKey(), func(o Object) error {
+		exists = exists || o.Key == c.lockKey()
+		return nil
+	})
+	if err != nil || !exists {
+		return lock, err
+	}
+
+	r, err := c.backend.Get(c.lockKey(), 0, -1)
+	if err != nil {
+		return lock, err
+	}
+	defer r.Close()
+
+	err = json.NewDecoder(r).Decode(&lock)
+	return lock, err
+}
+
+func (c *Catalog) writeLock(lock catalogLock) error {
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	opts := PutOptions{StorageClass: catalogStorageClass(c.archive.StorageClassOf(c.backend)), ModTime: time.Now()}
+	return c.backend.Put(c.lockKey(), bytes.NewReader(data), int64(len(data)), opts)
+}
+
+// catalogStorageClass returns the storage class of catalog objects, which are
+// read often, so cold storage classes are replaced by STANDARD.
+func catalogStorageClass(class string) string {
+	switch strings.ToUpper(class) {
+	case "GLACIER", "GLACIER_IR", "DEEP_ARCHIVE", "ARCHIVE", "COLDLINE", "COLD":
+		return "STANDARD"
+	default:
+		return class
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// testSnapshot returns a gzipped snapshot of the archive without any items.
+func testSnapshot(t *testing.T, archive string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(catalogHeader{Format: catalogFormat, Archive: archive}); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCatalogSnapshot(t *testing.T) {
+	backend := newMemBackend("mem")
+	old := []string{
+		"photos/catalog/20190101T000000Z-a.jsonl.gz",
+		"photos/catalog/20190102T000000Z-b.jsonl.gz",
+		"photos/catalog/20190103T000000Z-a.jsonl.gz",
+	}
+	for _, key := range old {
+		backend.objects[key] = testSnapshot(t, "photos")
+	}
+
+	cfg := CatalogConfig{Keep: 2}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	a := testArchive(t, ArchiveConfig{Name: "photos", StorageClass: "DEEP_ARCHIVE"}, backend)
+	item := CacheItem{
+		Filename:   "2019/07/IMG_0001.JPG",
+		Size:       4,
+		ModTime:    time.Date(2019, 7, 14, 10, 0, 0, 0, time.UTC),
+		Key:        "photos/2019/07/IMG_0001.JPG",
+		ArchivedAt: time.Date(2019, 7, 15, 10, 0, 0, 0, time.UTC),
+		Copies:     []Copy{{Backend: "mem", Key: "photos/2019/07/IMG_0001.JPG", Size: 4}},
+	}
+	if err := a.Cache.Set(item); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCatalog(a, cfg)
+	if err := c.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots, err := c.snapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 || snapshots[0] != old[2] || snapshots[1] != c.merged {
+		t.Fatalf("snapshots = %q, want %s and the new snapshot", snapshots, old[2])
+	}
+
+	// Catalog objects are read on every run, so they aren't stored in the
+	// archive's cold storage class.
+	for _, key := range []string{c.merged, c.lockKey()} {
+		if class := backend.classes[key]; class != "STANDARD" {
+			t.Errorf("storage class of %s = %q, want STANDARD", key, class)
+		}
+	}
+
+	// An unchanged cache isn't uploaded again.
+	merged := c.merged
+	if err := c.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if c.merged != merged {
+		t.Errorf("unchanged cache uploaded as %s", c.merged)
+	}
+
+	other := testArchive(t, ArchiveConfig{Name: "photos"}, backend)
+	n, err := NewCatalog(other, cfg).Merge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := other.Cache.Get(item.Filename)
+	if n != 1 || err != nil || got.Key != item.Key || got.Size != item.Size {
+		t.Errorf("Merge() = %d, cached %+v, %v, want %+v", n, got, err, item)
+	}
+}
@@ -0,0 +1,881 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// ImportCloudCmd handles the "import cloud" command.
+var ImportCloudCmd = &cobra.Command{
+	Use:   "cloud EXPORT...",
+	Short: "Imports Google Takeout archives and iCloud Photos exports",
+	Long: `Archives the photos and videos in the exports of cloud photo services: Google
+Takeout archives, as .zip or .tgz files or extracted, and iCloud Photos exports.
+Pass all parts of a multi-part export at once, since the metadata of a file may
+be in another part than the file itself.
+
+Each file is matched with what the export knows about it: the capture time,
+location, description and albums in Takeout's JSON files, and the creation time
+and albums in iCloud's CSV files. The file's own metadata takes precedence, the
+export only fills in what the file lacks. Files that Takeout includes once per
+album are archived once, with all of their albums as tags.
+
+The files are extracted to --staging-dir and their modification times, which
+exports lose, are set to their capture times. They are then archived under the
+path they would have been copied to by import, e.g.
+2019/2019-07-14/IMG_0001.JPG, so key templates that use the modification time
+date them correctly. Files are extracted and archived in batches of about 1 GiB,
+and each batch is removed from the staging directory before the next one is
+extracted.
+
+Files that are already in the catalog are skipped, so an interrupted import can
+be run again. A file whose path is taken by another file is renamed like
+IMG_0001(1).JPG.
+
+With --dry-run nothing is extracted or uploaded. The planned action for each
+file is decided from the export's metadata and the start of the file, and
+printed as a table or as one JSON object per line with --json.`,
+	Run: RunImportCloudCmd,
+}
+
+// CloudMetadata is what a cloud export knows about one of its files.
+type CloudMetadata struct {
+
+	// Taken is when the file was captured, which is zero if it is unknown.
+	Taken time.Time
+
+	// Location is where the file was captured, if it is known.
+	Location *Location
+
+	// Description is the caption that the file was given.
+	Description string
+
+	// Albums are the titles of the albums that the file belongs to.
+	Albums []string
+
+	// Deleted is set for files that iCloud lists as recently deleted.
+	Deleted bool
+}
+
+// Apply adds the metadata to the metadata read from the file. The capture
+// time and location only fill in what the file lacks, and the albums become
+// tags.
+func (md *CloudMetadata) Apply(m *Media) {
+	if m.Taken.IsZero() {
+		m.Taken = md.Taken
+	}
+	if m.Location == nil {
+		m.Location = md.Location
+	}
+	if md.Description != "" {
+		m.Description = md.Description
+	}
+	for _, album := range md.Albums {
+		if !containsString(m.Tags, album) {
+			m.Tags = append(m.Tags, album)
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// exportFile is a regular file in a cloud export.
+type exportFile struct {
+
+	// Name is the file's slash separated path in the export.
+	Name    string
+	Size    int64
+	ModTime time.Time
+
+	open func() (io.ReadCloser, error)
+}
+
+// walkExport calls fn for each regular file in the export, which is a
+// directory, a zip file or a gzipped tar file. Files can only be opened
+// during the call. Hidden files, such as the ones macOS adds to zip files,
+// are left out.
+func walkExport(export string, fn func(exportFile) error) error {
+	info, err := os.Stat(export)
+	if err != nil {
+		return err
+	}
+
+	visit := func(f exportFile) error {
+		if strings.HasPrefix(path.Base(f.Name), ".") || strings.HasPrefix(f.Name, "__MACOSX/") {
+			return nil
+		}
+		return fn(f)
+	}
+
+	lower := strings.ToLower(export)
+	switch {
+	case info.IsDir():
+		return filepath.Walk(export, func(p string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(export, p)
+			if err != nil {
+				return err
+			}
+			return visit(exportFile{
+				Name:    filepath.ToSlash(rel),
+				Size:    info.Size(),
+				ModTime: info.ModTime(),
+				open:    func() (io.ReadCloser, error) { return os.Open(p) },
+			})
+		})
+
+	case strings.HasSuffix(lower, ".zip"):
+		r, err := zip.OpenReader(export)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			if !f.FileInfo().Mode().IsRegular() {
+				continue
+			}
+			err := visit(exportFile{
+				Name:    f.Name,
+				Size:    int64(f.UncompressedSize64),
+				ModTime: f.Modified,
+				open:    f.Open,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case strings.HasSuffix(lower, ".tgz") || strings.HasSuffix(lower, ".tar.gz"):
+		f, err := os.Open(export)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+
+		tr := tar.NewReader(gz)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if !h.FileInfo().Mode().IsRegular() {
+				continue
+			}
+			err = visit(exportFile{
+				Name:    strings.TrimPrefix(h.Name, "./"),
+				Size:    h.Size,
+				ModTime: h.ModTime,
+				open:    func() (io.ReadCloser, error) { return ioutil.NopCloser(tr), nil },
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return fmt.Errorf("unsupported export, expected a directory, .zip or .tgz file [export=%s]", export)
+}
+
+// takeoutJSON is the metadata file that Google Takeout writes for each media
+// file, e.g. IMG_0001.JPG.json, and for each album, metadata.json.
+type takeoutJSON struct {
+	Title          string `json:"title"`
+	Description    string `json:"description"`
+	PhotoTakenTime struct {
+		Timestamp string `json:"timestamp"`
+	} `json:"photoTakenTime"`
+	GeoData     takeoutGeo `json:"geoData"`
+	GeoDataExif takeoutGeo `json:"geoDataExif"`
+}
+
+type takeoutGeo struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// location returns the position, which Takeout sets to zero if it is unknown.
+func (g takeoutGeo) location() *Location {
+	if g.Latitude == 0 && g.Longitude == 0 {
+		return nil
+	}
+	return &Location{Latitude: g.Latitude, Longitude: g.Longitude}
+}
+
+// metadata returns the media file's metadata. The location that was set in
+// Google Photos takes precedence over the one that it read from the file.
+func (j takeoutJSON) metadata() *CloudMetadata {
+	md := &CloudMetadata{Description: strings.TrimSpace(j.Description)}
+	if ts, err := strconv.ParseInt(j.PhotoTakenTime.Timestamp, 10, 64); err == nil && ts > 0 {
+		md.Taken = time.Unix(ts, 0)
+	}
+	if md.Location = j.GeoData.location(); md.Location == nil {
+		md.Location = j.GeoDataExif.location()
+	}
+	return md
+}
+
+// takeoutEntry is the metadata of a media file in a Takeout folder. Its stem
+// is the name of the JSON file without the extensions that Takeout adds,
+// which is the media file's name, possibly truncated, and the counter is the
+// number that Takeout appends to names that occur more than once in a folder.
+type takeoutEntry struct {
+	stem     string
+	counter  string
+	title    string
+	metadata *CloudMetadata
+}
+
+// takeoutCounter matches the counter that Takeout appends to names that
+// occur more than once in a folder, e.g. IMG_0001(1).JPG, whose JSON file is
+// IMG_0001.JPG(1).json.
+var takeoutCounter = regexp.MustCompile(`\((\d+)\)$`)
+
+// splitCounter splits the counter off a name without its extension.
+func splitCounter(name string) (string, string) {
+	if m := takeoutCounter.FindStringSubmatchIndex(name); m != nil {
+		return name[:m[0]], name[m[2]:m[3]]
+	}
+	return name, ""
+}
+
+// takeoutYearFolder matches the folders that Takeout groups the files that
+// aren't in an album into.
+var takeoutYearFolder = regexp.MustCompile(`^Photos from \d{4}$`)
+
+// icloudTimeLayouts are the formats of the dates in iCloud's CSV files, e.g.
+// "Sunday July 14,2019 10:11 AM GMT".
+var icloudTimeLayouts = []string{
+	"Monday January 2,2006 3:04 PM MST",
+	"Monday January 2, 2006 3:04 PM MST",
+}
+
+// cloudMedia is a media file in a cloud export.
+type cloudMedia struct {
+	export string
+	file   exportFile
+}
+
+// CloudIndex holds the metadata and the media files found in cloud exports.
+// Takeout's metadata is looked up by folder, since the folders are the same
+// in each part of an export, and iCloud's by file name.
+type CloudIndex struct {
+	takeout      map[string][]takeoutEntry
+	albums       map[string]string
+	details      map[string]*CloudMetadata
+	icloudAlbums map[string][]string
+	media        []cloudMedia
+}
+
+// NewCloudIndex returns an empty CloudIndex.
+func NewCloudIndex() *CloudIndex {
+	return &CloudIndex{
+		takeout:      make(map[string][]takeoutEntry),
+		albums:       make(map[string]string),
+		details:      make(map[string]*CloudMetadata),
+		icloudAlbums: make(map[string][]string),
+	}
+}
+
+// Read adds the metadata and the media files of the export to the index.
+// Metadata that can't be parsed is logged and left out.
+func (x *CloudIndex) Read(export string) error {
+	return walkExport(export, func(f exportFile) error {
+		dir, base := path.Dir(f.Name), path.Base(f.Name)
+		ext := strings.ToLower(path.Ext(base))
+
+		var err error
+		switch {
+		case mediaClass(base) != ClassOther:
+			x.media = append(x.media, cloudMedia{export: export, file: f})
+		case ext == ".json":
+			err = x.readTakeoutJSON(f, dir, base)
+		case ext == ".csv" && strings.HasPrefix(base, "Photo Details"):
+			err = x.readFile(f, x.readDetails)
+		case ext == ".csv" && path.Base(dir) == "Albums":
+			album := strings.TrimSuffix(base, path.Ext(base))
+			err = x.readFile(f, func(r io.Reader) error { return x.readAlbum(album, r) })
+		}
+		if err != nil {
+			log.Printf("WARNING cannot read metadata [export=%s] [file=%s]: %s", export, f.Name, err)
+		}
+		return nil
+	})
+}
+
+func (x *CloudIndex) readFile(f exportFile, fn func(io.Reader) error) error {
+	r, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return fn(r)
+}
+
+func (x *CloudIndex) readTakeoutJSON(f exportFile, dir, base string) error {
+	var j takeoutJSON
+	err := x.readFile(f, func(r io.Reader) error {
+		return json.NewDecoder(r).Decode(&j)
+	})
+	if err != nil {
+		return err
+	}
+
+	if base == "metadata.json" {
+		if j.Title != "" && !takeoutYearFolder.MatchString(j.Title) {
+			x.albums[dir] = j.Title
+		}
+		return nil
+	}
+	if j.Title == "" && j.PhotoTakenTime.Timestamp == "" {
+		return nil
+	}
+
+	// IMG_0001.JPG.supplemental-metadata(1).json and its truncations.
+	stem, counter := splitCounter(strings.TrimSuffix(base, path.Ext(base)))
+	if i := strings.LastIndex(stem, "."); i >= 0 && i < len(stem)-1 && strings.HasPrefix("supplemental-metadata", strings.ToLower(stem[i+1:])) {
+		stem = stem[:i]
+	}
+	x.takeout[dir] = append(x.takeout[dir], takeoutEntry{stem: stem, counter: counter, title: j.Title, metadata: j.metadata()})
+	return nil
+}
+
+// readDetails reads one of iCloud's "Photo Details.csv" files.
+func (x *CloudIndex) readDetails(r io.Reader) error {
+	rows, err := readCSV(r)
+	if err != nil || len(rows) == 0 {
+		return err
+	}
+
+	cols := make(map[string]int)
+	for i, name := range rows[0] {
+		cols[name] = i
+	}
+	nameCol, ok := cols["imgName"]
+	if !ok {
+		return errors.New("imgName column not found")
+	}
+	field := func(row []string, name string) string {
+		if i, ok := cols[name]; ok && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+
+	for _, row := range rows[1:] {
+		if nameCol >= len(row) {
+			continue
+		}
+		md := &CloudMetadata{Deleted: strings.EqualFold(field(row, "deleted"), "yes")}
+		for _, layout := range icloudTimeLayouts {
+			if t, err := time.Parse(layout, field(row, "originalCreationDate")); err == nil {
+				md.Taken = t.Local()
+				break
+			}
+		}
+		x.details[strings.ToLower(row[nameCol])] = md
+	}
+	return nil
+}
+
+// readAlbum reads one of the CSV files that list the files in iCloud albums.
+func (x *CloudIndex) readAlbum(album string, r io.Reader) error {
+	rows, err := readCSV(r)
+	if err != nil {
+		return err
+	}
+	for i, row := range rows {
+		if i == 0 || len(row) == 0 || row[0] == "" {
+			continue
+		}
+		x.icloudAlbums[strings.ToLower(row[0])] = append(x.icloudAlbums[strings.ToLower(row[0])], album)
+	}
+	return nil
+}
+
+func readCSV(r io.Reader) ([][]string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	rows, err := cr.ReadAll()
+	if len(rows) > 0 && len(rows[0]) > 0 {
+		rows[0][0] = strings.TrimPrefix(rows[0][0], "\ufeff")
+	}
+	return rows, err
+}
+
+// Lookup returns what the exports know about the media file, which is nil
+// if they don't know anything.
+func (x *CloudIndex) Lookup(name string) *CloudMetadata {
+	dir, base := path.Dir(name), path.Base(name)
+
+	// IMG_0001(1).JPG and IMG_0001-edited.JPG share the JSON file of
+	// IMG_0001.JPG, which is titled IMG_0001.JPG, or of the first
+	// IMG_0001.JPG if there are several.
+	ext := path.Ext(base)
+	stem, counter := splitCounter(strings.TrimSuffix(base, ext))
+	stem = strings.TrimSuffix(stem, "-edited")
+	orig := stem + ext
+
+	var md *CloudMetadata
+	best := 0
+	for _, e := range x.takeout[dir] {
+		if e.counter != counter {
+			continue
+		}
+		score := 0
+		switch {
+		case e.title == orig:
+			score = 4
+		case e.stem == orig:
+			score = 3
+		case e.stem == stem:
+			score = 2
+		case len(e.stem) >= 40 && strings.HasPrefix(orig, e.stem):
+			score = 1
+		}
+		if score > best {
+			copied := *e.metadata
+			md, best = &copied, score
+		}
+	}
+
+	if md == nil {
+		if details, ok := x.details[strings.ToLower(base)]; ok {
+			copied := *details
+			md = &copied
+		}
+	}
+
+	var albums []string
+	if album, ok := x.albums[dir]; ok {
+		albums = append(albums, album)
+	}
+	albums = append(albums, x.icloudAlbums[strings.ToLower(base)]...)
+	if len(albums) > 0 {
+		if md == nil {
+			md = &CloudMetadata{}
+		}
+		md.Albums = albums
+	}
+	return md
+}
+
+// cloudCopy identifies the copies of a file that Takeout includes in each of
+// its albums' folders.
+type cloudCopy struct {
+	name  string
+	size  int64
+	taken int64
+}
+
+// cloudFile is a media file that is imported from a cloud export.
+type cloudFile struct {
+	file     exportFile
+	metadata *CloudMetadata
+}
+
+// CloudImport imports the media files of a CloudIndex's exports.
+type CloudImport struct {
+	Importer *Importer
+
+	// Staging is the directory that the exports' files are extracted to.
+	Staging string
+
+	files   map[string]map[string]*cloudFile
+	skipped map[string][]ImportFile
+	planned map[string]bool
+}
+
+// NewCloudImport returns a CloudImport of the media files in the index. The
+// files that the exports contain more than once, in the folder of each of
+// their albums, are only imported once, with all of the albums.
+func NewCloudImport(im *Importer, index *CloudIndex, staging string) *CloudImport {
+	c := &CloudImport{
+		Importer: im,
+		Staging:  staging,
+		files:    make(map[string]map[string]*cloudFile),
+		skipped:  make(map[string][]ImportFile),
+		planned:  make(map[string]bool),
+	}
+
+	first := make(map[cloudCopy]*cloudFile)
+	names := make(map[cloudCopy]string)
+	for _, m := range index.media {
+		md := index.Lookup(m.file.Name)
+		key := cloudCopy{name: strings.ToLower(path.Base(m.file.Name)), size: m.file.Size}
+		if md != nil {
+			key.taken = md.Taken.Unix()
+		}
+
+		if f, ok := first[key]; ok {
+			if md != nil && f.metadata != nil {
+				for _, album := range md.Albums {
+					if !containsString(f.metadata.Albums, album) {
+						f.metadata.Albums = append(f.metadata.Albums, album)
+					}
+				}
+			}
+			c.skip(m.export, m.file, "copy of "+names[key])
+			continue
+		}
+		if md != nil && md.Deleted {
+			c.skip(m.export, m.file, "deleted")
+			continue
+		}
+
+		f := &cloudFile{file: m.file, metadata: md}
+		first[key], names[key] = f, m.file.Name
+		if c.files[m.export] == nil {
+			c.files[m.export] = make(map[string]*cloudFile)
+		}
+		c.files[m.export][m.file.Name] = f
+	}
+	return c
+}
+
+func (c *CloudImport) skip(export string, f exportFile, reason string) {
+	c.skipped[export] = append(c.skipped[export], ImportFile{
+		Action: ImportSkip,
+		Source: exportSource(export, f.Name),
+		Size:   f.Size,
+		Reason: reason,
+	})
+}
+
+// exportSource names a file in an export, e.g.
+// takeout-001.zip/Takeout/Google Photos/Photos from 2019/IMG_0001.JPG.
+func exportSource(export, name string) string {
+	return filepath.ToSlash(filepath.Clean(export)) + "/" + name
+}
+
+// exportHeadSize is how much of each file is read to plan its import. Images
+// record their capture time and camera at the start, and the export's
+// metadata fills in what videos record at the end.
+const exportHeadSize = 256 << 10
+
+// stagingBatchSize is how many bytes of an export are extracted to the staging
+// directory before they are archived and removed.
+const stagingBatchSize = 1 << 30
+
+// Plan decides what importing each of the export's media files entails from
+// the export's metadata and the start of each file, without extracting them.
+// The number of files that couldn't be read is returned as well, which are
+// logged and left out.
+func (c *CloudImport) Plan(ctx context.Context, export string) ([]ImportFile, int, error) {
+	failed := 0
+	files := append([]ImportFile(nil), c.skipped[export]...)
+	err := walkExport(export, func(f exportFile) error {
+		cf, ok := c.files[export][f.Name]
+		if !ok {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		file, err := c.plan(export, f, cf.metadata)
+		if err != nil {
+			log.Println("ERROR", err)
+			failed++
+			return nil
+		}
+		files = append(files, file)
+		return nil
+	})
+	return files, failed, err
+}
+
+// plan decides where the file is archived, and dates it with its capture
+// time. Files that are in the catalog are skipped. The path of another file
+// is avoided by adding a counter to the name.
+func (c *CloudImport) plan(export string, f exportFile, md *CloudMetadata) (ImportFile, error) {
+	file := ImportFile{
+		Action:   ImportArchive,
+		Source:   exportSource(export, f.Name),
+		Size:     f.Size,
+		Reason:   "new",
+		metadata: md,
+		member:   f.Name,
+	}
+
+	r, err := f.open()
+	if err != nil {
+		return file, fmt.Errorf("%s [source=%s]", err, file.Source)
+	}
+	head, err := ioutil.ReadAll(io.LimitReader(r, exportHeadSize))
+	r.Close()
+	if err != nil {
+		return file, fmt.Errorf("%s [source=%s]", err, file.Source)
+	}
+	m := ExtractMedia(bytes.NewReader(head), int64(len(head)), f.Name)
+	if md != nil {
+		md.Apply(m)
+	}
+
+	file.modTime = f.ModTime
+	var captured string
+	if !m.Taken.IsZero() {
+		file.modTime = m.Taken
+		captured = m.Taken.Format(takenLayout)
+	}
+
+	name := path.Base(f.Name)
+	if filename, ok := c.Importer.fingerprints[newFingerprint(name, f.Size, captured, file.modTime)]; ok {
+		file.Action, file.Filename, file.Reason = ImportSkip, filename, "in catalog"
+		return file, nil
+	}
+
+	data := ImportFolderData{Taken: file.modTime, Camera: m.Camera(), Card: filepath.Base(export)}
+	if md != nil && len(md.Albums) > 0 {
+		data.Album = md.Albums[0]
+	}
+
+	ext := path.Ext(name)
+	for n := 0; file.Filename == ""; n++ {
+		candidate := name
+		if n > 0 {
+			candidate = fmt.Sprintf("%s(%d)%s", strings.TrimSuffix(name, ext), n, ext)
+		}
+		_, filename, err := c.Importer.destination(data, candidate)
+		if err != nil {
+			return file, fmt.Errorf("%s [source=%s]", err, file.Source)
+		}
+		if c.planned[filename] {
+			continue
+		}
+
+		item, err := c.Importer.Archive.Cache.Get(filename)
+		if err == ErrNotCached {
+			file.Filename = filename
+		} else if err != nil {
+			return file, err
+		} else if item.Size == f.Size && item.ModTime.Equal(file.modTime) {
+			file.Action, file.Filename, file.Reason = ImportSkip, filename, "in catalog"
+			return file, nil
+		}
+	}
+
+	c.planned[file.Filename] = true
+	return file, nil
+}
+
+// Archive extracts the files planned to be archived to a directory under the
+// staging directory, and archives them in batches of about stagingBatchSize
+// bytes, removing each batch before the next one is extracted. It returns the
+// number of files that failed.
+func (c *CloudImport) Archive(ctx context.Context, export string, files []ImportFile) (int, error) {
+	planned := make(map[string]ImportFile)
+	for _, f := range files {
+		if f.Action == ImportArchive {
+			planned[f.member] = f
+		}
+	}
+	if len(planned) == 0 {
+		return 0, nil
+	}
+
+	dir, err := ioutil.TempDir(c.Staging, filepath.Base(export)+".")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	failed := 0
+	var batch []ImportFile
+	var size int64
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		n, err := archiveImported(ctx, c.Importer, batch)
+		failed += n
+		for _, f := range batch {
+			os.Remove(f.Path)
+		}
+		batch, size = nil, 0
+		return err
+	}
+
+	err = walkExport(export, func(f exportFile) error {
+		file, ok := planned[f.Name]
+		if !ok {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := stage(dir, f, &file); err != nil {
+			log.Println("ERROR", err)
+			failed++
+			return nil
+		}
+		batch = append(batch, file)
+		if size += f.Size; size >= stagingBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	return failed, err
+}
+
+// stage extracts the file to dir, under its relative path in the archive, and
+// sets its modification time to the time that it was planned with.
+func stage(dir string, f exportFile, file *ImportFile) error {
+	file.Path = filepath.Join(dir, filepath.FromSlash(file.Filename))
+	file.local = file.Path
+	if err := os.MkdirAll(filepath.Dir(file.Path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file.Path), ".import-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	r, err := f.open()
+	if err == nil {
+		_, err = io.Copy(tmp, r)
+		r.Close()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("%s [source=%s]", err, file.Source)
+	}
+
+	if err := os.Rename(tmp.Name(), file.Path); err != nil {
+		return err
+	}
+	return os.Chtimes(file.Path, file.modTime, file.modTime)
+}
+
+// RunImportCloudCmd is the work function for ImportCloudCmd.
+func RunImportCloudCmd(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		panic(errors.New("export is required"))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	EventListener(cancel)
+
+	dryRun := viper.GetBool("dry-run")
+	im, catalog, db := openImporter(true, dryRun)
+	defer db.Close()
+
+	index := NewCloudIndex()
+	for _, export := range args {
+		if err := index.Read(export); err != nil {
+			panic(err)
+		}
+	}
+
+	// Dry runs only read the exports, so nothing is staged.
+	var staging string
+	if !dryRun {
+		var err error
+		if staging, err = ioutil.TempDir(viper.GetString("staging-dir"), "media-archive-import-"); err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(staging)
+	}
+
+	c := NewCloudImport(im, index, staging)
+	failed := 0
+	for _, export := range args {
+		n, err := importExport(ctx, c, export, dryRun)
+		if err != nil {
+			log.Println("ERROR", err)
+			n++
+		}
+		failed += n
+	}
+
+	if catalog != nil {
+		if err := catalog.Snapshot(); err != nil {
+			log.Println("ERROR", err)
+		}
+	}
+
+	if failed > 0 {
+		os.RemoveAll(staging)
+		os.Exit(1)
+	}
+}
+
+// importExport imports the media files of a single export and returns the
+// number of files that failed.
+func importExport(ctx context.Context, c *CloudImport, export string, dryRun bool) (int, error) {
+	files, failed, err := c.Plan(ctx, export)
+	if err != nil {
+		return failed, err
+	}
+
+	if dryRun {
+		return failed, printImportPlan(os.Stdout, files, viper.GetBool("json"))
+	}
+
+	counts := make(map[string]int)
+	for _, f := range files {
+		counts[f.Action]++
+	}
+	n, err := c.Archive(ctx, export, files)
+	failed += n
+	if err != nil {
+		return failed, err
+	}
+
+	log.Printf("export imported [export=%s] [archived=%d] [skipped=%d] [errors=%d]", export, counts[ImportArchive], counts[ImportSkip], failed)
+	return failed, nil
+}
+
+// InitImportCloudCmdConfig adds configuration options specific to
+// ImportCloudCmd.
+func InitImportCloudCmdConfig(cmd *cobra.Command) {
+
+	cmd.Flags().String("staging-dir", "", "The directory that the exports' files are extracted to, defaults to the system's temporary directory.")
+	viper.BindPFlag("staging-dir", cmd.Flags().Lookup("staging-dir"))
+	viper.SetDefault("staging-dir", "")
+}
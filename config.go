@@ -0,0 +1,544 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// DefaultKeyTemplate is the key template used when an archive doesn't define
+// one. It mirrors the layout of the root directory under the archive name.
+const DefaultKeyTemplate = "{{.Archive}}/{{.Path}}"
+
+// Config is the configuration file's top-level structure.
+type Config struct {
+	Archives []ArchiveConfig `mapstructure:"archives"`
+
+	// Bandwidth limits the combined upload bandwidth of all backends.
+	Bandwidth BandwidthConfig `mapstructure:"bandwidth"`
+}
+
+// ArchiveConfig defines a named archive.
+type ArchiveConfig struct {
+
+	// Name uniquely identifies the archive, e.g. my-photos.
+	Name string `mapstructure:"name"`
+
+	// Roots are the directories that media files are contained under.
+	Roots []RootConfig `mapstructure:"roots"`
+
+	// Backends are the storage backends that media files are archived to.
+	Backends []BackendConfig `mapstructure:"backends"`
+
+	// Include and Exclude are glob patterns matched against the path of a
+	// file relative to its root, see Filter for the syntax.
+	Include []string `mapstructure:"include"`
+	Exclude []string `mapstructure:"exclude"`
+
+	// KeyTemplate is a text/template that renders the key a file is stored
+	// under, see KeyData for the available fields.
+	KeyTemplate string `mapstructure:"key-template"`
+
+	// StorageClass is the storage class files are archived with. Backends
+	// may override it.
+	StorageClass string `mapstructure:"storage-class"`
+
+	// BundleThreshold enables bundling, i.e. files smaller than it are packed
+	// into tar objects of about BundleSize bytes instead of being uploaded
+	// individually, which saves per-request and per-object costs.
+	BundleThreshold int64 `mapstructure:"bundle-threshold"`
+	BundleSize      int64 `mapstructure:"bundle-size"`
+
+	// Catalog shares the archive's cache with other machines through its
+	// first backend.
+	Catalog CatalogConfig `mapstructure:"catalog"`
+
+	// Previews uploads thumbnails and previews of images next to the
+	// originals, so that the archive can be browsed without restoring them.
+	Previews PreviewConfig `mapstructure:"previews"`
+
+	// Duplicates configures how near-duplicate images are found, see
+	// DuplicatesCmd.
+	Duplicates DuplicatesConfig `mapstructure:"duplicates"`
+}
+
+// Defaults of PreviewConfig.
+const (
+	DefaultPreviewStorageClass = "STANDARD"
+	DefaultThumbnailSize       = 256
+	DefaultPreviewSize         = 1280
+)
+
+// PreviewConfig configures the thumbnails and previews of an archive's
+// images, which are JPEGs stored under the archive's previews/ prefix.
+type PreviewConfig struct {
+
+	// Enabled turns previews on.
+	Enabled bool `mapstructure:"enabled"`
+
+	// StorageClass is the storage class of previews, which should be one
+	// that can be read right away. It defaults to STANDARD.
+	StorageClass string `mapstructure:"storage-class"`
+
+	// ThumbnailSize and PreviewSize are the sizes in pixels of the square
+	// that thumbnails and previews fit in.
+	ThumbnailSize int `mapstructure:"thumbnail-size"`
+	PreviewSize   int `mapstructure:"preview-size"`
+}
+
+// Validate sets the defaults and checks the sizes.
+func (c *PreviewConfig) Validate() error {
+	if c.StorageClass == "" {
+		c.StorageClass = DefaultPreviewStorageClass
+	}
+	if c.ThumbnailSize == 0 {
+		c.ThumbnailSize = DefaultThumbnailSize
+	}
+	if c.PreviewSize == 0 {
+		c.PreviewSize = DefaultPreviewSize
+	}
+	if c.ThumbnailSize < 16 || c.PreviewSize > 4096 || c.ThumbnailSize > c.PreviewSize {
+		return fmt.Errorf("invalid preview sizes, expected 16 <= thumbnail-size <= preview-size <= 4096 [thumbnail-size=%d] [preview-size=%d]", c.ThumbnailSize, c.PreviewSize)
+	}
+	return nil
+}
+
+// DefaultDuplicateDistance is the largest distance between the perceptual
+// hashes of images that are considered duplicates when an archive doesn't
+// set one.
+const DefaultDuplicateDistance = 6
+
+// DuplicatesConfig configures how an archive's near-duplicate images are
+// found and handled.
+type DuplicatesConfig struct {
+
+	// Distance is the largest number of bits, out of 64, that the
+	// perceptual hashes of duplicates may differ in.
+	Distance int `mapstructure:"distance"`
+
+	// SkipUploads doesn't upload new images that are no better than an
+	// archived image within Distance, see Archive.duplicateOf. They are
+	// cached as duplicates of that image instead.
+	SkipUploads bool `mapstructure:"skip-uploads"`
+}
+
+// Validate sets the default distance and checks it.
+func (c *DuplicatesConfig) Validate() error {
+	if c.Distance == 0 {
+		c.Distance = DefaultDuplicateDistance
+	}
+	if c.Distance < 1 || c.Distance > 32 {
+		return fmt.Errorf("invalid duplicate distance, expected 1 to 32 [distance=%d]", c.Distance)
+	}
+	return nil
+}
+
+// CatalogConfig configures the catalog snapshots of an archive, see Catalog.
+type CatalogConfig struct {
+
+	// Interval is how often a snapshot is uploaded, e.g. 1h. Sharing the
+	// catalog is disabled if it isn't set.
+	Interval string `mapstructure:"interval"`
+
+	// Lease is how long a machine holds the lock while it writes a snapshot,
+	// which defaults to DefaultCatalogLease.
+	Lease string `mapstructure:"lease"`
+
+	// Keep is the number of snapshots that are kept, which defaults to
+	// DefaultCatalogKeep. Older snapshots are deleted after each upload.
+	Keep int `mapstructure:"keep"`
+
+	// interval and lease are parsed by Validate.
+	interval time.Duration
+	lease    time.Duration
+	keep     int
+}
+
+// Validate parses the durations.
+func (c *CatalogConfig) Validate() error {
+	var err error
+	if c.Interval != "" {
+		if c.interval, err = time.ParseDuration(c.Interval); err != nil || c.interval <= 0 {
+			return fmt.Errorf("invalid catalog interval [interval=%s]", c.Interval)
+		}
+	}
+
+	c.lease = DefaultCatalogLease
+	if c.Lease != "" {
+		if c.lease, err = time.ParseDuration(c.Lease); err != nil || c.lease <= 0 {
+			return fmt.Errorf("invalid catalog lease [lease=%s]", c.Lease)
+		}
+	}
+
+	c.keep = DefaultCatalogKeep
+	if c.Keep < 0 {
+		return fmt.Errorf("invalid number of catalog snapshots to keep [keep=%d]", c.Keep)
+	} else if c.Keep > 0 {
+		c.keep = c.Keep
+	}
+	return nil
+}
+
+// Enabled reports whether the catalog is shared.
+func (c CatalogConfig) Enabled() bool {
+	return c.interval > 0
+}
+
+// RootConfig defines a directory that media files are contained under.
+type RootConfig struct {
+
+	// Path is the directory on the local filesystem.
+	Path string `mapstructure:"path"`
+
+	// Prefix is prepended to the paths of the files under this root, so that
+	// files with the same relative path in different roots don't collide.
+	// It defaults to the directory's base name for archives with more than
+	// one root.
+	Prefix string `mapstructure:"prefix"`
+}
+
+// BackendConfig configures a storage backend.
+type BackendConfig struct {
+
+	// Type is the kind of backend, e.g. s3.
+	Type string `mapstructure:"type"`
+
+	// Bucket is the S3 or Cloud Storage bucket that files are stored in.
+	Bucket string `mapstructure:"bucket"`
+
+	// StorageClass overrides the archive's storage class for this backend.
+	// Previews and catalog objects keep their own classes.
+	StorageClass string `mapstructure:"storage-class"`
+
+	// Endpoint is the URL of an S3-compatible service, e.g. MinIO or Wasabi.
+	// It defaults to AWS. For gcs and azure backends it is the URL of the
+	// service or an emulator such as fake-gcs-server or Azurite.
+	Endpoint string `mapstructure:"endpoint"`
+
+	// Region is the bucket's region. It defaults to the region set in the
+	// environment, or us-east-1 when Endpoint is set.
+	Region string `mapstructure:"region"`
+
+	// PathStyle addresses buckets as https://endpoint/bucket instead of
+	// https://bucket.endpoint, which most self-hosted services require.
+	PathStyle bool `mapstructure:"path-style"`
+
+	// CABundle is a PEM file containing certificates that are trusted in
+	// addition to the system's, e.g. a self-signed MinIO certificate.
+	CABundle string `mapstructure:"ca-bundle"`
+
+	// DisableSSL connects to Endpoint over plain HTTP.
+	DisableSSL bool `mapstructure:"disable-ssl"`
+
+	// Credentials configures the AWS credentials used by the backend.
+	Credentials CredentialsConfig `mapstructure:"credentials"`
+
+	// Host is the remote host of an sftp backend, optionally with a port.
+	Host string `mapstructure:"host"`
+
+	// User is the user that logs in to Host.
+	User string `mapstructure:"user"`
+
+	// Path is the remote directory that files are stored under.
+	Path string `mapstructure:"path"`
+
+	// KeyFile is the private key used to log in to Host. The SSH agent is
+	// used if it isn't set. KeyPassphraseFile contains the key's passphrase
+	// if it is encrypted.
+	KeyFile           string `mapstructure:"key-file"`
+	KeyPassphraseFile string `mapstructure:"key-passphrase-file"`
+
+	// KnownHosts is the known_hosts file that Host's key is verified against.
+	// It defaults to ~/.ssh/known_hosts.
+	KnownHosts string `mapstructure:"known-hosts"`
+
+	// Connections is the maximum number of concurrent connections.
+	Connections int `mapstructure:"connections"`
+
+	// URL is the WebDAV collection that files are stored under, e.g.
+	// https://cloud.example.com/remote.php/dav/files/me/Archive.
+	URL string `mapstructure:"url"`
+
+	// UploadsURL enables Nextcloud chunked uploads for files larger than
+	// ChunkSize, e.g. https://cloud.example.com/remote.php/dav/uploads/me.
+	UploadsURL string `mapstructure:"uploads-url"`
+
+	// ChunkSize is the size of the pieces large files are uploaded in by
+	// webdav, gcs and azure backends.
+	ChunkSize int64 `mapstructure:"chunk-size"`
+
+	// PasswordFile contains the password used to authenticate User with
+	// basic auth. TokenFile contains a bearer token, and takes precedence.
+	PasswordFile string `mapstructure:"password-file"`
+	TokenFile    string `mapstructure:"token-file"`
+
+	// Bandwidth limits the upload bandwidth of this backend, in addition to
+	// the global limit.
+	Bandwidth BandwidthConfig `mapstructure:"bandwidth"`
+
+	// CredentialsFile is a Google service account key file. Application
+	// default credentials are used if it isn't set.
+	CredentialsFile string `mapstructure:"credentials-file"`
+
+	// Account and Container are the Azure storage account and the container
+	// that files are stored in. AccountKeyFile contains the account's shared
+	// key, otherwise Azure AD credentials are read from the environment.
+	Account        string `mapstructure:"account"`
+	Container      string `mapstructure:"container"`
+	AccountKeyFile string `mapstructure:"account-key-file"`
+}
+
+// LoadConfig reads the configuration file set via --config, or searches the
+// XDG config directories for media-archive/config.{yaml,toml,...}. If no file
+// is found, a single archive is configured from the command line flags and
+// MEDIA_ARCHIVE_* environment variables.
+func LoadConfig() (*Config, error) {
+	if file := viper.GetString("config"); file != "" {
+		viper.SetConfigFile(file)
+	} else {
+		viper.SetConfigName("config")
+		for _, dir := range configDirs() {
+			viper.AddConfigPath(filepath.Join(dir, "media-archive"))
+		}
+	}
+
+	cfg := &Config{}
+	err := viper.ReadInConfig()
+	if _, ok := err.(viper.ConfigFileNotFoundError); ok && viper.GetString("config") == "" {
+		cfg.Archives = []ArchiveConfig{flagArchiveConfig()}
+	} else if err != nil {
+		return nil, err
+	} else if err := viper.UnmarshalKey("archives", &cfg.Archives); err != nil {
+		return nil, err
+	} else if err := viper.UnmarshalKey("bandwidth", &cfg.Bandwidth); err != nil {
+		return nil, err
+	}
+
+	if limit := viper.GetString("bandwidth-limit"); limit != "" {
+		cfg.Bandwidth.Limit = limit
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Validate checks that the configuration is complete and applies defaults.
+func (c *Config) Validate() error {
+	if len(c.Archives) == 0 {
+		return errors.New("no archives configured")
+	}
+	if err := c.Bandwidth.Validate(); err != nil {
+		return fmt.Errorf("%s [bandwidth=global]", err)
+	}
+
+	names := make(map[string]bool)
+	for i := range c.Archives {
+		a := &c.Archives[i]
+		if a.Name == "" {
+			return fmt.Errorf("archive name is required [index=%d]", i)
+		}
+		if names[a.Name] {
+			return fmt.Errorf("duplicate archive name [archive=%s]", a.Name)
+		}
+		names[a.Name] = true
+
+		if len(a.Roots) == 0 {
+			return fmt.Errorf("archive has no roots [archive=%s]", a.Name)
+		}
+		if err := validateRoots(a.Roots); err != nil {
+			return fmt.Errorf("%s [archive=%s]", err, a.Name)
+		}
+		if len(a.Backends) == 0 {
+			return fmt.Errorf("archive has no backends [archive=%s]", a.Name)
+		}
+		for j := range a.Backends {
+			if err := a.Backends[j].Validate(); err != nil {
+				return fmt.Errorf("%s [archive=%s]", err, a.Name)
+			}
+			if err := a.Backends[j].Bandwidth.Validate(); err != nil {
+				return fmt.Errorf("%s [archive=%s] [backend=%s]", err, a.Name, a.Backends[j].Type)
+			}
+		}
+
+		if a.KeyTemplate == "" {
+			a.KeyTemplate = DefaultKeyTemplate
+		}
+		if a.StorageClass == "" {
+			a.StorageClass = DefaultStorageClass
+		}
+		if a.BundleThreshold > 0 && a.BundleSize <= 0 {
+			a.BundleSize = DefaultBundleSize
+		}
+		if a.BundleThreshold > a.BundleSize {
+			return fmt.Errorf("bundle-threshold must not exceed bundle-size [archive=%s]", a.Name)
+		}
+		if err := a.Catalog.Validate(); err != nil {
+			return fmt.Errorf("%s [archive=%s]", err, a.Name)
+		}
+		if err := a.Previews.Validate(); err != nil {
+			return fmt.Errorf("%s [archive=%s]", err, a.Name)
+		}
+		if err := a.Duplicates.Validate(); err != nil {
+			return fmt.Errorf("%s [archive=%s]", err, a.Name)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks that the backend's required settings are present.
+func (b *BackendConfig) Validate() error {
+	switch b.Type {
+	case BackendS3:
+		if b.Bucket == "" {
+			return fmt.Errorf("bucket is required [backend=%s]", b.Type)
+		}
+		if err := b.Credentials.Validate(); err != nil {
+			return fmt.Errorf("%s [backend=%s]", err, b.Type)
+		}
+	case BackendSFTP:
+		if b.Host == "" || b.User == "" {
+			return fmt.Errorf("host and user are required [backend=%s]", b.Type)
+		}
+		if b.Path == "" {
+			b.Path = "."
+		}
+		if b.KnownHosts == "" {
+			b.KnownHosts = defaultKnownHosts()
+		}
+		if b.Connections < 1 {
+			b.Connections = DefaultSFTPConnections
+		}
+	case BackendWebDAV:
+		if b.URL == "" {
+			return fmt.Errorf("url is required [backend=%s]", b.Type)
+		}
+		if b.User != "" && b.PasswordFile == "" && b.TokenFile == "" {
+			return fmt.Errorf("password-file is required with user [backend=%s]", b.Type)
+		}
+		if b.ChunkSize <= 0 {
+			b.ChunkSize = DefaultWebDAVChunkSize
+		}
+	case BackendGCS:
+		if b.Bucket == "" {
+			return fmt.Errorf("bucket is required [backend=%s]", b.Type)
+		}
+		if b.ChunkSize <= 0 {
+			b.ChunkSize = DefaultGCSChunkSize
+		}
+	case BackendAzure:
+		if b.Container == "" {
+			return fmt.Errorf("container is required [backend=%s]", b.Type)
+		}
+		if b.Account == "" && b.Endpoint == "" {
+			return fmt.Errorf("account or endpoint is required [backend=%s]", b.Type)
+		}
+		if b.AccountKeyFile != "" && b.Account == "" {
+			return fmt.Errorf("account is required with account-key-file [backend=%s]", b.Type)
+		}
+		if b.ChunkSize <= 0 {
+			b.ChunkSize = DefaultAzureBlockSize
+		}
+	default:
+		return fmt.Errorf("invalid backend type [backend=%s]", b.Type)
+	}
+	return nil
+}
+
+// validateRoots cleans the roots' paths and prefixes, and ensures that no two
+// roots overlap on disk or map to the same prefix.
+func validateRoots(roots []RootConfig) error {
+	for i := range roots {
+		r := &roots[i]
+		if r.Path == "" {
+			return fmt.Errorf("root path is required [index=%d]", i)
+		}
+
+		path, err := filepath.Abs(r.Path)
+		if err != nil {
+			return err
+		}
+		r.Path = path
+
+		r.Prefix = strings.Trim(filepath.ToSlash(filepath.Clean("/"+r.Prefix)), "/")
+		if r.Prefix == "" && len(roots) > 1 {
+			r.Prefix = filepath.Base(r.Path)
+		}
+	}
+
+	for i, a := range roots {
+		for _, b := range roots[i+1:] {
+			if nestedPath(a.Path, b.Path, string(filepath.Separator)) {
+				return fmt.Errorf("roots overlap [root=%s] [root=%s]", a.Path, b.Path)
+			}
+			if a.Prefix == b.Prefix || nestedPath(a.Prefix, b.Prefix, "/") {
+				return fmt.Errorf("root prefixes collide, set a unique prefix [root=%s] [root=%s]", a.Path, b.Path)
+			}
+		}
+	}
+
+	return nil
+}
+
+// nestedPath reports whether a and b are the same path or one is an ancestor
+// of the other.
+func nestedPath(a, b, sep string) bool {
+	if a == b {
+		return true
+	}
+	return strings.HasPrefix(a, strings.TrimSuffix(b, sep)+sep) || strings.HasPrefix(b, strings.TrimSuffix(a, sep)+sep)
+}
+
+// Archive returns the named archive's configuration.
+func (c *Config) Archive(name string) (ArchiveConfig, error) {
+	for _, a := range c.Archives {
+		if a.Name == name {
+			return a, nil
+		}
+	}
+	return ArchiveConfig{}, fmt.Errorf("archive not found [archive=%s]", name)
+}
+
+// flagArchiveConfig returns the archive configured by the command line flags.
+func flagArchiveConfig() ArchiveConfig {
+	return ArchiveConfig{
+		Name:  viper.GetString("archive-name"),
+		Roots: []RootConfig{{Path: viper.GetString("root-dir")}},
+		Backends: []BackendConfig{{
+			Type:   BackendS3,
+			Bucket: viper.GetString("aws-bucket"),
+		}},
+	}
+}
+
+// configDirs returns the XDG base directories that are searched for the
+// configuration file, in order of preference.
+func configDirs() []string {
+	var dirs []string
+
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		dirs = append(dirs, dir)
+	} else if home := os.Getenv("HOME"); home != "" {
+		dirs = append(dirs, filepath.Join(home, ".config"))
+	}
+
+	xdgDirs := os.Getenv("XDG_CONFIG_DIRS")
+	if xdgDirs == "" {
+		xdgDirs = "/etc/xdg"
+	}
+	for _, dir := range strings.Split(xdgDirs, ":") {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	return dirs
+}
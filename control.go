@@ -0,0 +1,560 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// ControlOff disables the control API when it is passed to --control.
+const ControlOff = "off"
+
+// controlSocket is the name of the control API's socket in the cache
+// directory.
+const controlSocket = "control.sock"
+
+// controlToken is the name of the file in the cache directory that holds the
+// token required by the control API when it listens on a TCP address.
+const controlToken = "control.token"
+
+// Control is the state of the running daemon that the control API acts on.
+// The API is served over a Unix socket in the cache directory, or a loopback
+// TCP address that requires the token written to controlToken. The web UI
+// requires the same token.
+type Control struct {
+	cancel   context.CancelFunc
+	started  time.Time
+	throttle *Throttle
+	progress *Progress
+
+	mu       sync.Mutex
+	archives []controlArchive
+	token    string
+}
+
+// controlArchive is an archive and the watcher that feeds it.
+type controlArchive struct {
+	archive *Archive
+	watcher *MediaWatcher
+}
+
+// ControlStatus is the response of GET /v1/status.
+type ControlStatus struct {
+	Started     time.Time      `json:"started"`
+	Archives    []string       `json:"archives"`
+	Paused      bool           `json:"paused"`
+	Limit       string         `json:"limit"`
+	Override    bool           `json:"override"`
+	TotalFiles  int64          `json:"total_files"`
+	TotalBytes  int64          `json:"total_bytes"`
+	DoneFiles   int64          `json:"done_files"`
+	DoneBytes   int64          `json:"done_bytes"`
+	FailedFiles int64          `json:"failed_files"`
+	Workers     map[int]string `json:"workers"`
+}
+
+// ControlQueue is the response of GET /v1/queue.
+type ControlQueue struct {
+	Active []string `json:"active"`
+	Queued []string `json:"queued"`
+}
+
+// ControlFailure is a copy whose last upload failed, as listed by
+// GET /v1/failures.
+type ControlFailure struct {
+	Archive    string    `json:"archive"`
+	Filename   string    `json:"filename"`
+	Backend    string    `json:"backend"`
+	Error      string    `json:"error"`
+	ArchivedAt time.Time `json:"archived_at"`
+}
+
+// controlResult is the response of the actions, and of failed requests.
+type controlResult struct {
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// NewControl returns a Control that shuts the daemon down by calling cancel.
+func NewControl(cancel context.CancelFunc) *Control {
+	return &Control{cancel: cancel, started: time.Now()}
+}
+
+// register adds an archive and its watcher. A nil Control ignores it.
+func (c *Control) register(archive *Archive, watcher *MediaWatcher) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.archives = append(c.archives, controlArchive{archive: archive, watcher: watcher})
+	c.mu.Unlock()
+}
+
+// ControlAddress returns the network and address of the control API set with
+// --control, which defaults to a Unix socket in the cache directory. TCP
+// addresses must be on the loopback interface.
+func ControlAddress() (string, string, error) {
+	addr := viper.GetString("control")
+	switch {
+	case addr == "":
+		dir, err := CacheDir()
+		if err != nil {
+			return "", "", err
+		}
+		return "unix", filepath.Join(dir, controlSocket), nil
+	case strings.HasPrefix(addr, "unix:"):
+		return "unix", strings.TrimPrefix(addr, "unix:"), nil
+	case strings.ContainsRune(addr, filepath.Separator):
+		return "unix", addr, nil
+	}
+
+	if !isLoopback(addr) {
+		return "", "", fmt.Errorf("control address must be a loopback host:port or a socket [address=%s]", addr)
+	}
+	return "tcp", addr, nil
+}
+
+// isLoopback reports whether addr is a host:port on the loopback interface.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// localOnly serves only requests addressed to addr, the loopback address a
+// handler listens on, so that pages of other sites can't reach it through DNS
+// rebinding or cross-site requests. The Host must be addr or a loopback name
+// with the same port, and so must the Origin if the request has one.
+func localOnly(h http.Handler, addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+	local := func(hostport string) bool {
+		host, p, err := net.SplitHostPort(hostport)
+		if err != nil || p != port {
+			return false
+		}
+		host = strings.ToLower(host)
+		ip := net.ParseIP(host)
+		return hostport == addr || host == "localhost" || (ip != nil && ip.IsLoopback())
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !local(r.Host) {
+			http.Error(w, "invalid host", http.StatusForbidden)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" {
+			u, err := url.Parse(origin)
+			if err != nil || !local(u.Host) {
+				http.Error(w, "cross-origin requests are not allowed", http.StatusForbidden)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Serve serves the control API until ctx is done. A stale socket left by a
+// daemon that didn't shut down cleanly is replaced, unless a daemon is still
+// listening on it. Other files at the socket path are never removed.
+func (c *Control) Serve(ctx context.Context, network, addr string) error {
+	if network == "unix" {
+		if conn, err := net.Dial(network, addr); err == nil {
+			conn.Close()
+			return fmt.Errorf("control socket in use, is another daemon running? [socket=%s]", addr)
+		}
+		if info, err := os.Lstat(addr); err == nil {
+			if info.Mode()&os.ModeSocket == 0 {
+				return fmt.Errorf("control socket path exists and isn't a socket [socket=%s]", addr)
+			}
+			os.Remove(addr)
+		}
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	if network == "unix" {
+		defer os.Remove(addr)
+		if err := os.Chmod(addr, 0600); err != nil {
+			l.Close()
+			return err
+		}
+	}
+
+	handler := c.Handler()
+	if network != "unix" {
+		token, err := c.Token()
+		if err != nil {
+			l.Close()
+			return err
+		}
+		handler = localOnly(withToken(handler, token), l.Addr().String())
+	}
+
+	srv := &http.Server{Handler: handler}
+	go func() {
+		<-ctx.Done()
+
+		// Let a shutdown request receive its response.
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("control API listening [network=%s] [address=%s]", network, addr)
+	if err := srv.Serve(l); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// controlTokenPath returns the path of the control API's token file.
+func controlTokenPath() (string, error) {
+	dir, err := CacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, controlToken), nil
+}
+
+// writeControlToken writes a new random token to the token file, which only
+// the user can read, and returns it.
+func writeControlToken() (string, error) {
+	path, err := controlTokenPath()
+	if err != nil {
+		return "", err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	// Replace the file so a token left readable by others isn't reused.
+	os.Remove(path)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", fmt.Errorf("cannot write the control token [filepath=%s]: %s", path, err)
+	}
+	if _, err := f.WriteString(token); err != nil {
+		f.Close()
+		return "", err
+	}
+	return token, f.Close()
+}
+
+// Token returns the token required by the control API on a TCP address and
+// by the web UI. It is written to the token file on the first call.
+func (c *Control) Token() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" {
+		return c.token, nil
+	}
+	token, err := writeControlToken()
+	if err != nil {
+		return "", err
+	}
+	c.token = token
+	return token, nil
+}
+
+// RemoveToken removes the token file if the daemon wrote one.
+func (c *Control) RemoveToken() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token == "" {
+		return
+	}
+	if path, err := controlTokenPath(); err == nil {
+		os.Remove(path)
+	}
+	c.token = ""
+}
+
+// readControlToken returns the token written by the running daemon.
+func readControlToken() (string, error) {
+	path, err := controlTokenPath()
+	if err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read the control token, is the daemon running? [filepath=%s]: %s", path, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// withToken serves only requests that carry the token as a bearer token.
+func withToken(h http.Handler, token string) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(controlResult{Error: "invalid or missing control token"})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Handler returns the HTTP handler of the control API.
+func (c *Control) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", onGet(c.status))
+	mux.HandleFunc("/v1/queue", onGet(c.queue))
+	mux.HandleFunc("/v1/failures", onGet(c.failures))
+	mux.HandleFunc("/v1/pause", onPost(c.pause))
+	mux.HandleFunc("/v1/resume", onPost(c.resume))
+	mux.HandleFunc("/v1/bandwidth", onPost(c.bandwidth))
+	mux.HandleFunc("/v1/reload", onPost(c.reload))
+	mux.HandleFunc("/v1/rescan", onPost(c.rescan))
+	mux.HandleFunc("/v1/retry", onPost(c.retry))
+	mux.HandleFunc("/v1/shutdown", onPost(c.shutdown))
+	return mux
+}
+
+// controlHandler returns the response body of a request, or an error that is
+// sent with the status code.
+type controlHandler func(r *http.Request) (interface{}, int, error)
+
+func onGet(h controlHandler) http.HandlerFunc {
+	return controlRoute(http.MethodGet, h)
+}
+
+func onPost(h controlHandler) http.HandlerFunc {
+	return controlRoute(http.MethodPost, h)
+}
+
+func controlRoute(method string, h controlHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var body interface{}
+		code := http.StatusMethodNotAllowed
+		err := fmt.Errorf("method not allowed [method=%s]", r.Method)
+		if r.Method == method {
+			body, code, err = h(r)
+		}
+		if err != nil {
+			body = controlResult{Error: err.Error()}
+		}
+
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(body)
+	}
+}
+
+func controlMessage(format string, args ...interface{}) (interface{}, int, error) {
+	return controlResult{Message: fmt.Sprintf(format, args...)}, http.StatusOK, nil
+}
+
+func (c *Control) status(r *http.Request) (interface{}, int, error) {
+	s := c.progress.Snapshot()
+	limit, override := c.throttle.Limit()
+	status := ControlStatus{
+		Started:     c.started,
+		Archives:    []string{},
+		Paused:      c.throttle.Paused(),
+		Limit:       limit,
+		Override:    override,
+		TotalFiles:  s.TotalFiles,
+		TotalBytes:  s.TotalBytes,
+		DoneFiles:   s.DoneFiles,
+		DoneBytes:   s.DoneBytes,
+		FailedFiles: s.FailedFiles,
+		Workers:     s.Workers,
+	}
+	for _, a := range c.registered() {
+		status.Archives = append(status.Archives, a.archive.Name)
+	}
+	return status, http.StatusOK, nil
+}
+
+func (c *Control) queue(r *http.Request) (interface{}, int, error) {
+	s := c.progress.Snapshot()
+	active := make(map[string]bool)
+	queue := ControlQueue{Active: []string{}, Queued: []string{}}
+	for _, path := range s.Workers {
+		active[path] = true
+		queue.Active = append(queue.Active, path)
+	}
+	sort.Strings(queue.Active)
+
+	for _, path := range c.progress.Queue() {
+		if !active[path] {
+			queue.Queued = append(queue.Queued, path)
+		}
+	}
+	return queue, http.StatusOK, nil
+}
+
+func (c *Control) failures(r *http.Request) (interface{}, int, error) {
+	failures, err := c.failed(r.FormValue("archive"), "")
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return failures, http.StatusOK, nil
+}
+
+// failed returns the failed copies in the named archive, or in all archives,
+// optionally only those of a single file.
+func (c *Control) failed(archive, filename string) ([]ControlFailure, error) {
+	failures := []ControlFailure{}
+	for _, a := range c.registered() {
+		if archive != "" && a.archive.Name != archive {
+			continue
+		}
+		err := a.archive.Cache.Walk(func(item CacheItem) error {
+			if filename != "" && item.Filename != filename {
+				return nil
+			}
+			for _, cp := range item.Copies {
+				if cp.Error != "" {
+					failures = append(failures, ControlFailure{
+						Archive:    a.archive.Name,
+						Filename:   item.Filename,
+						Backend:    cp.Backend,
+						Error:      cp.Error,
+						ArchivedAt: cp.ArchivedAt,
+					})
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return failures, nil
+}
+
+func (c *Control) pause(r *http.Request) (interface{}, int, error) {
+	if err := c.throttle.Override(BandwidthPause); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return controlMessage("uploads paused")
+}
+
+func (c *Control) resume(r *http.Request) (interface{}, int, error) {
+	c.throttle.Resume()
+	limit, _ := c.throttle.Limit()
+	return controlMessage("bandwidth schedule resumed, the limit is %s", limit)
+}
+
+func (c *Control) bandwidth(r *http.Request) (interface{}, int, error) {
+	limit := r.FormValue("limit")
+	if limit == "" {
+		return nil, http.StatusBadRequest, errors.New("limit is required")
+	}
+	if err := c.throttle.Override(limit); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	limit, _ = c.throttle.Limit()
+	return controlMessage("bandwidth limit overridden, the limit is %s", limit)
+}
+
+func (c *Control) reload(r *http.Request) (interface{}, int, error) {
+	cfg, err := reloadBandwidth()
+	if err == nil {
+		err = c.throttle.Reload(cfg)
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("cannot reload bandwidth schedule: %s", err)
+	}
+	return controlMessage("bandwidth schedule reloaded")
+}
+
+func (c *Control) rescan(r *http.Request) (interface{}, int, error) {
+	path := r.FormValue("path")
+	if !filepath.IsAbs(path) {
+		return nil, http.StatusBadRequest, fmt.Errorf("path must be absolute [path=%s]", path)
+	}
+
+	var archives []string
+	for _, a := range c.registered() {
+		if !a.watcher.Contains(path) {
+			continue
+		}
+		if err := a.watcher.Rescan(path); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		archives = append(archives, a.archive.Name)
+	}
+	if len(archives) == 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("path isn't under the roots of any archive [path=%s]", path)
+	}
+
+	log.Printf("rescan requested [path=%s] [archives=%s]", path, strings.Join(archives, ","))
+	return controlMessage("rescanning %s [archives=%s]", path, strings.Join(archives, ","))
+}
+
+// retry sends the files with failed copies to their archive again, which
+// uploads them to the backends that don't have a current copy.
+func (c *Control) retry(r *http.Request) (interface{}, int, error) {
+	archive, filename := r.FormValue("archive"), r.FormValue("file")
+	failures, err := c.failed(archive, filename)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	retried := make(map[string]bool)
+	for _, f := range failures {
+		id := f.Archive + "\n" + f.Filename
+		if retried[id] {
+			continue
+		}
+		for _, a := range c.registered() {
+			if a.archive.Name != f.Archive {
+				continue
+			}
+			path, ok := a.watcher.LocalPath(f.Filename)
+			if !ok {
+				continue
+			}
+			if err := a.watcher.Rescan(path); err != nil {
+				log.Println("ERROR", fmt.Errorf("cannot retry file [archive=%s] [filename=%s]: %s", f.Archive, f.Filename, err))
+				continue
+			}
+			retried[id] = true
+		}
+	}
+
+	log.Printf("retry requested [files=%d]", len(retried))
+	return controlMessage("retrying %d files", len(retried))
+}
+
+func (c *Control) shutdown(r *http.Request) (interface{}, int, error) {
+	log.Printf("shutdown requested through the control API")
+	c.cancel()
+	return controlMessage("shutting down")
+}
+
+func (c *Control) registered() []controlArchive {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]controlArchive(nil), c.archives...)
+}
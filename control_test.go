@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLocalOnly(t *testing.T) {
+	h := localOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "127.0.0.1:8080")
+
+	tests := []struct {
+		host   string
+		origin string
+		code   int
+	}{
+		{"127.0.0.1:8080", "", http.StatusOK},
+		{"localhost:8080", "http://localhost:8080", http.StatusOK},
+		{"[::1]:8080", "", http.StatusOK},
+		{"evil.example:8080", "", http.StatusForbidden},
+		{"127.0.0.1:9090", "", http.StatusForbidden},
+		{"127.0.0.1", "", http.StatusForbidden},
+		{"127.0.0.1:8080", "http://evil.example", http.StatusForbidden},
+		{"127.0.0.1:8080", "null", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Host = tt.host
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("host %q origin %q: status %d, want %d", tt.host, tt.origin, w.Code, tt.code)
+		}
+	}
+}
+
+func TestWithToken(t *testing.T) {
+	h := withToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "secret")
+
+	for header, code := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/v1/shutdown", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != code {
+			t.Errorf("Authorization %q: status %d, want %d", header, w.Code, code)
+		}
+	}
+}
+
+func TestWithUIToken(t *testing.T) {
+	h := withUIToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "secret")
+
+	tests := []struct {
+		url    string
+		header string
+		cookie string
+		code   int
+	}{
+		{"/", "", "", http.StatusUnauthorized},
+		{"/", "", "wrong", http.StatusUnauthorized},
+		{"/", "", "secret", http.StatusOK},
+		{"/api/archives", "Bearer secret", "", http.StatusOK},
+		{"/api/archives", "Bearer wrong", "", http.StatusUnauthorized},
+		{"/?token=wrong", "", "", http.StatusUnauthorized},
+		{"/?token=secret", "", "", http.StatusSeeOther},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: uiTokenCookie, Value: tt.cookie})
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s Authorization %q cookie %q: status %d, want %d", tt.url, tt.header, tt.cookie, w.Code, tt.code)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/thumbnail?token=secret&size=64", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if loc := w.Header().Get("Location"); loc != "/thumbnail?size=64" {
+		t.Errorf("redirected to %q, want /thumbnail?size=64", loc)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != "secret" || !cookies[0].HttpOnly {
+		t.Errorf("cookies %v, want an HttpOnly token cookie", cookies)
+	}
+}
+
+func TestServeStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewControl(cancel)
+
+	// A file that isn't a socket is left alone.
+	file := filepath.Join(dir, "file.sock")
+	if err := ioutil.WriteFile(file, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Serve(ctx, "unix", file); err == nil {
+		t.Error("expected an error serving on a regular file")
+	}
+	if b, err := ioutil.ReadFile(file); err != nil || string(b) != "data" {
+		t.Errorf("file was modified: %q %v", b, err)
+	}
+
+	// A socket nobody listens on is replaced.
+	sock := filepath.Join(dir, "stale.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	served := make(chan error, 1)
+	go func() { served <- c.Serve(ctx, "unix", sock) }()
+	for i := 0; ; i++ {
+		conn, err := net.Dial("unix", sock)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatalf("control API not listening on the stale socket: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-served; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Credential sources that can be set in CredentialsConfig.Source.
+const (
+	CredentialsDefault     = "default"
+	CredentialsProfile     = "profile"
+	CredentialsStatic      = "static"
+	CredentialsAssumeRole  = "assume-role"
+	CredentialsWebIdentity = "web-identity"
+)
+
+// CredentialsConfig configures where a backend's AWS credentials come from.
+type CredentialsConfig struct {
+
+	// Source is one of the Credentials* constants. It defaults to the SDK's
+	// default credential chain, i.e. environment variables, the shared
+	// credentials file and the instance role.
+	Source string `mapstructure:"source"`
+
+	// Profile is a named profile in the shared config and credentials files.
+	// It is required by the profile source, and is used as the base
+	// credentials for the assume-role source if set.
+	Profile string `mapstructure:"profile"`
+
+	// KeysFile contains the static access key ID, secret access key and
+	// optional session token as "aws_access_key_id = ..." lines, which is
+	// the shared credentials file format without the profile header.
+	// "AWS_ACCESS_KEY_ID=..." lines are also accepted.
+	KeysFile string `mapstructure:"keys-file"`
+
+	// RoleARN is the role assumed by the assume-role and web-identity
+	// sources.
+	RoleARN string `mapstructure:"role-arn"`
+
+	// ExternalID is passed when assuming RoleARN.
+	ExternalID string `mapstructure:"external-id"`
+
+	// SessionName identifies the role session in CloudTrail. It defaults to
+	// media-archive.
+	SessionName string `mapstructure:"session-name"`
+
+	// TokenFile contains the OIDC token for the web-identity source. It is
+	// re-read whenever the credentials are refreshed.
+	TokenFile string `mapstructure:"token-file"`
+}
+
+// Validate checks that the settings required by the source are present.
+func (c *CredentialsConfig) Validate() error {
+	switch c.Source {
+	case "", CredentialsDefault:
+		c.Source = CredentialsDefault
+	case CredentialsProfile:
+		if c.Profile == "" {
+			return fmt.Errorf("profile is required [credentials=%s]", c.Source)
+		}
+	case CredentialsStatic:
+		if c.KeysFile == "" {
+			return fmt.Errorf("keys-file is required [credentials=%s]", c.Source)
+		}
+	case CredentialsAssumeRole:
+		if c.RoleARN == "" {
+			return fmt.Errorf("role-arn is required [credentials=%s]", c.Source)
+		}
+	case CredentialsWebIdentity:
+		// Fall back to the variables set by EKS and other OIDC providers.
+		if c.RoleARN == "" {
+			c.RoleARN = os.Getenv("AWS_ROLE_ARN")
+		}
+		if c.TokenFile == "" {
+			c.TokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+		}
+		if c.RoleARN == "" || c.TokenFile == "" {
+			return fmt.Errorf("role-arn and token-file are required [credentials=%s]", c.Source)
+		}
+	default:
+		return fmt.Errorf("invalid credentials source [credentials=%s]", c.Source)
+	}
+
+	if c.SessionName == "" {
+		c.SessionName = "media-archive"
+	}
+
+	return nil
+}
+
+// awsSession returns a session whose credentials are configured by cfg. The
+// returned session is not configured with an endpoint, so it can be used for
+// STS as well as S3.
+func awsSession(cfg CredentialsConfig, region string) (*session.Session, error) {
+	opts := session.Options{}
+	if region != "" {
+		opts.Config.WithRegion(region)
+	}
+	if cfg.Profile != "" {
+		opts.Profile = cfg.Profile
+		opts.SharedConfigState = session.SharedConfigEnable
+	}
+
+	sess, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var creds *credentials.Credentials
+	switch cfg.Source {
+	case CredentialsStatic:
+		value, err := readKeysFile(cfg.KeysFile)
+		if err != nil {
+			return nil, err
+		}
+		creds = credentials.NewStaticCredentialsFromCreds(value)
+
+	case CredentialsAssumeRole:
+		creds = stscreds.NewCredentials(sess, cfg.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = cfg.SessionName
+			if cfg.ExternalID != "" {
+				p.ExternalID = aws.String(cfg.ExternalID)
+			}
+		})
+
+	case CredentialsWebIdentity:
+		anon := sess.Copy(&aws.Config{Credentials: credentials.AnonymousCredentials})
+		creds = credentials.NewCredentials(&webIdentityProvider{
+			client:      sts.New(anon),
+			roleARN:     cfg.RoleARN,
+			sessionName: cfg.SessionName,
+			tokenFile:   cfg.TokenFile,
+		})
+	}
+
+	if creds != nil {
+		sess = sess.Copy(&aws.Config{Credentials: creds})
+	}
+
+	return sess, nil
+}
+
+// validateCredentials resolves the session's credentials so that problems
+// are reported at startup instead of on the first upload. When verify is
+// set, the credentials are also checked against STS, which only works for
+// AWS and not for S3-compatible services.
+func validateCredentials(sess *session.Session, cfg CredentialsConfig, verify bool) error {
+	if _, err := sess.Config.Credentials.Get(); err != nil {
+		return fmt.Errorf("cannot resolve credentials [credentials=%s]: %s", cfg.Source, err)
+	}
+
+	if !verify {
+		return nil
+	}
+
+	out, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return fmt.Errorf("invalid credentials [credentials=%s]: %s", cfg.Source, err)
+	}
+
+	log.Printf("credentials validated [credentials=%s] [identity=%s]", cfg.Source, aws.StringValue(out.Arn))
+	return nil
+}
+
+// readKeysFile parses static credentials from file.
+func readKeysFile(file string) (credentials.Value, error) {
+	value := credentials.Value{ProviderName: "KeysFileProvider"}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return value, err
+	}
+	defer f.Close()
+
+	if stat, err := f.Stat(); err == nil && stat.Mode().Perm()&0077 != 0 {
+		log.Printf("WARNING keys file is readable by other users [file=%s]", file)
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "[") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		v := strings.Trim(strings.TrimSpace(parts[1]), `"'`)
+		switch strings.ToLower(strings.TrimSpace(parts[0])) {
+		case "aws_access_key_id":
+			value.AccessKeyID = v
+		case "aws_secret_access_key":
+			value.SecretAccessKey = v
+		case "aws_session_token":
+			value.SessionToken = v
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return value, err
+	}
+
+	if value.AccessKeyID == "" || value.SecretAccessKey == "" {
+		return value, fmt.Errorf("keys file must contain aws_access_key_id and aws_secret_access_key [file=%s]", file)
+	}
+
+	return value, nil
+}
+
+// webIdentityProvider exchanges an OIDC token for temporary credentials via
+// STS AssumeRoleWithWebIdentity.
+type webIdentityProvider struct {
+	credentials.Expiry
+
+	client      *sts.STS
+	roleARN     string
+	sessionName string
+	tokenFile   string
+}
+
+// Retrieve implements credentials.Provider.
+func (p *webIdentityProvider) Retrieve() (credentials.Value, error) {
+	value := credentials.Value{ProviderName: "WebIdentityProvider"}
+
+	token, err := ioutil.ReadFile(p.tokenFile)
+	if err != nil {
+		return value, err
+	}
+
+	out, err := p.client.AssumeRoleWithWebIdentity(&sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(p.roleARN),
+		RoleSessionName:  aws.String(p.sessionName),
+		WebIdentityToken: aws.String(strings.TrimSpace(string(token))),
+	})
+	if err != nil {
+		return value, err
+	}
+
+	// Refresh a little early so requests never go out with expired keys.
+	p.SetExpiration(aws.TimeValue(out.Credentials.Expiration), time.Minute)
+
+	value.AccessKeyID = aws.StringValue(out.Credentials.AccessKeyId)
+	value.SecretAccessKey = aws.StringValue(out.Credentials.SecretAccessKey)
+	value.SessionToken = aws.StringValue(out.Credentials.SessionToken)
+	return value, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// CtlCmd handles the "ctl" command.
+var CtlCmd = &cobra.Command{
+	Use:   "ctl COMMAND [ARG]",
+	Short: "Controls the running daemon",
+	Long: `Sends a command to the control API of the daemon started by media-archive,
+which listens on a Unix socket in the cache directory unless --control is set.
+
+  status              show the bandwidth limit and progress
+  queue               list the files that are being archived or are queued
+  failures [ARCHIVE]  list the copies whose last upload failed
+  pause               pause uploads until resume is sent
+  resume              return to the configured bandwidth schedule
+  bandwidth LIMIT     override the bandwidth limit, e.g. 2MB
+  reload              reload the bandwidth schedule from the configuration file
+  rescan PATH         archive the file, or the files under the directory, again
+  retry [ARCHIVE [FILE]]
+                      upload the files with failed copies again
+  shutdown            shut the daemon down, as SIGTERM does
+
+Failures are read from the cache, which the daemon writes every few seconds.
+With --json the API's responses are printed as they are.`,
+	Run: RunCtlCmd,
+}
+
+// controlClient calls the control API.
+type controlClient struct {
+	client *http.Client
+	base   string
+	token  string
+}
+
+func newControlClient() (*controlClient, error) {
+	network, addr, err := ControlAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	// Requests to a socket are sent to a placeholder host.
+	base := "http://" + addr
+	transport := &http.Transport{}
+	var token string
+	if network == "unix" {
+		base = "http://media-archive"
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}
+	} else if token, err = readControlToken(); err != nil {
+		return nil, err
+	}
+
+	return &controlClient{
+		client: &http.Client{Transport: transport, Timeout: time.Minute},
+		base:   base,
+		token:  token,
+	}, nil
+}
+
+// call sends a request to the endpoint and decodes the response into v. The
+// raw response is copied to raw if it is set.
+func (c *controlClient) call(method, endpoint string, params url.Values, v interface{}, raw io.Writer) error {
+	u := c.base + "/v1/" + endpoint
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot reach the daemon, is it running? %s", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var result controlResult
+		if err := json.Unmarshal(data, &result); err != nil || result.Error == "" {
+			return fmt.Errorf("control API error [status=%d]", resp.StatusCode)
+		}
+		return errors.New(result.Error)
+	}
+
+	if raw != nil {
+		_, err := raw.Write(data)
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// RunCtlCmd is the work function for CtlCmd.
+func RunCtlCmd(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		panic(errors.New("command is required"))
+	}
+
+	client, err := newControlClient()
+	if err != nil {
+		panic(err)
+	}
+
+	if err := ctl(client, args[0], args[1:], os.Stdout, viper.GetBool("json")); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+// ctl runs a ctl command and prints the response to w.
+func ctl(client *controlClient, command string, args []string, w io.Writer, asJSON bool) error {
+	var raw io.Writer
+	if asJSON {
+		raw = w
+	}
+
+	arg := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	}
+
+	params := url.Values{}
+	switch command {
+	case "status":
+		var s ControlStatus
+		if err := client.call(http.MethodGet, "status", nil, &s, raw); err != nil || asJSON {
+			return err
+		}
+		return printControlStatus(w, s)
+
+	case "queue":
+		var q ControlQueue
+		if err := client.call(http.MethodGet, "queue", nil, &q, raw); err != nil || asJSON {
+			return err
+		}
+		for _, path := range q.Active {
+			fmt.Fprintf(w, "active  %s\n", path)
+		}
+		for _, path := range q.Queued {
+			fmt.Fprintf(w, "queued  %s\n", path)
+		}
+		return nil
+
+	case "failures":
+		if a := arg(0); a != "" {
+			params.Set("archive", a)
+		}
+		var failures []ControlFailure
+		if err := client.call(http.MethodGet, "failures", params, &failures, raw); err != nil || asJSON {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ARCHIVE\tFILE\tBACKEND\tERROR")
+		for _, f := range failures {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", f.Archive, f.Filename, f.Backend, strings.Join(strings.Fields(f.Error), " "))
+		}
+		return tw.Flush()
+
+	case "pause", "resume", "reload", "shutdown":
+
+	case "bandwidth":
+		if arg(0) == "" {
+			return errors.New("limit is required, e.g. ctl bandwidth 2MB")
+		}
+		params.Set("limit", arg(0))
+
+	case "rescan":
+		if arg(0) == "" {
+			return errors.New("path is required")
+		}
+		path, err := filepath.Abs(arg(0))
+		if err != nil {
+			return err
+		}
+		params.Set("path", path)
+
+	case "retry":
+		if a := arg(0); a != "" {
+			params.Set("archive", a)
+		}
+		if f := arg(1); f != "" {
+			params.Set("file", f)
+		}
+
+	default:
+		return fmt.Errorf("unknown command [command=%s]", command)
+	}
+
+	var result controlResult
+	if err := client.call(http.MethodPost, command, params, &result, raw); err != nil || asJSON {
+		return err
+	}
+	_, err := fmt.Fprintln(w, result.Message)
+	return err
+}
+
+func printControlStatus(w io.Writer, s ControlStatus) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	limit := s.Limit
+	if s.Override {
+		limit += " (override)"
+	}
+	fmt.Fprintf(tw, "started\t%s\n", s.Started.Format(time.RFC3339))
+	for _, name := range s.Archives {
+		fmt.Fprintf(tw, "archive\t%s\n", name)
+	}
+	fmt.Fprintf(tw, "limit\t%s\n", limit)
+	fmt.Fprintf(tw, "files\t%d/%d archived, %d failed\n", s.DoneFiles, s.TotalFiles, s.FailedFiles)
+	fmt.Fprintf(tw, "bytes\t%s/%s\n", formatBytes(s.DoneBytes), formatBytes(s.TotalBytes))
+
+	for _, id := range workerIDs(s.Workers) {
+		fmt.Fprintf(tw, "worker %d\t%s\n", id, s.Workers[id])
+	}
+	return tw.Flush()
+}
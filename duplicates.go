@@ -0,0 +1,488 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Actions recommended for the images in a duplicate group.
+const (
+	DuplicateKeep    = "keep"
+	DuplicateRemove  = "duplicate"
+	DuplicateSkipped = "skipped"
+)
+
+// DuplicatesCmd handles the "duplicates" command.
+var DuplicatesCmd = &cobra.Command{
+	Use:   "duplicates [archive...]",
+	Short: "Finds near-duplicate images",
+	Long: `Groups the archived images whose perceptual hashes differ in at most --distance
+bits, which defaults to the archive's duplicates.distance, e.g. the same photo
+re-exported at a different quality or resized by a messaging app. Exact copies
+are found as well.
+
+Each group lists the copy to keep first, which is the raw file, otherwise the
+image with the most pixels, then the one that kept its capture time, then the
+largest file. The other images are listed as "duplicate", or as "skipped" if
+they weren't uploaded because the archive sets duplicates.skip-uploads.
+
+Images are hashed when they are archived. Run "cache index" to hash images that
+were archived by an older version. All archives are searched unless archive
+names are passed.`,
+	Run: RunDuplicatesCmd,
+}
+
+// CachedImage is an image in the cache with a perceptual hash.
+type CachedImage struct {
+	Filename    string `json:"filename"`
+	Hash        string `json:"hash"`
+	Class       string `json:"class"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Size        int64  `json:"size"`
+	Taken       string `json:"taken,omitempty"`
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+	Group       string `json:"group,omitempty"`
+
+	// hash is Hash parsed.
+	hash uint64
+
+	// uploaded is whether the image has a successful copy on a backend.
+	uploaded bool
+}
+
+// compare compares the quality of two copies of an image, returning a
+// positive number if i is better than o. Raw files beat other files, then
+// more pixels win, then images that kept their capture time, then larger
+// files, which are less compressed.
+func (i CachedImage) compare(o CachedImage) int {
+	switch {
+	case (i.Class == ClassRaw) != (o.Class == ClassRaw):
+		return boolCompare(i.Class == ClassRaw)
+	case i.Width*i.Height != o.Width*o.Height:
+		return boolCompare(i.Width*i.Height > o.Width*o.Height)
+	case (i.Taken != "") != (o.Taken != ""):
+		return boolCompare(i.Taken != "")
+	case i.Size != o.Size:
+		return boolCompare(i.Size > o.Size)
+	}
+	return 0
+}
+
+// companion reports whether i and o are in the same file group, e.g. a raw
+// file and the JPEG the camera saved with it, which aren't duplicates.
+func (i CachedImage) companion(o CachedImage) bool {
+	return i.Group != "" && i.Group == o.Group
+}
+
+// better reports whether i is a better copy than o, breaking ties by filename
+// so that images are ordered consistently.
+func (i CachedImage) better(o CachedImage) bool {
+	if c := i.compare(o); c != 0 {
+		return c > 0
+	}
+	return i.Filename < o.Filename
+}
+
+func boolCompare(b bool) int {
+	if b {
+		return 1
+	}
+	return -1
+}
+
+// DuplicateImage is an image in a DuplicateGroup.
+type DuplicateImage struct {
+	CachedImage
+
+	// Action is DuplicateKeep, DuplicateRemove or DuplicateSkipped.
+	Action string `json:"action"`
+
+	// Distance is the distance of the image's hash from the kept image's.
+	Distance int `json:"distance"`
+}
+
+// DuplicateGroup is a group of near-duplicate images, the one to keep first.
+type DuplicateGroup struct {
+	Archive string           `json:"archive"`
+	Images  []DuplicateImage `json:"images"`
+}
+
+// FindDuplicates groups the images in cache whose hashes are within distance
+// of another image in the group. Images in the same file group aren't
+// compared. Groups are ordered by the kept image's filename.
+func FindDuplicates(archive string, cache Cache, distance int) ([]DuplicateGroup, error) {
+	var images []CachedImage
+	var tree hashTree
+	err := cache.Images(func(img CachedImage) error {
+		tree.add(img.hash, len(images))
+		images = append(images, img)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Union-find, so that groups are the connected images.
+	parent := make([]int, len(images))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i, img := range images {
+		tree.near(img.hash, distance, func(j, _ int) {
+			if img.companion(images[j]) {
+				return
+			}
+			if a, b := find(i), find(j); a != b {
+				parent[a] = b
+			}
+		})
+	}
+
+	members := make(map[int][]CachedImage)
+	for i, img := range images {
+		members[find(i)] = append(members[find(i)], img)
+	}
+
+	var groups []DuplicateGroup
+	for _, imgs := range members {
+		if len(imgs) < 2 {
+			continue
+		}
+		sort.Slice(imgs, func(i, j int) bool { return imgs[i].better(imgs[j]) })
+
+		g := DuplicateGroup{Archive: archive}
+		for i, img := range imgs {
+			d := DuplicateImage{CachedImage: img, Action: DuplicateRemove, Distance: HashDistance(imgs[0].hash, img.hash)}
+			switch {
+			case i == 0:
+				d.Action = DuplicateKeep
+			case img.DuplicateOf != "":
+				d.Action = DuplicateSkipped
+			}
+			g.Images = append(g.Images, d)
+		}
+		groups = append(groups, g)
+	}
+
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Images[0].Filename < groups[j].Images[0].Filename })
+	return groups, nil
+}
+
+// imageIndex holds the hashes of an archive's uploaded images that new images
+// are checked against when the archive skips duplicates. It is loaded from
+// the cache on first use. Images that are removed leave an entry without a
+// filename, as the tree can't drop values.
+type imageIndex struct {
+	mu     sync.Mutex
+	loaded bool
+	images []CachedImage
+	names  map[string]int
+	tree   hashTree
+}
+
+func (x *imageIndex) add(img CachedImage) {
+	x.remove(img.Filename)
+	x.names[img.Filename] = len(x.images)
+	x.tree.add(img.hash, len(x.images))
+	x.images = append(x.images, img)
+}
+
+func (x *imageIndex) remove(filename string) {
+	if i, ok := x.names[filename]; ok {
+		x.images[i].Filename = ""
+		delete(x.names, filename)
+	}
+}
+
+// loadImages loads the archive's uploaded images into the index unless they
+// already are. The index must be locked.
+func (a *Archive) loadImages() error {
+	x := &a.images
+	if x.loaded {
+		return nil
+	}
+
+	x.names = make(map[string]int)
+	err := a.Cache.Images(func(i CachedImage) error {
+		if i.DuplicateOf == "" && i.uploaded {
+			x.add(i)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	x.loaded = true
+	return nil
+}
+
+// indexImage adds the image described by item to the index once it has been
+// uploaded, so that the images archived after it are checked against it. It
+// is removed from the index if it is a duplicate or no upload succeeded.
+func (a *Archive) indexImage(item CacheItem) error {
+	if !a.Duplicates.SkipUploads || item.Media == nil || item.Media.Hash == "" {
+		return nil
+	}
+
+	x := &a.images
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if err := a.loadImages(); err != nil {
+		return err
+	}
+
+	uploaded := false
+	for _, c := range item.Copies {
+		uploaded = uploaded || c.Error == ""
+	}
+	if item.DuplicateOf != "" || !uploaded {
+		x.remove(item.Filename)
+		return nil
+	}
+
+	img, err := newCachedImage(item.Filename, item.Size, item.Media)
+	if err != nil {
+		return err
+	}
+	img.Group = item.Group
+	x.add(img)
+	return nil
+}
+
+// duplicateOf returns the best uploaded image that img is within the
+// archive's duplicate distance of and no better than, or "" if there is none.
+// Images whose file was changed or removed since it was uploaded are dropped
+// from the index instead.
+func (a *Archive) duplicateOf(img CachedImage) (string, error) {
+	x := &a.images
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if err := a.loadImages(); err != nil {
+		return "", err
+	}
+
+	var candidates []CachedImage
+	x.tree.near(img.hash, a.Duplicates.Distance, func(i, _ int) {
+		o := x.images[i]
+		if o.Filename != "" && o.Filename != img.Filename && !img.companion(o) && img.compare(o) <= 0 {
+			candidates = append(candidates, o)
+		}
+	})
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].better(candidates[j]) })
+
+	for _, o := range candidates {
+		if a.hasCurrentCopy(o.Filename) {
+			return o.Filename, nil
+		}
+		x.remove(o.Filename)
+	}
+	return "", nil
+}
+
+// hasCurrentCopy reports whether the file at relpath is in the archive's
+// roots, unchanged since it was cached, and has a current copy on at least
+// one backend, so that its duplicates can be skipped.
+func (a *Archive) hasCurrentCopy(relpath string) bool {
+	item, err := a.Cache.Get(relpath)
+	if err != nil || item.DuplicateOf != "" {
+		return false
+	}
+
+	p, ok := localPath(a.roots, relpath)
+	if !ok {
+		return false
+	}
+	info, err := os.Stat(p)
+	if err != nil || item.Modified(info) {
+		return false
+	}
+
+	// Files archived before copies were tracked were uploaded to every
+	// backend that was configured at the time.
+	if len(item.Copies) == 0 {
+		return !item.ArchivedAt.IsZero()
+	}
+	for _, c := range item.Copies {
+		if c.Current(info) {
+			return true
+		}
+	}
+	return false
+}
+
+// newCachedImage returns the image at relpath described by m, which must have
+// a perceptual hash.
+func newCachedImage(relpath string, size int64, m *Media) (CachedImage, error) {
+	img := CachedImage{Filename: relpath, Hash: m.Hash, Class: m.Class, Width: m.Width, Height: m.Height, Size: size}
+	if !m.Taken.IsZero() {
+		img.Taken = m.Taken.Format(takenLayout)
+	}
+	var err error
+	img.hash, err = parseHash(m.Hash)
+	return img, err
+}
+
+// checkDuplicate hashes the image at path and returns item updated as a
+// duplicate of an archived image, or an empty item if it isn't a duplicate
+// and should be uploaded.
+func (a *Archive) checkDuplicate(path, relpath string, info os.FileInfo, item CacheItem) (CacheItem, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return CacheItem{}, err
+	}
+	defer f.Close()
+
+	m, _ := analyzeMedia(f, info.Size(), relpath)
+	if m.Hash == "" {
+		return CacheItem{}, nil
+	}
+
+	img, err := newCachedImage(relpath, info.Size(), m)
+	if err != nil {
+		return CacheItem{}, err
+	}
+
+	group, err := a.Group(path, relpath, m.ContentID)
+	if err != nil {
+		return CacheItem{}, err
+	}
+	img.Group = group.Name()
+
+	dup, err := a.duplicateOf(img)
+	if err != nil || dup == "" {
+		return CacheItem{}, err
+	}
+
+	key, err := a.GroupKey(group, path, relpath, info)
+	if err != nil {
+		return CacheItem{}, err
+	}
+
+	item.Filename = relpath
+	item.Size = info.Size()
+	item.ModTime = info.ModTime()
+	item.Key = key
+	item.Media = m
+	item.DuplicateOf = dup
+	item.Group = group.Name()
+	item.Companions = group.Companions(relpath)
+	return item, nil
+}
+
+// RunDuplicatesCmd is the work function for DuplicatesCmd.
+func RunDuplicatesCmd(cmd *cobra.Command, args []string) {
+	cfg, err := LoadConfig()
+	if err != nil {
+		panic(err)
+	}
+
+	names := args
+	if len(names) == 0 {
+		for _, ac := range cfg.Archives {
+			names = append(names, ac.Name)
+		}
+	}
+
+	dir, err := CacheDir()
+	if err != nil {
+		panic(err)
+	}
+
+	db, err := OpenSQLiteDBReadOnly(dir)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	var groups []DuplicateGroup
+	for _, name := range names {
+		ac, err := cfg.Archive(name)
+		if err != nil {
+			panic(err)
+		}
+
+		cache, err := db.Cache(name)
+		if err != nil {
+			panic(err)
+		}
+
+		distance := viper.GetInt("distance")
+		if distance <= 0 {
+			distance = ac.Duplicates.Distance
+		}
+
+		found, err := FindDuplicates(name, cache, distance)
+		if err != nil {
+			panic(err)
+		}
+		groups = append(groups, found...)
+	}
+
+	if err := printDuplicates(os.Stdout, groups, viper.GetBool("json")); err != nil {
+		panic(err)
+	}
+}
+
+// printDuplicates writes the groups as a table, or as one JSON object per
+// group, and logs how much space the duplicates take up.
+func printDuplicates(w io.Writer, groups []DuplicateGroup, asJSON bool) error {
+	var duplicates int
+	var size int64
+	for _, g := range groups {
+		for _, img := range g.Images[1:] {
+			duplicates++
+			size += img.Size
+		}
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(w)
+		for _, g := range groups {
+			if err := enc.Encode(g); err != nil {
+				return err
+			}
+		}
+	} else {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ARCHIVE\tGROUP\tACTION\tDISTANCE\tPIXELS\tSIZE\tFILE")
+		for i, g := range groups {
+			for _, img := range g.Images {
+				fmt.Fprintf(tw, "%s\t%d\t%s\t%d\t%dx%d\t%s\t%s\n", g.Archive, i+1, img.Action, img.Distance, img.Width, img.Height, formatBytes(img.Size), img.Filename)
+			}
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("duplicates found [groups=%d] [duplicates=%d] [size=%s]", len(groups), duplicates, formatBytes(size))
+	return nil
+}
+
+// InitDuplicatesCmdConfig adds configuration options specific to
+// DuplicatesCmd.
+func InitDuplicatesCmdConfig(cmd *cobra.Command) {
+
+	cmd.Flags().Int("distance", 0, "The largest number of bits that the hashes of duplicates differ in, defaults to the archive's duplicates.distance.")
+	viper.BindPFlag("distance", cmd.Flags().Lookup("distance"))
+	viper.SetDefault("distance", 0)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindDuplicates(t *testing.T) {
+	a := testArchive(t, ArchiveConfig{Name: "photos"})
+	taken := time.Date(2019, 7, 14, 10, 0, 0, 0, time.UTC)
+
+	images := []struct {
+		filename, class string
+		hash            uint64
+		width, height   int
+		size            int64
+		group, dupOf    string
+	}{
+		// A chain of copies within 4 bits of the next one is a single group,
+		// although the first and last are 6 bits apart. The raw file is kept.
+		{"a/IMG_0001.JPG", ClassImage, 0x00, 4000, 3000, 5 << 20, "", ""},
+		{"b/IMG_0001.CR2", ClassRaw, 0x03, 4000, 3000, 25 << 20, "", ""},
+		{"c/small.jpg", ClassImage, 0x3f, 1000, 750, 200 << 10, "", ""},
+		{"d/skipped.jpg", ClassImage, 0x01, 1000, 750, 150 << 10, "", "b/IMG_0001.CR2"},
+
+		// A raw file and its JPEG are companions, not duplicates.
+		{"e/IMG_0002.CR2", ClassRaw, 0xff00ff00, 4000, 3000, 25 << 20, "e/IMG_0002.CR2", ""},
+		{"e/IMG_0002.JPG", ClassImage, 0xff00ff00, 4000, 3000, 5 << 20, "e/IMG_0002.CR2", ""},
+
+		// Images far from the others stand alone.
+		{"f/other.jpg", ClassImage, 0xffffffff00000000, 4000, 3000, 5 << 20, "", ""},
+	}
+	for _, img := range images {
+		err := a.Cache.Set(CacheItem{
+			Filename:    img.filename,
+			Size:        img.size,
+			ModTime:     taken,
+			Key:         img.filename,
+			ArchivedAt:  taken,
+			DuplicateOf: img.dupOf,
+			Group:       img.group,
+			Media: &Media{
+				Class:  img.class,
+				Taken:  taken,
+				Hash:   formatHash(img.hash),
+				Width:  img.width,
+				Height: img.height,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	groups, err := FindDuplicates("photos", a.Cache, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 {
+		t.Fatalf("found %d groups, want 1: %+v", len(groups), groups)
+	}
+
+	var got []string
+	for _, img := range groups[0].Images {
+		got = append(got, img.Filename+" "+img.Action)
+	}
+	want := []string{
+		"b/IMG_0001.CR2 " + DuplicateKeep,
+		"a/IMG_0001.JPG " + DuplicateRemove,
+		"c/small.jpg " + DuplicateRemove,
+		"d/skipped.jpg " + DuplicateSkipped,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("group:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if d := groups[0].Images[2].Distance; d != 4 {
+		t.Errorf("distance of c/small.jpg from the kept image = %d, want 4", d)
+	}
+
+	// With a smaller distance, c/small.jpg falls out of the chain.
+	groups, err = FindDuplicates("photos", a.Cache, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || len(groups[0].Images) != 3 {
+		t.Fatalf("found %+v, want a group of 3", groups)
+	}
+	for _, img := range groups[0].Images {
+		if img.Filename == "c/small.jpg" {
+			t.Errorf("c/small.jpg grouped at distance 1")
+		}
+	}
+}
+
+func TestCachedImageBetter(t *testing.T) {
+	base := CachedImage{Filename: "b.jpg", Class: ClassImage, Width: 4000, Height: 3000, Size: 5 << 20, Taken: "2019-07-14T10:00:00"}
+	tests := []struct {
+		name          string
+		better, worse func(*CachedImage)
+	}{
+		{"raw", func(i *CachedImage) { i.Class, i.Width, i.Size = ClassRaw, 100, 1 }, nil},
+		{"more pixels", func(i *CachedImage) { i.Width, i.Size, i.Taken = 5000, 1, "" }, nil},
+		{"capture time", func(i *CachedImage) { i.Size = 1 }, func(i *CachedImage) { i.Taken = "" }},
+		{"larger file", func(i *CachedImage) { i.Size++ }, nil},
+		{"filename", func(i *CachedImage) { i.Filename = "a.jpg" }, nil},
+	}
+	for _, tt := range tests {
+		better, worse := base, base
+		tt.better(&better)
+		if tt.worse != nil {
+			tt.worse(&worse)
+		}
+		if !better.better(worse) || worse.better(better) {
+			t.Errorf("%s: %+v isn't better than %+v", tt.name, better, worse)
+		}
+	}
+}
@@ -16,6 +16,20 @@ func HandleErrors(in ...<-chan error) {
 	}()
 }
 
+// notifyClosed passes the errors sent through in to the returned channel, and
+// calls done once in is closed.
+func notifyClosed(in <-chan error, done func()) <-chan error {
+	out := make(chan error)
+	go func() {
+		for err := range in {
+			out <- err
+		}
+		close(out)
+		done()
+	}()
+	return out
+}
+
 // merge implements the fan-in pattern and merges the passed error channels
 // into a single channel that can be processed.
 //
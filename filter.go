@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Filter decides whether a file is archived based on include and exclude
+// glob patterns. Patterns support the filepath.Match syntax plus "**", which
+// matches any number of directories. Patterns without a slash are matched
+// against the file's base name, others against the path relative to the
+// root directory.
+type Filter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// NewFilter compiles the include and exclude patterns. An empty include list
+// includes everything.
+func NewFilter(include, exclude []string) (*Filter, error) {
+	f := &Filter{}
+	var err error
+	if f.include, err = compilePatterns(include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = compilePatterns(exclude); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Match reports whether the file at the relative path should be archived.
+// A nil Filter matches everything.
+func (f *Filter) Match(relpath string) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.include) > 0 && !matchAny(f.include, relpath) {
+		return false
+	}
+	return !matchAny(f.exclude, relpath)
+}
+
+// matchAny reports whether relpath matches any of the patterns.
+func matchAny(patterns []*regexp.Regexp, relpath string) bool {
+	for _, re := range patterns {
+		if re.MatchString(relpath) {
+			return true
+		}
+	}
+	return false
+}
+
+// compilePatterns converts glob patterns to regular expressions.
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(globToRegexp(p))
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// globToRegexp translates a glob pattern into an anchored regular expression.
+func globToRegexp(glob string) string {
+	var b bytes.Buffer
+
+	// Patterns without a slash match the base name in any directory.
+	glob = strings.TrimPrefix(glob, "/")
+	if !strings.Contains(glob, "/") {
+		b.WriteString("^(?:.*/)?")
+	} else {
+		b.WriteString("^")
+	}
+	glob = path.Clean(glob)
+
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case c == '*' && strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case c == '*' && strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	// A pattern that matches a directory matches everything beneath it.
+	b.WriteString("(?:/.*)?$")
+	return b.String()
+}
@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestFilterMatch(t *testing.T) {
+	tests := []struct {
+		include, exclude []string
+		relpath          string
+		want             bool
+	}{
+		{nil, nil, "2019/IMG_0001.JPG", true},
+		{[]string{"*.JPG"}, nil, "IMG_0001.JPG", true},
+		{[]string{"*.JPG"}, nil, "2019/07/IMG_0001.JPG", true},
+		{[]string{"*.JPG"}, nil, "2019/07/IMG_0001.jpg", false},
+		{[]string{"*.[jJ][pP][gG]"}, nil, "2019/IMG_0001.jpg", true},
+		{[]string{"IMG_????.JPG"}, nil, "IMG_0001.JPG", true},
+		{[]string{"IMG_????.JPG"}, nil, "IMG_01.JPG", false},
+		{[]string{"2019/*.JPG"}, nil, "2019/IMG_0001.JPG", true},
+		{[]string{"2019/*.JPG"}, nil, "2019/07/IMG_0001.JPG", false},
+		{[]string{"/2019/*.JPG"}, nil, "2019/IMG_0001.JPG", true},
+		{[]string{"2019/**/*.JPG"}, nil, "2019/IMG_0001.JPG", true},
+		{[]string{"2019/**/*.JPG"}, nil, "2019/07/14/IMG_0001.JPG", true},
+		{[]string{"2019/**/*.JPG"}, nil, "2020/07/IMG_0001.JPG", false},
+		{[]string{"2019/**"}, nil, "2019/07/IMG_0001.JPG", true},
+		{[]string{"2019"}, nil, "2019/07/IMG_0001.JPG", true},
+		{[]string{"2019"}, nil, "2019-07/IMG_0001.JPG", false},
+		{nil, []string{".*"}, ".DS_Store", false},
+		{nil, []string{".*"}, "2019/.thumbnails/IMG_0001.JPG", false},
+		{nil, []string{".*"}, "2019/IMG_0001.JPG", true},
+		{nil, []string{"[!A-Z]*"}, "IMG_0001.JPG", true},
+		{nil, []string{"[!A-Z]*"}, "img_0001.jpg", false},
+		{nil, []string{"**/Thumbs.db"}, "Thumbs.db", false},
+		{nil, []string{"**/Thumbs.db"}, "2019/07/Thumbs.db", false},
+		{nil, []string{`\*.JPG`}, "IMG_0001.JPG", true},
+		{nil, []string{`\*.JPG`}, "*.JPG", false},
+		{nil, []string{"a[b"}, "a[b", false},
+		{[]string{"*.JPG", "*.MOV"}, []string{"Private/**"}, "2019/IMG_0002.MOV", true},
+		{[]string{"*.JPG", "*.MOV"}, []string{"Private/**"}, "Private/IMG_0002.MOV", false},
+	}
+	for _, tt := range tests {
+		f, err := NewFilter(tt.include, tt.exclude)
+		if err != nil {
+			t.Fatalf("NewFilter(%q, %q): %s", tt.include, tt.exclude, err)
+		}
+		if got := f.Match(tt.relpath); got != tt.want {
+			t.Errorf("include %q exclude %q: Match(%q) = %t, want %t", tt.include, tt.exclude, tt.relpath, got, tt.want)
+		}
+	}
+}
+
+func TestNilFilterMatchesEverything(t *testing.T) {
+	var f *Filter
+	if !f.Match("2019/IMG_0001.JPG") {
+		t.Error("nil Filter didn't match")
+	}
+}
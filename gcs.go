@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// DefaultGCSChunkSize is the default size of the chunks that a GCSBackend
+// sends per request of a resumable upload.
+const DefaultGCSChunkSize = 16 << 20
+
+// gcsStorageClasses maps S3 storage classes, which archives are configured
+// with, to their closest Cloud Storage equivalents.
+var gcsStorageClasses = map[string]string{
+	"STANDARD":            "STANDARD",
+	"REDUCED_REDUNDANCY":  "STANDARD",
+	"INTELLIGENT_TIERING": "STANDARD",
+	"STANDARD_IA":         "NEARLINE",
+	"ONEZONE_IA":          "NEARLINE",
+	"GLACIER_IR":          "COLDLINE",
+	"GLACIER":             "COLDLINE",
+	"DEEP_ARCHIVE":        "ARCHIVE",
+}
+
+// GCSBackend archives files to a Google Cloud Storage bucket. Files larger
+// than the chunk size are sent with resumable uploads, so a failed request
+// only retries the current chunk.
+type GCSBackend struct {
+	name      string
+	bucket    string
+	chunkSize int
+	client    *storage.Client
+}
+
+// NewGCSBackend returns a GCSBackend configured by cfg. The bucket is read at
+// startup to validate the credentials.
+func NewGCSBackend(cfg BackendConfig) (*GCSBackend, error) {
+	var opts []option.ClientOption
+	if cfg.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(cfg.Endpoint))
+	}
+
+	// Emulators such as fake-gcs-server don't check credentials.
+	if cfg.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(cfg.CredentialsFile))
+	} else if cfg.Endpoint != "" {
+		opts = append(opts, option.WithoutAuthentication())
+	}
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &GCSBackend{
+		name:      cfg.Name(),
+		bucket:    cfg.Bucket,
+		chunkSize: int(cfg.ChunkSize),
+		client:    client,
+	}
+
+	if _, err := client.Bucket(b.bucket).Attrs(ctx); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("cannot read bucket [backend=%s]: %s", b.Name(), err)
+	}
+
+	return b, nil
+}
+
+// Name implements Backend.
+func (b *GCSBackend) Name() string {
+	return b.name
+}
+
+// Put implements Backend.
+func (b *GCSBackend) Put(key string, r io.ReadSeeker, size int64, opts PutOptions) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := b.client.Bucket(b.bucket).Object(key).NewWriter(ctx)
+	w.ChunkSize = b.chunkSize
+	w.StorageClass = gcsStorageClass(opts.StorageClass)
+	w.Metadata = opts.Metadata
+
+	// The object is only committed by Close, so it is aborted by cancelling
+	// the context if the body fails or is shorter than size.
+	n, err := io.Copy(w, io.LimitReader(r, size))
+	if err == nil && n != size {
+		err = fmt.Errorf("short write [expected=%d] [written=%d]", size, n)
+	}
+	if err != nil {
+		cancel()
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Get implements Backend.
+func (b *GCSBackend) Get(key string, offset, length int64) (io.ReadCloser, error) {
+	return b.client.Bucket(b.bucket).Object(key).NewRangeReader(context.Background(), offset, length)
+}
+
+// List implements Backend.
+func (b *GCSBackend) List(prefix string, fn func(Object) error) error {
+	it := b.client.Bucket(b.bucket).Objects(context.Background(), &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = fn(Object{
+			Key:      attrs.Name,
+			Size:     attrs.Size,
+			ModTime:  attrs.Updated,
+			ETag:     attrs.Etag,
+			MD5:      hex.EncodeToString(attrs.MD5),
+			Metadata: attrs.Metadata,
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Delete implements Backend.
+func (b *GCSBackend) Delete(key string) error {
+	return b.client.Bucket(b.bucket).Object(key).Delete(context.Background())
+}
+
+// gcsStorageClass returns the Cloud Storage class for an S3 storage class.
+// Native class names are passed through.
+func gcsStorageClass(class string) string {
+	class = strings.ToUpper(class)
+	if c, ok := gcsStorageClasses[class]; ok {
+		return c
+	}
+	return class
+}
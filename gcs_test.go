@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+// TestGCSRoundTrip runs against the Cloud Storage emulator at
+// MEDIA_ARCHIVE_TEST_GCS_ENDPOINT, e.g. fake-gcs-server's
+// http://localhost:4443/storage/v1/. The bucket must exist.
+func TestGCSRoundTrip(t *testing.T) {
+	b, err := NewGCSBackend(BackendConfig{
+		Type:      BackendGCS,
+		Endpoint:  testEnv(t, "MEDIA_ARCHIVE_TEST_GCS_ENDPOINT"),
+		Bucket:    testEnv(t, "MEDIA_ARCHIVE_TEST_GCS_BUCKET"),
+		ChunkSize: DefaultGCSChunkSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackendRoundTrip(t, b)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// companionRanks order the classes of the files in a group, the primary file
+// being the one with the lowest rank. Files of other classes aren't grouped.
+var companionRanks = map[string]int{
+	ClassRaw:     0,
+	ClassImage:   1,
+	ClassVideo:   2,
+	ClassAudio:   3,
+	ClassSidecar: 4,
+}
+
+// FileGroup is a file and its companions, e.g. the JPEG that a camera saved
+// next to a raw file, the video of a Live Photo, or an XMP sidecar. The files
+// in a group are stored next to each other and restored together.
+type FileGroup struct {
+
+	// Primary is the relative path of the file that names the group: the raw
+	// file, otherwise the image, then the video.
+	Primary string
+
+	// Members are the relative paths of the files in the group, including
+	// Primary, in filename order.
+	Members []string
+}
+
+// Name returns the name that the group's members are cached with, which is
+// empty for files without companions.
+func (g FileGroup) Name() string {
+	if len(g.Members) < 2 {
+		return ""
+	}
+	return g.Primary
+}
+
+// Companions returns the members of the group other than relpath.
+func (g FileGroup) Companions(relpath string) []string {
+	var companions []string
+	for _, m := range g.Members {
+		if m != relpath {
+			companions = append(companions, m)
+		}
+	}
+	return companions
+}
+
+// splitStem splits a file name into the stem that it shares with its
+// companions and the suffix that tells them apart, e.g. IMG_0001 and .CR2.
+// Sidecars that are named after the full name of their file, such as
+// IMG_0001.CR2.xmp, keep both extensions in the suffix.
+func splitStem(name string) (stem, suffix string) {
+	stem = strings.TrimSuffix(name, path.Ext(name))
+	if mediaClass(name) == ClassSidecar && mediaClass(stem) != ClassOther {
+		stem = strings.TrimSuffix(stem, path.Ext(stem))
+	}
+	return stem, name[len(stem):]
+}
+
+// relDir returns the directory part of a relative path including the trailing
+// slash, which is empty for files in the root.
+func relDir(relpath string) string {
+	return relpath[:strings.LastIndex(relpath, "/")+1]
+}
+
+// Group returns the group of the file at path, whose relative path is
+// relpath: the media files and sidecars in the same directory with the same
+// stem, ignoring case, and the files in the directory whose content
+// identifier is contentID, e.g. a Live Photo whose video was renamed. Files
+// that the archive's filter excludes aren't members.
+func (a *Archive) Group(path, relpath, contentID string) (FileGroup, error) {
+	g := FileGroup{Primary: relpath, Members: []string{relpath}}
+	if _, ok := companionRanks[mediaClass(relpath)]; !ok {
+		return g, nil
+	}
+
+	dir := filepath.Dir(path)
+	stem, _ := splitStem(filepath.Base(path))
+	names, err := a.dirs.siblings(dir, stem)
+	if err != nil {
+		return g, err
+	}
+	member := map[string]bool{relpath: true}
+	for _, name := range names {
+		sibling := relDir(relpath) + name
+		if !member[sibling] && a.included(filepath.Join(dir, name)) {
+			member[sibling] = true
+			g.Members = append(g.Members, sibling)
+		}
+	}
+
+	if contentID != "" {
+		matches, err := a.Cache.ContentMatches(contentID)
+		if err != nil {
+			return g, err
+		}
+		for _, m := range append(matches, a.contents.add(contentID, relpath)...) {
+			if !member[m] && relDir(m) == relDir(relpath) {
+				member[m] = true
+				g.Members = append(g.Members, m)
+			}
+		}
+	}
+
+	sort.Strings(g.Members)
+	g.Primary = g.Members[0]
+	for _, m := range g.Members[1:] {
+		if companionRanks[mediaClass(m)] < companionRanks[mediaClass(g.Primary)] {
+			g.Primary = m
+		}
+	}
+
+	// Sidecars without the file they describe stand alone.
+	if mediaClass(g.Primary) == ClassSidecar {
+		return FileGroup{Primary: relpath, Members: []string{relpath}}, nil
+	}
+	return g, nil
+}
+
+// included reports whether the archive's filter includes the file at path.
+func (a *Archive) included(path string) bool {
+	_, rel := resolveRoot(a.roots, path)
+	return a.Filter.Match(rel)
+}
+
+// GroupKey returns the key that the file at path, a member of g, is stored
+// under. The primary is stored under the key template's key, and its
+// companions next to it, under the primary's key with their own suffix, e.g.
+// 2019/07/IMG_0001.CR2 and 2019/07/IMG_0001.JPG, even if the template uses
+// the files' modification times. Companions fall back to the template's key
+// if another member has the same suffix, or if the primary's key doesn't end
+// with the primary's suffix.
+func (a *Archive) GroupKey(g FileGroup, path, relpath string, info os.FileInfo) (string, error) {
+	key, err := a.Key(relpath, info)
+	if err != nil || g.Name() == "" || relpath == g.Primary {
+		return key, err
+	}
+
+	_, suffix := splitStem(filepath.Base(path))
+	for _, m := range g.Members {
+		if _, s := splitStem(m[len(relDir(m)):]); m != relpath && strings.EqualFold(s, suffix) {
+			return key, nil
+		}
+	}
+
+	// The primary's key is the one it is uploaded under next, or the cached
+	// key if it was removed locally.
+	name := g.Primary[len(relDir(g.Primary)):]
+	var primary string
+	if pinfo, err := os.Stat(filepath.Join(filepath.Dir(path), name)); err == nil {
+		if primary, err = a.Key(g.Primary, pinfo); err != nil {
+			return "", err
+		}
+	} else if item, err := a.Cache.Get(g.Primary); err == nil {
+		primary = item.Key
+	} else if err != ErrNotCached {
+		return "", err
+	}
+
+	_, psuffix := splitStem(name)
+	if primary == "" || len(primary) < len(psuffix) || !strings.EqualFold(primary[len(primary)-len(psuffix):], psuffix) {
+		return key, nil
+	}
+	return primary[:len(primary)-len(psuffix)] + suffix, nil
+}
+
+// dirIndex caches the names of the media files in directories by their lower
+// case stem, so that a directory isn't listed again for each of its files. A
+// listing is reused until the directory's modification time changes.
+type dirIndex struct {
+	mu   sync.Mutex
+	dirs map[string]dirListing
+}
+
+type dirListing struct {
+	modTime time.Time
+	stems   map[string][]string
+}
+
+// maxDirListings is the number of listings that a dirIndex holds before it
+// is cleared.
+const maxDirListings = 64
+
+// siblings returns the names of the media files and sidecars in dir whose
+// stem is stem, ignoring case.
+func (x *dirIndex) siblings(dir, stem string) ([]string, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	l, ok := x.dirs[dir]
+	if !ok || !l.modTime.Equal(info.ModTime()) {
+		f, err := os.Open(dir)
+		if err != nil {
+			return nil, err
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		l = dirListing{modTime: info.ModTime(), stems: make(map[string][]string)}
+		for _, name := range names {
+			if _, ok := companionRanks[mediaClass(name)]; ok {
+				s, _ := splitStem(name)
+				l.stems[strings.ToLower(s)] = append(l.stems[strings.ToLower(s)], name)
+			}
+		}
+		if x.dirs == nil || len(x.dirs) >= maxDirListings {
+			x.dirs = make(map[string]dirListing)
+		}
+		x.dirs[dir] = l
+	}
+	return l.stems[strings.ToLower(stem)], nil
+}
+
+// contentIndex holds the files that were grouped by content identifier since
+// the archive was opened, as they may not be cached yet.
+type contentIndex struct {
+	mu    sync.Mutex
+	files map[string][]string
+}
+
+// maxContentIDs is the number of identifiers that a contentIndex holds before
+// it is cleared.
+const maxContentIDs = 10000
+
+// add records that the file at relpath has the content identifier, and
+// returns the other files that have it.
+func (x *contentIndex) add(id, relpath string) []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	files := x.files[id]
+	for _, f := range files {
+		if f == relpath {
+			return files
+		}
+	}
+	if x.files == nil || len(x.files) >= maxContentIDs {
+		x.files = make(map[string][]string)
+	}
+	x.files[id] = append(files[:len(files):len(files)], relpath)
+	return files
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitStem(t *testing.T) {
+	tests := []struct {
+		name, stem, suffix string
+	}{
+		{"IMG_0001.CR2", "IMG_0001", ".CR2"},
+		{"IMG_0001.JPG", "IMG_0001", ".JPG"},
+		{"IMG_0001.xmp", "IMG_0001", ".xmp"},
+		{"IMG_0001.CR2.xmp", "IMG_0001", ".CR2.xmp"},
+		{"IMG_0001.JPG.XMP", "IMG_0001", ".JPG.XMP"},
+		{"IMG_0001.notes.xmp", "IMG_0001.notes", ".xmp"},
+		{"holiday.2019.MOV", "holiday.2019", ".MOV"},
+		{"README", "README", ""},
+		{".xmp", "", ".xmp"},
+	}
+	for _, tt := range tests {
+		stem, suffix := splitStem(tt.name)
+		if stem != tt.stem || suffix != tt.suffix {
+			t.Errorf("splitStem(%q) = %q, %q, want %q, %q", tt.name, stem, suffix, tt.stem, tt.suffix)
+		}
+	}
+}
+
+// testGroupArchive returns an archive whose root holds the named empty files
+// in a 2019 directory, each dated by its position in names.
+func testGroupArchive(t *testing.T, cfg ArchiveConfig, names ...string) (*Archive, string) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "2019")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range names {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := time.Date(2019, 7, 14, 10, 0, 0, 0, time.UTC).Add(time.Duration(i) * 24 * time.Hour)
+		if err := os.Chtimes(p, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg.Name = "photos"
+	cfg.Roots = []RootConfig{{Path: root}}
+	return testArchive(t, cfg), dir
+}
+
+func TestArchiveGroup(t *testing.T) {
+	a, dir := testGroupArchive(t, ArchiveConfig{Exclude: []string{"*.tmp.xmp"}},
+		"IMG_0001.CR2", "IMG_0001.JPG", "IMG_0001.CR2.xmp",
+		"IMG_0002.HEIC", "img_0002.mov",
+		"IMG_0003.xmp",
+		"IMG_0004.JPG", "IMG_0004.tmp.xmp",
+		"IMG_0005.JPG", "renamed.MOV",
+		"notes.txt", "notes.xmp",
+	)
+
+	tests := []struct {
+		name, contentID, primary string
+		members                  []string
+	}{
+		// A raw file with the camera's JPEG and a sidecar named after the
+		// raw file's full name.
+		{"IMG_0001.JPG", "", "IMG_0001.CR2", []string{"IMG_0001.CR2", "IMG_0001.CR2.xmp", "IMG_0001.JPG"}},
+		{"IMG_0001.CR2.xmp", "", "IMG_0001.CR2", []string{"IMG_0001.CR2", "IMG_0001.CR2.xmp", "IMG_0001.JPG"}},
+
+		// A Live Photo, whose stems differ in case.
+		{"img_0002.mov", "", "IMG_0002.HEIC", []string{"IMG_0002.HEIC", "img_0002.mov"}},
+
+		// Sidecars without their file, excluded files and files that
+		// aren't media stand alone.
+		{"IMG_0003.xmp", "", "IMG_0003.xmp", nil},
+		{"IMG_0004.JPG", "", "IMG_0004.JPG", nil},
+		{"notes.txt", "", "notes.txt", nil},
+		{"notes.xmp", "", "notes.xmp", nil},
+
+		// A Live Photo whose video was renamed is grouped by content
+		// identifier, once both files were seen.
+		{"IMG_0005.JPG", "live-5", "IMG_0005.JPG", nil},
+		{"renamed.MOV", "live-5", "IMG_0005.JPG", []string{"IMG_0005.JPG", "renamed.MOV"}},
+	}
+	for _, tt := range tests {
+		g, err := a.Group(filepath.Join(dir, tt.name), "2019/"+tt.name, tt.contentID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"2019/" + tt.name}
+		if tt.members != nil {
+			want = nil
+			for _, m := range tt.members {
+				want = append(want, "2019/"+m)
+			}
+		}
+		if g.Primary != "2019/"+tt.primary || strings.Join(g.Members, ",") != strings.Join(want, ",") {
+			t.Errorf("Group(%s) = %s %v, want %s %v", tt.name, g.Primary, g.Members, "2019/"+tt.primary, want)
+		}
+		if (len(want) > 1) != (g.Name() != "") {
+			t.Errorf("Group(%s).Name() = %q", tt.name, g.Name())
+		}
+	}
+}
+
+func TestArchiveGroupKey(t *testing.T) {
+	// The files are dated a day apart, and the template puts the date in
+	// the key.
+	cfg := ArchiveConfig{KeyTemplate: `{{.Archive}}/{{.ModTime.Format "2006/01-02"}}/{{.Name}}`}
+	a, dir := testGroupArchive(t, cfg,
+		"IMG_0001.CR2", "IMG_0001.JPG", "IMG_0001.CR2.xmp",
+		"IMG_0002.HEIC", "IMG_0002.MOV", "IMG_0002.mov",
+		"IMG_0003.JPG",
+	)
+
+	tests := []struct {
+		name, key string
+	}{
+		// Companions are stored next to the primary with their own suffix.
+		{"IMG_0001.CR2", "photos/2019/07-14/IMG_0001.CR2"},
+		{"IMG_0001.JPG", "photos/2019/07-14/IMG_0001.JPG"},
+		{"IMG_0001.CR2.xmp", "photos/2019/07-14/IMG_0001.CR2.xmp"},
+
+		// Members with the same suffix keep the template's key.
+		{"IMG_0002.HEIC", "photos/2019/07-17/IMG_0002.HEIC"},
+		{"IMG_0002.MOV", "photos/2019/07-18/IMG_0002.MOV"},
+		{"IMG_0002.mov", "photos/2019/07-19/IMG_0002.mov"},
+
+		// Files without companions have the template's key.
+		{"IMG_0003.JPG", "photos/2019/07-20/IMG_0003.JPG"},
+	}
+	for _, tt := range tests {
+		p := filepath.Join(dir, tt.name)
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, err := a.Group(p, "2019/"+tt.name, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := a.GroupKey(g, p, "2019/"+tt.name, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != tt.key {
+			t.Errorf("GroupKey(%s) = %s, want %s", tt.name, key, tt.key)
+		}
+	}
+
+	// Once the primary is removed locally, its cached key is used.
+	if err := a.Cache.Set(CacheItem{Filename: "2019/IMG_0001.CR2", Key: "photos/2018/12-31/IMG_0001.CR2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "IMG_0001.CR2")); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "IMG_0001.JPG")
+	info, _ := os.Stat(p)
+	g := FileGroup{Primary: "2019/IMG_0001.CR2", Members: []string{"2019/IMG_0001.CR2", "2019/IMG_0001.JPG"}}
+	if key, err := a.GroupKey(g, p, "2019/IMG_0001.JPG", info); err != nil || key != "photos/2018/12-31/IMG_0001.JPG" {
+		t.Errorf("GroupKey with a removed primary = %s, %v, want photos/2018/12-31/IMG_0001.JPG", key, err)
+	}
+}
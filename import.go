@@ -0,0 +1,861 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Actions that importing a file from a card can entail.
+const (
+	ImportCopy     = "copy"
+	ImportArchive  = "archive"
+	ImportSkip     = "skip"
+	ImportConflict = "conflict"
+)
+
+// DefaultImportFolder is the template of the folders that imported files are
+// copied into, relative to --into.
+const DefaultImportFolder = `{{.Taken.Format "2006/2006-01-02"}}`
+
+// ImportMarker is the file that --mark writes to the root of a card once all
+// of its media is archived.
+const ImportMarker = "MEDIA-ARCHIVE.TXT"
+
+// cardMediaDirs are the directories of a camera card that hold media: the DCF
+// folders under DCIM, and the video folders of AVCHD and XAVC cameras.
+var cardMediaDirs = []string{"DCIM", "PRIVATE/AVCHD/BDMV/STREAM", "PRIVATE/M4ROOT/CLIP", "MP_ROOT"}
+
+// ImportCmd handles the "import" command.
+var ImportCmd = &cobra.Command{
+	Use:   "import CARD...",
+	Short: "Imports the media on camera cards",
+	Long: `Imports the photos and videos on a camera card, e.g. /media/EOS_DIGITAL. The
+media is found in the card's DCIM folders, and in the video folders of AVCHD
+and XAVC cameras.
+
+Each file is copied into --into, which defaults to the archive's first root,
+under a folder rendered from the --folder template with the file's capture
+time, e.g. 2019/2019-07-14/IMG_0001.JPG. The copy is read back and compared
+with the card before it is renamed into place, so the daemon archives it like
+any other file. With --direct the files are archived straight from the card
+instead, under the path they would have been copied to.
+
+Files that are already in the catalog are skipped, even if they were renamed or
+moved since: they are recognized by their name, size and capture time. Files
+whose destination exists with different content are reported as conflicts.
+
+Once every file on the card is archived, --erase removes the imported files
+from the card and --mark writes ` + ImportMarker + ` to its root listing them.
+Copies are archived by the daemon, so --wait waits for it. Otherwise import
+the card again later; files that are already archived are skipped.
+
+With --dry-run nothing is copied or uploaded, and the planned action for each
+file is printed, as a table or as one JSON object per line with --json.
+
+Exports of cloud photo services are imported with "import cloud".`,
+	Run: RunImportCmd,
+}
+
+// ImportFolderData contains the fields available to the import folder
+// template.
+type ImportFolderData struct {
+
+	// Taken is when the file was captured, or its modification time if the
+	// capture time is unknown. Companions share the capture time of their
+	// primary file.
+	Taken time.Time
+
+	// Camera is the camera's make and model, e.g. "Canon EOS 5D", which is
+	// empty if it is unknown.
+	Camera string
+
+	// Card is the name of the card's mount point, e.g. EOS_DIGITAL, or the
+	// name of the cloud export.
+	Card string
+
+	// Album is the first album that a file of a cloud export belongs to,
+	// which is empty for cards.
+	Album string
+}
+
+// Fingerprint identifies a file regardless of its path, so that a file on a
+// card is recognized after it was archived under another name: its lower case
+// base name, its size, and its capture time or, if that is unknown, its
+// modification time to the second.
+type Fingerprint struct {
+	Name string
+	Size int64
+	Time string
+}
+
+func newFingerprint(name string, size int64, taken string, modTime time.Time) Fingerprint {
+	if taken == "" {
+		taken = modTime.UTC().Format(time.RFC3339)
+	}
+	return Fingerprint{Name: strings.ToLower(name), Size: size, Time: taken}
+}
+
+// ImportFile is a media file on a card, and what importing it entails.
+type ImportFile struct {
+	Action string `json:"action"`
+	Source string `json:"source"`
+
+	// Path is where the file is copied to, and Filename is its path in the
+	// archive. For files that are in the catalog already Filename is the
+	// path they were archived under.
+	Path     string `json:"path"`
+	Filename string `json:"filename"`
+
+	Size   int64  `json:"size"`
+	Reason string `json:"reason"`
+
+	// local is the file that is archived directly: the file on the card, or
+	// the file extracted from a cloud export. Metadata is what the export
+	// knows about it.
+	local    string
+	metadata *CloudMetadata
+	info     os.FileInfo
+
+	// member is the file's name in a cloud export, and modTime is the time
+	// that the file is dated with once it is extracted.
+	member  string
+	modTime time.Time
+}
+
+// Importer imports the media on camera cards into an archive.
+type Importer struct {
+	Archive *Archive
+
+	// Dir is the directory under one of the archive's roots that files are
+	// copied into, and Folder renders the folder under Dir from an
+	// ImportFolderData.
+	Dir    string
+	Folder *template.Template
+
+	// Direct archives the files from the card instead of copying them.
+	Direct bool
+
+	fingerprints map[Fingerprint]string
+}
+
+// NewImporter returns an Importer that copies files into the folders that
+// folder renders under dir, or archives them directly. The fingerprints of
+// the archived files are read from the archive's cache.
+func NewImporter(archive *Archive, dir, folder string, direct bool) (*Importer, error) {
+	tmpl, err := template.New("folder").Option("missingkey=error").Parse(folder)
+	if err != nil {
+		return nil, fmt.Errorf("invalid folder template: %s", err)
+	}
+
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if root, _ := resolveRoot(archive.roots, dir); root.Path == "" {
+		return nil, fmt.Errorf("directory not under a root [archive=%s] [dir=%s]", archive.Name, dir)
+	}
+
+	im := &Importer{
+		Archive:      archive,
+		Dir:          dir,
+		Folder:       tmpl,
+		Direct:       direct,
+		fingerprints: make(map[Fingerprint]string),
+	}
+	err = archive.Cache.Fingerprints(func(filename string, fp Fingerprint) error {
+		im.fingerprints[fp] = filename
+		return nil
+	})
+	return im, err
+}
+
+// CardMedia returns the paths of the media files and sidecars on the card
+// mounted at card, in path order. Hidden files, such as the ones macOS leaves
+// behind, and files that aren't media, such as the cameras' databases, are
+// left out.
+func CardMedia(card string) ([]string, error) {
+	var dirs []string
+	for _, d := range cardMediaDirs {
+		dir := filepath.Join(card, filepath.FromSlash(d))
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			dirs = append(dirs, dir)
+		}
+	}
+	if strings.EqualFold(filepath.Base(card), "DCIM") {
+		dirs = append(dirs, card)
+	}
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("no DCIM directory found [card=%s]", card)
+	}
+
+	var paths []string
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if strings.HasPrefix(info.Name(), ".") {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.IsDir() && mediaClass(path) != ClassOther {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// cardName returns the name of the card mounted at card.
+func cardName(card string) string {
+	card = filepath.Clean(card)
+	if strings.EqualFold(filepath.Base(card), "DCIM") {
+		card = filepath.Dir(card)
+	}
+	return filepath.Base(card)
+}
+
+// Plan decides what importing each media file on the card entails.
+func (im *Importer) Plan(card string) ([]ImportFile, error) {
+	paths, err := CardMedia(card)
+	if err != nil {
+		return nil, err
+	}
+
+	type cardFile struct {
+		path  string
+		info  os.FileInfo
+		media *Media
+	}
+	var found []cardFile
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, cardFile{path: path, info: info, media: ExtractMedia(f, info.Size(), path)})
+		f.Close()
+	}
+
+	// Companions are copied into the folder of the best ranked member with
+	// a capture time, since sidecars don't have one.
+	type dated struct {
+		taken time.Time
+		rank  int
+	}
+	dates := make(map[string]dated)
+	companions := func(path string) string {
+		stem, _ := splitStem(filepath.Base(path))
+		return filepath.Join(filepath.Dir(path), strings.ToLower(stem))
+	}
+	for _, f := range found {
+		rank := companionRanks[f.media.Class]
+		if d, ok := dates[companions(f.path)]; !f.media.Taken.IsZero() && (!ok || rank < d.rank) {
+			dates[companions(f.path)] = dated{taken: f.media.Taken, rank: rank}
+		}
+	}
+
+	var files []ImportFile
+	planned := make(map[string]string)
+	for _, f := range found {
+		taken := dates[companions(f.path)].taken
+		if taken.IsZero() {
+			taken = f.info.ModTime()
+		}
+
+		data := ImportFolderData{Taken: taken, Camera: f.media.Camera(), Card: cardName(card)}
+		dst, filename, err := im.destination(data, filepath.Base(f.path))
+		if err != nil {
+			return nil, fmt.Errorf("%s [source=%s]", err, f.path)
+		}
+		file := ImportFile{
+			Action:   ImportCopy,
+			Source:   f.path,
+			Path:     dst,
+			Filename: filename,
+			Size:     f.info.Size(),
+			Reason:   "new",
+			local:    f.path,
+			info:     f.info,
+		}
+		if im.Direct {
+			file.Action = ImportArchive
+		}
+
+		var captured string
+		if !f.media.Taken.IsZero() {
+			captured = f.media.Taken.Format(takenLayout)
+		}
+		fp := newFingerprint(filepath.Base(f.path), f.info.Size(), captured, f.info.ModTime())
+
+		if filename, ok := im.fingerprints[fp]; ok {
+			file.Action, file.Filename, file.Reason = ImportSkip, filename, "in catalog"
+		} else if other, ok := planned[dst]; ok {
+			file.Action, file.Reason = ImportConflict, "same name as "+other
+		} else if info, err := os.Stat(dst); err == nil {
+			if info.Size() == f.info.Size() && info.ModTime().Equal(f.info.ModTime()) {
+				file.Action, file.Reason = ImportSkip, "already copied"
+			} else {
+				file.Action, file.Reason = ImportConflict, "destination exists"
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		planned[dst] = f.path
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// destination returns the path that the file called name is copied to, in the
+// folder rendered from data, and its relative path in the archive.
+func (im *Importer) destination(data ImportFolderData, name string) (string, string, error) {
+	var b bytes.Buffer
+	if err := im.Folder.Execute(&b, data); err != nil {
+		return "", "", err
+	}
+	folder := filepath.Clean(filepath.FromSlash(b.String()))
+	if filepath.IsAbs(folder) || folder == ".." || strings.HasPrefix(folder, ".."+string(filepath.Separator)) {
+		return "", "", fmt.Errorf("folder not under the import directory [folder=%s]", b.String())
+	}
+
+	dst := filepath.Join(im.Dir, folder, name)
+	root, rel := resolveRoot(im.Archive.roots, dst)
+	return dst, strings.TrimLeft(root.Prefix+"/"+rel, "/"), nil
+}
+
+// Copy copies the file from the card to its destination. The copy is written
+// to a temporary file that is synced and read back, and only renamed into
+// place if its content matches what was read from the card. The file's
+// modification time is kept.
+func (im *Importer) Copy(f ImportFile) error {
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0755); err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(f.Path), fmt.Sprintf(".%s.%s.tmp", filepath.Base(f.Path), hex.EncodeToString(suffix)))
+
+	err := copyFile(f.Source, tmp, f.info)
+	if err == nil {
+		err = os.Rename(tmp, f.Path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("%s [source=%s] [filepath=%s]", err, f.Source, f.Path)
+	}
+	return nil
+}
+
+// copyFile copies src, described by info, to the new file dst and verifies
+// the copy.
+func copyFile(src, dst string, info os.FileInfo) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	h := md5.New()
+	n, err := io.Copy(w, io.TeeReader(r, h))
+	if err == nil {
+		err = w.Sync()
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if n != info.Size() {
+		return fmt.Errorf("size mismatch [expected=%d] [read=%d]", info.Size(), n)
+	}
+
+	sum, err := md5File(dst)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, h.Sum(nil)) {
+		return fmt.Errorf("copy doesn't match the card [md5=%x] [copy-md5=%x]", h.Sum(nil), sum)
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+func md5File(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Archived reports whether every backend has a current copy of the file, so
+// that it may be removed from the card. Duplicates that weren't uploaded
+// aren't archived.
+func (im *Importer) Archived(f ImportFile) (bool, error) {
+	item, err := im.Archive.Cache.Get(f.Filename)
+	if err == ErrNotCached {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return len(item.Copies) > 0 && item.DuplicateOf == "" && len(im.Archive.Pending(item, f.info)) == 0, nil
+}
+
+// unarchived returns the files that aren't archived yet.
+func (im *Importer) unarchived(files []ImportFile) ([]ImportFile, error) {
+	var pending []ImportFile
+	for _, f := range files {
+		ok, err := im.Archived(f)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			pending = append(pending, f)
+		}
+	}
+	return pending, nil
+}
+
+// importSource is the MediaSource of the files archived directly from a
+// card or a cloud export, which are named by the path they would have been
+// copied to.
+type importSource struct {
+	media     chan string
+	filenames map[string]string
+	metadata  map[string]*CloudMetadata
+}
+
+func (s *importSource) Media() <-chan string {
+	return s.media
+}
+
+func (s *importSource) RelativePath(path string) string {
+	return s.filenames[path]
+}
+
+func (s *importSource) Annotate(relpath string, m *Media) {
+	if md := s.metadata[relpath]; md != nil {
+		md.Apply(m)
+	}
+}
+
+// ArchiveDirect archives the files whose action is ImportArchive until ctx is
+// done, and returns the channel that ArchiveMedia reports errors through.
+func (im *Importer) ArchiveDirect(ctx context.Context, files []ImportFile, progress *Progress, workers int) <-chan error {
+	src := &importSource{
+		media:     make(chan string),
+		filenames: make(map[string]string),
+		metadata:  make(map[string]*CloudMetadata),
+	}
+	for _, f := range files {
+		if f.Action == ImportArchive {
+			src.filenames[f.local] = f.Filename
+			src.metadata[f.Filename] = f.metadata
+		}
+	}
+
+	go func() {
+		defer close(src.media)
+		for _, f := range files {
+			if f.Action != ImportArchive {
+				continue
+			}
+			progress.Discover(f.local, f.Size)
+			select {
+			case src.media <- f.local:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ArchiveMedia(ctx, src, im.Archive, progress, workers)
+}
+
+// Finish erases the imported files from the card, and writes a marker that
+// lists them to the card's root if mark is set. Files that were skipped are
+// only erased once their content is verified, since they were matched by
+// their size and times.
+func (im *Importer) Finish(card string, files []ImportFile, erase, mark bool) error {
+	if mark {
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "Archived to %s on %s:\r\n", im.Archive.Name, time.Now().Format(time.RFC3339))
+		for _, f := range files {
+			rel, err := filepath.Rel(card, f.Source)
+			if err != nil {
+				rel = f.Source
+			}
+			fmt.Fprintf(&b, "%s\t%s\r\n", filepath.ToSlash(rel), f.Filename)
+		}
+		if err := ioutil.WriteFile(filepath.Join(card, ImportMarker), b.Bytes(), 0644); err != nil {
+			return err
+		}
+		log.Printf("card marked as imported [card=%s] [marker=%s]", card, ImportMarker)
+	}
+
+	if erase {
+		kept := 0
+		for _, f := range files {
+			if f.Action == ImportSkip {
+				if err := im.verify(f); err != nil {
+					log.Printf("WARNING file left on the card [source=%s] [filename=%s]: %s", f.Source, f.Filename, err)
+					kept++
+					continue
+				}
+			}
+			if err := os.Remove(f.Source); err != nil {
+				return err
+			}
+		}
+		log.Printf("card erased [card=%s] [files=%d] [kept=%d]", card, len(files)-kept, kept)
+	}
+	return nil
+}
+
+// verify compares the content of a skipped file with the copy it was matched
+// with: the file it was already copied to, the local original of the file in
+// the catalog, or else the archived copy.
+func (im *Importer) verify(f ImportFile) error {
+	sum, err := md5File(f.Source)
+	if err != nil {
+		return err
+	}
+
+	local := f.Path
+	if f.Reason == "in catalog" {
+		local, _ = localPath(im.Archive.roots, f.Filename)
+	}
+	if local != "" {
+		if other, err := md5File(local); err == nil {
+			if !bytes.Equal(sum, other) {
+				return fmt.Errorf("content doesn't match [filepath=%s]", local)
+			}
+			return nil
+		}
+	}
+
+	item, err := im.Archive.Cache.Get(f.Filename)
+	if err != nil {
+		return err
+	}
+	src, ok := restoreSource(item, im.Archive.Backends)
+	if !ok {
+		return errors.New("no archived copy to verify against")
+	}
+	r, err := openCopy(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, h.Sum(nil)) {
+		return fmt.Errorf("content doesn't match the archived copy [backend=%s]", src.backend.Name())
+	}
+	return nil
+}
+
+// RunImportCmd is the work function for ImportCmd.
+func RunImportCmd(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		panic(errors.New("card is required"))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	EventListener(cancel)
+
+	dryRun := viper.GetBool("dry-run")
+	im, catalog, db := openImporter(viper.GetBool("direct"), dryRun)
+	defer db.Close()
+
+	failed := 0
+	for _, card := range args {
+		n, err := importCard(ctx, im, card, dryRun)
+		if err != nil {
+			log.Println("ERROR", err)
+			n++
+		}
+		failed += n
+	}
+
+	if catalog != nil && im.Direct {
+		if err := catalog.Snapshot(); err != nil {
+			log.Println("ERROR", err)
+		}
+	}
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// openImporter opens the cache and the archive that files are imported into,
+// and returns an Importer for it. The archive's catalog is merged first, so
+// that files imported on other machines are skipped as well, and returned
+// unless the catalog isn't shared or this is a dry run.
+func openImporter(direct, dryRun bool) (*Importer, *Catalog, *SQLiteDB) {
+	cfg, err := LoadConfig()
+	if err != nil {
+		panic(err)
+	}
+
+	ac, err := importArchiveConfig(cfg)
+	if err != nil {
+		panic(err)
+	}
+
+	dir, err := CacheDir()
+	if err != nil {
+		panic(err)
+	}
+
+	var db *SQLiteDB
+	if dryRun {
+		db, err = OpenSQLiteDBReadOnly(dir)
+	} else {
+		db, err = OpenSQLiteDB(dir)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	cache, err := db.Cache(ac.Name)
+	if err != nil {
+		panic(err)
+	}
+
+	var archive *Archive
+	if dryRun {
+		archive, err = NewOfflineArchive(ac, cache)
+	} else {
+		var throttle *Throttle
+		if throttle, err = NewThrottle("global", cfg.Bandwidth); err == nil {
+			archive, err = NewArchive(ac, cache, throttle)
+		}
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	var catalog *Catalog
+	if ac.Catalog.Enabled() && !dryRun {
+		catalog = NewCatalog(archive, ac.Catalog)
+		if _, err := catalog.Merge(); err != nil {
+			log.Println("ERROR", err)
+		}
+	}
+
+	into := viper.GetString("into")
+	if into == "" {
+		into = ac.Roots[0].Path
+	}
+	im, err := NewImporter(archive, into, viper.GetString("folder"), direct)
+	if err != nil {
+		panic(err)
+	}
+	return im, catalog, db
+}
+
+// importArchiveConfig returns the archive that files are imported into: the
+// only configured archive, or the one named by --archive-name.
+func importArchiveConfig(cfg *Config) (ArchiveConfig, error) {
+	if len(cfg.Archives) == 1 {
+		return cfg.Archives[0], nil
+	}
+	return cfg.Archive(viper.GetString("archive-name"))
+}
+
+// importCard imports the media on a single card and returns the number of
+// files that failed or conflict.
+func importCard(ctx context.Context, im *Importer, card string, dryRun bool) (int, error) {
+	files, err := im.Plan(card)
+	if err != nil {
+		return 0, err
+	}
+
+	if dryRun {
+		return 0, printImportPlan(os.Stdout, files, viper.GetBool("json"))
+	}
+
+	failed := 0
+	counts := make(map[string]int)
+	var imported []ImportFile
+	for _, f := range files {
+		counts[f.Action]++
+		switch f.Action {
+		case ImportConflict:
+			log.Printf("ERROR file not imported [source=%s] [filepath=%s]: %s", f.Source, f.Path, f.Reason)
+			continue
+		case ImportCopy:
+			if err := im.Copy(f); err != nil {
+				log.Println("ERROR", err)
+				failed++
+				continue
+			}
+			log.Printf("file imported [card=%s] [source=%s] [filepath=%s]", card, f.Source, f.Path)
+		}
+		imported = append(imported, f)
+	}
+
+	if im.Direct {
+		n, err := archiveImported(ctx, im, files)
+		if err != nil {
+			return failed, err
+		}
+		failed += n
+	}
+
+	log.Printf("card imported [card=%s] [copied=%d] [archived=%d] [skipped=%d] [conflicts=%d] [errors=%d]", card, counts[ImportCopy], counts[ImportArchive], counts[ImportSkip], counts[ImportConflict], failed)
+	failed += counts[ImportConflict]
+
+	erase, mark := viper.GetBool("erase"), viper.GetBool("mark")
+	if !erase && !mark {
+		return failed, nil
+	}
+	if failed > 0 {
+		log.Printf("WARNING card left as it is since not every file was imported [card=%s]", card)
+		return failed, nil
+	}
+
+	// Copies are archived by the daemon, which writes the cache in batches.
+	pending, err := im.unarchived(imported)
+	deadline := time.Now().Add(viper.GetDuration("wait"))
+	for err == nil && len(pending) > 0 && time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return failed, ctx.Err()
+		case <-time.After(cacheFlushInterval):
+		}
+		pending, err = im.unarchived(pending)
+	}
+	if err != nil {
+		return failed, err
+	}
+	if len(pending) > 0 {
+		log.Printf("WARNING card left as it is since files aren't archived yet [card=%s] [pending=%d] [first=%s]", card, len(pending), pending[0].Filename)
+		return failed, nil
+	}
+
+	return failed, im.Finish(card, imported, erase, mark)
+}
+
+// archiveImported archives the files whose action is ImportArchive, reporting
+// progress like the daemon does, and returns the number of errors.
+func archiveImported(ctx context.Context, im *Importer, files []ImportFile) (int, error) {
+	progress := NewProgress()
+	reporter, err := NewProgressReporter(progress, os.Stderr, viper.GetString("progress"), viper.GetDuration("progress-interval"))
+	if err != nil {
+		return 0, err
+	}
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	if reporter != nil {
+		go reporter.Run(ctx)
+	}
+
+	failed := 0
+	for err := range im.ArchiveDirect(ctx, files, progress, viper.GetInt("workers")) {
+		log.Println("ERROR", err)
+		failed++
+	}
+	return failed, ctx.Err()
+}
+
+// printImportPlan writes the action planned for each file as a table, or as
+// one JSON object per line.
+func printImportPlan(w io.Writer, files []ImportFile, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		for _, f := range files {
+			if err := enc.Encode(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tSOURCE\tFILENAME\tSIZE\tREASON")
+	for _, f := range files {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", f.Action, f.Source, f.Filename, formatBytes(f.Size), f.Reason)
+	}
+	return tw.Flush()
+}
+
+// InitImportCmdConfig adds configuration options specific to ImportCmd.
+func InitImportCmdConfig(cmd *cobra.Command) {
+
+	cmd.PersistentFlags().String("into", "", "The directory under one of the archive's roots that files are copied into, defaults to the first root.")
+	viper.BindPFlag("into", cmd.PersistentFlags().Lookup("into"))
+	viper.SetDefault("into", "")
+
+	cmd.PersistentFlags().String("folder", DefaultImportFolder, "The template of the folder that each file is copied into, with the fields Taken, Camera, Card and Album.")
+	viper.BindPFlag("folder", cmd.PersistentFlags().Lookup("folder"))
+	viper.SetDefault("folder", DefaultImportFolder)
+
+	cmd.Flags().Bool("direct", false, "Archive the files from the card instead of copying them.")
+	viper.BindPFlag("direct", cmd.Flags().Lookup("direct"))
+	viper.SetDefault("direct", false)
+
+	cmd.Flags().Bool("erase", false, "Remove the imported files from the card once all of them are archived.")
+	viper.BindPFlag("erase", cmd.Flags().Lookup("erase"))
+	viper.SetDefault("erase", false)
+
+	cmd.Flags().Bool("mark", false, "Write "+ImportMarker+" to the card once all of its files are archived.")
+	viper.BindPFlag("mark", cmd.Flags().Lookup("mark"))
+	viper.SetDefault("mark", false)
+
+	cmd.Flags().Duration("wait", 0, "How long to wait for the daemon to archive the copies before the card is erased or marked.")
+	viper.BindPFlag("wait", cmd.Flags().Lookup("wait"))
+	viper.SetDefault("wait", 0)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCard writes the files to a card's DCIM directory, dated modTime, and
+// returns the card's path.
+func testCard(t *testing.T, modTime time.Time, files map[string]string) string {
+	card := filepath.Join(t.TempDir(), "EOS_DIGITAL")
+	for name, data := range files {
+		p := filepath.Join(card, "DCIM", "100CANON", name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return card
+}
+
+// testImporter returns an Importer that copies into the import directory of
+// an archive with a single root, where the files in archived were archived
+// to b with the content of the files in the map.
+func testImporter(t *testing.T, b *memBackend, modTime time.Time, archived map[string]string) *Importer {
+	root := t.TempDir()
+	a := testArchive(t, ArchiveConfig{Name: "photos", Roots: []RootConfig{{Path: root}}}, b)
+	for filename, data := range archived {
+		if err := b.Put(filename, strings.NewReader(data), int64(len(data)), PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		err := a.Cache.Set(CacheItem{
+			Filename:   filename,
+			Size:       int64(len(data)),
+			ModTime:    modTime,
+			Key:        filename,
+			ArchivedAt: modTime,
+			Copies:     []Copy{{Backend: b.Name(), Key: filename, Size: int64(len(data)), ModTime: modTime, ArchivedAt: modTime}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	im, err := NewImporter(a, filepath.Join(root, "import"), DefaultImportFolder, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return im
+}
+
+func TestImporterPlan(t *testing.T) {
+	modTime := time.Date(2019, 7, 14, 10, 0, 0, 0, time.UTC)
+	card := testCard(t, modTime, map[string]string{
+		"IMG_0001.JPG": "archived",
+		"IMG_0002.JPG": "new",
+		"IMG_0003.JPG": "copied",
+		"IMG_0004.JPG": "conflicting",
+		"INDEX.DAT":    "not media",
+	})
+	im := testImporter(t, newMemBackend("mem"), modTime, map[string]string{
+		"2019/IMG_0001.JPG": "archived",
+	})
+
+	// A previous import copied IMG_0003.JPG, and another file is in the way
+	// of IMG_0004.JPG.
+	folder := filepath.Join(im.Dir, "2019", "2019-07-14")
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyFile(filepath.Join(card, "DCIM", "100CANON", "IMG_0003.JPG"), filepath.Join(folder, "IMG_0003.JPG"), testStat(t, filepath.Join(card, "DCIM", "100CANON", "IMG_0003.JPG"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(folder, "IMG_0004.JPG"), []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := im.Plan(card)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		name, action, filename, reason string
+	}{
+		{"IMG_0001.JPG", ImportSkip, "2019/IMG_0001.JPG", "in catalog"},
+		{"IMG_0002.JPG", ImportCopy, "import/2019/2019-07-14/IMG_0002.JPG", "new"},
+		{"IMG_0003.JPG", ImportSkip, "import/2019/2019-07-14/IMG_0003.JPG", "already copied"},
+		{"IMG_0004.JPG", ImportConflict, "import/2019/2019-07-14/IMG_0004.JPG", "destination exists"},
+	}
+	if len(files) != len(want) {
+		t.Fatalf("planned %d files, want %d: %+v", len(files), len(want), files)
+	}
+	for i, w := range want {
+		f := files[i]
+		if filepath.Base(f.Source) != w.name || f.Action != w.action || f.Filename != w.filename || f.Reason != w.reason {
+			t.Errorf("planned %s %s %s (%s), want %s %s %s (%s)", filepath.Base(f.Source), f.Action, f.Filename, f.Reason, w.name, w.action, w.filename, w.reason)
+		}
+	}
+	if p := filepath.Join(folder, "IMG_0002.JPG"); files[1].Path != p {
+		t.Errorf("copied to %s, want %s", files[1].Path, p)
+	}
+}
+
+func TestImporterFinish(t *testing.T) {
+	modTime := time.Date(2019, 7, 14, 10, 0, 0, 0, time.UTC)
+	card := testCard(t, modTime, map[string]string{
+		"IMG_0001.JPG": "archived",
+		"IMG_0002.JPG": "modified",
+		"IMG_0003.JPG": "new",
+	})
+
+	// IMG_0002.JPG matches an archived file by its name, size and time,
+	// but not by its content.
+	im := testImporter(t, newMemBackend("mem"), modTime, map[string]string{
+		"2019/IMG_0001.JPG": "archived",
+		"2019/IMG_0002.JPG": "original",
+	})
+
+	files, err := im.Plan(card)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if f.Action == ImportCopy {
+			if err := im.Copy(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := im.Finish(card, files, true, true); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(card, "DCIM", "100CANON")
+	for name, kept := range map[string]bool{"IMG_0001.JPG": false, "IMG_0002.JPG": true, "IMG_0003.JPG": false} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != kept {
+			t.Errorf("%s kept on the card: %v, want %v", name, err == nil, kept)
+		}
+	}
+
+	marker, err := ioutil.ReadFile(filepath.Join(card, ImportMarker))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"DCIM/100CANON/IMG_0001.JPG\t2019/IMG_0001.JPG\r\n",
+		"DCIM/100CANON/IMG_0003.JPG\timport/2019/2019-07-14/IMG_0003.JPG\r\n",
+	} {
+		if !strings.Contains(string(marker), line) {
+			t.Errorf("marker doesn't list %q:\n%s", line, marker)
+		}
+	}
+}
+
+func TestImporterVerifyLocal(t *testing.T) {
+	modTime := time.Date(2019, 7, 14, 10, 0, 0, 0, time.UTC)
+	card := testCard(t, modTime, map[string]string{"IMG_0001.JPG": "archived"})
+
+	// The local original is compared without reading the archived copy,
+	// which is gone from the backend.
+	b := newMemBackend("mem")
+	im := testImporter(t, b, modTime, map[string]string{"2019/IMG_0001.JPG": "archived"})
+	delete(b.objects, "2019/IMG_0001.JPG")
+
+	files, err := im.Plan(card)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.verify(files[0]); err == nil {
+		t.Error("verified without a local original or an archived copy")
+	}
+
+	local := filepath.Join(im.Archive.roots[0].Path, "2019", "IMG_0001.JPG")
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(local, []byte("archived"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.verify(files[0]); err != nil {
+		t.Errorf("verify against the local original: %s", err)
+	}
+}
+
+func testStat(t *testing.T, p string) os.FileInfo {
+	info, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
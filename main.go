@@ -6,8 +6,11 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -26,19 +29,177 @@ func RunRootCmd(cmd *cobra.Command, args []string) {
 	ctx, cancel := context.WithCancel(context.Background())
 	EventListener(cancel)
 
-	archive := viper.GetString("archive-name")
-	bucket := viper.GetString("aws-bucket")
-	root := viper.GetString("root-dir")
+	cfg, err := LoadConfig()
+	if err != nil {
+		panic(err)
+	}
+
+	// There is nothing to watch in a dry run, the roots are scanned once.
+	if viper.GetBool("dry-run") {
+		if err := DryRun(cfg, os.Stdout, viper.GetBool("json")); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	dir, err := CacheDir()
+	if err != nil {
+		panic(err)
+	}
 
-	watcher, err := NewMediaWatcher(root)
+	db, err := OpenSQLiteDB(dir)
 	if err != nil {
 		panic(err)
 	}
+	defer db.Close()
 
-	err2 := ArchiveMedia(watcher, archive, bucket)
-	HandleErrors(watcher.Errors(), err2)
+	control := NewControl(cancel)
+	errs, catalogs, stopped := ArchiveAll(ctx, cfg, db, true, control)
+	HandleErrors(errs...)
 
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		if viper.GetString("control") == ControlOff {
+			return
+		}
+		network, addr, err := ControlAddress()
+		if err == nil {
+			err = control.Serve(ctx, network, addr)
+		}
+		if err != nil {
+			log.Println("ERROR", fmt.Errorf("cannot serve the control API: %s", err))
+		}
+	}()
+
+	uiServed := make(chan struct{})
+	go func() {
+		defer close(uiServed)
+		addr := viper.GetString("ui")
+		if addr == "" {
+			return
+		}
+		restoreDir := viper.GetString("ui-restore-dir")
+		if restoreDir == "" {
+			restoreDir = filepath.Join(dir, "restores")
+		}
+		if err := NewUI(db, control, restoreDir).Serve(ctx, addr); err != nil {
+			log.Println("ERROR", fmt.Errorf("cannot serve the web UI: %s", err))
+		}
+	}()
+
+	// The files archived before the shutdown must be cached before the
+	// final snapshot is taken and the cache is closed.
 	<-ctx.Done()
+	<-stopped
+	SnapshotCatalogs(catalogs)
+	<-served
+	<-uiServed
+	control.RemoveToken()
+}
+
+// ArchiveAll starts archiving all configured archives, and returns their
+// error channels. If watch is set the roots are watched for changes,
+// otherwise they are scanned once and the channels are closed when all files
+// have been archived. Progress is reported and archiving continues until ctx
+// is done, and the returned stopped channel is closed once every archive has
+// stopped and written its cache. Archives that share their catalog merge it
+// before archiving starts, and their catalogs are returned. The archives are
+// registered with control unless it is nil.
+func ArchiveAll(ctx context.Context, cfg *Config, db *SQLiteDB, watch bool, control *Control) ([]<-chan error, []*Catalog, <-chan struct{}) {
+	progress := NewProgress()
+	reporter, err := NewProgressReporter(progress, os.Stderr, viper.GetString("progress"), viper.GetDuration("progress-interval"))
+	if err != nil {
+		panic(err)
+	}
+	if reporter != nil {
+		go reporter.Run(ctx)
+	}
+
+	throttle, err := NewThrottle("global", cfg.Bandwidth)
+	if err != nil {
+		panic(err)
+	}
+	ThrottleListener(throttle, reloadBandwidth)
+	go func() {
+		<-ctx.Done()
+		throttle.Stop()
+	}()
+	if control != nil {
+		control.throttle = throttle
+		control.progress = progress
+	}
+
+	var errs []<-chan error
+	var catalogs []*Catalog
+	var archiving sync.WaitGroup
+	for _, ac := range cfg.Archives {
+		cache, err := db.Cache(ac.Name)
+		if err != nil {
+			panic(err)
+		}
+
+		archive, err := NewArchive(ac, cache, throttle)
+		if err != nil {
+			panic(err)
+		}
+
+		if ac.Catalog.Enabled() {
+			catalog := NewCatalog(archive, ac.Catalog)
+			if _, err := catalog.Merge(); err != nil {
+				log.Println("ERROR", err)
+			}
+			go catalog.Run(ctx)
+			catalogs = append(catalogs, catalog)
+		}
+
+		var watcher *MediaWatcher
+		if watch {
+			if watcher, err = NewMediaWatcher(ac.Roots, archive.Filter, progress); err != nil {
+				panic(err)
+			}
+		} else {
+			watcher = ScanMedia(ac.Roots, archive.Filter, progress)
+		}
+
+		control.register(archive, watcher)
+		archiving.Add(1)
+		archived := ArchiveMedia(ctx, watcher, archive, progress, viper.GetInt("workers"))
+		errs = append(errs, watcher.Errors(), notifyClosed(archived, archiving.Done))
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		archiving.Wait()
+		close(stopped)
+	}()
+
+	return errs, catalogs, stopped
+}
+
+// SnapshotCatalogs uploads a final snapshot of each catalog.
+func SnapshotCatalogs(catalogs []*Catalog) {
+	for _, c := range catalogs {
+		if err := c.Snapshot(); err != nil {
+			log.Println("ERROR", err)
+		}
+	}
+}
+
+// reloadBandwidth re-reads the global bandwidth settings from the
+// configuration file.
+func reloadBandwidth() (BandwidthConfig, error) {
+	var cfg BandwidthConfig
+	if err := viper.ReadInConfig(); err != nil {
+		return cfg, err
+	}
+	if err := viper.UnmarshalKey("bandwidth", &cfg); err != nil {
+		return cfg, err
+	}
+	if limit := viper.GetString("bandwidth-limit"); limit != "" {
+		cfg.Limit = limit
+	}
+	return cfg, cfg.Validate()
 }
 
 var TestCmd = &cobra.Command{
@@ -52,7 +213,18 @@ func RunTestCmd(cmd *cobra.Command, args []string) {
 	ctx, cancel := context.WithCancel(context.Background())
 	EventListener(cancel)
 
-	cache, err := NewSQLiteCache("media-archive")
+	dir, err := CacheDir()
+	if err != nil {
+		panic(err)
+	}
+
+	db, err := OpenSQLiteDB(dir)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	cache, err := db.Cache(viper.GetString("archive-name"))
 	if err != nil {
 		panic(err)
 	}
@@ -63,7 +235,7 @@ func RunTestCmd(cmd *cobra.Command, args []string) {
 		panic(err)
 	}
 
-	err = cache.Set(CacheItem{filename})
+	err = cache.Set(CacheItem{Filename: filename})
 	if err != nil {
 		panic(err)
 	}
@@ -86,7 +258,13 @@ func main() {
 	AddSubcommands(RootCmd)
 	InitGlobalConfig(RootCmd)
 	InitRootCmdConfig(RootCmd)
-	InitTestCmdConfig(TestCmd)
+	InitUIConfig(RootCmd)
+	InitStatusCmdConfig(StatusCmd)
+	InitRestoreCmdConfig(RestoreCmd)
+	InitQueryCmdConfig(QueryCmd)
+	InitDuplicatesCmdConfig(DuplicatesCmd)
+	InitImportCmdConfig(ImportCmd)
+	InitImportCloudCmdConfig(ImportCloudCmd)
 
 	if err := RootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -111,6 +289,19 @@ func EventListener(cancel context.CancelFunc) {
 // AddSubcommands adds subcommands (usually) to the root command.
 func AddSubcommands(cmd *cobra.Command) {
 	cmd.AddCommand(TestCmd)
+	cmd.AddCommand(StatusCmd)
+	cmd.AddCommand(RestoreCmd)
+	cmd.AddCommand(SyncCmd)
+	cmd.AddCommand(QueryCmd)
+	cmd.AddCommand(DuplicatesCmd)
+	cmd.AddCommand(CtlCmd)
+
+	ImportCmd.AddCommand(ImportCloudCmd)
+	cmd.AddCommand(ImportCmd)
+
+	CacheCmd.AddCommand(CacheRebuildCmd)
+	CacheCmd.AddCommand(CacheIndexCmd)
+	cmd.AddCommand(CacheCmd)
 }
 
 // InitGlobalConfig adds global configuration options.
@@ -120,27 +311,56 @@ func InitGlobalConfig(cmd *cobra.Command) {
 	viper.BindPFlag("debug", cmd.PersistentFlags().Lookup("debug"))
 	viper.SetDefault("debug", false)
 
-	cmd.Flags().StringP("archive-name", "n", "media-archive", "The name of the archive, e.g. my-photos.")
-	viper.BindPFlag("archive-name", cmd.Flags().Lookup("archive-name"))
+	cmd.PersistentFlags().StringP("config", "c", "", "The configuration file, defaults to searching the XDG config directories for media-archive/config.yaml.")
+	viper.BindPFlag("config", cmd.PersistentFlags().Lookup("config"))
+	viper.SetDefault("config", "")
+
+	cmd.PersistentFlags().String("cache-dir", "", "The directory the cache database is stored in, defaults to the user cache directory.")
+	viper.BindPFlag("cache-dir", cmd.PersistentFlags().Lookup("cache-dir"))
+	viper.SetDefault("cache-dir", "")
+
+	cmd.PersistentFlags().String("control", "", "The address of the control API, a Unix socket path or a loopback host:port. Defaults to control.sock in the cache directory, \"off\" disables it.")
+	viper.BindPFlag("control", cmd.PersistentFlags().Lookup("control"))
+	viper.SetDefault("control", "")
+
+	cmd.PersistentFlags().StringP("archive-name", "n", "media-archive", "The name of the archive, e.g. my-photos.")
+	viper.BindPFlag("archive-name", cmd.PersistentFlags().Lookup("archive-name"))
 	viper.SetDefault("archive-name", "media-archive")
 }
 
-// InitRootCmdConfig adds configuration options specific to RootCmd.
+// InitRootCmdConfig adds configuration options for archiving, which are shared
+// by RootCmd and its subcommands.
 func InitRootCmdConfig(cmd *cobra.Command) {
 
-	cmd.Flags().StringP("root-dir", "D", ".", "The root directory that media files are contained under.")
-	viper.BindPFlag("root-dir", cmd.Flags().Lookup("root-dir"))
+	cmd.PersistentFlags().StringP("root-dir", "D", ".", "The root directory that media files are contained under.")
+	viper.BindPFlag("root-dir", cmd.PersistentFlags().Lookup("root-dir"))
 	viper.SetDefault("root-dir", ".")
 
-	cmd.Flags().StringP("aws-bucket", "b", "", "The AWS S3 bucket that media files are archived to.")
-	viper.BindPFlag("aws-bucket", cmd.Flags().Lookup("aws-bucket"))
+	cmd.PersistentFlags().StringP("aws-bucket", "b", "", "The AWS S3 bucket that media files are archived to.")
+	viper.BindPFlag("aws-bucket", cmd.PersistentFlags().Lookup("aws-bucket"))
 	viper.SetDefault("aws-bucket", "")
-}
 
-// InitTestCmdConfig adds configuration options specific to TestCmd.
-func InitTestCmdConfig(cmd *cobra.Command) {
+	cmd.PersistentFlags().IntP("workers", "w", 4, "The number of files that are uploaded concurrently.")
+	viper.BindPFlag("workers", cmd.PersistentFlags().Lookup("workers"))
+	viper.SetDefault("workers", 4)
 
-	cmd.Flags().StringP("root-dir", "D", ".", "The root directory that media files are contained under.")
-	viper.BindPFlag("root-dir", cmd.Flags().Lookup("root-dir"))
-	viper.SetDefault("root-dir", ".")
+	cmd.PersistentFlags().String("progress", ProgressAuto, "How progress is reported, one of auto, tty, log or off.")
+	viper.BindPFlag("progress", cmd.PersistentFlags().Lookup("progress"))
+	viper.SetDefault("progress", ProgressAuto)
+
+	cmd.PersistentFlags().String("bandwidth-limit", "", "The global upload bandwidth limit, e.g. 1MB for 1 MiB/s. Overrides the configuration file's limit.")
+	viper.BindPFlag("bandwidth-limit", cmd.PersistentFlags().Lookup("bandwidth-limit"))
+	viper.SetDefault("bandwidth-limit", "")
+
+	cmd.PersistentFlags().Duration("progress-interval", time.Minute, "How often a progress summary is logged when not running in a terminal.")
+	viper.BindPFlag("progress-interval", cmd.PersistentFlags().Lookup("progress-interval"))
+	viper.SetDefault("progress-interval", time.Minute)
+
+	cmd.PersistentFlags().Bool("dry-run", false, "Show what would be archived without uploading or writing to the cache.")
+	viper.BindPFlag("dry-run", cmd.PersistentFlags().Lookup("dry-run"))
+	viper.SetDefault("dry-run", false)
+
+	cmd.PersistentFlags().Bool("json", false, "Print output as JSON, one object per line.")
+	viper.BindPFlag("json", cmd.PersistentFlags().Lookup("json"))
+	viper.SetDefault("json", false)
 }
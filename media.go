@@ -0,0 +1,761 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Media classes, which are derived from the file's extension.
+const (
+	ClassImage   = "image"
+	ClassRaw     = "raw"
+	ClassVideo   = "video"
+	ClassAudio   = "audio"
+	ClassSidecar = "sidecar"
+	ClassOther   = "other"
+)
+
+var mediaClasses = map[string]string{
+	".jpg": ClassImage, ".jpeg": ClassImage, ".png": ClassImage, ".gif": ClassImage,
+	".heic": ClassImage, ".heif": ClassImage, ".webp": ClassImage, ".bmp": ClassImage,
+	".tif": ClassImage, ".tiff": ClassImage,
+
+	".cr2": ClassRaw, ".cr3": ClassRaw, ".nef": ClassRaw, ".arw": ClassRaw,
+	".dng": ClassRaw, ".orf": ClassRaw, ".rw2": ClassRaw, ".raf": ClassRaw,
+	".srw": ClassRaw, ".pef": ClassRaw,
+
+	".mov": ClassVideo, ".mp4": ClassVideo, ".m4v": ClassVideo, ".avi": ClassVideo,
+	".mkv": ClassVideo, ".mts": ClassVideo, ".m2ts": ClassVideo, ".3gp": ClassVideo,
+
+	".mp3": ClassAudio, ".m4a": ClassAudio, ".aac": ClassAudio, ".wav": ClassAudio,
+	".flac": ClassAudio, ".ogg": ClassAudio,
+
+	".xmp": ClassSidecar, ".aae": ClassSidecar, ".thm": ClassSidecar,
+}
+
+// takenLayout is the format that capture times are stored and queried in.
+// It is the wall clock time where the file was captured, without a zone.
+const takenLayout = "2006-01-02T15:04:05"
+
+// Media is the metadata extracted from a media file.
+type Media struct {
+
+	// Class is the kind of file, e.g. ClassImage or ClassVideo.
+	Class string `json:"class"`
+
+	// Taken is when the file was captured, which is zero if it is unknown.
+	Taken time.Time `json:"taken"`
+
+	// Make and Model identify the camera.
+	Make  string `json:"make,omitempty"`
+	Model string `json:"model,omitempty"`
+
+	// Location is where the file was captured, if it is known.
+	Location *Location `json:"location,omitempty"`
+
+	// Tags are the keywords in the file's XMP metadata, and the albums of a
+	// cloud export that it belongs to.
+	Tags []string `json:"tags,omitempty"`
+
+	// Description is the caption that the file was given in a cloud photo
+	// service. It is only searchable, not cached.
+	Description string `json:"description,omitempty"`
+
+	// Hash is the perceptual hash of an image, see Picture.Hash, and Width
+	// and Height are its size in pixels once it is upright. They are only
+	// set for images that were decoded.
+	Hash   string `json:"hash,omitempty"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+
+	// ContentID is the identifier that Apple devices give both files of a
+	// Live Photo, read from the photo's maker note and the video's
+	// QuickTime metadata.
+	ContentID string `json:"content_id,omitempty"`
+
+	// Orientation is the EXIF orientation, from 1 to 8, which is zero if it
+	// is unknown. It isn't cached, previews are rotated with it.
+	Orientation int `json:"-"`
+}
+
+// Location is a GPS position in decimal degrees.
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// Camera returns the camera's make and model, leaving out the make if the
+// model already starts with it, e.g. "Canon EOS 5D".
+func (m *Media) Camera() string {
+	if m.Make == "" || strings.HasPrefix(strings.ToLower(m.Model), strings.ToLower(m.Make)) {
+		return m.Model
+	}
+	return strings.TrimSpace(m.Make + " " + m.Model)
+}
+
+// mediaClass returns the class of the file by its extension.
+func mediaClass(name string) string {
+	if class, ok := mediaClasses[strings.ToLower(filepath.Ext(name))]; ok {
+		return class
+	}
+	return ClassOther
+}
+
+// ExtractMedia reads the metadata of the file called name from r, which holds
+// size bytes. EXIF is read from JPEG, TIFF based raw and HEIF files, and the
+// creation time, camera and location from MP4 and QuickTime files. Metadata
+// that can't be parsed is left out, so the class is always set.
+func ExtractMedia(r io.ReaderAt, size int64, name string) *Media {
+	m := &Media{Class: mediaClass(name)}
+
+	head := make([]byte, 12)
+	if n, _ := r.ReadAt(head, 0); n < len(head) {
+		return m
+	}
+
+	switch {
+	case head[0] == 0xFF && head[1] == 0xD8:
+		readJPEG(r, size, m)
+	case isTIFF(head):
+		readTIFF(io.NewSectionReader(r, 0, size), m)
+	case string(head[4:8]) == "ftyp":
+		switch string(head[8:12]) {
+		case "heic", "heix", "heim", "heis", "mif1", "msf1":
+			readHEIF(r, size, m)
+		default:
+			readMP4(r, size, m)
+		}
+	}
+
+	if m.Class == ClassSidecar || m.Class == ClassImage || m.Class == ClassRaw {
+		m.Tags = readXMPTags(r, size)
+	}
+	return m
+}
+
+// isTIFF reports whether the file starts with a TIFF header, including the
+// variants used by Olympus and Panasonic raw files.
+func isTIFF(head []byte) bool {
+	for _, magic := range []string{"II*\x00", "MM\x00*", "IIRO", "IIRS", "IIU\x00"} {
+		if bytes.HasPrefix(head, []byte(magic)) {
+			return true
+		}
+	}
+	return false
+}
+
+// readJPEG reads the EXIF segment of a JPEG file.
+func readJPEG(r io.ReaderAt, size int64, m *Media) {
+	hdr := make([]byte, 10)
+	for off := int64(2); off+4 <= size; {
+		if n, _ := r.ReadAt(hdr, off); n < 4 || hdr[0] != 0xFF {
+			return
+		}
+		marker := hdr[1]
+		length := int64(binary.BigEndian.Uint16(hdr[2:4]))
+
+		// Image data follows the start of scan, so there is no more
+		// metadata.
+		if marker == 0xDA || marker == 0xD9 || length < 2 {
+			return
+		}
+		if marker == 0xE1 && length >= 8 && string(hdr[4:10]) == "Exif\x00\x00" {
+			readTIFF(io.NewSectionReader(r, off+10, length-8), m)
+			return
+		}
+		off += 2 + length
+	}
+}
+
+// readHEIF finds the EXIF item of a HEIF file, e.g. an iPhone photo, through
+// the item information and location boxes of its meta box.
+func readHEIF(r io.ReaderAt, size int64, m *Media) {
+	if tiff := heifExif(r, size); tiff != nil {
+		readTIFF(tiff, m)
+	}
+}
+
+// heifExif returns the TIFF structure of the EXIF item of a HEIF file, or nil
+// if it has none.
+func heifExif(r io.ReaderAt, size int64) *io.SectionReader {
+	var exifID uint32
+	var found bool
+	var start, length int64
+	walkBoxes(r, 0, size, func(typ string, off, n int64) error {
+		if typ != "meta" {
+			return nil
+		}
+		// meta is a full box with a version and flags.
+		return walkBoxes(r, off+4, off+n, func(typ string, off, n int64) error {
+			data := make([]byte, n)
+			if _, err := r.ReadAt(data, off); err != nil {
+				return err
+			}
+			switch typ {
+			case "iinf":
+				exifID, found = heifExifItem(r, data, off)
+			case "iloc":
+				if found {
+					start, length = heifItemLocation(data, exifID)
+				}
+			}
+			return nil
+		})
+	})
+	if start <= 0 || length <= 4 {
+		return nil
+	}
+
+	// The item starts with the offset of the TIFF header, which usually
+	// follows an "Exif\0\0" prefix.
+	var skip [4]byte
+	if _, err := r.ReadAt(skip[:], start); err != nil {
+		return nil
+	}
+	tiff := start + 4 + int64(binary.BigEndian.Uint32(skip[:]))
+	if tiff >= start+length {
+		return nil
+	}
+	return io.NewSectionReader(r, tiff, start+length-tiff)
+}
+
+// heifExifItem returns the ID of the Exif item listed in an iinf box.
+func heifExifItem(r io.ReaderAt, data []byte, base int64) (uint32, bool) {
+	if len(data) < 6 {
+		return 0, false
+	}
+	first := int64(6)
+	if data[0] != 0 {
+		first = 8
+	}
+
+	var id uint32
+	var found bool
+	walkBoxes(r, base+first, base+int64(len(data)), func(typ string, off, n int64) error {
+		if typ != "infe" || found {
+			return nil
+		}
+		e := data[off-base : off-base+n]
+		switch {
+		case len(e) >= 12 && e[0] == 2:
+			id = uint32(binary.BigEndian.Uint16(e[4:6]))
+			found = string(e[8:12]) == "Exif"
+		case len(e) >= 14 && e[0] == 3:
+			id = binary.BigEndian.Uint32(e[4:8])
+			found = string(e[10:14]) == "Exif"
+		}
+		return nil
+	})
+	return id, found
+}
+
+// heifItemLocation returns the offset and length of the first extent of an
+// item listed in an iloc box.
+func heifItemLocation(data []byte, item uint32) (int64, int64) {
+	if len(data) < 8 {
+		return 0, 0
+	}
+	version := data[0]
+	offsetSize, lengthSize := int(data[4]>>4), int(data[4]&0x0F)
+	baseSize, indexSize := int(data[5]>>4), 0
+	if version == 1 || version == 2 {
+		indexSize = int(data[5] & 0x0F)
+	}
+
+	p := 6
+	read := func(n int) (uint64, bool) {
+		if n == 0 {
+			return 0, true
+		}
+		if p+n > len(data) {
+			return 0, false
+		}
+		var v uint64
+		for _, b := range data[p : p+n] {
+			v = v<<8 | uint64(b)
+		}
+		p += n
+		return v, true
+	}
+
+	idSize := 2
+	if version == 2 {
+		idSize = 4
+	}
+	count, ok := read(idSize)
+	for i := uint64(0); ok && i < count; i++ {
+		var id, extents, base, offset, length uint64
+		id, ok = read(idSize)
+		if ok && (version == 1 || version == 2) {
+			_, ok = read(2)
+		}
+		if ok {
+			_, ok = read(2)
+		}
+		if ok {
+			base, ok = read(baseSize)
+		}
+		if ok {
+			extents, ok = read(2)
+		}
+		for e := uint64(0); ok && e < extents; e++ {
+			var o, l uint64
+			if _, ok = read(indexSize); ok {
+				o, ok = read(offsetSize)
+			}
+			if ok {
+				l, ok = read(lengthSize)
+			}
+			if e == 0 {
+				offset, length = o, l
+			}
+		}
+		if ok && uint32(id) == item {
+			return int64(base + offset), int64(length)
+		}
+	}
+	return 0, 0
+}
+
+// readMP4 reads the creation time from the movie header of an MP4 or
+// QuickTime file, and the camera, location and local creation time from the
+// metadata that phones and cameras add to the movie.
+func readMP4(r io.ReaderAt, size int64, m *Media) {
+	walkBoxes(r, 0, size, func(typ string, off, n int64) error {
+		if typ != "moov" {
+			return nil
+		}
+		return walkBoxes(r, off, off+n, func(typ string, off, n int64) error {
+			switch typ {
+			case "mvhd":
+				readMovieHeader(r, off, n, m)
+			case "udta":
+				walkBoxes(r, off, off+n, func(typ string, off, n int64) error {
+					if typ == "\xa9xyz" && n > 4 && n < 256 {
+						data := make([]byte, n)
+						if _, err := r.ReadAt(data, off); err == nil {
+							m.Location = parseISO6709(string(data[4:]))
+						}
+					}
+					return nil
+				})
+			case "meta":
+				readQuickTimeKeys(r, off, n, m)
+			}
+			return nil
+		})
+	})
+}
+
+// mp4Epoch is the start of the times in MP4 and QuickTime files.
+var mp4Epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func readMovieHeader(r io.ReaderAt, off, n int64, m *Media) {
+	data := make([]byte, 12)
+	if n < int64(len(data)) || !m.Taken.IsZero() {
+		return
+	}
+	if _, err := r.ReadAt(data, off); err != nil {
+		return
+	}
+
+	var secs uint64
+	if data[0] == 1 {
+		secs = binary.BigEndian.Uint64(data[4:12])
+	} else {
+		secs = uint64(binary.BigEndian.Uint32(data[4:8]))
+	}
+
+	// Many cameras leave the time unset.
+	if secs > 0 {
+		m.Taken = mp4Epoch.Add(time.Duration(secs) * time.Second).Local()
+	}
+}
+
+// readQuickTimeKeys reads the com.apple.quicktime metadata of a meta box,
+// whose keys box names the entries of the ilst box by their index.
+func readQuickTimeKeys(r io.ReaderAt, off, n int64, m *Media) {
+	// MP4 files declare meta as a full box, QuickTime files don't.
+	var version [4]byte
+	if _, err := r.ReadAt(version[:], off); err == nil && binary.BigEndian.Uint32(version[:]) == 0 {
+		off, n = off+4, n-4
+	}
+
+	var keys []string
+	values := make(map[int]string)
+	walkBoxes(r, off, off+n, func(typ string, off, n int64) error {
+		if (typ != "keys" && typ != "ilst") || n > 1<<20 {
+			return nil
+		}
+		data := make([]byte, n)
+		if _, err := r.ReadAt(data, off); err != nil {
+			return err
+		}
+
+		if typ == "keys" {
+			for p := 8; p+8 <= len(data); {
+				size := int(binary.BigEndian.Uint32(data[p:]))
+				if size < 8 || p+size > len(data) {
+					break
+				}
+				keys = append(keys, string(data[p+8:p+size]))
+				p += size
+			}
+			return nil
+		}
+
+		// Each entry holds a data box with a type and a locale before the
+		// value.
+		for p := 0; p+8 <= len(data); {
+			size := int(binary.BigEndian.Uint32(data[p:]))
+			if size < 8 || p+size > len(data) {
+				break
+			}
+			index := int(binary.BigEndian.Uint32(data[p+4:]))
+			if entry := data[p+8 : p+size]; len(entry) >= 16 && string(entry[4:8]) == "data" {
+				values[index] = string(entry[16:])
+			}
+			p += size
+		}
+		return nil
+	})
+
+	for i, key := range keys {
+		v := strings.TrimRight(values[i+1], "\x00")
+		switch key {
+		case "com.apple.quicktime.make":
+			m.Make = v
+		case "com.apple.quicktime.model":
+			m.Model = v
+		case "com.apple.quicktime.location.ISO6709":
+			m.Location = parseISO6709(v)
+		case "com.apple.quicktime.creationdate":
+			if t, err := time.Parse("2006-01-02T15:04:05-0700", v); err == nil {
+				m.Taken = t
+			}
+		case "com.apple.quicktime.content.identifier":
+			m.ContentID = v
+		}
+	}
+}
+
+var iso6709 = regexp.MustCompile(`^([+-]\d+(?:\.\d+)?)([+-]\d+(?:\.\d+)?)`)
+
+// parseISO6709 parses a location such as "+37.3318-122.0312+012.345/".
+func parseISO6709(s string) *Location {
+	match := iso6709.FindStringSubmatch(s)
+	if match == nil {
+		return nil
+	}
+	lat, err1 := strconv.ParseFloat(match[1], 64)
+	lon, err2 := strconv.ParseFloat(match[2], 64)
+	if err1 != nil || err2 != nil {
+		return nil
+	}
+	return &Location{Latitude: lat, Longitude: lon}
+}
+
+// walkBoxes calls fn with the type, the offset of the content and the content
+// size of each ISO base media box between start and end.
+func walkBoxes(r io.ReaderAt, start, end int64, fn func(typ string, off, n int64) error) error {
+	hdr := make([]byte, 16)
+	for off := start; off+8 <= end; {
+		if _, err := r.ReadAt(hdr[:8], off); err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[:4]))
+		typ := string(hdr[4:8])
+		content := off + 8
+
+		switch size {
+		case 0:
+			size = end - off
+		case 1:
+			if _, err := r.ReadAt(hdr[8:16], off+8); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+			content += 8
+		}
+		if size < content-off || off+size > end {
+			return fmt.Errorf("invalid box [type=%q] [offset=%d]", typ, off)
+		}
+
+		if err := fn(typ, content, off+size-content); err != nil {
+			return err
+		}
+		off += size
+	}
+	return nil
+}
+
+// EXIF tags that are read.
+const (
+	tagMake           = 0x010F
+	tagModel          = 0x0110
+	tagOrientation    = 0x0112
+	tagDateTime       = 0x0132
+	tagExifIFD        = 0x8769
+	tagGPSIFD         = 0x8825
+	tagDateOriginal   = 0x9003
+	tagOffsetOriginal = 0x9011
+	tagMakerNote      = 0x927C
+	tagGPSLatRef      = 0x0001
+	tagGPSLat         = 0x0002
+	tagGPSLonRef      = 0x0003
+	tagGPSLon         = 0x0004
+)
+
+// tiffTypeSizes are the sizes of the TIFF field types by type ID.
+var tiffTypeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4}
+
+// tiffField is an entry of a TIFF image file directory. Values larger than
+// 64KB aren't read, only their offset is.
+type tiffField struct {
+	typ   uint16
+	count uint32
+	off   int64
+	data  []byte
+}
+
+type tiffReader struct {
+	r     *io.SectionReader
+	order binary.ByteOrder
+}
+
+// readTIFF reads the camera, capture time and location from the EXIF data in
+// the TIFF structure read by r.
+func readTIFF(r *io.SectionReader, m *Media) {
+	t, off, err := newTIFFReader(r)
+	if err != nil {
+		return
+	}
+	ifd0, err := t.ifd(off)
+	if err != nil {
+		return
+	}
+	m.Make = t.ascii(ifd0[tagMake])
+	m.Model = t.ascii(ifd0[tagModel])
+	m.Orientation = int(t.uint(ifd0[tagOrientation]))
+	taken := t.ascii(ifd0[tagDateTime])
+
+	if f, ok := ifd0[tagExifIFD]; ok {
+		if exif, err := t.ifd(int64(t.uint(f))); err == nil {
+			if v := t.ascii(exif[tagDateOriginal]); v != "" {
+				taken = v
+			}
+			m.Taken = parseExifTime(taken, t.ascii(exif[tagOffsetOriginal]))
+			m.ContentID = appleContentID(exif[tagMakerNote].data)
+		}
+	}
+	if m.Taken.IsZero() {
+		m.Taken = parseExifTime(taken, "")
+	}
+
+	if f, ok := ifd0[tagGPSIFD]; ok {
+		if gps, err := t.ifd(int64(t.uint(f))); err == nil {
+			lat, ok1 := t.degrees(gps[tagGPSLat], t.ascii(gps[tagGPSLatRef]))
+			lon, ok2 := t.degrees(gps[tagGPSLon], t.ascii(gps[tagGPSLonRef]))
+			if ok1 && ok2 && (lat != 0 || lon != 0) {
+				m.Location = &Location{Latitude: lat, Longitude: lon}
+			}
+		}
+	}
+}
+
+// appleMakerNote is the header of the maker note of Apple devices, which is
+// followed by the version and the byte order of its image file directory.
+const appleMakerNote = "Apple iOS\x00"
+
+// appleContentID returns the content identifier in an Apple maker note, which
+// is "" for other maker notes. The offsets in the note are relative to its
+// start.
+func appleContentID(note []byte) string {
+	if len(note) < 16 || !bytes.HasPrefix(note, []byte(appleMakerNote)) {
+		return ""
+	}
+	t := &tiffReader{r: io.NewSectionReader(bytes.NewReader(note), 0, int64(len(note))), order: binary.BigEndian}
+	if string(note[12:14]) == "II" {
+		t.order = binary.LittleEndian
+	}
+	fields, err := t.ifd(14)
+	if err != nil {
+		return ""
+	}
+	return t.ascii(fields[0x0011])
+}
+
+// newTIFFReader reads the byte order of the TIFF structure read by r, and
+// returns the offset of its first image file directory.
+func newTIFFReader(r *io.SectionReader) (*tiffReader, int64, error) {
+	hdr := make([]byte, 8)
+	if _, err := r.ReadAt(hdr, 0); err != nil {
+		return nil, 0, err
+	}
+	t := &tiffReader{r: r, order: binary.LittleEndian}
+	if hdr[0] == 'M' {
+		t.order = binary.BigEndian
+	}
+	return t, int64(t.order.Uint32(hdr[4:8])), nil
+}
+
+// ifd reads the image file directory at off.
+func (t *tiffReader) ifd(off int64) (map[uint16]tiffField, error) {
+	buf := make([]byte, 12)
+	if _, err := t.r.ReadAt(buf[:2], off); err != nil {
+		return nil, err
+	}
+	n := int64(t.order.Uint16(buf[:2]))
+	if n > 1000 {
+		return nil, errors.New("too many IFD entries")
+	}
+
+	fields := make(map[uint16]tiffField, n)
+	for i := int64(0); i < n; i++ {
+		if _, err := t.r.ReadAt(buf, off+2+i*12); err != nil {
+			return nil, err
+		}
+		f := tiffField{typ: t.order.Uint16(buf[2:4]), count: t.order.Uint32(buf[4:8])}
+		size := uint64(tiffTypeSizes[f.typ]) * uint64(f.count)
+		if size == 0 {
+			continue
+		}
+
+		// Values that fit are stored in the entry, others at an offset.
+		if size <= 4 {
+			f.data = make([]byte, size)
+			copy(f.data, buf[8:])
+		} else {
+			f.off = int64(t.order.Uint32(buf[8:12]))
+			if size <= 1<<16 {
+				f.data = make([]byte, size)
+				if _, err := t.r.ReadAt(f.data, f.off); err != nil {
+					continue
+				}
+			}
+		}
+		fields[t.order.Uint16(buf[0:2])] = f
+	}
+	return fields, nil
+}
+
+// next returns the offset of the image file directory that follows the one at
+// off, which is zero for the last one.
+func (t *tiffReader) next(off int64) int64 {
+	buf := make([]byte, 4)
+	if _, err := t.r.ReadAt(buf[:2], off); err != nil {
+		return 0
+	}
+	n := int64(t.order.Uint16(buf[:2]))
+	if _, err := t.r.ReadAt(buf, off+2+n*12); err != nil {
+		return 0
+	}
+	return int64(t.order.Uint32(buf))
+}
+
+func (t *tiffReader) ascii(f tiffField) string {
+	if f.typ != 2 {
+		return ""
+	}
+	if i := bytes.IndexByte(f.data, 0); i >= 0 {
+		return strings.TrimSpace(string(f.data[:i]))
+	}
+	return strings.TrimSpace(string(f.data))
+}
+
+func (t *tiffReader) uint(f tiffField) uint32 {
+	return t.uintAt(f, 0)
+}
+
+// uintAt returns the i-th value of a SHORT, LONG or IFD field.
+func (t *tiffReader) uintAt(f tiffField, i int) uint32 {
+	switch {
+	case f.typ == 3 && len(f.data) >= 2*(i+1):
+		return uint32(t.order.Uint16(f.data[2*i:]))
+	case (f.typ == 4 || f.typ == 13) && len(f.data) >= 4*(i+1):
+		return t.order.Uint32(f.data[4*i:])
+	}
+	return 0
+}
+
+// degrees converts a GPS coordinate, stored as degrees, minutes and seconds,
+// to decimal degrees that are negative in the south and west.
+func (t *tiffReader) degrees(f tiffField, ref string) (float64, bool) {
+	if f.typ != 5 || len(f.data) < 24 {
+		return 0, false
+	}
+	var v float64
+	for i, div := range []float64{1, 60, 3600} {
+		num := t.order.Uint32(f.data[i*8:])
+		den := t.order.Uint32(f.data[i*8+4:])
+		if den == 0 {
+			return 0, false
+		}
+		v += float64(num) / float64(den) / div
+	}
+	if ref == "S" || ref == "W" {
+		v = -v
+	}
+	return v, !math.IsNaN(v)
+}
+
+// parseExifTime parses an EXIF date, e.g. "2019:07:14 10:11:12", with an
+// optional offset such as "+02:00". Times without an offset are local.
+func parseExifTime(v, offset string) time.Time {
+	if v == "" {
+		return time.Time{}
+	}
+	if offset != "" {
+		if t, err := time.Parse("2006:01:02 15:04:05-07:00", v+offset); err == nil {
+			return t
+		}
+	}
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", v, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+var (
+	xmpSubject = regexp.MustCompile(`(?s)<dc:subject>(.*?)</dc:subject>`)
+	xmpItem    = regexp.MustCompile(`(?s)<rdf:li[^>]*>(.*?)</rdf:li>`)
+)
+
+// xmpScanSize is how much of a file is searched for an XMP packet.
+const xmpScanSize = 256 << 10
+
+// readXMPTags returns the keywords of the XMP packet near the start of the
+// file, which is where sidecars, JPEG and most raw files keep it.
+func readXMPTags(r io.ReaderAt, size int64) []string {
+	n := size
+	if n > xmpScanSize {
+		n = xmpScanSize
+	}
+	data := make([]byte, n)
+	if _, err := r.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil
+	}
+
+	match := xmpSubject.FindSubmatch(data)
+	if match == nil {
+		return nil
+	}
+	var tags []string
+	for _, item := range xmpItem.FindAllSubmatch(match[1], -1) {
+		if tag := strings.TrimSpace(html.UnescapeString(string(item[1]))); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
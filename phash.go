@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"math/bits"
+	"strconv"
+)
+
+// hashSourceSize is the size that images are scaled down to before they are
+// averaged into the grid that perceptual hashes are computed from, so that
+// every pixel of the source contributes.
+const hashSourceSize = 256
+
+// Hash returns the perceptual hash of the picture, a difference hash (dHash):
+// the upright picture is averaged into a grid of 9x8 gray cells, and each bit
+// is set if a cell is brighter than its right neighbour. Resized and
+// recompressed copies of a picture have hashes that differ in a few bits,
+// see HashDistance.
+func (p *Picture) Hash() uint64 {
+	w, h := 9, 8
+	if p.Orientation >= 5 && p.Orientation <= 8 {
+		w, h = 8, 9
+	}
+	grid := orient(grayGrid(scaleImage(p.Image, hashSourceSize), w, h), p.Orientation)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if gray(grid.At(x, y)) > gray(grid.At(x+1, y)) {
+				hash |= 1 << uint(y*8+x)
+			}
+		}
+	}
+	return hash
+}
+
+// grayGrid averages all pixels of img into a w by h grid of gray cells.
+func grayGrid(img image.Image, w, h int) *image.Gray {
+	b := img.Bounds()
+	dst := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var sum, n int
+			for py := y0; py < y1; py++ {
+				for px := x0; px < x1; px++ {
+					sum += int(gray(img.At(px, py)))
+					n++
+				}
+			}
+			dst.SetGray(x, y, color.Gray{Y: uint8(sum / n)})
+		}
+	}
+	return dst
+}
+
+func gray(c color.Color) uint8 {
+	return color.GrayModel.Convert(c).(color.Gray).Y
+}
+
+// HashDistance returns the Hamming distance between two perceptual hashes,
+// i.e. the number of bits that differ.
+func HashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// formatHash and parseHash convert perceptual hashes to and from the hex
+// strings they are cached as.
+func formatHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+func parseHash(s string) (uint64, error) {
+	return strconv.ParseUint(s, 16, 64)
+}
+
+// analyzeMedia extracts the metadata of the file called name, which holds
+// size bytes read from r, like ExtractMedia. Images are decoded as well to set
+// their perceptual hash and size, and the decoded picture is returned so that
+// previews can be made of it. It is nil for other files and for images that
+// can't be decoded.
+func analyzeMedia(r io.ReaderAt, size int64, name string) (*Media, *Picture) {
+	m := ExtractMedia(r, size, name)
+	if !CanPreview(name) {
+		return m, nil
+	}
+
+	pic, err := DecodePicture(r, size, m)
+	if err != nil {
+		if err != ErrNoPreview {
+			log.Printf("WARNING cannot decode image [filename=%s]: %s", name, err)
+		}
+		return m, nil
+	}
+
+	m.Hash = formatHash(pic.Hash())
+	m.Width, m.Height = pic.Size()
+	return m, pic
+}
+
+// hashTree is a BK-tree of perceptual hashes, which finds the hashes within a
+// distance of another without comparing it with all of them. Each hash holds
+// the values it was added with.
+type hashTree struct {
+	root *hashNode
+}
+
+type hashNode struct {
+	hash     uint64
+	values   []int
+	children map[int]*hashNode
+}
+
+func (t *hashTree) add(hash uint64, value int) {
+	if t.root == nil {
+		t.root = &hashNode{hash: hash, values: []int{value}}
+		return
+	}
+
+	n := t.root
+	for {
+		d := HashDistance(n.hash, hash)
+		if d == 0 {
+			n.values = append(n.values, value)
+			return
+		}
+		child, ok := n.children[d]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[int]*hashNode)
+			}
+			n.children[d] = &hashNode{hash: hash, values: []int{value}}
+			return
+		}
+		n = child
+	}
+}
+
+// near calls fn with the values of the hashes that are at most max bits from
+// hash, and their distance.
+func (t *hashTree) near(hash uint64, max int, fn func(value, distance int)) {
+	if t.root == nil {
+		return
+	}
+
+	stack := []*hashNode{t.root}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		d := HashDistance(n.hash, hash)
+		if d <= max {
+			for _, v := range n.values {
+				fn(v, d)
+			}
+		}
+
+		// By the triangle inequality, only children at a distance from
+		// their parent within max of d can hold matches.
+		for cd, child := range n.children {
+			if cd >= d-max && cd <= d+max {
+				stack = append(stack, child)
+			}
+		}
+	}
+}
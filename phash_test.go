@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"testing"
+)
+
+// testImage draws a w by h picture of soft shapes, scaled to its size, in one
+// of two scenes.
+func testImage(w, h, scene int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			fx, fy := float64(x)/float64(w), float64(y)/float64(h)
+			var v float64
+			switch scene {
+			case 0:
+				v = 0.5 + 0.3*math.Sin(fx*7+fy*2) + 0.2*math.Cos(fy*11)
+			default:
+				v = 0.5 + 0.3*math.Cos(fx*13-fy*5) - 0.2*math.Sin(fx*fy*17)
+			}
+			g := uint8(math.Max(0, math.Min(255, v*255)))
+			img.Set(x, y, color.RGBA{R: g, G: uint8(int(g) * 3 / 4), B: 255 - g, A: 255})
+		}
+	}
+	return img
+}
+
+// recompress encodes img as a JPEG of the quality and decodes it again.
+func recompress(t *testing.T, img image.Image, quality int) image.Image {
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, img, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+	out, err := jpeg.Decode(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestHashDistance(t *testing.T) {
+	original := testImage(1200, 900, 0)
+	hash := (&Picture{Image: original}).Hash()
+
+	tests := []struct {
+		name string
+		pic  *Picture
+		near bool
+	}{
+		{"resized", &Picture{Image: scaleImage(original, 320)}, true},
+		{"thumbnail", &Picture{Image: scaleImage(original, 64)}, true},
+		{"recompressed", &Picture{Image: recompress(t, scaleImage(original, 800), 40)}, true},
+		{"rotated with orientation", &Picture{Image: orient(scaleImage(original, 600), 8), Orientation: 6}, true},
+		{"rotated", &Picture{Image: orient(original, 6)}, false},
+		{"other scene", &Picture{Image: testImage(1200, 900, 1)}, false},
+	}
+	for _, tt := range tests {
+		d := HashDistance(hash, tt.pic.Hash())
+		if near := d <= DefaultDuplicateDistance; near != tt.near {
+			t.Errorf("%s: distance %d, want near %t", tt.name, d, tt.near)
+		}
+	}
+}
+
+func TestHashDistanceBits(t *testing.T) {
+	tests := []struct {
+		a, b uint64
+		want int
+	}{
+		{0, 0, 0},
+		{0, 1, 1},
+		{0xff00, 0x00ff, 16},
+		{math.MaxUint64, 0, 64},
+	}
+	for _, tt := range tests {
+		if got := HashDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("HashDistance(%x, %x) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if h, err := parseHash(formatHash(tt.a)); err != nil || h != tt.a {
+			t.Errorf("parseHash(formatHash(%x)) = %x, %v", tt.a, h, err)
+		}
+	}
+}
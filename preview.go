@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Kinds of previews.
+const (
+	PreviewThumbnail = "thumbnail"
+	PreviewMedium    = "preview"
+)
+
+// Preview is a JPEG thumbnail or preview of an archived image, stored under
+// the archive's previews/ prefix in a storage class that can be read right
+// away, unlike the original's.
+type Preview struct {
+	Kind   string `json:"kind"`
+	Key    string `json:"key"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Size   int64  `json:"size"`
+}
+
+// PreviewPrefix returns the prefix that previews of the archive's files are
+// stored under.
+func (a *Archive) PreviewPrefix() string {
+	return a.Name + "/previews/"
+}
+
+// PreviewKey returns the key of a file's preview of the kind, which mirrors
+// the file's path, e.g. my-photos/previews/2019/IMG_0001.JPG.thumbnail.jpg.
+func (a *Archive) PreviewKey(relpath, kind string) string {
+	return a.PreviewPrefix() + relpath + "." + kind + ".jpg"
+}
+
+// parsePreviewKey returns the path of the file and the kind of the preview
+// stored under key, see PreviewKey.
+func (a *Archive) parsePreviewKey(key string) (string, string, bool) {
+	if !strings.HasPrefix(key, a.PreviewPrefix()) || !strings.HasSuffix(key, ".jpg") {
+		return "", "", false
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(key, a.PreviewPrefix()), ".jpg")
+	for _, kind := range []string{PreviewThumbnail, PreviewMedium} {
+		if strings.HasSuffix(name, "."+kind) {
+			return strings.TrimSuffix(name, "."+kind), kind, true
+		}
+	}
+	return "", "", false
+}
+
+// uploadPreviews makes the thumbnail and preview of an image decoded into
+// pic, and uploads them to the backends. It returns the previews that were
+// uploaded to at least one backend, or nil if the archive doesn't enable
+// previews or pic is nil. Failures are logged rather than failing the file,
+// since the original was archived.
+func (a *Archive) uploadPreviews(backends []Backend, pic *Picture, relpath string) []Preview {
+	if !a.Previews.Enabled || len(backends) == 0 || pic == nil {
+		return nil
+	}
+
+	renditions, err := pic.Previews(a.Previews.ThumbnailSize, a.Previews.PreviewSize)
+	if err != nil {
+		log.Printf("WARNING cannot make previews [archive=%s] [filename=%s]: %s", a.Name, relpath, err)
+		return nil
+	}
+
+	opts := PutOptions{StorageClass: a.Previews.StorageClass, ModTime: time.Now()}
+	var previews []Preview
+	for i, kind := range []string{PreviewThumbnail, PreviewMedium} {
+		p := Preview{
+			Kind:   kind,
+			Key:    a.PreviewKey(relpath, kind),
+			Width:  renditions[i].Width,
+			Height: renditions[i].Height,
+			Size:   int64(len(renditions[i].Data)),
+		}
+
+		uploaded := false
+		for _, backend := range backends {
+			if err := backend.Put(p.Key, bytes.NewReader(renditions[i].Data), p.Size, opts); err != nil {
+				log.Println("WARNING", fmt.Errorf("cannot upload preview: %s [backend=%s] [key=%s]", err, backend.Name(), p.Key))
+				continue
+			}
+			uploaded = true
+		}
+		if uploaded {
+			previews = append(previews, p)
+		}
+	}
+
+	if len(previews) > 0 {
+		log.Printf("previews uploaded [archive=%s] [filename=%s] [previews=%d]", a.Name, relpath, len(previews))
+	}
+	return previews
+}
+
+// previewFor returns the thumbnail if an image of max pixels is wanted and
+// it is no smaller than thumbnailSize, otherwise the preview. Either falls
+// back to the other.
+func previewFor(previews []Preview, max, thumbnailSize int) (Preview, bool) {
+	kind := PreviewMedium
+	if max <= thumbnailSize {
+		kind = PreviewThumbnail
+	}
+	for _, p := range previews {
+		if p.Kind == kind {
+			return p, true
+		}
+	}
+	if len(previews) > 0 {
+		return previews[0], true
+	}
+	return Preview{}, false
+}
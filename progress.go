@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Progress modes that control how the ProgressReporter renders output.
+const (
+	ProgressAuto = "auto"
+	ProgressTTY  = "tty"
+	ProgressLog  = "log"
+	ProgressOff  = "off"
+)
+
+// Progress tracks the number of files and bytes discovered and archived, as
+// well as the file each upload worker is currently processing. It is safe for
+// concurrent use.
+type Progress struct {
+	mu      sync.Mutex
+	started time.Time
+
+	totalFiles, totalBytes int64
+	doneFiles, doneBytes   int64
+	failedFiles            int64
+
+	// sizes maps every discovered path to its size so that files reported
+	// by both the pre-scan and the watcher are only counted once.
+	sizes map[string]int64
+
+	// done maps the paths that have been archived, skipped or have failed to
+	// their outcome.
+	done map[string]string
+
+	// workers maps the worker ID to the path currently being archived.
+	workers    map[int]string
+	numWorkers int
+}
+
+// Outcomes of the files in Progress.
+const (
+	progressDone    = "done"
+	progressFailed  = "failed"
+	progressSkipped = "skipped"
+)
+
+// ProgressSnapshot is a point-in-time copy of the counters in Progress.
+type ProgressSnapshot struct {
+	TotalFiles, TotalBytes int64
+	DoneFiles, DoneBytes   int64
+	FailedFiles            int64
+	Elapsed                time.Duration
+	Workers                map[int]string
+}
+
+// NewProgress returns a Progress with the clock started.
+func NewProgress() *Progress {
+	return &Progress{
+		started: time.Now(),
+		sizes:   make(map[string]int64),
+		done:    make(map[string]string),
+		workers: make(map[int]string),
+	}
+}
+
+// Discover adds a file to the totals. Paths that were already discovered are
+// ignored.
+func (p *Progress) Discover(path string, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.sizes[path]; ok {
+		return
+	}
+	p.sizes[path] = size
+	p.totalFiles++
+	p.totalBytes += size
+}
+
+// NextWorker allocates an ID that is unique across all upload workers.
+func (p *Progress) NextWorker() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	id := p.numWorkers
+	p.numWorkers++
+	return id
+}
+
+// Start records that worker began archiving path.
+func (p *Progress) Start(worker int, path string) {
+	p.mu.Lock()
+	p.workers[worker] = path
+	p.mu.Unlock()
+}
+
+// Idle records that worker handed off its file, e.g. to the bundler, which
+// reports whether it was archived.
+func (p *Progress) Idle(worker int) {
+	p.mu.Lock()
+	delete(p.workers, worker)
+	p.mu.Unlock()
+}
+
+// Done records that worker finished archiving path.
+func (p *Progress) Done(worker int, path string) {
+	p.finish(worker, path, false)
+}
+
+// Fail records that worker gave up on archiving path.
+func (p *Progress) Fail(worker int, path string) {
+	p.finish(worker, path, true)
+}
+
+// Skip records that worker didn't need to archive path, e.g. because it is
+// unchanged since it was last archived. The file is removed from the totals
+// so that it doesn't skew the throughput and ETA.
+func (p *Progress) Skip(worker int, path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.workers, worker)
+	if p.done[path] != "" {
+		return
+	}
+	p.done[path] = progressSkipped
+
+	if size, ok := p.sizes[path]; ok {
+		p.totalFiles--
+		p.totalBytes -= size
+	}
+}
+
+func (p *Progress) finish(worker int, path string, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.workers, worker)
+	if p.done[path] != "" {
+		return
+	}
+
+	if failed {
+		p.done[path] = progressFailed
+		p.failedFiles++
+		return
+	}
+	p.done[path] = progressDone
+	p.doneFiles++
+	p.doneBytes += p.sizes[path]
+}
+
+// Requeue returns a file that was archived, skipped or has failed to the
+// totals, e.g. when it is retried, so that its new outcome is counted.
+func (p *Progress) Requeue(path string, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	old, discovered := p.sizes[path]
+	switch p.done[path] {
+	case "":
+		if discovered {
+			return
+		}
+	case progressFailed:
+		p.failedFiles--
+		p.totalFiles--
+		p.totalBytes -= old
+	case progressDone:
+		p.doneFiles--
+		p.doneBytes -= old
+		p.totalFiles--
+		p.totalBytes -= old
+	}
+
+	delete(p.done, path)
+	p.sizes[path] = size
+	p.totalFiles++
+	p.totalBytes += size
+}
+
+// Snapshot returns a copy of the current counters.
+func (p *Progress) Snapshot() ProgressSnapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	workers := make(map[int]string, len(p.workers))
+	for id, path := range p.workers {
+		workers[id] = path
+	}
+
+	return ProgressSnapshot{
+		TotalFiles:  p.totalFiles,
+		TotalBytes:  p.totalBytes,
+		DoneFiles:   p.doneFiles,
+		DoneBytes:   p.doneBytes,
+		FailedFiles: p.failedFiles,
+		Elapsed:     time.Since(p.started),
+		Workers:     workers,
+	}
+}
+
+// Queue returns the discovered files that haven't been archived, skipped or
+// failed yet, including the files that are being archived, in path order.
+func (p *Progress) Queue() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var queue []string
+	for path := range p.sizes {
+		if p.done[path] == "" {
+			queue = append(queue, path)
+		}
+	}
+	sort.Strings(queue)
+	return queue
+}
+
+// ProgressReporter periodically renders a Progress, either as a progress bar
+// that is redrawn in place when writing to a terminal, or as summary log lines
+// otherwise.
+type ProgressReporter struct {
+	progress *Progress
+	out      io.Writer
+	tty      bool
+	interval time.Duration
+
+	// rate is the smoothed throughput in bytes per second.
+	rate      float64
+	lastBytes int64
+	lastTick  time.Time
+}
+
+// NewProgressReporter returns a ProgressReporter that writes to out. The mode
+// is one of the Progress* constants, and interval is how often summary lines
+// are logged in non-interactive mode. A nil reporter is returned when mode is
+// ProgressOff.
+func NewProgressReporter(progress *Progress, out *os.File, mode string, interval time.Duration) (*ProgressReporter, error) {
+	r := &ProgressReporter{progress: progress, out: out, interval: interval}
+
+	switch mode {
+	case ProgressOff:
+		return nil, nil
+	case ProgressAuto:
+		r.tty = isTerminal(out)
+	case ProgressTTY:
+		r.tty = true
+	case ProgressLog:
+		r.tty = false
+	default:
+		return nil, fmt.Errorf("invalid progress mode [mode=%s]", mode)
+	}
+
+	// Redraw the progress bar often enough to look alive.
+	if r.tty {
+		r.interval = 500 * time.Millisecond
+	}
+
+	return r, nil
+}
+
+// Run renders progress until the context is cancelled.
+func (r *ProgressReporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	r.lastTick = time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			if r.tty {
+				fmt.Fprintln(r.out)
+			}
+			return
+		case now := <-ticker.C:
+			s := r.progress.Snapshot()
+			r.sample(now, s.DoneBytes)
+			if r.tty {
+				r.renderBar(s)
+			} else {
+				r.renderLine(s)
+			}
+		}
+	}
+}
+
+// sample updates the throughput using an exponentially weighted moving
+// average so that the ETA doesn't jump around after every file.
+func (r *ProgressReporter) sample(now time.Time, doneBytes int64) {
+	secs := now.Sub(r.lastTick).Seconds()
+	if secs <= 0 {
+		return
+	}
+
+	current := float64(doneBytes-r.lastBytes) / secs
+	if r.rate == 0 {
+		r.rate = current
+	} else {
+		r.rate = 0.8*r.rate + 0.2*current
+	}
+
+	r.lastBytes = doneBytes
+	r.lastTick = now
+}
+
+// eta returns the estimated time remaining, or zero if it can't be computed.
+func (r *ProgressReporter) eta(s ProgressSnapshot) time.Duration {
+	remaining := s.TotalBytes - s.DoneBytes
+	if r.rate < 1 || remaining <= 0 {
+		return 0
+	}
+	return time.Duration(float64(remaining)/r.rate) * time.Second
+}
+
+// renderBar redraws the progress bar and per-worker status lines in place.
+func (r *ProgressReporter) renderBar(s ProgressSnapshot) {
+	const width = 30
+
+	filled := width
+	if s.TotalBytes > 0 {
+		filled = int(float64(width) * float64(s.DoneBytes) / float64(s.TotalBytes))
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "\r\033[K[%s%s] %d/%d files  %s/%s  %s/s  ETA %s",
+		strings.Repeat("=", filled), strings.Repeat(" ", width-filled),
+		s.DoneFiles, s.TotalFiles,
+		formatBytes(s.DoneBytes), formatBytes(s.TotalBytes),
+		formatBytes(int64(r.rate)), formatETA(r.eta(s)),
+	)
+	if s.FailedFiles > 0 {
+		fmt.Fprintf(&b, "  %d failed", s.FailedFiles)
+	}
+
+	for _, id := range workerIDs(s.Workers) {
+		fmt.Fprintf(&b, "\n\033[K  worker %d: %s", id, s.Workers[id])
+	}
+
+	// Move the cursor back up so the next redraw overwrites these lines.
+	if n := len(s.Workers); n > 0 {
+		fmt.Fprintf(&b, "\033[%dA", n)
+	}
+
+	r.out.Write(b.Bytes())
+}
+
+// renderLine logs a single summary line.
+func (r *ProgressReporter) renderLine(s ProgressSnapshot) {
+	log.Printf("progress [files=%d/%d] [bytes=%s/%s] [failed=%d] [rate=%s/s] [eta=%s] [workers=%d]",
+		s.DoneFiles, s.TotalFiles,
+		formatBytes(s.DoneBytes), formatBytes(s.TotalBytes),
+		s.FailedFiles, formatBytes(int64(r.rate)), formatETA(r.eta(s)), len(s.Workers),
+	)
+	for _, id := range workerIDs(s.Workers) {
+		log.Printf("progress [worker=%d] [filepath=%s]", id, s.Workers[id])
+	}
+}
+
+// workerIDs returns the sorted IDs of the busy workers.
+func workerIDs(workers map[int]string) []int {
+	ids := make([]int, 0, len(workers))
+	for id := range workers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// isTerminal reports whether f is a character device, i.e. an interactive
+// terminal as opposed to a pipe or a file.
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeCharDevice != 0
+}
+
+// formatBytes returns a human readable representation of n bytes.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatETA returns a human readable duration, or "--" if it is unknown.
+func formatETA(d time.Duration) string {
+	if d <= 0 {
+		return "--"
+	}
+	return d.Truncate(time.Second).String()
+}
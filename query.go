@@ -0,0 +1,632 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Output formats of the query command.
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+	FormatKeys  = "keys"
+)
+
+// QueryCmd handles the "query" command.
+var QueryCmd = &cobra.Command{
+	Use:   "query QUERY",
+	Short: "Searches the archived media files",
+	Long: `Searches the cache for archived files. The query is a list of terms that must
+all match, e.g.
+
+  media-archive query 'taken:2019-07 camera:"iPhone 11" type:video size>1GB'
+
+  taken:2019, taken:2019-07, taken:2019-07-14   captured in the year, month or day
+  taken:2019-01..2019-06                        captured in the range, inclusive
+  taken>2019, taken>=, taken<, taken<=          captured after or before
+  camera:"iPhone 11"                            camera make or model starts with
+  type:video                                    image, raw, video, audio, sidecar or other
+  size>1GB, size>=, size<, size<=, size=        file size, in binary units
+  bbox:LAT1,LON1,LAT2,LON2                      captured inside the bounding box
+  has:location, has:camera, has:taken           the metadata is known
+  ext:jpg                                       file extension
+  tag:beach                                     XMP keyword or cloud album
+  archive:NAME                                  file is in the archive
+  dir:2019/Summer                               file is directly in the directory
+  path:2019                                     file is under the directory
+
+Other words are matched against the file names, directories and tags using the
+SQLite full text index. A trailing * matches a prefix, and quotes match phrases.
+
+Results are printed as a table, as JSON lines with --format=json or --json, or
+as a list of file names with --format=keys, which restore reads with
+--files-from:
+
+  media-archive query 'archive:photos taken:2019' --format=keys | \
+    media-archive restore photos --files-from - --to /tmp/2019
+
+Metadata is extracted when files are archived. Run "cache index" to extract it
+for files that were archived by an older version.`,
+	Run: RunQueryCmd,
+}
+
+// CacheIndexCmd handles the "cache index" command.
+var CacheIndexCmd = &cobra.Command{
+	Use:   "index [archive...]",
+	Short: "Extracts the metadata of archived files for queries",
+	Long: `Reads the metadata of the archived files under the roots of each archive and
+stores it in the cache along with the perceptual hashes of images, so that files
+archived before metadata was extracted can be queried and checked for
+duplicates. Files that aren't cached or were modified since they were archived
+are left alone. All archives are indexed unless archive names are passed.`,
+	Run: RunCacheIndexCmd,
+}
+
+// QueryResult is a file that matched a query.
+type QueryResult struct {
+	Archive  string    `json:"archive"`
+	Filename string    `json:"filename"`
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Class    string    `json:"class"`
+	Taken    string    `json:"taken"`
+	Camera   string    `json:"camera"`
+	Location *Location `json:"location,omitempty"`
+}
+
+// Query is a parsed query, i.e. the conditions of a SQL query over the files,
+// archives and media tables, and the terms matched by the full text index.
+type Query struct {
+	where []string
+	args  []interface{}
+	text  []string
+}
+
+// queryOperators are the operators that separate a field from its value,
+// longest first.
+var queryOperators = []string{">=", "<=", ":", ">", "<", "="}
+
+// ParseQuery parses a query, see QueryCmd for the syntax.
+func ParseQuery(s string) (*Query, error) {
+	words, err := splitQuery(s)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Query{}
+	for _, w := range words {
+		field, op, value := "", "", w.text
+		for _, o := range queryOperators {
+			if i := strings.Index(w.text, o); i > 0 && isQueryField(w.text[:i]) {
+				field, op, value = strings.ToLower(w.text[:i]), o, w.text[i+len(o):]
+				break
+			}
+		}
+
+		if field == "" {
+			q.match("", value, w.quoted)
+			continue
+		}
+		if err := q.add(field, op, value, w.quoted); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+func isQueryField(s string) bool {
+	switch strings.ToLower(s) {
+	case "taken", "camera", "type", "class", "size", "bbox", "has", "ext", "tag", "archive", "dir", "path":
+		return true
+	}
+	return false
+}
+
+// add adds the condition of a field term.
+func (q *Query) add(field, op, value string, quoted bool) error {
+	invalid := fmt.Errorf("invalid query term [term=%s%s%s]", field, op, value)
+	if op != ":" && field != "taken" && field != "size" {
+		return invalid
+	}
+
+	switch field {
+	case "taken":
+		return q.taken(op, value)
+
+	case "camera":
+		pattern := likeEscaper.Replace(value) + "%"
+		q.cond(`(m.camera LIKE ? ESCAPE '\' OR m.model LIKE ? ESCAPE '\')`, pattern, pattern)
+
+	case "type", "class":
+		class := strings.ToLower(value)
+		switch class {
+		case ClassImage, ClassRaw, ClassVideo, ClassAudio, ClassSidecar, ClassOther:
+		default:
+			return fmt.Errorf("invalid media type [type=%s]", value)
+		}
+		q.cond("m.class = ?", class)
+
+	case "size":
+		n, err := parseBytes(value)
+		if err != nil {
+			return err
+		}
+		if op == ":" {
+			op = "="
+		}
+		q.cond("f.size "+op+" ?", n)
+
+	case "bbox":
+		var c []float64
+		for _, v := range strings.Split(value, ",") {
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return invalid
+			}
+			c = append(c, f)
+		}
+		if len(c) != 4 {
+			return invalid
+		}
+		q.cond("m.latitude BETWEEN ? AND ? AND m.longitude BETWEEN ? AND ?", minFloat(c[0], c[2]), maxFloat(c[0], c[2]), minFloat(c[1], c[3]), maxFloat(c[1], c[3]))
+
+	case "has":
+		switch strings.ToLower(value) {
+		case "location", "gps":
+			q.cond("m.latitude IS NOT NULL")
+		case "camera":
+			q.cond("m.camera != ''")
+		case "taken":
+			q.cond("m.taken_at != ''")
+		default:
+			return invalid
+		}
+
+	case "ext":
+		q.cond(`f.filename LIKE ? ESCAPE '\'`, "%."+likeEscaper.Replace(strings.TrimPrefix(value, ".")))
+
+	case "tag":
+		q.match("tags", value, quoted)
+
+	case "archive":
+		q.cond("a.name = ?", value)
+
+	case "dir":
+		dir := strings.Trim(value, "/")
+		if dir == "" || dir == "." {
+			q.cond("f.filename NOT LIKE '%/%'")
+			break
+		}
+		q.cond(`f.filename LIKE ? ESCAPE '\' AND substr(f.filename, ?) NOT LIKE '%/%'`, likeEscaper.Replace(dir)+"/%", len(dir)+2)
+
+	case "path":
+		if dir := strings.Trim(value, "/"); dir != "" && dir != "." {
+			q.cond(`f.filename LIKE ? ESCAPE '\'`, likeEscaper.Replace(dir)+"/%")
+		}
+	}
+	return nil
+}
+
+// taken adds the condition of a taken term. Dates are matched as ranges of
+// the wall clock times that capture times are stored as.
+func (q *Query) taken(op, value string) error {
+	if op == ":" && strings.Contains(value, "..") {
+		parts := strings.SplitN(value, "..", 2)
+		if parts[0] != "" {
+			if err := q.taken(">=", parts[0]); err != nil {
+				return err
+			}
+		}
+		if parts[1] != "" {
+			return q.taken("<=", parts[1])
+		}
+		return nil
+	}
+
+	start, end, err := parseDateRange(value)
+	if err != nil {
+		return err
+	}
+	lo, hi := start.Format(takenLayout), end.Format(takenLayout)
+	switch op {
+	case ":", "=":
+		q.cond("m.taken_at >= ? AND m.taken_at < ?", lo, hi)
+	case ">":
+		q.cond("m.taken_at >= ?", hi)
+	case ">=":
+		q.cond("m.taken_at >= ?", lo)
+	case "<":
+		q.cond("m.taken_at != '' AND m.taken_at < ?", lo)
+	case "<=":
+		q.cond("m.taken_at != '' AND m.taken_at < ?", hi)
+	}
+	return nil
+}
+
+// parseDateRange returns the start and the end of a year, month or day.
+func parseDateRange(v string) (time.Time, time.Time, error) {
+	for _, f := range []struct {
+		layout string
+		y, m   int
+		d      int
+	}{
+		{"2006-01-02", 0, 0, 1},
+		{"2006-01", 0, 1, 0},
+		{"2006", 1, 0, 0},
+	} {
+		if t, err := time.Parse(f.layout, v); err == nil {
+			return t, t.AddDate(f.y, f.m, f.d), nil
+		}
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("invalid date, expected YYYY, YYYY-MM or YYYY-MM-DD [date=%s]", v)
+}
+
+func (q *Query) cond(where string, args ...interface{}) {
+	q.where = append(q.where, where)
+	q.args = append(q.args, args...)
+}
+
+// match adds a full text term, which is matched against column if it is set.
+// Quoted terms are matched as phrases.
+func (q *Query) match(column, value string, quoted bool) {
+	value = strings.Replace(value, `"`, "", -1)
+	if value == "" {
+		return
+	}
+	if quoted || strings.ContainsAny(value, " \t") {
+		value = `"` + value + `"`
+	}
+	if column != "" {
+		value = column + ":" + value
+	}
+	q.text = append(q.text, value)
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// queryWord is a word of a query, with its quotes removed.
+type queryWord struct {
+	text   string
+	quoted bool
+}
+
+// splitQuery splits a query into words at spaces outside of double quotes.
+func splitQuery(s string) ([]queryWord, error) {
+	var words []queryWord
+	var w queryWord
+	inWord, inQuote := false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			inWord, w.quoted = true, true
+		case (r == ' ' || r == '\t' || r == '\n') && !inQuote:
+			if inWord {
+				words = append(words, w)
+			}
+			w, inWord = queryWord{}, false
+		default:
+			w.text += string(r)
+			inWord = true
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("unterminated quote in query [query=%s]", s)
+	}
+	if inWord {
+		words = append(words, w)
+	}
+	return words, nil
+}
+
+// SQL returns the query's SQL statement and arguments. Results after the
+// first offset are returned, up to limit unless it is 0.
+func (q *Query) SQL(limit, offset int) (string, []interface{}) {
+	where := append([]string{"1 = 1"}, q.where...)
+	args := append([]interface{}{}, q.args...)
+	if len(q.text) > 0 {
+		where = append(where, "m.id IN (SELECT docid FROM media_text WHERE media_text MATCH ?)")
+		args = append(args, strings.Join(q.text, " "))
+	}
+
+	stmt := `
+		SELECT a.name, f.filename, f.key, f.size, f.mod_time,
+			IFNULL(m.class, ''), IFNULL(m.taken_at, ''), IFNULL(m.camera, ''), m.latitude, m.longitude
+		FROM files f
+		JOIN archives a ON a.id = f.archive_id
+		LEFT JOIN media m ON m.archive_id = f.archive_id AND m.filename = f.filename
+		WHERE ` + strings.Join(where, " AND ") + `
+		ORDER BY a.name, f.filename`
+	if limit > 0 {
+		stmt += " LIMIT " + strconv.Itoa(limit)
+	}
+	if offset > 0 {
+		if limit <= 0 {
+			stmt += " LIMIT -1"
+		}
+		stmt += " OFFSET " + strconv.Itoa(offset)
+	}
+	return stmt, args
+}
+
+// Query calls fn for each file that matches q, in archive and filename
+// order, stopping at the first error. See Query.SQL for limit and offset.
+func (d *SQLiteDB) Query(q *Query, limit, offset int, fn func(QueryResult) error) error {
+	stmt, args := q.SQL(limit, offset)
+	rows, err := d.db.Query(stmt, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r QueryResult
+		var modTime int64
+		var lat, lon sql.NullFloat64
+		if err := rows.Scan(&r.Archive, &r.Filename, &r.Key, &r.Size, &modTime, &r.Class, &r.Taken, &r.Camera, &lat, &lon); err != nil {
+			return err
+		}
+		r.ModTime = fromUnixNano(modTime)
+		if lat.Valid && lon.Valid {
+			r.Location = &Location{Latitude: lat.Float64, Longitude: lon.Float64}
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// RunQueryCmd is the work function for QueryCmd.
+func RunQueryCmd(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		panic(errors.New("query is required"))
+	}
+
+	format := viper.GetString("format")
+	if viper.GetBool("json") {
+		format = FormatJSON
+	}
+	if format != FormatTable && format != FormatJSON && format != FormatKeys {
+		panic(fmt.Errorf("invalid format, expected table, json or keys [format=%s]", format))
+	}
+
+	q, err := ParseQuery(strings.Join(args, " "))
+	if err != nil {
+		panic(err)
+	}
+
+	dir, err := CacheDir()
+	if err != nil {
+		panic(err)
+	}
+
+	db, err := OpenSQLiteDBReadOnly(dir)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	if err := printQuery(db, q, viper.GetInt("limit"), format, os.Stdout); err != nil {
+		panic(err)
+	}
+}
+
+// printQuery writes the files that match q to w in the format.
+func printQuery(db *SQLiteDB, q *Query, limit int, format string, w io.Writer) error {
+	var tw *tabwriter.Writer
+	enc := json.NewEncoder(w)
+	if format == FormatTable {
+		tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ARCHIVE\tFILE\tSIZE\tTAKEN\tCAMERA\tTYPE")
+	}
+
+	err := db.Query(q, limit, 0, func(r QueryResult) error {
+		switch format {
+		case FormatJSON:
+			return enc.Encode(r)
+		case FormatKeys:
+			_, err := fmt.Fprintln(w, r.Filename)
+			return err
+		}
+		_, err := fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Archive, r.Filename, formatBytes(r.Size), orDash(r.Taken), orDash(r.Camera), orDash(r.Class))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if tw != nil {
+		return tw.Flush()
+	}
+	return nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// RunCacheIndexCmd is the work function for CacheIndexCmd.
+func RunCacheIndexCmd(cmd *cobra.Command, args []string) {
+	cfg, err := LoadConfig()
+	if err != nil {
+		panic(err)
+	}
+
+	names := args
+	if len(names) == 0 {
+		for _, ac := range cfg.Archives {
+			names = append(names, ac.Name)
+		}
+	}
+
+	dir, err := CacheDir()
+	if err != nil {
+		panic(err)
+	}
+
+	db, err := OpenSQLiteDB(dir)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	for _, name := range names {
+		ac, err := cfg.Archive(name)
+		if err != nil {
+			panic(err)
+		}
+
+		cache, err := db.Cache(name)
+		if err != nil {
+			panic(err)
+		}
+
+		archive, err := NewOfflineArchive(ac, cache)
+		if err != nil {
+			panic(err)
+		}
+
+		if err := IndexMedia(ac, archive); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// IndexMedia extracts the metadata of the archived files under the archive's
+// roots and stores it in the cache.
+func IndexMedia(cfg ArchiveConfig, archive *Archive) error {
+	watcher := ScanMedia(cfg.Roots, archive.Filter, NewProgress())
+	errs := make(chan error)
+	go func() {
+		for err := range watcher.Errors() {
+			errs <- err
+		}
+		close(errs)
+	}()
+
+	var items []CacheItem
+	files, indexed := 0, 0
+	flush := func() error {
+		if len(items) == 0 {
+			return nil
+		}
+		err := archive.Cache.SetMany(items)
+		indexed += len(items)
+		items = items[:0]
+		return err
+	}
+
+	for media, failed := watcher.Media(), errs; media != nil || failed != nil; {
+		select {
+		case err, ok := <-failed:
+			if !ok {
+				failed = nil
+				continue
+			}
+			log.Println("ERROR", err)
+
+		case path, ok := <-media:
+			if !ok {
+				media = nil
+				continue
+			}
+			files++
+
+			item, err := indexFile(archive, path, watcher.RelativePath(path))
+			if err != nil {
+				log.Println("ERROR", err)
+				continue
+			}
+			if item.Media == nil {
+				continue
+			}
+
+			if items = append(items, item); len(items) >= cacheFlushSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	log.Printf("cache indexed [archive=%s] [files=%d] [indexed=%d]", archive.Name, files, indexed)
+	return nil
+}
+
+// indexFile returns the cache item of the file at path with its metadata, or
+// an item without metadata if the file isn't archived in its current state.
+func indexFile(archive *Archive, path, relpath string) (CacheItem, error) {
+	item, err := archive.Cache.Get(relpath)
+	if err == ErrNotCached {
+		return CacheItem{}, nil
+	}
+	if err != nil {
+		return CacheItem{}, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return CacheItem{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return CacheItem{}, err
+	}
+	if item.Modified(info) {
+		return CacheItem{}, nil
+	}
+
+	// The copies are unchanged, so they aren't written again.
+	item.Copies = nil
+	item.Media, _ = analyzeMedia(f, info.Size(), relpath)
+	return item, nil
+}
+
+// InitQueryCmdConfig adds configuration options specific to QueryCmd.
+func InitQueryCmdConfig(cmd *cobra.Command) {
+
+	cmd.Flags().String("format", FormatTable, "The output format: table, json or keys.")
+	viper.BindPFlag("format", cmd.Flags().Lookup("format"))
+	viper.SetDefault("format", FormatTable)
+
+	cmd.Flags().Int("limit", 0, "The maximum number of files to list, or 0 for all of them.")
+	viper.BindPFlag("limit", cmd.Flags().Lookup("limit"))
+	viper.SetDefault("limit", 0)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  Query
+	}{
+		{"", Query{}},
+		{"beach", Query{text: []string{"beach"}}},
+		{`"summer holiday" sun*`, Query{text: []string{`"summer holiday"`, "sun*"}}},
+		{"taken:2019", Query{
+			where: []string{"m.taken_at >= ? AND m.taken_at < ?"},
+			args:  []interface{}{"2019-01-01T00:00:00", "2020-01-01T00:00:00"},
+		}},
+		{"Taken:2019-07", Query{
+			where: []string{"m.taken_at >= ? AND m.taken_at < ?"},
+			args:  []interface{}{"2019-07-01T00:00:00", "2019-08-01T00:00:00"},
+		}},
+		{"taken:2019-01..2019-06", Query{
+			where: []string{"m.taken_at >= ?", "m.taken_at != '' AND m.taken_at < ?"},
+			args:  []interface{}{"2019-01-01T00:00:00", "2019-07-01T00:00:00"},
+		}},
+		{"taken>2019-07-14", Query{
+			where: []string{"m.taken_at >= ?"},
+			args:  []interface{}{"2019-07-15T00:00:00"},
+		}},
+		{"taken<2019", Query{
+			where: []string{"m.taken_at != '' AND m.taken_at < ?"},
+			args:  []interface{}{"2019-01-01T00:00:00"},
+		}},
+		{`camera:"iPhone 11"`, Query{
+			where: []string{`(m.camera LIKE ? ESCAPE '\' OR m.model LIKE ? ESCAPE '\')`},
+			args:  []interface{}{"iPhone 11%", "iPhone 11%"},
+		}},
+		{"type:Video size>1GB", Query{
+			where: []string{"m.class = ?", "f.size > ?"},
+			args:  []interface{}{ClassVideo, int64(1 << 30)},
+		}},
+		{"size:10K", Query{
+			where: []string{"f.size = ?"},
+			args:  []interface{}{int64(10 << 10)},
+		}},
+		{"bbox:48,3,47,2", Query{
+			where: []string{"m.latitude BETWEEN ? AND ? AND m.longitude BETWEEN ? AND ?"},
+			args:  []interface{}{47.0, 48.0, 2.0, 3.0},
+		}},
+		{"has:location ext:.jpg", Query{
+			where: []string{"m.latitude IS NOT NULL", `f.filename LIKE ? ESCAPE '\'`},
+			args:  []interface{}{"%.jpg"},
+		}},
+		{`tag:"new york" archive:photos`, Query{
+			where: []string{"a.name = ?"},
+			args:  []interface{}{"photos"},
+			text:  []string{`tags:"new york"`},
+		}},
+		{"dir:2019/Summer_1/", Query{
+			where: []string{`f.filename LIKE ? ESCAPE '\' AND substr(f.filename, ?) NOT LIKE '%/%'`},
+			args:  []interface{}{`2019/Summer\_1/%`, 15},
+		}},
+		{"dir:/", Query{where: []string{"f.filename NOT LIKE '%/%'"}}},
+		{"path:2019", Query{
+			where: []string{`f.filename LIKE ? ESCAPE '\'`},
+			args:  []interface{}{"2019/%"},
+		}},
+		{"note:x a:b", Query{text: []string{"note:x", "a:b"}}},
+	}
+	for _, tt := range tests {
+		got, err := ParseQuery(tt.query)
+		if err != nil {
+			t.Errorf("ParseQuery(%q): %s", tt.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("ParseQuery(%q) = %#v, want %#v", tt.query, *got, tt.want)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, query := range []string{
+		`camera:"iPhone`,
+		"taken:July",
+		"taken:2019-13",
+		"type:photo",
+		"size:big",
+		"bbox:1,2,3",
+		"bbox:a,b,c,d",
+		"has:wings",
+		"camera>Canon",
+	} {
+		if _, err := ParseQuery(query); err == nil {
+			t.Errorf("ParseQuery(%q) succeeded, want an error", query)
+		}
+	}
+}
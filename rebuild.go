@@ -0,0 +1,432 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// CacheCmd handles the "cache" command.
+var CacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manages the local cache",
+}
+
+// CacheRebuildCmd handles the "cache rebuild" command.
+var CacheRebuildCmd = &cobra.Command{
+	Use:   "rebuild [archive...]",
+	Short: "Rebuilds the cache from the backends",
+	Long: `Lists the backends of each archive and records the local files that are already
+archived in the cache, so that only files that are genuinely new or modified
+are uploaded after the cache was lost.
+
+A local file matches an object stored under its key if the sizes are equal and
+the fingerprint matches: the modification time stored with the object, its MD5
+sum where the backend lists one, or otherwise the object's modification time.
+Bundles are downloaded to read the members' offsets. Bundles in the Glacier
+storage classes or the Azure archive tier can't be read, and their members are
+uploaded again.
+
+With --dry-run the matches are counted but the cache isn't written. All
+archives are rebuilt unless archive names are passed.`,
+	Run: RunCacheRebuildCmd,
+}
+
+// remoteMember is a file stored in a bundle on a backend. The bundle was
+// uploaded at archivedAt.
+type remoteMember struct {
+	bundle     string
+	offset     int64
+	size       int64
+	modTime    time.Time
+	archivedAt time.Time
+}
+
+// remoteIndex is the listing of a backend, with bundle members by key.
+type remoteIndex struct {
+	objects map[string]Object
+	members map[string][]remoteMember
+}
+
+// RunCacheRebuildCmd is the work function for CacheRebuildCmd.
+func RunCacheRebuildCmd(cmd *cobra.Command, args []string) {
+	cfg, err := LoadConfig()
+	if err != nil {
+		panic(err)
+	}
+
+	names := args
+	if len(names) == 0 {
+		for _, ac := range cfg.Archives {
+			names = append(names, ac.Name)
+		}
+	}
+
+	dir, err := CacheDir()
+	if err != nil {
+		panic(err)
+	}
+
+	db, err := OpenSQLiteDB(dir)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	for _, name := range names {
+		ac, err := cfg.Archive(name)
+		if err != nil {
+			panic(err)
+		}
+
+		cache, err := db.Cache(name)
+		if err != nil {
+			panic(err)
+		}
+
+		archive, err := NewArchive(ac, cache, nil)
+		if err != nil {
+			panic(err)
+		}
+
+		if err := RebuildCache(ac, archive, viper.GetBool("dry-run")); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RebuildCache matches the files under the archive's roots with the objects
+// on its backends, and records the matching copies in the cache unless
+// dryRun is set. Files without a matching copy are left alone.
+func RebuildCache(cfg ArchiveConfig, archive *Archive, dryRun bool) error {
+	indexes := make(map[string]*remoteIndex, len(archive.Backends))
+	bundles := make(map[string][]tarMember)
+	for _, b := range archive.Backends {
+		index, err := listBackend(archive, b, bundles)
+		if err != nil {
+			return fmt.Errorf("cannot list backend [backend=%s]: %s", b.Name(), err)
+		}
+		indexes[b.Name()] = index
+	}
+
+	watcher := ScanMedia(cfg.Roots, archive.Filter, NewProgress())
+	errs := make(chan error)
+	go func() {
+		for err := range watcher.Errors() {
+			errs <- err
+		}
+		close(errs)
+	}()
+
+	var items []CacheItem
+	files, matched, copies := 0, 0, 0
+	flush := func() error {
+		if dryRun || len(items) == 0 {
+			items = items[:0]
+			return nil
+		}
+		err := archive.Cache.SetMany(items)
+		items = items[:0]
+		return err
+	}
+
+	for media, failed := watcher.Media(), errs; media != nil || failed != nil; {
+		select {
+		case err, ok := <-failed:
+			if !ok {
+				failed = nil
+				continue
+			}
+			log.Println("ERROR", err)
+
+		case path, ok := <-media:
+			if !ok {
+				media = nil
+				continue
+			}
+			files++
+
+			item, err := matchFile(archive, indexes, path, watcher.RelativePath(path))
+			if err != nil {
+				log.Println("ERROR", err)
+				continue
+			}
+			if len(item.Copies) == 0 {
+				continue
+			}
+			item.Previews = remotePreviews(archive, indexes, item.Filename)
+			matched++
+			copies += len(item.Copies)
+
+			if items = append(items, item); len(items) >= cacheFlushSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	log.Printf("cache rebuilt [archive=%s] [files=%d] [matched=%d] [copies=%d] [dry-run=%t]", archive.Name, files, matched, copies, dryRun)
+	return nil
+}
+
+// listBackend lists the objects under the archive's prefix and the members of
+// its bundles. Bundles that were already read from another backend, with the
+// same size, are taken from bundles rather than downloaded again.
+func listBackend(archive *Archive, b Backend, bundles map[string][]tarMember) (*remoteIndex, error) {
+	index := &remoteIndex{
+		objects: make(map[string]Object),
+		members: make(map[string][]remoteMember),
+	}
+
+	prefix, err := archive.Prefix()
+	if err != nil {
+		return nil, err
+	}
+	bundlePrefix := archive.Name + "/bundles/"
+	prefixes := []string{prefix}
+	for _, prefix := range []string{bundlePrefix, archive.PreviewPrefix()} {
+		if !strings.HasPrefix(prefix, prefixes[0]) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+
+	for _, prefix := range prefixes {
+		err := b.List(prefix, func(o Object) error {
+			index.objects[o.Key] = o
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for key, o := range index.objects {
+		if !strings.HasPrefix(key, bundlePrefix) || !strings.HasSuffix(key, ".tar") {
+			continue
+		}
+
+		id := fmt.Sprintf("%s\n%d", key, o.Size)
+		members, ok := bundles[id]
+		if !ok {
+			var err error
+			if members, err = readBundle(b, key); err != nil {
+				log.Printf("WARNING cannot read bundle [backend=%s] [bundle=%s]: %s", b.Name(), key, err)
+				continue
+			}
+			bundles[id] = members
+		}
+
+		for _, m := range members {
+			index.members[m.Name] = append(index.members[m.Name], remoteMember{
+				bundle:     key,
+				offset:     m.offset,
+				size:       m.Size,
+				modTime:    m.ModTime,
+				archivedAt: o.ModTime,
+			})
+		}
+	}
+
+	return index, nil
+}
+
+// remotePreviews returns the previews of the file found on any backend. Their
+// dimensions aren't known.
+func remotePreviews(archive *Archive, indexes map[string]*remoteIndex, relpath string) []Preview {
+	var previews []Preview
+	for _, kind := range []string{PreviewThumbnail, PreviewMedium} {
+		key := archive.PreviewKey(relpath, kind)
+		for _, index := range indexes {
+			if o, ok := index.objects[key]; ok {
+				previews = append(previews, Preview{Kind: kind, Key: key, Size: o.Size})
+				break
+			}
+		}
+	}
+	return previews
+}
+
+// tarMember is the header of a file in a bundle, and where its content
+// starts.
+type tarMember struct {
+	*tar.Header
+	offset int64
+}
+
+// readBundle downloads a bundle and returns the headers of its members.
+func readBundle(b Backend, key string) ([]tarMember, error) {
+	r, err := b.Get(key, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var members []tarMember
+	cr := &countingReader{r: r}
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return members, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, tarMember{Header: hdr, offset: cr.n})
+	}
+}
+
+// matchFile returns the cache item of the file at path, with a copy for each
+// backend that has an object or bundle member matching the file.
+func matchFile(archive *Archive, indexes map[string]*remoteIndex, path, relpath string) (CacheItem, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return CacheItem{}, err
+	}
+
+	// Live Photos are grouped by the content identifier in their metadata,
+	// which is cheap to read compared to the images' pixels.
+	var contentID string
+	if class := mediaClass(relpath); class == ClassImage || class == ClassVideo {
+		f, err := os.Open(path)
+		if err != nil {
+			return CacheItem{}, err
+		}
+		contentID = ExtractMedia(f, info.Size(), relpath).ContentID
+		f.Close()
+	}
+
+	group, err := archive.Group(path, relpath, contentID)
+	if err != nil {
+		return CacheItem{}, err
+	}
+	key, err := archive.GroupKey(group, path, relpath, info)
+	if err != nil {
+		return CacheItem{}, err
+	}
+
+	item := CacheItem{
+		Filename:   relpath,
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+		Key:        key,
+		Group:      group.Name(),
+		Companions: group.Companions(relpath),
+	}
+
+	// The local file is only hashed if a backend lists an MD5 sum.
+	var sum string
+	md5sum := func() (string, error) {
+		if sum != "" {
+			return sum, nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		h := md5.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
+		}
+		sum = hex.EncodeToString(h.Sum(nil))
+		return sum, nil
+	}
+
+	for _, b := range archive.Backends {
+		index := indexes[b.Name()]
+		c := Copy{
+			Backend: b.Name(),
+			Key:     key,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+
+		if o, ok := index.objects[key]; ok && o.Size == info.Size() {
+			ok, err := fingerprintMatches(o, info, md5sum)
+			if err != nil {
+				return CacheItem{}, err
+			}
+			if ok {
+				c.ArchivedAt = o.ModTime
+				item.SetCopy(c)
+				continue
+			}
+		}
+
+		// Several bundles can contain a matching version of the file, so
+		// take the most recently uploaded one.
+		for _, m := range index.members[key] {
+			if m.size != info.Size() || !sameSecond(m.modTime, info.ModTime()) {
+				continue
+			}
+			if c.Bundle == "" || !m.archivedAt.Before(c.ArchivedAt) {
+				c.Bundle = m.bundle
+				c.Offset = m.offset
+				c.ArchivedAt = m.archivedAt
+			}
+		}
+		if c.Bundle != "" {
+			item.SetCopy(c)
+		}
+	}
+
+	for _, c := range item.Copies {
+		if c.ArchivedAt.After(item.ArchivedAt) {
+			item.ArchivedAt = c.ArchivedAt
+		}
+	}
+
+	// Matched files are indexed for queries as if they were archived.
+	if len(item.Copies) > 0 {
+		f, err := os.Open(path)
+		if err != nil {
+			return CacheItem{}, err
+		}
+		item.Media, _ = analyzeMedia(f, info.Size(), relpath)
+		f.Close()
+	}
+	return item, nil
+}
+
+// fingerprintMatches compares an object of the same size with the local file
+// described by info, using the modification time stored with the object if
+// there is one, then its MD5 sum, then the object's own modification time,
+// which backends such as SFTP and WebDAV set to the file's.
+func fingerprintMatches(o Object, info os.FileInfo, md5sum func() (string, error)) (bool, error) {
+	if v, ok := o.Metadata["mtime"]; ok {
+		mtime, err := time.Parse(time.RFC3339Nano, v)
+		return err == nil && mtime.Equal(info.ModTime()), nil
+	}
+
+	if o.MD5 != "" {
+		sum, err := md5sum()
+		if err != nil {
+			return false, err
+		}
+		return strings.EqualFold(sum, o.MD5), nil
+	}
+
+	return sameSecond(o.ModTime, info.ModTime()), nil
+}
+
+// sameSecond reports whether the times are less than a second apart, since
+// tar headers and most file servers don't store sub-second times.
+func sameSecond(a, b time.Time) bool {
+	d := a.Sub(b)
+	return d > -time.Second && d < time.Second
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// RestoreCmd handles the "restore" command.
+var RestoreCmd = &cobra.Command{
+	Use:   "restore ARCHIVE [PATTERN...]",
+	Short: "Downloads archived files",
+	Long: `Downloads the archived files whose paths match the glob patterns, or all files
+if no patterns are passed, to the directory set with --to. With --files-from,
+only the files listed in the file, one path per line, are restored, e.g. the
+output of "query --format=keys" when it is passed "-" to read standard input.
+
+Each file is downloaded from the first backend with a current copy, or from the
+backend set with --backend. Files that were packed into a bundle are extracted
+transparently: a single file is read with a ranged request, and bundles that
+contain several of the requested files are downloaded once.
+
+With --dry-run the files are listed along with the backend, key and bundle that
+they would be restored from, and nothing is downloaded.
+
+Files in the Glacier storage classes or the Azure archive tier must be restored
+or rehydrated with the provider's tools before they can be downloaded.`,
+	Run: RunRestoreCmd,
+}
+
+// restoreFile is an archived file and the copy it is restored from.
+type restoreFile struct {
+	item    CacheItem
+	copy    Copy
+	backend Backend
+}
+
+// RunRestoreCmd is the work function for RestoreCmd.
+func RunRestoreCmd(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		panic(errors.New("archive name is required"))
+	}
+
+	to := viper.GetString("to")
+	if to == "" && !viper.GetBool("dry-run") {
+		panic(errors.New("--to is required"))
+	}
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		panic(err)
+	}
+	ac, err := cfg.Archive(args[0])
+	if err != nil {
+		panic(err)
+	}
+
+	filter, err := NewFilter(args[1:], nil)
+	if err != nil {
+		panic(err)
+	}
+
+	dir, err := CacheDir()
+	if err != nil {
+		panic(err)
+	}
+
+	db, err := OpenSQLiteDB(dir)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	cache, err := db.Cache(ac.Name)
+	if err != nil {
+		panic(err)
+	}
+
+	archive, err := NewArchive(ac, cache, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	match := filter.Match
+	if from := viper.GetString("files-from"); from != "" {
+		names, err := readFileList(from)
+		if err != nil {
+			panic(err)
+		}
+		match = func(filename string) bool {
+			return names[filename] && filter.Match(filename)
+		}
+	}
+
+	files, err := restorePlan(archive, match, viper.GetString("backend"))
+	if err != nil {
+		panic(err)
+	}
+
+	if viper.GetBool("dry-run") {
+		printRestorePlan(os.Stdout, files)
+		return
+	}
+
+	restored, failed := 0, 0
+	for _, group := range groupBundles(files) {
+		n, errs := restoreGroup(archive, group, to)
+		restored += n
+		failed += len(errs)
+		for _, err := range errs {
+			log.Println("ERROR", err)
+		}
+	}
+
+	log.Printf("restore complete [archive=%s] [files=%d] [failed=%d]", archive.Name, restored, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// readFileList reads the paths listed in the named file, or standard input if
+// name is "-", skipping blank lines.
+func readFileList(name string) (map[string]bool, error) {
+	r := os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			names[line] = true
+		}
+	}
+	return names, scanner.Err()
+}
+
+// restorePlan selects the copy that each file accepted by match is restored
+// from. Files archived before copies were tracked are read from their key.
+// Files are restored with their companions, see FileGroup, even if match
+// doesn't accept them.
+func restorePlan(archive *Archive, match func(string) bool, backendName string) ([]restoreFile, error) {
+	var backends []Backend
+	for _, b := range archive.Backends {
+		if backendName == "" || b.Name() == backendName {
+			backends = append(backends, b)
+		}
+	}
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("backend not found [archive=%s] [backend=%s]", archive.Name, backendName)
+	}
+
+	var files []restoreFile
+	add := func(item CacheItem) {
+		if f, ok := restoreSource(item, backends); ok {
+			files = append(files, f)
+		} else if item.DuplicateOf != "" {
+			log.Printf("WARNING file not uploaded as it is a duplicate [archive=%s] [filename=%s] [duplicate-of=%s]", archive.Name, item.Filename, item.DuplicateOf)
+		} else {
+			log.Printf("WARNING no current copy of file [archive=%s] [filename=%s]", archive.Name, item.Filename)
+		}
+	}
+
+	// Grouped files that don't match are held until it is known whether
+	// another file of their group does.
+	var groups []string
+	matched := make(map[string]bool)
+	companions := make(map[string][]CacheItem)
+	err := archive.Cache.Walk(func(item CacheItem) error {
+		if !match(item.Filename) {
+			if item.Group != "" {
+				companions[item.Group] = append(companions[item.Group], item)
+			}
+			return nil
+		}
+
+		if item.Group != "" && !matched[item.Group] {
+			matched[item.Group] = true
+			groups = append(groups, item.Group)
+		}
+		add(item)
+		return nil
+	})
+
+	for _, group := range groups {
+		for _, item := range companions[group] {
+			log.Printf("restoring companion [archive=%s] [filename=%s] [group=%s]", archive.Name, item.Filename, group)
+			add(item)
+		}
+	}
+
+	return files, err
+}
+
+// restoreSource returns the copy on the first of backends that is current.
+// Files archived before copies were tracked are read from their key on the
+// first backend. Duplicates that weren't uploaded have no copy.
+func restoreSource(item CacheItem, backends []Backend) (restoreFile, bool) {
+	if len(item.Copies) == 0 && item.DuplicateOf == "" {
+		return restoreFile{item: item, copy: Copy{Key: item.Key, Size: item.Size}, backend: backends[0]}, true
+	}
+
+	for _, b := range backends {
+		if c, ok := item.Copy(b.Name()); ok && copyState(item, b.Name()) == CopyOK {
+			return restoreFile{item: item, copy: c, backend: b}, true
+		}
+	}
+	return restoreFile{}, false
+}
+
+// openCopy opens the content of the file's copy, using a ranged request for
+// bundle members.
+func openCopy(f restoreFile) (io.ReadCloser, error) {
+	key, offset, length := f.copy.Key, int64(0), int64(-1)
+	if f.copy.Bundle != "" {
+		key, offset, length = f.copy.Bundle, f.copy.Offset, f.copy.Size
+	}
+
+	r, err := f.backend.Get(key, offset, length)
+	if err != nil {
+		return nil, fmt.Errorf("%s [backend=%s] [key=%s]", err, f.backend.Name(), key)
+	}
+	return r, nil
+}
+
+// printRestorePlan writes the file, backend, key and bundle that each file
+// would be restored from.
+func printRestorePlan(w io.Writer, files []restoreFile) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tBACKEND\tKEY\tSIZE\tBUNDLE")
+	for _, f := range files {
+		bundle := f.copy.Bundle
+		if bundle == "" {
+			bundle = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", f.item.Filename, f.backend.Name(), f.copy.Key, formatBytes(f.copy.Size), bundle)
+	}
+	tw.Flush()
+}
+
+// groupBundles groups files that are read from the same bundle on the same
+// backend. Files that aren't bundled are in groups of their own.
+func groupBundles(files []restoreFile) [][]restoreFile {
+	var groups [][]restoreFile
+	index := make(map[string]int)
+	for _, f := range files {
+		if f.copy.Bundle == "" {
+			groups = append(groups, []restoreFile{f})
+			continue
+		}
+
+		id := f.backend.Name() + "\n" + f.copy.Bundle
+		if i, ok := index[id]; ok {
+			groups[i] = append(groups[i], f)
+		} else {
+			index[id] = len(groups)
+			groups = append(groups, []restoreFile{f})
+		}
+	}
+	return groups
+}
+
+// restoreGroup restores a group of files returned by groupBundles, and returns
+// the number of files restored along with the errors of those that weren't.
+func restoreGroup(archive *Archive, group []restoreFile, to string) (int, []error) {
+	first := group[0]
+
+	// Read a single file directly.
+	if len(group) == 1 {
+		r, err := openCopy(first)
+		if err != nil {
+			return 0, []error{err}
+		}
+		defer r.Close()
+
+		if err := restoreTo(archive, first, r, to); err != nil {
+			return 0, []error{err}
+		}
+		return 1, nil
+	}
+
+	// Otherwise stream the whole bundle and extract the requested members.
+	// They are identified by offset since a bundle can contain more than one
+	// version of a file.
+	members := make(map[int64]restoreFile, len(group))
+	for _, f := range group {
+		members[f.copy.Offset] = f
+	}
+
+	r, err := first.backend.Get(first.copy.Bundle, 0, -1)
+	if err != nil {
+		return 0, []error{fmt.Errorf("%s [backend=%s] [bundle=%s]", err, first.backend.Name(), first.copy.Bundle)}
+	}
+	defer r.Close()
+
+	restored := 0
+	var errs []error
+	cr := &countingReader{r: r}
+	tr := tar.NewReader(cr)
+	for len(members) > 0 {
+		hdr, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				err = errors.New("file not found in bundle")
+			}
+			for _, f := range members {
+				errs = append(errs, fmt.Errorf("%s [backend=%s] [bundle=%s] [key=%s]", err, first.backend.Name(), first.copy.Bundle, f.copy.Key))
+			}
+			break
+		}
+
+		f, ok := members[cr.n]
+		if !ok || hdr.Name != f.copy.Key {
+			continue
+		}
+		delete(members, cr.n)
+
+		if err := restoreTo(archive, f, tr, to); err != nil {
+			errs = append(errs, err)
+		} else {
+			restored++
+		}
+	}
+
+	return restored, errs
+}
+
+// checkFilename returns an error if the relative path of a file would escape
+// the directory that it is joined to, i.e. if it is absolute or contains a
+// ".." element. Filenames aren't trusted, since catalogs merge them from
+// other machines.
+func checkFilename(filename string) error {
+	if filename == "" || strings.HasPrefix(filename, "/") || strings.HasPrefix(filename, "\\") || filepath.IsAbs(filename) || filepath.VolumeName(filename) != "" {
+		return fmt.Errorf("invalid filename [filename=%s]", filename)
+	}
+	for _, elem := range strings.FieldsFunc(filename, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if elem == ".." {
+			return fmt.Errorf("invalid filename [filename=%s]", filename)
+		}
+	}
+	return nil
+}
+
+// restoreTo writes the file's content read from r to its path under dir. The
+// content is written to a temporary file that is renamed once it is complete,
+// and the file's modification time is restored.
+func restoreTo(archive *Archive, f restoreFile, r io.Reader, dir string) error {
+	if err := checkFilename(f.item.Filename); err != nil {
+		return fmt.Errorf("%s [backend=%s] [key=%s]", err, f.backend.Name(), f.copy.Key)
+	}
+	dst := filepath.Join(dir, filepath.FromSlash(f.item.Filename))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(dst), fmt.Sprintf(".%s.%s.tmp", filepath.Base(dst), hex.EncodeToString(suffix)))
+
+	w, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(w, r)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n != f.copy.Size {
+		err = fmt.Errorf("size mismatch [expected=%d] [read=%d]", f.copy.Size, n)
+	}
+	if err == nil && !f.item.ModTime.IsZero() {
+		err = os.Chtimes(tmp, f.item.ModTime, f.item.ModTime)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("%s [backend=%s] [key=%s] [filepath=%s]", err, f.backend.Name(), f.copy.Key, dst)
+	}
+
+	log.Printf("file restored [archive=%s] [backend=%s] [key=%s] [filepath=%s]", archive.Name, f.backend.Name(), f.copy.Key, dst)
+	return nil
+}
+
+// InitRestoreCmdConfig adds configuration options specific to RestoreCmd.
+func InitRestoreCmdConfig(cmd *cobra.Command) {
+
+	cmd.Flags().String("to", "", "The directory that files are restored to.")
+	viper.BindPFlag("to", cmd.Flags().Lookup("to"))
+	viper.SetDefault("to", "")
+
+	cmd.Flags().String("backend", "", "The name of the backend to restore from, e.g. s3://my-bucket. Defaults to the first backend with a current copy.")
+	viper.BindPFlag("backend", cmd.Flags().Lookup("backend"))
+	viper.SetDefault("backend", "")
+
+	cmd.Flags().String("files-from", "", "Only restore the files listed in the file, one per line, or - to read them from standard input.")
+	viper.BindPFlag("files-from", cmd.Flags().Lookup("files-from"))
+	viper.SetDefault("files-from", "")
+}
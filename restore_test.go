@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// nameBackend is a Backend that only has a name.
+type nameBackend string
+
+func (b nameBackend) Name() string { return string(b) }
+
+func (b nameBackend) Put(key string, r io.ReadSeeker, size int64, opts PutOptions) error {
+	return errors.New("not implemented")
+}
+
+func (b nameBackend) Get(key string, offset, length int64) (io.ReadCloser, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (b nameBackend) List(prefix string, fn func(Object) error) error {
+	return errors.New("not implemented")
+}
+
+func (b nameBackend) Delete(key string) error {
+	return errors.New("not implemented")
+}
+
+func TestCheckFilename(t *testing.T) {
+	tests := []struct {
+		filename string
+		valid    bool
+	}{
+		{"IMG_0001.JPG", true},
+		{"2019/07/IMG_0001.JPG", true},
+		{"2019/..hidden/IMG_0001.JPG", true},
+		{"", false},
+		{"../x", false},
+		{"2019/../../x", false},
+		{"2019/..", false},
+		{`..\x`, false},
+		{"/etc/passwd", false},
+		{`\x`, false},
+	}
+	for _, tt := range tests {
+		if err := checkFilename(tt.filename); (err == nil) != tt.valid {
+			t.Errorf("checkFilename(%q) = %v, want valid %t", tt.filename, err, tt.valid)
+		}
+	}
+}
+
+func TestRestoreToRejectsEscapingFilenames(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "media-archive-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "to")
+
+	for _, filename := range []string{"../x", "a/../../x", "/x"} {
+		f := restoreFile{
+			item:    CacheItem{Filename: filename, Size: 4},
+			copy:    Copy{Backend: "test", Key: "x", Size: 4},
+			backend: nameBackend("test"),
+		}
+		err := restoreTo(&Archive{Name: "test"}, f, strings.NewReader("data"), dir)
+		if err == nil {
+			t.Errorf("restoreTo(%q) succeeded, want an error", filename)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(tmp, "x")); !os.IsNotExist(err) {
+		t.Errorf("file written outside the restore directory: %v", err)
+	}
+}
+
+func TestMergeItemRejectsEscapingFilenames(t *testing.T) {
+	if _, changed := mergeItem(CacheItem{}, CacheItem{Filename: "../x", Key: "x"}); changed {
+		t.Error("mergeItem merged an item named ../x")
+	}
+}
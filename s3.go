@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// DefaultStorageClass is the storage class used when an archive doesn't
+// configure one.
+const DefaultStorageClass = s3.StorageClassStandardIa
+
+// S3Backend archives files to an AWS S3 bucket, or a bucket in an
+// S3-compatible service such as MinIO, Wasabi, Backblaze B2 or Ceph.
+type S3Backend struct {
+	name   string
+	bucket string
+	svc    *s3.S3
+}
+
+// NewS3Backend returns an S3Backend configured by cfg.
+func NewS3Backend(cfg BackendConfig) (*S3Backend, error) {
+	config, err := s3Config(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// The credentials are resolved with a session that isn't configured with
+	// the endpoint so that STS requests go to AWS.
+	sess, err := awsSession(cfg.Credentials, aws.StringValue(config.Region))
+	if err != nil {
+		return nil, fmt.Errorf("%s [backend=%s]", err, cfg.Name())
+	}
+	if err := validateCredentials(sess, cfg.Credentials, cfg.Endpoint == ""); err != nil {
+		return nil, fmt.Errorf("%s [backend=%s]", err, cfg.Name())
+	}
+	sess = sess.Copy(config)
+
+	return &S3Backend{
+		name:   cfg.Name(),
+		bucket: cfg.Bucket,
+		svc:    s3.New(sess),
+	}, nil
+}
+
+// s3Config translates the backend configuration to the SDK's configuration.
+func s3Config(cfg BackendConfig) (*aws.Config, error) {
+	config := aws.NewConfig()
+
+	if cfg.Endpoint != "" {
+		config.WithEndpoint(cfg.Endpoint)
+
+		// Self-hosted services rarely care about the region, but requests
+		// still have to be signed with one.
+		if cfg.Region == "" {
+			config.WithRegion("us-east-1")
+		}
+	}
+	if cfg.Region != "" {
+		config.WithRegion(cfg.Region)
+	}
+	if cfg.PathStyle {
+		config.WithS3ForcePathStyle(true)
+	}
+	if cfg.DisableSSL {
+		config.WithDisableSSL(true)
+	}
+
+	if cfg.CABundle != "" {
+		client, err := caBundleClient(cfg.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		config.WithHTTPClient(client)
+	}
+
+	return config, nil
+}
+
+// caBundleClient returns an HTTP client that trusts the certificates in the
+// PEM file in addition to the system's root certificates.
+func caBundleClient(file string) (*http.Client, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA bundle [file=%s]", file)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport}, nil
+}
+
+// Name implements Backend.
+func (b *S3Backend) Name() string {
+	return b.name
+}
+
+// Put implements Backend.
+func (b *S3Backend) Put(key string, r io.ReadSeeker, size int64, opts PutOptions) error {
+	params := &s3.PutObjectInput{
+		Bucket:        aws.String(b.bucket),
+		Key:           aws.String(key),
+		Body:          r,
+		ContentLength: aws.Int64(size),
+		Metadata:      aws.StringMap(opts.Metadata),
+	}
+	if opts.StorageClass != "" {
+		params.StorageClass = aws.String(opts.StorageClass)
+	}
+
+	// Hash the payload for the signature up front. The signer would
+	// otherwise read the body an extra time through the throttle.
+	body := unthrottled(r)
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	req, _ := b.svc.PutObjectRequest(params)
+	req.HTTPRequest.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(h.Sum(nil)))
+	return req.Send()
+}
+
+// Get implements Backend. Objects in the Glacier storage classes must be
+// restored before they can be read.
+func (b *S3Backend) Get(key string, offset, length int64) (io.ReadCloser, error) {
+	params := &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	}
+	if r := httpRange(offset, length); r != "" {
+		params.Range = aws.String(r)
+	}
+
+	out, err := b.svc.GetObject(params)
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// List implements Backend.
+func (b *S3Backend) List(prefix string, fn func(Object) error) error {
+	params := &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(prefix),
+	}
+
+	var ferr error
+	err := b.svc.ListObjectsV2Pages(params, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range page.Contents {
+			obj := Object{
+				Key:     aws.StringValue(o.Key),
+				Size:    aws.Int64Value(o.Size),
+				ModTime: aws.TimeValue(o.LastModified),
+				ETag:    strings.Trim(aws.StringValue(o.ETag), `"`),
+			}
+
+			// The ETag of an object uploaded in a single request is its
+			// MD5 sum, unless it is encrypted with KMS.
+			if len(obj.ETag) == 32 && !strings.Contains(obj.ETag, "-") {
+				obj.MD5 = obj.ETag
+			}
+
+			if ferr = fn(obj); ferr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+// Delete implements Backend.
+func (b *S3Backend) Delete(key string) error {
+	_, err := b.svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
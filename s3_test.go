@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+// TestS3RoundTrip runs against the S3-compatible service at
+// MEDIA_ARCHIVE_TEST_S3_ENDPOINT, e.g. MinIO, with credentials read from the
+// AWS_* environment variables. The bucket must exist.
+func TestS3RoundTrip(t *testing.T) {
+	b, err := NewS3Backend(BackendConfig{
+		Type:      BackendS3,
+		Endpoint:  testEnv(t, "MEDIA_ARCHIVE_TEST_S3_ENDPOINT"),
+		Bucket:    testEnv(t, "MEDIA_ARCHIVE_TEST_S3_BUCKET"),
+		PathStyle: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackendRoundTrip(t, b)
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// DefaultSFTPConnections is the default size of an SFTPBackend's connection
+// pool.
+const DefaultSFTPConnections = 4
+
+// SFTPBackend archives files to a directory on a remote host over SFTP.
+// Connections are pooled so that concurrent upload workers don't each pay
+// for an SSH handshake, and the number of open connections is capped.
+type SFTPBackend struct {
+	name   string
+	addr   string
+	dir    string
+	config *ssh.ClientConfig
+
+	// idle holds open connections that aren't in use, and slots limits the
+	// number of connections that are open at once.
+	idle  chan *sftpConn
+	slots chan struct{}
+}
+
+// sftpConn is a pooled SFTP session along with its SSH connection.
+// PosixRename is set if the server supports the atomic rename extension.
+type sftpConn struct {
+	ssh         *ssh.Client
+	client      *sftp.Client
+	posixRename bool
+}
+
+// NewSFTPBackend returns an SFTPBackend configured by cfg. A connection is
+// established to validate the host key and credentials at startup.
+func NewSFTPBackend(cfg BackendConfig) (*SFTPBackend, error) {
+	hostKeys, err := knownhosts.New(cfg.KnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read known hosts [file=%s]: %s", cfg.KnownHosts, err)
+	}
+
+	auth, err := sshAuth(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := cfg.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	b := &SFTPBackend{
+		name: cfg.Name(),
+		addr: addr,
+		dir:  cfg.Path,
+		config: &ssh.ClientConfig{
+			User:            cfg.User,
+			Auth:            auth,
+			HostKeyCallback: hostKeys,
+		},
+		idle:  make(chan *sftpConn, cfg.Connections),
+		slots: make(chan struct{}, cfg.Connections),
+	}
+
+	conn, err := b.acquire()
+	if err != nil {
+		return nil, fmt.Errorf("%s [backend=%s]", err, b.Name())
+	}
+	b.release(conn)
+
+	return b, nil
+}
+
+// sshAuth returns the public key authentication method, using the configured
+// private key, or the SSH agent when no key file is set.
+func sshAuth(cfg BackendConfig) ([]ssh.AuthMethod, error) {
+	if cfg.KeyFile == "" {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return nil, fmt.Errorf("key-file is required when no SSH agent is running [backend=%s]", cfg.Type)
+		}
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, err
+		}
+		return []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(conn).Signers)}, nil
+	}
+
+	pem, err := ioutil.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var signer ssh.Signer
+	if cfg.KeyPassphraseFile != "" {
+		passphrase, err := ioutil.ReadFile(cfg.KeyPassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(strings.TrimRight(string(passphrase), "\r\n")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key [file=%s]: %s", cfg.KeyFile, err)
+		}
+	} else if signer, err = ssh.ParsePrivateKey(pem); err != nil {
+		return nil, fmt.Errorf("invalid private key [file=%s]: %s", cfg.KeyFile, err)
+	}
+
+	return []ssh.AuthMethod{ssh.PublicKeys(signer)}, nil
+}
+
+// Name implements Backend.
+func (b *SFTPBackend) Name() string {
+	return b.name
+}
+
+// Put implements Backend. The file is written to a temporary name in the
+// destination directory and renamed once complete, so a partial upload never
+// appears under the final name.
+func (b *SFTPBackend) Put(key string, r io.ReadSeeker, size int64, opts PutOptions) error {
+	conn, err := b.acquire()
+	if err != nil {
+		return err
+	}
+
+	err = b.put(conn, key, r, size, opts)
+	if err != nil {
+
+		// The error might be caused by a broken connection, so don't reuse
+		// it. A new one is dialed on demand.
+		b.discard(conn)
+		return err
+	}
+
+	b.release(conn)
+	return nil
+}
+
+func (b *SFTPBackend) put(conn *sftpConn, key string, r io.Reader, size int64, opts PutOptions) error {
+	client := conn.client
+	dst := path.Join(b.dir, key)
+	if err := client.MkdirAll(path.Dir(dst)); err != nil {
+		return fmt.Errorf("cannot create directory [dir=%s]: %s", path.Dir(dst), err)
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	tmp := path.Join(path.Dir(dst), fmt.Sprintf(".%s.%s.tmp", path.Base(dst), hex.EncodeToString(suffix)))
+
+	f, err := client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+
+	n, err := f.ReadFrom(r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n != size {
+		err = fmt.Errorf("short write [expected=%d] [written=%d]", size, n)
+	}
+	if err != nil {
+		client.Remove(tmp)
+		return err
+	}
+
+	if !opts.ModTime.IsZero() {
+		if err := client.Chtimes(tmp, opts.ModTime, opts.ModTime); err != nil {
+			client.Remove(tmp)
+			return err
+		}
+	}
+
+	// The atomic rename extension replaces an existing file.
+	if conn.posixRename {
+		if err := client.PosixRename(tmp, dst); err != nil {
+			client.Remove(tmp)
+			return err
+		}
+		return nil
+	}
+
+	// Plain SFTP rename fails if the destination exists, so an existing file
+	// is moved aside, and only removed once the new one is in place.
+	old := path.Join(path.Dir(dst), fmt.Sprintf(".%s.%s.old", path.Base(dst), hex.EncodeToString(suffix)))
+	replaced := true
+	if err := client.Rename(dst, old); err != nil {
+		if _, serr := client.Stat(dst); !os.IsNotExist(serr) {
+			client.Remove(tmp)
+			return err
+		}
+		replaced = false
+	}
+	if err := client.Rename(tmp, dst); err != nil {
+		if replaced {
+			client.Rename(old, dst)
+		}
+		client.Remove(tmp)
+		return err
+	}
+	if replaced {
+		if err := client.Remove(old); err != nil {
+			log.Printf("WARNING cannot remove replaced file [backend=%s] [filepath=%s]: %s", b.Name(), old, err)
+		}
+	}
+
+	return nil
+}
+
+// Get implements Backend. The connection is held until the returned reader is
+// closed.
+func (b *SFTPBackend) Get(key string, offset, length int64) (io.ReadCloser, error) {
+	conn, err := b.acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := conn.client.Open(path.Join(b.dir, key))
+	if err != nil {
+		b.release(conn)
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		b.discard(conn)
+		return nil, err
+	}
+
+	var r io.Reader = f
+	if length >= 0 {
+		r = io.LimitReader(f, length)
+	}
+	return readCloser{r, &sftpFile{f: f, b: b, conn: conn}}, nil
+}
+
+// List implements Backend. Directories are walked from the one containing
+// prefix, and a missing directory has no objects.
+func (b *SFTPBackend) List(prefix string, fn func(Object) error) error {
+	conn, err := b.acquire()
+	if err != nil {
+		return err
+	}
+
+	if err := b.list(conn.client, prefix, fn); err != nil {
+		b.discard(conn)
+		return err
+	}
+
+	b.release(conn)
+	return nil
+}
+
+// Delete implements Backend.
+func (b *SFTPBackend) Delete(key string) error {
+	conn, err := b.acquire()
+	if err != nil {
+		return err
+	}
+
+	err = conn.client.Remove(path.Join(b.dir, key))
+	b.release(conn)
+	return err
+}
+
+func (b *SFTPBackend) list(client *sftp.Client, prefix string, fn func(Object) error) error {
+	root := path.Join(b.dir, prefix)
+	if prefix == "" || !strings.HasSuffix(prefix, "/") {
+		root = path.Dir(root)
+	}
+
+	walker := client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if os.IsNotExist(err) && walker.Path() == root {
+				return nil
+			}
+			return err
+		}
+
+		info := walker.Stat()
+		if info.IsDir() {
+			continue
+		}
+
+		key := walker.Path()
+		if dir := path.Clean(b.dir); dir != "." {
+			key = strings.TrimPrefix(strings.TrimPrefix(key, dir), "/")
+		}
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if err := fn(Object{Key: key, Size: info.Size(), ModTime: info.ModTime()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sftpFile closes a remote file and returns its connection to the pool.
+type sftpFile struct {
+	f    *sftp.File
+	b    *SFTPBackend
+	conn *sftpConn
+}
+
+func (s *sftpFile) Close() error {
+	err := s.f.Close()
+	if err != nil {
+		s.b.discard(s.conn)
+		return err
+	}
+	s.b.release(s.conn)
+	return nil
+}
+
+// acquire returns an idle connection, or dials a new one if there is none
+// and the pool isn't full. Otherwise it blocks until one is released. An
+// idle connection the server has dropped in the meantime is replaced.
+func (b *SFTPBackend) acquire() (*sftpConn, error) {
+	b.slots <- struct{}{}
+	select {
+	case conn := <-b.idle:
+		if _, err := conn.client.Getwd(); err == nil {
+			return conn, nil
+		}
+		log.Printf("reconnecting idle connection [backend=%s]", b.Name())
+		conn.close()
+	default:
+	}
+
+	conn, err := b.dial()
+	if err != nil {
+		<-b.slots
+		return nil, err
+	}
+	return conn, nil
+}
+
+// release returns a healthy connection to the pool.
+func (b *SFTPBackend) release(conn *sftpConn) {
+	b.idle <- conn
+	<-b.slots
+}
+
+// discard closes a connection that may be broken and frees its slot.
+func (b *SFTPBackend) discard(conn *sftpConn) {
+	conn.close()
+	<-b.slots
+}
+
+// dial opens a new SSH connection and SFTP session.
+func (b *SFTPBackend) dial() (*sftpConn, error) {
+	client, err := ssh.Dial("tcp", b.addr, b.config)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := sftp.NewClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	_, posixRename := session.HasExtension("posix-rename@openssh.com")
+	return &sftpConn{ssh: client, client: session, posixRename: posixRename}, nil
+}
+
+func (c *sftpConn) close() {
+	c.client.Close()
+	c.ssh.Close()
+}
+
+// defaultKnownHosts returns the user's known_hosts file.
+func defaultKnownHosts() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
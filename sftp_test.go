@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestSFTPRoundTrip runs against the SSH server at
+// MEDIA_ARCHIVE_TEST_SFTP_HOST, logging in as MEDIA_ARCHIVE_TEST_SFTP_USER
+// with the key in MEDIA_ARCHIVE_TEST_SFTP_KEY_FILE. The host key is verified
+// against MEDIA_ARCHIVE_TEST_SFTP_KNOWN_HOSTS, and files are stored under
+// MEDIA_ARCHIVE_TEST_SFTP_PATH, which defaults to the login directory.
+func TestSFTPRoundTrip(t *testing.T) {
+	b, err := NewSFTPBackend(BackendConfig{
+		Type:        BackendSFTP,
+		Host:        testEnv(t, "MEDIA_ARCHIVE_TEST_SFTP_HOST"),
+		User:        testEnv(t, "MEDIA_ARCHIVE_TEST_SFTP_USER"),
+		KeyFile:     testEnv(t, "MEDIA_ARCHIVE_TEST_SFTP_KEY_FILE"),
+		KnownHosts:  testEnv(t, "MEDIA_ARCHIVE_TEST_SFTP_KNOWN_HOSTS"),
+		Path:        os.Getenv("MEDIA_ARCHIVE_TEST_SFTP_PATH"),
+		Connections: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackendRoundTrip(t, b)
+
+	// Idle connections the server dropped are replaced.
+	for i := len(b.idle); i > 0; i-- {
+		conn := <-b.idle
+		conn.ssh.Close()
+		b.idle <- conn
+	}
+	if err := b.List("media-archive-test/", func(Object) error { return nil }); err != nil {
+		t.Errorf("List on a dropped connection: %s", err)
+	}
+
+	// Replacing a file leaves the new content in place.
+	key := "media-archive-test/replaced.txt"
+	for _, data := range []string{"old content", "new"} {
+		if err := b.Put(key, strings.NewReader(data), int64(len(data)), PutOptions{}); err != nil {
+			t.Fatalf("Put: %s", err)
+		}
+	}
+	r, err := b.Get(key, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if got, err := ioutil.ReadAll(r); err != nil || string(got) != "new" {
+		t.Errorf("Get = %q, %v, want %q", got, err, "new")
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Copy states shown by the status command.
+const (
+	CopyOK      = "ok"
+	CopyFailed  = "failed"
+	CopyStale   = "stale"
+	CopyMissing = "-"
+)
+
+// File states reported by the status command.
+const (
+	StatusNew       = "new"
+	StatusModified  = "modified"
+	StatusArchived  = "archived"
+	StatusDuplicate = "duplicate"
+	StatusPending   = "pending"
+	StatusFailed    = "failed"
+	StatusMissing   = "missing"
+	StatusOrphaned  = "orphaned"
+)
+
+// StatusCmd handles the "status" command.
+var StatusCmd = &cobra.Command{
+	Use:     "status [archive...]",
+	Aliases: []string{"diff"},
+	Short:   "Compares the local files with the cache and the backends",
+	Long: `Walks the roots of each archive and compares the files with the cache. Files
+are reported as:
+
+  new       not archived yet
+  modified  changed since they were archived
+  archived  a current copy exists on every backend
+  duplicate not uploaded, an archived image is the same or better
+  pending   unchanged, but a backend is missing a current copy
+  failed    unchanged, but the last upload to a backend failed
+  missing   archived, but no longer found locally
+
+With --remote the backends are listed as well, and objects under the archive's
+prefix that the cache doesn't reference are reported as orphaned.
+
+With --copies the state of each file's copy on every backend is shown instead:
+"ok" if the current version was uploaded, "stale" if an older version was
+uploaded, and "failed" if the last upload failed.
+
+All archives are shown unless archive names are passed.`,
+	Run: RunStatusCmd,
+}
+
+// StatusReport lists an archive's files by state.
+type StatusReport struct {
+	Archive   string         `json:"archive"`
+	New       []string       `json:"new"`
+	Modified  []string       `json:"modified"`
+	Archived  []string       `json:"archived"`
+	Duplicate []string       `json:"duplicate"`
+	Pending   []string       `json:"pending"`
+	Failed    []string       `json:"failed"`
+	Missing   []string       `json:"missing"`
+	Orphaned  []RemoteObject `json:"orphaned,omitempty"`
+}
+
+// RemoteObject is an object stored on a backend.
+type RemoteObject struct {
+	Backend string `json:"backend"`
+	Key     string `json:"key"`
+	Size    int64  `json:"size"`
+}
+
+// RunStatusCmd is the work function for StatusCmd.
+func RunStatusCmd(cmd *cobra.Command, args []string) {
+	cfg, err := LoadConfig()
+	if err != nil {
+		panic(err)
+	}
+
+	names := args
+	if len(names) == 0 {
+		for _, ac := range cfg.Archives {
+			names = append(names, ac.Name)
+		}
+	}
+
+	dir, err := CacheDir()
+	if err != nil {
+		panic(err)
+	}
+
+	db, err := OpenSQLiteDBReadOnly(dir)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	enc := json.NewEncoder(os.Stdout)
+	for i, name := range names {
+		ac, err := cfg.Archive(name)
+		if err != nil {
+			panic(err)
+		}
+
+		cache, err := db.Cache(name)
+		if err != nil {
+			panic(err)
+		}
+
+		if i > 0 && !viper.GetBool("json") {
+			fmt.Fprintln(w)
+		}
+
+		if viper.GetBool("copies") {
+			if err := printStatus(w, name, cache, viper.GetBool("incomplete")); err != nil {
+				panic(err)
+			}
+			continue
+		}
+
+		var archive *Archive
+		if viper.GetBool("remote") {
+			archive, err = NewArchive(ac, cache, nil)
+		} else {
+			archive, err = NewOfflineArchive(ac, cache)
+		}
+		if err != nil {
+			panic(err)
+		}
+
+		report, err := Status(ac, archive, viper.GetBool("remote"))
+		if err != nil {
+			panic(err)
+		}
+
+		if viper.GetBool("json") {
+			err = enc.Encode(report)
+		} else {
+			err = printReport(w, report, viper.GetBool("all"))
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+	w.Flush()
+}
+
+// Status compares the files under the archive's roots with the cache, and
+// the cache with the backends if remote is set.
+func Status(cfg ArchiveConfig, archive *Archive, remote bool) (*StatusReport, error) {
+	report := &StatusReport{
+		Archive:   archive.Name,
+		New:       []string{},
+		Modified:  []string{},
+		Archived:  []string{},
+		Duplicate: []string{},
+		Pending:   []string{},
+		Failed:    []string{},
+		Missing:   []string{},
+	}
+
+	watcher := ScanMedia(cfg.Roots, archive.Filter, NewProgress())
+	actions := make(chan Action)
+	go func() {
+		for err := range merge(watcher.Errors(), PlanMedia(watcher, archive, actions)) {
+			log.Println("ERROR", err)
+		}
+		close(actions)
+	}()
+
+	local := make(map[string]bool)
+	for action := range actions {
+		filename := watcher.RelativePath(action.Path)
+		local[filename] = true
+
+		switch {
+		case action.Action == ActionSkip && strings.HasPrefix(action.Reason, "duplicate of"):
+			report.Duplicate = append(report.Duplicate, filename)
+		case action.Action == ActionSkip:
+			report.Archived = append(report.Archived, filename)
+		case action.Reason == "new":
+			report.New = append(report.New, filename)
+		case action.Reason == "modified":
+			report.Modified = append(report.Modified, filename)
+		case strings.Contains(action.Reason, "failed copy"):
+			report.Failed = append(report.Failed, filename)
+		default:
+			report.Pending = append(report.Pending, filename)
+		}
+	}
+
+	// Keys and bundles referenced by the cache, by backend. Files archived
+	// before copies were tracked are referenced on every backend.
+	referenced := make(map[string]map[string]bool)
+	for _, b := range archive.Backends {
+		referenced[b.Name()] = make(map[string]bool)
+	}
+	cached := make(map[string]bool)
+	err := archive.Cache.Walk(func(item CacheItem) error {
+		cached[item.Filename] = true
+		if !local[item.Filename] {
+			report.Missing = append(report.Missing, item.Filename)
+		}
+		if len(item.Copies) == 0 {
+			for _, keys := range referenced {
+				keys[item.Key] = true
+			}
+		}
+		for _, c := range item.Copies {
+			if keys, ok := referenced[c.Backend]; ok {
+				keys[c.Key] = true
+				keys[c.Bundle] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if remote {
+		report.Orphaned = []RemoteObject{}
+		prefix, err := archive.Prefix()
+		if err != nil {
+			return nil, err
+		}
+		prefixes := []string{prefix}
+		for _, prefix := range []string{archive.Name + "/bundles/", archive.PreviewPrefix()} {
+			if !strings.HasPrefix(prefix, prefixes[0]) {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+
+		// Catalog snapshots aren't files, and previews are referenced by
+		// the path of their file.
+		catalog := archive.Name + "/catalog/"
+
+		for _, b := range archive.Backends {
+			for _, prefix := range prefixes {
+				err := b.List(prefix, func(o Object) error {
+					if strings.HasPrefix(o.Key, catalog) {
+						return nil
+					}
+					if relpath, _, ok := archive.parsePreviewKey(o.Key); ok && cached[relpath] {
+						return nil
+					}
+					if !referenced[b.Name()][o.Key] {
+						report.Orphaned = append(report.Orphaned, RemoteObject{Backend: b.Name(), Key: o.Key, Size: o.Size})
+					}
+					return nil
+				})
+				if err != nil {
+					return nil, fmt.Errorf("cannot list backend [backend=%s] [prefix=%s]: %s", b.Name(), prefix, err)
+				}
+			}
+		}
+	}
+
+	for _, files := range [][]string{report.New, report.Modified, report.Archived, report.Duplicate, report.Pending, report.Failed, report.Missing} {
+		sort.Strings(files)
+	}
+	return report, nil
+}
+
+// printReport writes the number of files in each state followed by the files
+// themselves. Archived files are only listed if all is set.
+func printReport(w *tabwriter.Writer, r *StatusReport, all bool) error {
+	states := []struct {
+		name  string
+		files []string
+	}{
+		{StatusNew, r.New},
+		{StatusModified, r.Modified},
+		{StatusArchived, r.Archived},
+		{StatusDuplicate, r.Duplicate},
+		{StatusPending, r.Pending},
+		{StatusFailed, r.Failed},
+		{StatusMissing, r.Missing},
+	}
+
+	fmt.Fprintf(w, "%s\n", r.Archive)
+	for _, s := range states {
+		fmt.Fprintf(w, "  %s\t%d\n", s.name, len(s.files))
+	}
+	if r.Orphaned != nil {
+		fmt.Fprintf(w, "  %s\t%d\n", StatusOrphaned, len(r.Orphaned))
+	}
+
+	for _, s := range states {
+		if s.name == StatusArchived && !all {
+			continue
+		}
+		for _, f := range s.files {
+			fmt.Fprintf(w, "%s\t%s\n", s.name, f)
+		}
+	}
+	for _, o := range r.Orphaned {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", StatusOrphaned, o.Key, o.Backend, formatBytes(o.Size))
+	}
+
+	return nil
+}
+
+// printStatus writes a table of the archive's files and the state of their
+// copies on every backend that has been archived to.
+func printStatus(w *tabwriter.Writer, archive string, cache Cache, incomplete bool) error {
+	var items []CacheItem
+	seen := make(map[string]bool)
+	err := cache.Walk(func(item CacheItem) error {
+		for _, c := range item.Copies {
+			seen[c.Backend] = true
+		}
+		items = append(items, item)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var backends []string
+	for name := range seen {
+		backends = append(backends, name)
+	}
+	sort.Strings(backends)
+
+	fmt.Fprintf(w, "ARCHIVE\tFILE\tCOPIES")
+	for _, name := range backends {
+		fmt.Fprintf(w, "\t%s", name)
+	}
+	fmt.Fprintln(w)
+
+	for _, item := range items {
+		states := make([]string, len(backends))
+		ok := 0
+		for i, name := range backends {
+			states[i] = copyState(item, name)
+			if states[i] == CopyOK {
+				ok++
+			}
+		}
+		if incomplete && ok == len(backends) {
+			continue
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d/%d", archive, item.Filename, ok, len(backends))
+		for _, state := range states {
+			fmt.Fprintf(w, "\t%s", state)
+		}
+		fmt.Fprintln(w)
+	}
+
+	return nil
+}
+
+// copyState returns the state of the item's copy on the named backend.
+func copyState(item CacheItem, backend string) string {
+	c, ok := item.Copy(backend)
+	switch {
+	case !ok:
+		return CopyMissing
+	case c.Error != "":
+		return CopyFailed
+	case c.Size != item.Size || !c.ModTime.Equal(item.ModTime):
+		return CopyStale
+	default:
+		return CopyOK
+	}
+}
+
+// InitStatusCmdConfig adds configuration options specific to StatusCmd.
+func InitStatusCmdConfig(cmd *cobra.Command) {
+
+	cmd.Flags().Bool("remote", false, "List the backends to find objects that the cache doesn't reference.")
+	viper.BindPFlag("remote", cmd.Flags().Lookup("remote"))
+	viper.SetDefault("remote", false)
+
+	cmd.Flags().Bool("all", false, "List archived files as well as the files in other states.")
+	viper.BindPFlag("all", cmd.Flags().Lookup("all"))
+	viper.SetDefault("all", false)
+
+	cmd.Flags().Bool("copies", false, "Show the state of each file's copy on every backend.")
+	viper.BindPFlag("copies", cmd.Flags().Lookup("copies"))
+	viper.SetDefault("copies", false)
+
+	cmd.Flags().Bool("incomplete", false, "With --copies, only show files that are missing a current copy on a backend.")
+	viper.BindPFlag("incomplete", cmd.Flags().Lookup("incomplete"))
+	viper.SetDefault("incomplete", false)
+}
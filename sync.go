@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// SyncCmd handles the "sync" command.
+var SyncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Archives the media files once and exits",
+	Long: `Scans the roots of every archive once, uploads the files that are new or
+modified, or that are missing a current copy on a backend, and exits when all
+uploads are complete. The exit status is non-zero if any upload failed.
+
+With --dry-run nothing is uploaded or written to the cache. Instead the planned
+action for every file is printed along with its key, size and the reason for
+the action, as a table or as one JSON object per line with --json.`,
+	Run: RunSyncCmd,
+}
+
+// RunSyncCmd is the work function for SyncCmd.
+func RunSyncCmd(cmd *cobra.Command, args []string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	EventListener(cancel)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		panic(err)
+	}
+
+	if viper.GetBool("dry-run") {
+		if err := DryRun(cfg, os.Stdout, viper.GetBool("json")); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	dir, err := CacheDir()
+	if err != nil {
+		panic(err)
+	}
+
+	db, err := OpenSQLiteDB(dir)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	failed := 0
+	all, catalogs, stopped := ArchiveAll(ctx, cfg, db, false, nil)
+	errs := merge(all...)
+	interrupt := ctx.Done()
+	var stopping <-chan struct{}
+	for done := false; !done; {
+		select {
+		case err, ok := <-errs:
+			if !ok {
+				done = true
+				break
+			}
+			failed++
+			log.Println("ERROR", err)
+
+		case <-interrupt:
+			log.Println("sync interrupted, waiting for the files in progress")
+			interrupt, stopping = nil, stopped
+
+		// The watchers' channels aren't closed when the scan is cut short, so
+		// an interrupted sync ends once the files in progress are cached.
+		case <-stopping:
+			done = true
+		}
+	}
+
+	SnapshotCatalogs(catalogs)
+	if ctx.Err() != nil {
+		os.Exit(1)
+	}
+
+	log.Printf("sync complete [archives=%d] [errors=%d]", len(cfg.Archives), failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// DryRun scans the roots of every archive once and writes the action planned
+// for each file to w, without touching the backends or writing to the cache.
+// The cache is opened read-only, so a dry run can run alongside an archiver.
+func DryRun(cfg *Config, w io.Writer, asJSON bool) error {
+	dir, err := CacheDir()
+	if err != nil {
+		return err
+	}
+
+	db, err := OpenSQLiteDBReadOnly(dir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	progress := NewProgress()
+	actions := make(chan Action)
+	var errs []<-chan error
+	for _, ac := range cfg.Archives {
+		cache, err := db.Cache(ac.Name)
+		if err != nil {
+			return err
+		}
+
+		archive, err := NewOfflineArchive(ac, cache)
+		if err != nil {
+			return err
+		}
+
+		watcher := ScanMedia(ac.Roots, archive.Filter, progress)
+		errs = append(errs, watcher.Errors(), PlanMedia(watcher, archive, actions))
+	}
+
+	failed := 0
+	go func() {
+		for err := range merge(errs...) {
+			failed++
+			log.Println("ERROR", err)
+		}
+		close(actions)
+	}()
+
+	counts := make(map[string]int)
+	var size int64
+	p := newActionPrinter(w, asJSON)
+	for action := range actions {
+		counts[action.Action]++
+		if action.Action != ActionSkip {
+			size += action.Size
+		}
+		if err := p.print(action); err != nil {
+			return err
+		}
+	}
+	if err := p.flush(); err != nil {
+		return err
+	}
+
+	log.Printf("dry run complete [upload=%d] [bundle=%d] [skip=%d] [size=%s] [errors=%d]", counts[ActionUpload], counts[ActionBundle], counts[ActionSkip], formatBytes(size), failed)
+	return nil
+}
+
+// actionPrinter writes planned actions as a table or as JSON lines.
+type actionPrinter struct {
+	tw  *tabwriter.Writer
+	enc *json.Encoder
+}
+
+func newActionPrinter(w io.Writer, asJSON bool) *actionPrinter {
+	if asJSON {
+		return &actionPrinter{enc: json.NewEncoder(w)}
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tARCHIVE\tPATH\tKEY\tSIZE\tREASON\tBACKENDS")
+	return &actionPrinter{tw: tw}
+}
+
+func (p *actionPrinter) print(a Action) error {
+	if p.enc != nil {
+		return p.enc.Encode(a)
+	}
+
+	backends := strings.Join(a.Backends, ",")
+	if backends == "" {
+		backends = "-"
+	}
+	_, err := fmt.Fprintf(p.tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", a.Action, a.Archive, a.Path, a.Key, formatBytes(a.Size), a.Reason, backends)
+	return err
+}
+
+func (p *actionPrinter) flush() error {
+	if p.tw != nil {
+		return p.tw.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Bandwidth limits that have a special meaning in BandwidthConfig.
+const (
+	BandwidthUnlimited = "unlimited"
+	BandwidthPause     = "pause"
+)
+
+// throttleChunk caps the size of a single read from a throttled reader so that
+// the rate is smooth rather than bursty.
+const throttleChunk = 32 << 10
+
+// BandwidthConfig limits the upload bandwidth, globally or per backend.
+type BandwidthConfig struct {
+
+	// Limit is the rate that applies when no schedule rule matches, e.g.
+	// 1MB for 1 MiB/s. It defaults to unlimited.
+	Limit string `mapstructure:"limit"`
+
+	// Schedule contains rules that set the limit during a time window. The
+	// first rule that matches the current time applies.
+	Schedule []ScheduleRule `mapstructure:"schedule"`
+}
+
+// ScheduleRule sets the limit on the given days between Start and End.
+type ScheduleRule struct {
+
+	// Days are lowercase day names or abbreviations, "weekdays" or
+	// "weekends". The rule applies to every day if none are set.
+	Days []string `mapstructure:"days"`
+
+	// Start and End are local times formatted as 15:04. A window that ends
+	// before it starts runs past midnight, and is matched against the day
+	// that it starts on.
+	Start string `mapstructure:"start"`
+	End   string `mapstructure:"end"`
+
+	// Limit is the rate within the window, "unlimited" or "pause".
+	Limit string `mapstructure:"limit"`
+}
+
+// Throttle is a token bucket whose rate follows a schedule. It can be paused,
+// in which case new uploads wait until it is resumed, and the schedule can be
+// overridden at runtime. It is safe for concurrent use.
+type Throttle struct {
+	mu       sync.Mutex
+	name     string
+	schedule schedule
+	override *rate
+
+	// unpaused is the last rate that applied before a pause, which uploads
+	// in progress keep to while the throttle is paused.
+	unpaused rate
+
+	tokens  float64
+	last    time.Time
+	stopped bool
+}
+
+// rate is a parsed bandwidth limit in bytes per second, where zero means
+// unlimited.
+type rate struct {
+	bytes  int64
+	paused bool
+}
+
+func (r rate) String() string {
+	switch {
+	case r.paused:
+		return BandwidthPause
+	case r.bytes == 0:
+		return BandwidthUnlimited
+	}
+	return formatBytes(r.bytes) + "/s"
+}
+
+// schedule is a parsed BandwidthConfig.
+type schedule struct {
+	limit rate
+	rules []scheduleRule
+}
+
+type scheduleRule struct {
+	days       [7]bool
+	start, end int // minutes after midnight
+	limit      rate
+}
+
+// NewThrottle returns the Throttle configured by cfg. The name identifies the
+// throttle in log messages.
+func NewThrottle(name string, cfg BandwidthConfig) (*Throttle, error) {
+	s, err := parseSchedule(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s [throttle=%s]", err, name)
+	}
+	return &Throttle{name: name, schedule: s, last: time.Now()}, nil
+}
+
+// Validate checks that the limits and schedule rules can be parsed.
+func (c BandwidthConfig) Validate() error {
+	_, err := parseSchedule(c)
+	return err
+}
+
+// Empty reports whether the bandwidth is unlimited at all times.
+func (c BandwidthConfig) Empty() bool {
+	return c.Limit == "" && len(c.Schedule) == 0
+}
+
+func parseSchedule(cfg BandwidthConfig) (schedule, error) {
+	var s schedule
+	var err error
+	if s.limit, err = parseRate(cfg.Limit); err != nil {
+		return s, err
+	}
+
+	for i, r := range cfg.Schedule {
+		var rule scheduleRule
+		if rule.limit, err = parseRate(r.Limit); err != nil {
+			return s, fmt.Errorf("%s [rule=%d]", err, i)
+		}
+		if rule.start, err = parseClock(r.Start); err != nil {
+			return s, fmt.Errorf("%s [rule=%d]", err, i)
+		}
+		if rule.end, err = parseClock(r.End); err != nil {
+			return s, fmt.Errorf("%s [rule=%d]", err, i)
+		}
+		if rule.days, err = parseDays(r.Days); err != nil {
+			return s, fmt.Errorf("%s [rule=%d]", err, i)
+		}
+		s.rules = append(s.rules, rule)
+	}
+
+	return s, nil
+}
+
+// parseRate parses a limit such as 1MB, 512KB/s or 1.5M. Units are powers of
+// 1024, and a bare number is bytes per second.
+func parseRate(s string) (rate, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	switch v {
+	case "", strings.ToUpper(BandwidthUnlimited):
+		return rate{}, nil
+	case strings.ToUpper(BandwidthPause):
+		return rate{paused: true}, nil
+	}
+
+	n, err := parseBytes(strings.TrimSuffix(v, "/S"))
+	if err != nil || n <= 0 {
+		return rate{}, fmt.Errorf("invalid bandwidth limit [limit=%s]", s)
+	}
+	return rate{bytes: n}, nil
+}
+
+// parseBytes parses a size such as 512K, 1.5GB or 10MiB, with binary units.
+func parseBytes(s string) (int64, error) {
+	v := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "IB")
+	v = strings.TrimSuffix(v, "B")
+	mult := int64(1)
+	if n := len(v); n > 0 {
+		if i := strings.IndexByte("KMGT", v[n-1]); i >= 0 {
+			mult = 1 << (10 * uint(i+1))
+			v = v[:n-1]
+		}
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size [size=%s]", s)
+	}
+	return int64(f * float64(mult)), nil
+}
+
+// parseClock parses a 15:04 formatted time into minutes after midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time, expected HH:MM [time=%s]", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+var dayNames = map[string][]time.Weekday{
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+}
+
+func init() {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		dayNames[name] = []time.Weekday{d}
+		dayNames[name[:3]] = []time.Weekday{d}
+	}
+}
+
+func parseDays(names []string) ([7]bool, error) {
+	var days [7]bool
+	if len(names) == 0 {
+		for d := range days {
+			days[d] = true
+		}
+		return days, nil
+	}
+
+	for _, name := range names {
+		weekdays, ok := dayNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return days, fmt.Errorf("invalid day [day=%s]", name)
+		}
+		for _, d := range weekdays {
+			days[d] = true
+		}
+	}
+	return days, nil
+}
+
+// at returns the limit that applies at t.
+func (s schedule) at(t time.Time) rate {
+	now := t.Hour()*60 + t.Minute()
+	yesterday := (t.Weekday() + 6) % 7
+	for _, r := range s.rules {
+		if r.start <= r.end {
+			if r.days[t.Weekday()] && now >= r.start && now < r.end {
+				return r.limit
+			}
+		} else if (r.days[t.Weekday()] && now >= r.start) || (r.days[yesterday] && now < r.end) {
+			return r.limit
+		}
+	}
+	return s.limit
+}
+
+// current returns the limit that applies now.
+func (t *Throttle) current(now time.Time) rate {
+	if t.override != nil {
+		return *t.override
+	}
+	return t.schedule.at(now)
+}
+
+// Override replaces the schedule with the limit, e.g. "pause" or "2MB",
+// until Resume is called.
+func (t *Throttle) Override(limit string) error {
+	r, err := parseRate(limit)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.override = &r
+	t.mu.Unlock()
+
+	log.Printf("bandwidth limit overridden [throttle=%s] [limit=%s]", t.name, limit)
+	return nil
+}
+
+// Resume returns to the configured schedule.
+func (t *Throttle) Resume() {
+	t.mu.Lock()
+	t.override = nil
+	t.mu.Unlock()
+
+	log.Printf("bandwidth schedule resumed [throttle=%s]", t.name)
+}
+
+// Reload replaces the configured schedule, keeping an override in place.
+func (t *Throttle) Reload(cfg BandwidthConfig) error {
+	s, err := parseSchedule(cfg)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.schedule = s
+	t.mu.Unlock()
+
+	log.Printf("bandwidth schedule reloaded [throttle=%s]", t.name)
+	return nil
+}
+
+// Limit returns the limit that applies now, and whether it overrides the
+// schedule.
+func (t *Throttle) Limit() (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.current(time.Now()).String(), t.override != nil
+}
+
+// Paused reports whether uploads are currently paused.
+func (t *Throttle) Paused() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.current(time.Now()).paused
+}
+
+// Stop makes uploads that are waiting for the throttle to resume fail with
+// errThrottleStopped, e.g. when the daemon shuts down. A nil Throttle is
+// ignored.
+func (t *Throttle) Stop() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.stopped = true
+	t.mu.Unlock()
+}
+
+// errThrottleStopped is returned by uploads that were paused when their
+// throttle was stopped.
+var errThrottleStopped = errors.New("upload stopped while paused")
+
+// waitResumed blocks while any of the throttles is paused, or until one of
+// them is stopped.
+func waitResumed(throttles []*Throttle) error {
+	for {
+		paused := false
+		for _, t := range throttles {
+			t.mu.Lock()
+			stopped := t.stopped
+			paused = paused || t.current(time.Now()).paused
+			t.mu.Unlock()
+			if stopped {
+				return errThrottleStopped
+			}
+		}
+		if !paused {
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// wait blocks until n bytes may be sent. Tokens accumulate for at most one
+// second, so idle time doesn't allow a long burst. While the throttle is
+// paused, the rate that applied before the pause is kept.
+func (t *Throttle) wait(n int) {
+	t.mu.Lock()
+	now := time.Now()
+	r := t.current(now)
+	if r.paused {
+		r = t.unpaused
+	} else {
+		t.unpaused = r
+	}
+	if r.bytes == 0 {
+		t.last = now
+		t.mu.Unlock()
+		return
+	}
+
+	limit := float64(r.bytes)
+	t.tokens += now.Sub(t.last).Seconds() * limit
+	if t.tokens > limit {
+		t.tokens = limit
+	}
+	t.last = now
+
+	// Reserve the tokens even if that makes the balance negative, so that
+	// concurrent readers queue up behind each other.
+	t.tokens -= float64(n)
+	delay := time.Duration(-t.tokens / limit * float64(time.Second))
+	t.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// throttledReader limits reads from an upload body by one or more throttles.
+// Reads don't block while a throttle is paused, since servers time out a
+// request whose body stalls, so uploads in progress finish at the rate that
+// applied before the pause. Seek is passed through, so it can be used as the
+// body of Backend.Put.
+type throttledReader struct {
+	io.ReadSeeker
+	throttles []*Throttle
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := r.ReadSeeker.Read(p)
+	for _, t := range r.throttles {
+		t.wait(n)
+	}
+	return n, err
+}
+
+// unthrottled returns the reader underneath a throttled upload body, so that
+// backends can read the body ahead of the upload, e.g. to compute checksums,
+// without using up bandwidth.
+func unthrottled(r io.ReadSeeker) io.ReadSeeker {
+	if t, ok := r.(*throttledReader); ok {
+		return t.ReadSeeker
+	}
+	return r
+}
+
+// throttledBackend applies throttles to the uploads of a backend. Uploads only
+// wait while any throttle is paused before they start.
+type throttledBackend struct {
+	Backend
+	throttles []*Throttle
+}
+
+// Put implements Backend.
+func (b *throttledBackend) Put(key string, r io.ReadSeeker, size int64, opts PutOptions) error {
+	if err := waitResumed(b.throttles); err != nil {
+		return err
+	}
+	return b.Backend.Put(key, &throttledReader{r, b.throttles}, size, opts)
+}
+
+// throttle wraps the backend if any of the throttles aren't nil.
+func throttle(backend Backend, throttles ...*Throttle) Backend {
+	var active []*Throttle
+	for _, t := range throttles {
+		if t != nil {
+			active = append(active, t)
+		}
+	}
+	if len(active) == 0 {
+		return backend
+	}
+	return &throttledBackend{backend, active}
+}
+
+// ThrottleListener adjusts the throttle when a signal is received: SIGUSR1
+// toggles between pausing uploads and following the schedule, and SIGUSR2
+// reloads the schedule via reload.
+func ThrottleListener(t *Throttle, reload func() (BandwidthConfig, error)) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range c {
+			switch sig {
+			case syscall.SIGUSR1:
+				t.mu.Lock()
+				paused := t.override != nil && t.override.paused
+				t.mu.Unlock()
+				if paused {
+					t.Resume()
+				} else {
+					t.Override(BandwidthPause)
+				}
+
+			case syscall.SIGUSR2:
+				cfg, err := reload()
+				if err == nil {
+					err = t.Reload(cfg)
+				}
+				if err != nil {
+					log.Println("ERROR", fmt.Errorf("cannot reload bandwidth schedule: %s", err))
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		limit string
+		want  rate
+		valid bool
+	}{
+		{"", rate{}, true},
+		{"unlimited", rate{}, true},
+		{"Pause", rate{paused: true}, true},
+		{"1024", rate{bytes: 1024}, true},
+		{"512K", rate{bytes: 512 << 10}, true},
+		{"1MB", rate{bytes: 1 << 20}, true},
+		{"1.5M", rate{bytes: 3 << 19}, true},
+		{"2MiB/s", rate{bytes: 2 << 20}, true},
+		{" 10mb/s ", rate{bytes: 10 << 20}, true},
+		{"1G", rate{bytes: 1 << 30}, true},
+		{"0", rate{}, false},
+		{"-1MB", rate{}, false},
+		{"fast", rate{}, false},
+		{"1XB", rate{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseRate(tt.limit)
+		if (err == nil) != tt.valid || (tt.valid && got != tt.want) {
+			t.Errorf("parseRate(%q) = %+v, %v, want %+v, valid %t", tt.limit, got, err, tt.want, tt.valid)
+		}
+	}
+}
+
+func TestScheduleAt(t *testing.T) {
+	s, err := parseSchedule(BandwidthConfig{
+		Limit: "1MB",
+		Schedule: []ScheduleRule{
+			{Start: "01:00", End: "07:00", Limit: "unlimited"},
+			{Days: []string{"weekdays"}, Start: "18:00", End: "23:00", Limit: "pause"},
+			{Days: []string{"sat"}, Start: "22:00", End: "02:00", Limit: "100KB"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2019-07-15 is a Monday.
+	day := func(d, hour, min int) time.Time {
+		return time.Date(2019, 7, 14+d, hour, min, 0, 0, time.Local)
+	}
+	tests := []struct {
+		at   time.Time
+		want rate
+	}{
+		{day(1, 0, 59), rate{bytes: 1 << 20}},
+		{day(1, 1, 0), rate{}},
+		{day(1, 6, 59), rate{}},
+		{day(1, 7, 0), rate{bytes: 1 << 20}},
+		{day(1, 18, 0), rate{paused: true}},
+		{day(5, 22, 59), rate{paused: true}},
+		{day(1, 23, 0), rate{bytes: 1 << 20}},
+		{day(0, 18, 30), rate{bytes: 1 << 20}},
+		{day(6, 18, 30), rate{bytes: 1 << 20}},
+		{day(6, 22, 0), rate{bytes: 100 << 10}},
+		{day(7, 0, 30), rate{bytes: 100 << 10}},
+		{day(7, 1, 30), rate{}}, // the first matching rule applies
+		{day(7, 2, 0), rate{}},
+		{day(0, 22, 30), rate{bytes: 1 << 20}},
+	}
+	for _, tt := range tests {
+		if got := s.at(tt.at); got != tt.want {
+			t.Errorf("at(%s) = %s, want %s", tt.at.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, rule := range []ScheduleRule{
+		{Start: "1:00pm", End: "18:00", Limit: "1MB"},
+		{Start: "18:00", End: "25:00", Limit: "1MB"},
+		{Days: []string{"someday"}, Start: "18:00", End: "20:00", Limit: "1MB"},
+		{Start: "18:00", End: "20:00", Limit: "slow"},
+	} {
+		if _, err := parseSchedule(BandwidthConfig{Schedule: []ScheduleRule{rule}}); err == nil {
+			t.Errorf("parseSchedule(%+v) succeeded, want an error", rule)
+		}
+	}
+}
+
+func TestThrottledReaderPaused(t *testing.T) {
+	th, err := NewThrottle("test", BandwidthConfig{Limit: "1MB"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &throttledReader{strings.NewReader(strings.Repeat("x", 2*throttleChunk)), []*Throttle{th}}
+	if _, err := r.Read(make([]byte, throttleChunk)); err != nil {
+		t.Fatal(err)
+	}
+
+	// An upload in progress isn't stalled by a pause, and keeps the limit
+	// that applied before it.
+	if err := th.Override(BandwidthPause); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(r)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read didn't complete while paused")
+	}
+	if th.unpaused.bytes != 1<<20 {
+		t.Errorf("rate while paused = %s, want 1MB", th.unpaused)
+	}
+}
+
+func TestThrottledBackendPaused(t *testing.T) {
+	th, err := NewThrottle("test", BandwidthConfig{Limit: BandwidthPause})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := throttle(newMemBackend("mem"), th, nil)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Put("key", strings.NewReader("data"), 4, PutOptions{})
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("upload started while paused: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := th.Override(BandwidthUnlimited); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload didn't start after resuming")
+	}
+}
+
+func TestThrottledBackendStopped(t *testing.T) {
+	th, err := NewThrottle("test", BandwidthConfig{Limit: BandwidthPause})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := throttle(newMemBackend("mem"), th, nil)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Put("key", strings.NewReader("data"), 4, PutOptions{})
+	}()
+
+	th.Stop()
+	select {
+	case err := <-done:
+		if err != errThrottleStopped {
+			t.Fatalf("upload returned %v, want %v", err, errThrottleStopped)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload didn't return after stopping")
+	}
+}
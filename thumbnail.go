@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"sort"
+)
+
+// thumbnailQuality is the JPEG quality of thumbnails and previews.
+const thumbnailQuality = 80
+
+// thumbnailSamples is the maximum number of pixels sampled along each axis
+// of the area that a thumbnail pixel covers, which bounds the work done for
+// large images.
+const thumbnailSamples = 4
+
+// maxPreviewPixels is the size of the largest image that is decoded to make
+// previews, which bounds the memory used by each archive worker.
+const maxPreviewPixels = 128 << 20
+
+// maxEmbeddedSize is the size of the largest JPEG read from a raw or HEIF
+// file.
+const maxEmbeddedSize = 32 << 20
+
+// EXIF tags that locate the JPEG images embedded in raw files.
+const (
+	tagNewSubfileType  = 0x00FE
+	tagCompression     = 0x0103
+	tagStripOffsets    = 0x0111
+	tagStripByteCounts = 0x0117
+	tagSubIFDs         = 0x014A
+	tagJPEGOffset      = 0x0201
+	tagJPEGLength      = 0x0202
+	tagPanasonicJPEG   = 0x002E
+)
+
+// cr3PreviewUUID is the UUID of the box that holds the preview of a Canon
+// CR3 file.
+var cr3PreviewUUID = []byte{0xea, 0xf4, 0x2b, 0x5e, 0x1c, 0x98, 0x4b, 0x88, 0xb9, 0xfb, 0xb7, 0xdc, 0x40, 0x6e, 0x4d, 0x16}
+
+// ErrNoPreview is returned for files that previews can't be made of.
+var ErrNoPreview = errors.New("no preview available for this type of file")
+
+// Rendition is a JPEG made by MakePreviews.
+type Rendition struct {
+	Data          []byte
+	Width, Height int
+}
+
+// CanPreview reports whether previews may be made of the file called name,
+// i.e. whether it is an image or a raw file.
+func CanPreview(name string) bool {
+	class := mediaClass(name)
+	return class == ClassImage || class == ClassRaw
+}
+
+// Picture is an image decoded to make previews and perceptual hashes of.
+type Picture struct {
+	image.Image
+
+	// Orientation is the image's EXIF orientation, which its renditions are
+	// rotated by.
+	Orientation int
+}
+
+// MakePreviews returns a JPEG of the file called name, which holds size bytes
+// read from r, for each of sizes, see DecodePicture and Picture.Previews.
+func MakePreviews(r io.ReaderAt, size int64, name string, sizes ...int) ([]Rendition, error) {
+	pic, err := DecodePicture(r, size, ExtractMedia(r, size, name))
+	if err != nil {
+		return nil, err
+	}
+	return pic.Previews(sizes...)
+}
+
+// DecodePicture decodes an image, which holds size bytes read from r and whose
+// metadata is m. JPEG, PNG and GIF images are decoded, and the largest JPEG
+// preview embedded in raw and HEIF files is used otherwise.
+func DecodePicture(r io.ReaderAt, size int64, m *Media) (*Picture, error) {
+	img, err := previewSource(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return &Picture{Image: img, Orientation: m.Orientation}, nil
+}
+
+// Size returns the width and height of the picture once it is upright.
+func (p *Picture) Size() (int, int) {
+	b := p.Bounds()
+	if p.Orientation >= 5 && p.Orientation <= 8 {
+		return b.Dy(), b.Dx()
+	}
+	return b.Dx(), b.Dy()
+}
+
+// Previews returns a JPEG of the picture for each of sizes, scaled down to fit
+// in a square of that many pixels and rotated by its orientation. Pictures
+// that are smaller than a size aren't enlarged.
+func (p *Picture) Previews(sizes ...int) ([]Rendition, error) {
+	var renditions []Rendition
+	for _, max := range sizes {
+		scaled := orient(scaleImage(p.Image, max), p.Orientation)
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+			return nil, err
+		}
+		b := scaled.Bounds()
+		renditions = append(renditions, Rendition{Data: buf.Bytes(), Width: b.Dx(), Height: b.Dy()})
+	}
+	return renditions, nil
+}
+
+// previewSource decodes the image that previews are made from.
+func previewSource(r io.ReaderAt, size int64) (image.Image, error) {
+	head := make([]byte, 16)
+	if n, _ := r.ReadAt(head, 0); n < len(head) {
+		return nil, ErrNoPreview
+	}
+
+	switch {
+	case head[0] == 0xFF && head[1] == 0xD8,
+		bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")),
+		bytes.HasPrefix(head, []byte("GIF8")):
+		return decodeImage(io.NewSectionReader(r, 0, size))
+	}
+
+	// Some embedded JPEGs, e.g. the lossless raw data of DNG files, can't
+	// be decoded, so the next largest is tried.
+	for _, data := range embeddedJPEGs(r, size, head) {
+		if img, err := decodeImage(bytes.NewReader(data)); err == nil {
+			return img, nil
+		}
+	}
+	return nil, ErrNoPreview
+}
+
+// decodeImage decodes an image unless it is larger than maxPreviewPixels.
+func decodeImage(r io.ReadSeeker) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxPreviewPixels {
+		return nil, errors.New("image too large for a preview")
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(r)
+	return img, err
+}
+
+// embeddedJPEGs returns the JPEGs embedded in a raw or HEIF file, largest
+// first. They are listed in the IFDs of TIFF based raw files, in the header of
+// Fujifilm RAF files, in the preview box of Canon CR3 files and in the EXIF
+// thumbnail of HEIF files.
+func embeddedJPEGs(r io.ReaderAt, size int64, head []byte) [][]byte {
+	type extent struct{ off, n int64 }
+	var extents []extent
+
+	switch {
+	case isTIFF(head):
+		for _, e := range tiffJPEGs(io.NewSectionReader(r, 0, size)) {
+			extents = append(extents, extent{e[0], e[1]})
+		}
+
+	case bytes.HasPrefix(head, []byte("FUJIFILMCCD-RAW")):
+		buf := make([]byte, 8)
+		if _, err := r.ReadAt(buf, 84); err == nil {
+			extents = append(extents, extent{int64(binary.BigEndian.Uint32(buf)), int64(binary.BigEndian.Uint32(buf[4:]))})
+		}
+
+	case string(head[4:8]) == "ftyp" && string(head[8:12]) == "crx ":
+		walkBoxes(r, 0, size, func(typ string, off, n int64) error {
+			uuid := make([]byte, 16)
+			if typ != "uuid" || n < 16 {
+				return nil
+			}
+			if _, err := r.ReadAt(uuid, off); err != nil || !bytes.Equal(uuid, cr3PreviewUUID) {
+				return nil
+			}
+			return walkBoxes(r, off+24, off+n, func(typ string, off, n int64) error {
+				if typ == "PRVW" && n > 16 {
+					extents = append(extents, extent{off + 16, n - 16})
+				}
+				return nil
+			})
+		})
+
+	case string(head[4:8]) == "ftyp":
+		if tiff := heifExif(r, size); tiff != nil {
+			_, base, _ := tiff.Outer()
+			for _, e := range tiffJPEGs(tiff) {
+				extents = append(extents, extent{base + e[0], e[1]})
+			}
+		}
+	}
+
+	sort.Slice(extents, func(i, j int) bool { return extents[i].n > extents[j].n })
+
+	var jpegs [][]byte
+	for _, e := range extents {
+		if e.n < 4 || e.n > maxEmbeddedSize || e.off < 0 || e.off+e.n > size {
+			continue
+		}
+		data := make([]byte, e.n)
+		if _, err := r.ReadAt(data, e.off); err != nil || data[0] != 0xFF || data[1] != 0xD8 {
+			continue
+		}
+		jpegs = append(jpegs, data)
+	}
+	return jpegs
+}
+
+// tiffJPEGs returns the offset and length of the JPEGs referenced by the IFDs
+// of a TIFF structure, including its sub-IFDs.
+func tiffJPEGs(r *io.SectionReader) [][2]int64 {
+	t, off, err := newTIFFReader(r)
+	if err != nil {
+		return nil
+	}
+
+	var jpegs [][2]int64
+	seen := make(map[int64]bool)
+	var visit func(off int64, depth int)
+	visit = func(off int64, depth int) {
+		for ; off > 0 && !seen[off] && len(seen) < 32; off = t.next(off) {
+			seen[off] = true
+			ifd, err := t.ifd(off)
+			if err != nil {
+				return
+			}
+
+			if o, n := t.uint(ifd[tagJPEGOffset]), t.uint(ifd[tagJPEGLength]); o > 0 && n > 0 {
+				jpegs = append(jpegs, [2]int64{int64(o), int64(n)})
+			}
+			if f, ok := ifd[tagPanasonicJPEG]; ok && f.off > 0 {
+				jpegs = append(jpegs, [2]int64{f.off, int64(f.count)})
+			}
+
+			// Strips compressed as JPEG, except the lossless raw data of the
+			// full resolution image, which isn't a preview.
+			compression := t.uint(ifd[tagCompression])
+			full := t.uint(ifd[tagNewSubfileType]) == 0
+			if (compression == 6 || compression == 7 && !full) && ifd[tagStripOffsets].count == 1 {
+				jpegs = append(jpegs, [2]int64{int64(t.uint(ifd[tagStripOffsets])), int64(t.uint(ifd[tagStripByteCounts]))})
+			}
+
+			if f, ok := ifd[tagSubIFDs]; ok && depth < 2 {
+				for i := 0; i < int(f.count); i++ {
+					visit(int64(t.uintAt(f, i)), depth+1)
+				}
+			}
+		}
+	}
+	visit(off, 0)
+	return jpegs
+}
+
+// scaleImage scales img down to fit in a square of max pixels, averaging the
+// pixels that each pixel of the result covers.
+func scaleImage(img image.Image, max int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= max && h <= max {
+		return img
+	}
+
+	dw, dh := max, h*max/w
+	if h > w {
+		dw, dh = w*max/h, max
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := b.Min.Y+y*h/dh, b.Min.Y+(y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := b.Min.X+x*w/dw, b.Min.X+(x+1)*w/dw
+			dst.Set(x, y, averageColor(img, x0, y0, x1, y1))
+		}
+	}
+	return dst
+}
+
+// averageColor averages up to thumbnailSamples² pixels spread evenly over the
+// rectangle.
+func averageColor(img image.Image, x0, y0, x1, y1 int) color.Color {
+	sx, sy := minInt(x1-x0, thumbnailSamples), minInt(y1-y0, thumbnailSamples)
+	if sx < 1 {
+		sx = 1
+	}
+	if sy < 1 {
+		sy = 1
+	}
+
+	var r, g, b, a, n uint32
+	for j := 0; j < sy; j++ {
+		y := y0 + (y1-y0)*j/sy
+		for i := 0; i < sx; i++ {
+			pr, pg, pb, pa := img.At(x0+(x1-x0)*i/sx, y).RGBA()
+			r, g, b, a, n = r+pr, g+pg, b+pb, a+pa, n+1
+		}
+	}
+	return color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)}
+}
+
+// orient flips and rotates img so that it is upright, given its EXIF
+// orientation.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := x, y
+			switch orientation {
+			case 2:
+				dx = w - 1 - x
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dy = h - 1 - y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,812 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+//go:embed ui
+var uiAssets embed.FS
+
+// maxThumbnailSize is the largest thumbnail served by the web UI, in pixels.
+const maxThumbnailSize = 2048
+
+// uiPageSize is the number of files listed per page by default, and
+// maxUIPageSize the largest page that may be requested.
+const (
+	uiPageSize    = 100
+	maxUIPageSize = 1000
+)
+
+// Facets that the web UI browses the catalog by.
+const (
+	FacetDate   = "date"
+	FacetFolder = "folder"
+	FacetCamera = "camera"
+)
+
+// States of restore jobs.
+const (
+	RestoreQueued  = "queued"
+	RestoreRunning = "running"
+	RestoreDone    = "done"
+	RestoreFailed  = "failed"
+)
+
+// uiTokenCookie is the cookie that holds the control token once the web UI
+// was opened with it.
+const uiTokenCookie = "media-archive-token"
+
+// UI is the web interface served by the daemon. It browses the archives
+// registered with the control through the cache, and restores or downloads
+// files from their backends. It requires the control token like the control
+// API on a TCP address, and may only listen on the loopback interface.
+type UI struct {
+	db         *SQLiteDB
+	control    *Control
+	restoreDir string
+
+	// decodes limits the thumbnails made from local originals at once.
+	decodes chan struct{}
+
+	mu    sync.Mutex
+	jobs  []*RestoreJob
+	queue chan *RestoreJob
+}
+
+// UIArchive is an archive listed by GET /api/archives.
+type UIArchive struct {
+	Name     string   `json:"name"`
+	Backends []string `json:"backends"`
+	Files    int64    `json:"files"`
+	Size     int64    `json:"size"`
+}
+
+// Facet is a date, folder or camera that files can be browsed by. Query is
+// the query term that lists its files.
+type Facet struct {
+	Label string `json:"label"`
+	Query string `json:"query"`
+	Count int64  `json:"count"`
+}
+
+// UIFile is a file listed by the web UI, along with the state of its copies,
+// whether the original is available locally for thumbnails and its archived
+// previews.
+type UIFile struct {
+	QueryResult
+	Copies   []UICopy  `json:"copies"`
+	Local    bool      `json:"local"`
+	Previews []Preview `json:"previews"`
+}
+
+// UICopy is the state of a file's copy on a backend, see copyState.
+type UICopy struct {
+	Backend    string    `json:"backend"`
+	State      string    `json:"state"`
+	Key        string    `json:"key,omitempty"`
+	Bundle     string    `json:"bundle,omitempty"`
+	ArchivedAt time.Time `json:"archived_at,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// UIFiles is the response of GET /api/files.
+type UIFiles struct {
+	Files []UIFile `json:"files"`
+	More  bool     `json:"more"`
+}
+
+// RestoreJob is a restore queued through the web UI.
+type RestoreJob struct {
+	ID       int       `json:"id"`
+	Archive  string    `json:"archive"`
+	Files    []string  `json:"files"`
+	To       string    `json:"to"`
+	State    string    `json:"state"`
+	Restored int       `json:"restored"`
+	Failed   int       `json:"failed"`
+	Errors   []string  `json:"errors,omitempty"`
+	Queued   time.Time `json:"queued"`
+	Finished time.Time `json:"finished,omitempty"`
+}
+
+// NewUI returns a UI that restores files to restoreDir, in a directory per
+// archive.
+func NewUI(db *SQLiteDB, control *Control, restoreDir string) *UI {
+	return &UI{
+		db:         db,
+		control:    control,
+		restoreDir: restoreDir,
+		decodes:    make(chan struct{}, runtime.NumCPU()),
+		queue:      make(chan *RestoreJob, 100),
+	}
+}
+
+// Serve serves the web UI on addr, which must be a loopback host:port, until
+// ctx is done. Queued restores are run one at a time.
+func (u *UI) Serve(ctx context.Context, addr string) error {
+	if !isLoopback(addr) {
+		return fmt.Errorf("web UI address must be a loopback host:port [address=%s]", addr)
+	}
+
+	token, err := u.control.Token()
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	go u.runRestores(ctx)
+
+	srv := &http.Server{Handler: localOnly(withUIToken(u.Handler(), token), l.Addr().String())}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("web UI listening [url=http://%s/]", l.Addr())
+	if err := srv.Serve(l); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// withUIToken serves only requests that carry the token in the UI's cookie or
+// as a bearer token. Opening the UI with the token in the token query
+// parameter sets the cookie and redirects to the page without it.
+func withUIToken(h http.Handler, token string) http.Handler {
+	valid := func(s string) bool {
+		return subtle.ConstantTimeCompare([]byte(s), []byte(token)) == 1
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if q := r.URL.Query(); q.Get("token") != "" {
+			if !valid(q.Get("token")) {
+				http.Error(w, "invalid token", http.StatusUnauthorized)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     uiTokenCookie,
+				Value:    token,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+			q.Del("token")
+			u := *r.URL
+			u.RawQuery = q.Encode()
+			http.Redirect(w, r, u.RequestURI(), http.StatusSeeOther)
+			return
+		}
+
+		if c, err := r.Cookie(uiTokenCookie); err == nil && valid(c.Value) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") && valid(strings.TrimPrefix(auth, "Bearer ")) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		http.Error(w, "open the web UI with ?token= and the token in control.token in the cache directory", http.StatusUnauthorized)
+	})
+}
+
+// Handler returns the HTTP handler of the web UI.
+func (u *UI) Handler() http.Handler {
+	assets, err := fs.Sub(uiAssets, "ui")
+	if err != nil {
+		panic(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(assets)))
+	mux.HandleFunc("/api/archives", onGet(u.archives))
+	mux.HandleFunc("/api/facets", onGet(u.facets))
+	mux.HandleFunc("/api/files", onGet(u.files))
+	mux.HandleFunc("/api/file", onGet(u.file))
+	mux.HandleFunc("/api/restores", u.restores)
+	mux.HandleFunc("/thumbnail", u.thumbnail)
+	mux.HandleFunc("/original", u.original)
+	return mux
+}
+
+// archive returns the registered archive with the name.
+func (u *UI) archive(name string) (controlArchive, error) {
+	for _, a := range u.control.registered() {
+		if a.archive.Name == name {
+			return a, nil
+		}
+	}
+	return controlArchive{}, fmt.Errorf("archive not found [archive=%s]", name)
+}
+
+func (u *UI) archives(r *http.Request) (interface{}, int, error) {
+	archives := []UIArchive{}
+	for _, a := range u.control.registered() {
+		ua := UIArchive{Name: a.archive.Name, Backends: []string{}}
+		for _, b := range a.archive.Backends {
+			ua.Backends = append(ua.Backends, b.Name())
+		}
+
+		err := u.db.db.QueryRow(`
+			SELECT COUNT(*), IFNULL(SUM(f.size), 0)
+			FROM files f JOIN archives a ON a.id = f.archive_id
+			WHERE a.name = ?`, ua.Name).Scan(&ua.Files, &ua.Size)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		archives = append(archives, ua)
+	}
+	return archives, http.StatusOK, nil
+}
+
+func (u *UI) facets(r *http.Request) (interface{}, int, error) {
+	a, err := u.archive(r.FormValue("archive"))
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+
+	facets, err := u.db.Facets(a.archive.Name, r.FormValue("by"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return facets, http.StatusOK, nil
+}
+
+// Facets returns the months that files in the archive were captured in, the
+// folders that contain them or the cameras that captured them, depending on
+// by. Months are listed newest first, folders by path and cameras by the
+// number of files.
+func (d *SQLiteDB) Facets(archive, by string) ([]Facet, error) {
+	facets := []Facet{}
+	var stmt string
+	switch by {
+	case FacetDate:
+		stmt = `
+			SELECT substr(m.taken_at, 1, 7), COUNT(*)
+			FROM media m
+			JOIN archives a ON a.id = m.archive_id
+			JOIN files f ON f.archive_id = m.archive_id AND f.filename = m.filename
+			WHERE a.name = ? AND m.taken_at != ''
+			GROUP BY 1 ORDER BY 1 DESC`
+	case FacetCamera:
+		stmt = `
+			SELECT m.camera, COUNT(*)
+			FROM media m
+			JOIN archives a ON a.id = m.archive_id
+			JOIN files f ON f.archive_id = m.archive_id AND f.filename = m.filename
+			WHERE a.name = ? AND m.camera != ''
+			GROUP BY m.camera ORDER BY 2 DESC, 1`
+	case FacetFolder:
+		return d.folders(archive)
+	default:
+		return nil, fmt.Errorf("invalid facet, expected date, folder or camera [facet=%s]", by)
+	}
+
+	rows, err := d.db.Query(stmt, archive)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var f Facet
+		if err := rows.Scan(&f.Label, &f.Count); err != nil {
+			return nil, err
+		}
+		if by == FacetDate {
+			f.Query = "taken:" + f.Label
+		} else {
+			f.Query = queryTerm("camera", f.Label)
+		}
+		facets = append(facets, f)
+	}
+	return facets, rows.Err()
+}
+
+// folders returns the folders that directly contain files in the archive.
+func (d *SQLiteDB) folders(archive string) ([]Facet, error) {
+	rows, err := d.db.Query(`
+		SELECT f.filename FROM files f JOIN archives a ON a.id = f.archive_id
+		WHERE a.name = ?`, archive)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var filename string
+		if err := rows.Scan(&filename); err != nil {
+			return nil, err
+		}
+		counts[path.Dir(filename)]++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	facets := []Facet{}
+	for dir, n := range counts {
+		label := dir
+		if dir == "." {
+			label = "/"
+		}
+		facets = append(facets, Facet{Label: label, Query: queryTerm("dir", dir), Count: n})
+	}
+	sort.Slice(facets, func(i, j int) bool { return facets[i].Label < facets[j].Label })
+	return facets, nil
+}
+
+// queryTerm returns a field term, quoting the value if it contains spaces.
+func queryTerm(field, value string) string {
+	if strings.ContainsAny(value, " \t") {
+		value = `"` + value + `"`
+	}
+	return field + ":" + value
+}
+
+func (u *UI) files(r *http.Request) (interface{}, int, error) {
+	q, err := ParseQuery(r.FormValue("q"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	limit, offset := uiPageSize, 0
+	if v := r.FormValue("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxUIPageSize {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid limit [limit=%s]", v)
+		}
+	}
+	if v := r.FormValue("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid offset [offset=%s]", v)
+		}
+	}
+
+	// One more file than requested tells whether there is another page.
+	var results []QueryResult
+	if err := u.db.Query(q, limit+1, offset, func(r QueryResult) error {
+		results = append(results, r)
+		return nil
+	}); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	page := UIFiles{Files: []UIFile{}}
+	if len(results) > limit {
+		results, page.More = results[:limit], true
+	}
+	for _, res := range results {
+		f, err := u.describe(res)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		page.Files = append(page.Files, f)
+	}
+	return page, http.StatusOK, nil
+}
+
+func (u *UI) file(r *http.Request) (interface{}, int, error) {
+	if _, err := u.archive(r.FormValue("archive")); err != nil {
+		return nil, http.StatusNotFound, err
+	}
+
+	q := &Query{}
+	q.cond("a.name = ?", r.FormValue("archive"))
+	q.cond("f.filename = ?", r.FormValue("file"))
+
+	var files []UIFile
+	err := u.db.Query(q, 1, 0, func(res QueryResult) error {
+		f, err := u.describe(res)
+		files = append(files, f)
+		return err
+	})
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if len(files) == 0 {
+		return nil, http.StatusNotFound, fmt.Errorf("file not found [archive=%s] [filename=%s]", r.FormValue("archive"), r.FormValue("file"))
+	}
+	return files[0], http.StatusOK, nil
+}
+
+// describe adds the state of the copies on each of the archive's backends
+// to a query result.
+func (u *UI) describe(res QueryResult) (UIFile, error) {
+	f := UIFile{QueryResult: res, Copies: []UICopy{}}
+	a, err := u.archive(res.Archive)
+	if err != nil {
+		// The archive was removed from the configuration.
+		return f, nil
+	}
+
+	item, err := a.archive.Cache.Get(res.Filename)
+	if err != nil {
+		return f, err
+	}
+	for _, b := range a.archive.Backends {
+		c, _ := item.Copy(b.Name())
+		f.Copies = append(f.Copies, UICopy{
+			Backend:    b.Name(),
+			State:      copyState(item, b.Name()),
+			Key:        c.Key,
+			Bundle:     c.Bundle,
+			ArchivedAt: c.ArchivedAt,
+			Error:      c.Error,
+		})
+	}
+
+	_, info := u.localFile(a, res.Filename)
+	f.Local = info != nil
+
+	cache, err := u.db.Cache(res.Archive)
+	if err != nil {
+		return f, err
+	}
+	if f.Previews, err = cache.Previews(res.Filename); f.Previews == nil {
+		f.Previews = []Preview{}
+	}
+	return f, err
+}
+
+// localFile returns the path and info of the file under the archive's roots.
+func (u *UI) localFile(a controlArchive, filename string) (string, os.FileInfo) {
+	p, ok := a.watcher.LocalPath(filename)
+	if !ok {
+		return "", nil
+	}
+	info, err := os.Stat(p)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", nil
+	}
+	return p, info
+}
+
+// thumbnail serves a JPEG thumbnail of an image. The archived thumbnail or
+// preview is served if it fits the size, otherwise one is made from the local
+// original, falling back to the archived previews that don't fit.
+func (u *UI) thumbnail(w http.ResponseWriter, r *http.Request) {
+	a, err := u.archive(r.FormValue("archive"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	size := DefaultThumbnailSize
+	if v := r.FormValue("size"); v != "" {
+		if size, err = strconv.Atoi(v); err != nil || size < 1 || size > maxThumbnailSize {
+			http.Error(w, "invalid size", http.StatusBadRequest)
+			return
+		}
+	}
+
+	filename := r.FormValue("file")
+	if !CanPreview(filename) {
+		http.Error(w, ErrNoPreview.Error(), http.StatusNotFound)
+		return
+	}
+
+	cache, err := u.db.Cache(a.archive.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	previews, err := cache.Previews(filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Archived previews are served without decoding the original unless a
+	// larger image is wanted.
+	cfg := a.archive.Previews
+	preview, archived := previewFor(previews, size, cfg.ThumbnailSize)
+	fits := archived && ((preview.Kind == PreviewThumbnail && size <= cfg.ThumbnailSize) ||
+		(preview.Kind == PreviewMedium && size > cfg.ThumbnailSize && size <= cfg.PreviewSize))
+	if fits && u.archivedPreview(w, r, a, preview) {
+		return
+	}
+
+	if p, info := u.localFile(a, filename); info != nil {
+		if notModified(w, r, fmt.Sprintf(`"%x-%x-%d"`, info.Size(), info.ModTime().UnixNano(), size)) {
+			return
+		}
+		data, err := u.localThumbnail(r.Context(), p, info, filename, size)
+		if err == nil {
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write(data)
+			return
+		}
+		if r.Context().Err() != nil {
+			return
+		}
+		if err != ErrNoPreview {
+			log.Printf("WARNING cannot make thumbnail [filepath=%s]: %s", p, err)
+		}
+	}
+
+	switch {
+	case !archived:
+		http.Error(w, "file not found locally and has no previews", http.StatusNotFound)
+	case fits || !u.archivedPreview(w, r, a, preview):
+		http.Error(w, "cannot read the preview from the backends", http.StatusBadGateway)
+	}
+}
+
+// localThumbnail makes a thumbnail of the local file at p, once fewer than
+// decodes thumbnails are being made.
+func (u *UI) localThumbnail(ctx context.Context, p string, info os.FileInfo, filename string, size int) ([]byte, error) {
+	select {
+	case u.decodes <- struct{}{}:
+		defer func() { <-u.decodes }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	renditions, err := MakePreviews(f, info.Size(), filename, size)
+	if err != nil {
+		return nil, err
+	}
+	return renditions[0].Data, nil
+}
+
+// archivedPreview serves the archived preview from the first backend that has
+// it, and reports whether it was served.
+func (u *UI) archivedPreview(w http.ResponseWriter, r *http.Request, a controlArchive, p Preview) bool {
+	if notModified(w, r, fmt.Sprintf(`"%s-%d"`, p.Kind, p.Size)) {
+		return true
+	}
+
+	for _, b := range a.archive.Backends {
+		rc, err := b.Get(p.Key, 0, -1)
+		if err != nil {
+			log.Println("WARNING", fmt.Errorf("cannot read preview: %s [backend=%s] [key=%s]", err, b.Name(), p.Key))
+			continue
+		}
+		defer rc.Close()
+
+		w.Header().Set("Content-Type", "image/jpeg")
+		io.Copy(w, rc)
+		return true
+	}
+	return false
+}
+
+// notModified sets the ETag and caching headers of a thumbnail, and responds
+// with 304 Not Modified if the browser has it.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// original streams the file's content from the first backend with a current
+// copy.
+func (u *UI) original(w http.ResponseWriter, r *http.Request) {
+	a, err := u.archive(r.FormValue("archive"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	item, err := a.archive.Cache.Get(r.FormValue("file"))
+	if err == ErrNotCached {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	src, ok := restoreSource(item, a.archive.Backends)
+	if !ok {
+		http.Error(w, "no current copy of file", http.StatusNotFound)
+		return
+	}
+
+	rc, err := openCopy(src)
+	if err != nil {
+		log.Println("ERROR", err)
+		http.Error(w, "cannot read the file from the backend", http.StatusBadGateway)
+		return
+	}
+	defer rc.Close()
+
+	name := path.Base(item.Filename)
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(src.copy.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	if _, err := io.Copy(w, rc); err != nil {
+		log.Printf("ERROR cannot download file [archive=%s] [filename=%s]: %s", a.archive.Name, item.Filename, err)
+	}
+}
+
+// restores lists the restore jobs, or queues one on POST.
+func (u *UI) restores(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		onPost(u.queueRestore)(w, r)
+		return
+	}
+	onGet(u.listRestores)(w, r)
+}
+
+func (u *UI) listRestores(r *http.Request) (interface{}, int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	// Copy the jobs so the worker can update them while they're encoded.
+	jobs := []RestoreJob{}
+	for i := len(u.jobs) - 1; i >= 0; i-- {
+		jobs = append(jobs, *u.jobs[i])
+	}
+	return jobs, http.StatusOK, nil
+}
+
+func (u *UI) queueRestore(r *http.Request) (interface{}, int, error) {
+	var req struct {
+		Archive string   `json:"archive"`
+		Files   []string `json:"files"`
+	}
+	if t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t != "application/json" {
+		return nil, http.StatusUnsupportedMediaType, errors.New("request must be application/json")
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid request: %s", err)
+	}
+	if _, err := u.archive(req.Archive); err != nil {
+		return nil, http.StatusNotFound, err
+	}
+	if len(req.Files) == 0 {
+		return nil, http.StatusBadRequest, errors.New("no files to restore")
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	job := &RestoreJob{
+		ID:      len(u.jobs) + 1,
+		Archive: req.Archive,
+		Files:   req.Files,
+		To:      filepath.Join(u.restoreDir, req.Archive),
+		State:   RestoreQueued,
+		Queued:  time.Now(),
+	}
+
+	select {
+	case u.queue <- job:
+	default:
+		return nil, http.StatusServiceUnavailable, errors.New("too many restores queued")
+	}
+	u.jobs = append(u.jobs, job)
+
+	log.Printf("restore queued [archive=%s] [files=%d] [to=%s]", job.Archive, len(job.Files), job.To)
+	return *job, http.StatusOK, nil
+}
+
+// runRestores runs the queued restore jobs until ctx is done.
+func (u *UI) runRestores(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-u.queue:
+			u.runRestore(job)
+		}
+	}
+}
+
+func (u *UI) runRestore(job *RestoreJob) {
+	u.update(job, func() { job.State = RestoreRunning })
+
+	var errs []error
+	restored := 0
+	a, err := u.archive(job.Archive)
+	if err == nil {
+		names := make(map[string]bool, len(job.Files))
+		for _, f := range job.Files {
+			names[f] = true
+		}
+
+		var files []restoreFile
+		files, err = restorePlan(a.archive, func(f string) bool { return names[f] }, "")
+		for _, f := range files {
+			delete(names, f.item.Filename)
+		}
+		var missing []string
+		for name := range names {
+			missing = append(missing, name)
+		}
+		sort.Strings(missing)
+		for _, name := range missing {
+			errs = append(errs, fmt.Errorf("no current copy of file [filename=%s]", name))
+		}
+
+		for _, group := range groupBundles(files) {
+			n, groupErrs := restoreGroup(a.archive, group, job.To)
+			restored += n
+			errs = append(errs, groupErrs...)
+		}
+	}
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	u.update(job, func() {
+		job.State = RestoreDone
+		if len(errs) > 0 {
+			job.State = RestoreFailed
+		}
+		job.Restored = restored
+		job.Failed = len(errs)
+		for _, err := range errs {
+			job.Errors = append(job.Errors, err.Error())
+		}
+		job.Finished = time.Now()
+	})
+
+	for _, err := range errs {
+		log.Println("ERROR", err)
+	}
+	log.Printf("restore complete [archive=%s] [files=%d] [failed=%d] [to=%s]", job.Archive, restored, len(errs), job.To)
+}
+
+// update changes the job while holding the lock.
+func (u *UI) update(job *RestoreJob, fn func()) {
+	u.mu.Lock()
+	fn()
+	u.mu.Unlock()
+}
+
+// InitUIConfig adds configuration options of the web UI to RootCmd.
+func InitUIConfig(cmd *cobra.Command) {
+
+	cmd.Flags().String("ui", "", "The loopback host:port that the web UI is served on, e.g. 127.0.0.1:8080. The web UI is disabled by default.")
+	viper.BindPFlag("ui", cmd.Flags().Lookup("ui"))
+	viper.SetDefault("ui", "")
+
+	cmd.Flags().String("ui-restore-dir", "", "The directory that the web UI restores files to, in a directory per archive. Defaults to restores in the cache directory.")
+	viper.BindPFlag("ui-restore-dir", cmd.Flags().Lookup("ui-restore-dir"))
+	viper.SetDefault("ui-restore-dir", "")
+}
@@ -0,0 +1,276 @@
+"use strict";
+
+// State of the page: the archive and facet being browsed, the search, the
+// files listed so far and the files selected for restoring.
+const state = {
+  archive: "",
+  by: "date",
+  facet: "",
+  search: "",
+  offset: 0,
+  files: [],
+  selected: new Set(),
+};
+
+const $ = (id) => document.getElementById(id);
+
+function el(tag, attrs, ...children) {
+  const e = document.createElement(tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    if (k === "class") {
+      e.className = v;
+    } else if (k.startsWith("on")) {
+      e.addEventListener(k.slice(2), v);
+    } else {
+      e.setAttribute(k, v);
+    }
+  }
+  for (const c of children) {
+    if (c !== null && c !== undefined) {
+      e.append(c);
+    }
+  }
+  return e;
+}
+
+async function api(path, params, options) {
+  const url = path + (params ? "?" + new URLSearchParams(params) : "");
+  const resp = await fetch(url, options);
+  const body = await resp.json();
+  if (!resp.ok) {
+    throw new Error(body.error || resp.statusText);
+  }
+  return body;
+}
+
+function fileParams(f, extra) {
+  return new URLSearchParams(Object.assign({ archive: f.archive, file: f.filename }, extra));
+}
+
+function formatBytes(n) {
+  const units = ["B", "KB", "MB", "GB", "TB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return (i ? n.toFixed(1) : n) + " " + units[i];
+}
+
+function quote(v) {
+  return /\s/.test(v) ? '"' + v + '"' : v;
+}
+
+function showError(err) {
+  $("summary").textContent = "Error: " + err.message;
+}
+
+async function loadArchives() {
+  const archives = await api("api/archives");
+  const select = $("archive");
+  select.replaceChildren(...archives.map((a) =>
+    el("option", { value: a.name }, `${a.name} (${a.files} files, ${formatBytes(a.size)})`)));
+  if (archives.length === 0) {
+    $("summary").textContent = "No archives are configured.";
+    return;
+  }
+  state.archive = archives[0].name;
+  await loadFacets();
+  await loadFiles(true);
+}
+
+async function loadFacets() {
+  const facets = await api("api/facets", { archive: state.archive, by: state.by });
+  $("facets").replaceChildren(...facets.map((f) => {
+    const li = el("li", { class: f.query === state.facet ? "active" : "" },
+      el("span", {}, f.label), el("span", { class: "count" }, String(f.count)));
+    li.addEventListener("click", () => {
+      state.facet = state.facet === f.query ? "" : f.query;
+      for (const other of $("facets").children) {
+        other.classList.remove("active");
+      }
+      if (state.facet) {
+        li.classList.add("active");
+      }
+      loadFiles(true).catch(showError);
+    });
+    return li;
+  }));
+}
+
+function query() {
+  return ["archive:" + quote(state.archive), state.facet, state.search].filter(Boolean).join(" ");
+}
+
+async function loadFiles(reset) {
+  if (reset) {
+    state.offset = 0;
+    state.files = [];
+    $("grid").replaceChildren();
+  }
+  const page = await api("api/files", { q: query(), offset: state.offset });
+  state.offset += page.files.length;
+  state.files.push(...page.files);
+  $("grid").append(...page.files.map(card));
+  $("more").hidden = !page.more;
+  $("summary").textContent = `${state.files.length}${page.more ? "+" : ""} files`;
+}
+
+function thumbnail(f, size) {
+  const placeholder = el("div", { class: "thumb" }, f.class || f.filename.split(".").pop());
+  const previewable = f.class === "image" || f.class === "raw";
+  if (!previewable || !(f.local || (f.previews && f.previews.length))) {
+    return placeholder;
+  }
+  const img = el("img", { loading: "lazy", alt: "", src: "thumbnail?" + fileParams(f, { size }) });
+  img.addEventListener("error", () => img.replaceWith(document.createTextNode(placeholder.textContent)));
+  return el("div", { class: "thumb" }, img);
+}
+
+function states(f) {
+  return el("div", { class: "states" }, ...f.copies.map((c) =>
+    el("span", { class: "state " + c.state, title: c.backend + ": " + c.state + (c.error ? "\n" + c.error : "") }, c.state)));
+}
+
+function card(f) {
+  const id = f.archive + "\n" + f.filename;
+  const box = el("input", { type: "checkbox", title: "Select for restoring" });
+  const div = el("div", { class: "card" }, box, thumbnail(f, 256),
+    el("div", { class: "name", title: f.filename }, f.filename.split("/").pop()),
+    el("div", { class: "info" }, [f.taken.slice(0, 10), f.camera].filter(Boolean).join(" · ") || formatBytes(f.size)),
+    states(f));
+
+  box.checked = state.selected.has(id);
+  div.classList.toggle("selected", box.checked);
+  box.addEventListener("click", (e) => {
+    e.stopPropagation();
+    if (box.checked) {
+      state.selected.add(id);
+    } else {
+      state.selected.delete(id);
+    }
+    div.classList.toggle("selected", box.checked);
+    $("restore-selected").disabled = state.selected.size === 0;
+    $("restore-selected").textContent = `Restore selected (${state.selected.size})`;
+  });
+  div.addEventListener("click", () => showDetails(f).catch(showError));
+  return div;
+}
+
+async function showDetails(summary) {
+  const f = await api("api/file", { archive: summary.archive, file: summary.filename });
+  $("restores").hidden = true;
+  $("details").hidden = false;
+  $("preview").replaceChildren(thumbnail(f, 1024));
+  $("details-name").textContent = f.filename;
+
+  const rows = [
+    ["Archive", f.archive],
+    ["Key", f.key],
+    ["Size", formatBytes(f.size)],
+    ["Modified", new Date(f.mod_time).toLocaleString()],
+    ["Type", f.class],
+    ["Taken", f.taken],
+    ["Camera", f.camera],
+    ["Location", f.location ? `${f.location.latitude.toFixed(5)}, ${f.location.longitude.toFixed(5)}` : ""],
+    ["Local", f.local ? "yes" : "no"],
+    ["Previews", (f.previews || []).map((p) => p.width ? `${p.kind} ${p.width}×${p.height}` : p.kind).join(", ")],
+  ];
+  $("details-meta").replaceChildren(...rows.filter((r) => r[1]).map((r) =>
+    el("tr", {}, el("td", {}, r[0]), el("td", {}, r[1]))));
+
+  $("details-copies").replaceChildren(...f.copies.map((c) =>
+    el("tr", {}, el("td", {}, c.backend),
+      el("td", {}, el("span", { class: "state " + c.state }, c.state), " ",
+        c.bundle ? `in ${c.bundle}` : c.key || "",
+        c.error ? el("div", { class: "errors" }, c.error) : null))));
+
+  $("download").href = "original?" + fileParams(f);
+  $("restore-one").onclick = () => restore(f.archive, [f.filename]);
+}
+
+async function restore(archive, files) {
+  try {
+    const job = await api("api/restores", null, {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ archive, files }),
+    });
+    $("summary").textContent = `Restore of ${job.files.length} files queued to ${job.to}`;
+    showRestores();
+  } catch (err) {
+    showError(err);
+  }
+}
+
+function restoreSelected() {
+  // Restores are queued per archive.
+  const byArchive = new Map();
+  for (const id of state.selected) {
+    const [archive, filename] = id.split("\n");
+    byArchive.set(archive, (byArchive.get(archive) || []).concat(filename));
+  }
+  for (const [archive, files] of byArchive) {
+    restore(archive, files);
+  }
+  state.selected.clear();
+  for (const c of document.querySelectorAll(".card")) {
+    c.classList.remove("selected");
+    c.querySelector("input").checked = false;
+  }
+  $("restore-selected").disabled = true;
+  $("restore-selected").textContent = "Restore selected";
+}
+
+let restoresTimer = null;
+
+async function showRestores() {
+  $("details").hidden = true;
+  $("restores").hidden = false;
+  const jobs = await api("api/restores");
+  $("restore-jobs").replaceChildren(...jobs.map((j) =>
+    el("li", {},
+      el("div", {}, el("strong", {}, `#${j.id} ${j.state}`), ` ${j.archive}, ${j.restored}/${j.files.length} files`),
+      el("div", {}, "to " + j.to),
+      j.errors ? el("div", { class: "errors" }, j.errors.join("\n")) : null)));
+
+  // Poll while restores are pending and the panel is open.
+  clearTimeout(restoresTimer);
+  if (jobs.some((j) => j.state === "queued" || j.state === "running")) {
+    restoresTimer = setTimeout(() => {
+      if (!$("restores").hidden) {
+        showRestores().catch(showError);
+      }
+    }, 2000);
+  }
+}
+
+$("archive").addEventListener("change", (e) => {
+  state.archive = e.target.value;
+  state.facet = "";
+  Promise.all([loadFacets(), loadFiles(true)]).catch(showError);
+});
+
+for (const tab of document.querySelectorAll(".tabs button")) {
+  tab.addEventListener("click", () => {
+    document.querySelector(".tabs .active").classList.remove("active");
+    tab.classList.add("active");
+    state.by = tab.dataset.by;
+    loadFacets().catch(showError);
+  });
+}
+
+$("search").addEventListener("submit", (e) => {
+  e.preventDefault();
+  state.search = $("query").value.trim();
+  loadFiles(true).catch(showError);
+});
+
+$("more").addEventListener("click", () => loadFiles(false).catch(showError));
+$("restore-selected").addEventListener("click", restoreSelected);
+$("show-restores").addEventListener("click", () => showRestores().catch(showError));
+for (const b of document.querySelectorAll("aside .close")) {
+  b.addEventListener("click", () => { b.parentElement.hidden = true; });
+}
+
+loadArchives().catch(showError);